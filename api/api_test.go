@@ -36,14 +36,29 @@
 package main_test
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math/rand"
+	"net"
+	"net/http"
 	"os"
+	"reflect"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/MorpheoOrg/morpheo-go-packages/common"
 	. "github.com/MorpheoOrg/morpheo-storage/api"
+	"github.com/iris-contrib/httpexpect"
 	"github.com/satori/go.uuid"
 	"gopkg.in/kataras/iris.v6"
 	"gopkg.in/kataras/iris.v6/adaptors/httprouter"
@@ -52,6 +67,7 @@ import (
 
 var (
 	app          *iris.Framework
+	api          *APIServer
 	objectRoutes = []string{
 		ProblemListRoute, ProblemRoute, ProblemBlobRoute,
 		DataListRoute, DataRoute, DataBlobRoute,
@@ -63,8 +79,13 @@ var (
 	postObjectMultipartRoutes = []string{ProblemListRoute, AlgoListRoute, DataListRoute, PredictionListRoute}
 
 	RandomUUID           uuid.UUID
+	Blob                 []byte
 	MultipartFormMap     map[string]map[string]string
 	MultipartFormUUIDMap map[string]map[string]string
+
+	// SHA-256 checksum and size of the file used as blob in the tests
+	BlobChecksum string
+	BlobSize     string
 )
 
 func TestMain(m *testing.M) {
@@ -75,6 +96,16 @@ func TestMain(m *testing.M) {
 	RandomUUID = uuid.NewV4()
 	MultipartFormMap, MultipartFormUUIDMap = NewMultipartFormMap(RandomUUID)
 
+	var err error
+	Blob, err = ioutil.ReadFile("main.go")
+	if err != nil {
+		fmt.Printf("Error reading test blob: %s\n", err)
+		os.Exit(1)
+	}
+	checksum := sha256.Sum256(Blob)
+	BlobChecksum = hex.EncodeToString(checksum[:])
+	BlobSize = strconv.Itoa(len(Blob))
+
 	os.Exit(m.Run())
 }
 
@@ -105,7 +136,31 @@ func TestGetListObject(t *testing.T) {
 		t.Logf(url)
 
 		// Test valid request returns Success
-		e.GET(url).WithBasicAuth("u", "p").Expect().Status(200)
+		e.GET(url).WithBasicAuth("u", "p").Expect().Status(200).JSON().Object().ContainsKey("total")
+
+		// Test valid pagination and ordering returns Success
+		e.GET(url).WithQuery("page", 2).WithQuery("page_size", 10).WithQuery("sort", "uuid").WithQuery("order", "asc").WithBasicAuth("u", "p").Expect().Status(200).JSON().Object().ValueEqual("page_size", 10)
+
+		// Test filtering by owner returns Success
+		e.GET(url).WithQuery("owner", "u").WithBasicAuth("u", "p").Expect().Status(200)
+
+		// Test invalid pagination and ordering returns BadRequest
+		e.GET(url).WithQuery("page", "first").WithBasicAuth("u", "p").Expect().Status(400).Body().Match("(.*)Error parsing page(.*)")
+		e.GET(url).WithQuery("page", -1).WithBasicAuth("u", "p").Expect().Status(400)
+		e.GET(url).WithQuery("page_size", MaxPageSize+1).WithBasicAuth("u", "p").Expect().Status(400)
+		e.GET(url).WithQuery("sort", "timestamp_upload; DROP TABLE data").WithBasicAuth("u", "p").Expect().Status(400).Body().Match("(.*)Invalid sort field(.*)")
+		e.GET(url).WithQuery("order", "sideways").WithBasicAuth("u", "p").Expect().Status(400).Body().Match("(.*)Invalid sort order(.*)")
+
+		// Test valid cursor returns Success
+		cursor := EncodeCursor(&Cursor{TimestampUpload: 1500000000, ID: RandomUUID, Order: "asc"})
+		cursorPage := e.GET(url).WithQuery("cursor", cursor).WithBasicAuth("u", "p").Expect().Status(200).JSON().Object()
+		cursorPage.ContainsKey("next_cursor")
+		// Cursor pages aren't counted
+		cursorPage.Value("total").Null()
+
+		// Test invalid cursor returns BadRequest
+		e.GET(url).WithQuery("cursor", "666devil").WithBasicAuth("u", "p").Expect().Status(400).Body().Match("(.*)Invalid cursor(.*)")
+		e.GET(url).WithQuery("cursor", cursor).WithQuery("sort", "uuid").WithBasicAuth("u", "p").Expect().Status(400)
 	}
 }
 
@@ -146,6 +201,300 @@ func TestGetObjectBlob(t *testing.T) {
 	}
 }
 
+func TestGetObjectBlobConditional(t *testing.T) {
+	e := httptest.New(app, t)
+
+	for _, url := range listObjectRoutes {
+		t.Logf(url)
+
+		// Test blob unchanged since a given date returns NotModified
+		e.GET(url+"/"+RandomUUID.String()+"/blob").WithBasicAuth("u", "p").WithHeader("If-Modified-Since", time.Now().UTC().Format(http.TimeFormat)).Expect().Status(304)
+		e.GET(url+"/"+RandomUUID.String()+"/blob").WithBasicAuth("u", "p").WithHeader("If-None-Match", "*").Expect().Status(304)
+
+		// Test ETag is the blob checksum
+		etag := "\"" + ProblemMockChecksum + "\""
+		e.GET(url+"/"+ProblemMockUUIDStr+"/blob").WithBasicAuth("u", "p").Expect().Status(200).Header("ETag").Equal(etag)
+		e.GET(url+"/"+ProblemMockUUIDStr+"/blob").WithBasicAuth("u", "p").WithHeader("If-None-Match", etag).Expect().Status(304)
+		e.GET(url+"/"+ProblemMockUUIDStr+"/blob").WithBasicAuth("u", "p").WithHeader("If-None-Match", "\""+DevilChecksum+"\"").Expect().Status(200)
+	}
+}
+
+func TestGetObjectBlobRange(t *testing.T) {
+	rangeApp, _ := newTestApp(NewMemoryBlobStore())
+	e := httptest.New(rangeApp, t)
+
+	id := uuid.NewV4().String()
+	e.POST(DataListRoute).WithBasicAuth("u", "p").WithMultipart().WithFormField("uuid", id).WithFormField("size", BlobSize).WithFile("blob", "main.go").Expect().Status(201)
+
+	// Test range request returns PartialContent
+	r := e.GET(DataListRoute+"/"+id+"/blob").WithBasicAuth("u", "p").WithHeader("Range", "bytes=10-19").Expect()
+	r.Status(206).Header("Content-Range").Equal("bytes 10-19/" + BlobSize)
+	r.Body().Equal(string(Blob[10:20]))
+
+	// Test whole blob is sent without range
+	e.GET(DataListRoute+"/"+id+"/blob").WithBasicAuth("u", "p").Expect().Status(200).Body().Equal(string(Blob))
+
+	// Test unsatisfiable range returns RequestedRangeNotSatisfiable
+	e.GET(DataListRoute+"/"+id+"/blob").WithBasicAuth("u", "p").WithHeader("Range", "bytes=66666666-").Expect().Status(416)
+}
+
+func TestHeadObjectBlob(t *testing.T) {
+	e := httptest.New(app, t)
+
+	for _, url := range listObjectRoutes {
+		t.Logf(url)
+
+		// Test HEAD returns the blob headers
+		r := e.HEAD(url+"/"+RandomUUID.String()+"/blob").WithBasicAuth("u", "p").Expect().Status(200)
+		r.Header("Content-Type").Equal("application/octet-stream")
+		r.Header("Content-Disposition").Equal("attachment; filename=" + RandomUUID.String())
+		r.Body().Empty()
+		e.HEAD(url+"/"+ProblemMockUUIDStr+"/blob").WithBasicAuth("u", "p").Expect().Status(200).Header("ETag").Equal("\"" + ProblemMockChecksum + "\"")
+		e.HEAD(url+"/"+ProblemMockUUIDStr+"/blob").WithBasicAuth("u", "p").WithHeader("If-None-Match", "\""+ProblemMockChecksum+"\"").Expect().Status(304)
+
+		// Test GET sends the same headers
+		e.GET(url+"/"+RandomUUID.String()+"/blob").WithBasicAuth("u", "p").Expect().Status(200).Header("Content-Disposition").Equal("attachment; filename=" + RandomUUID.String())
+
+		// Test HEAD on invalid or unknown UUID returns BadRequest or NotFound
+		e.HEAD(url+"/invalid/blob").WithBasicAuth("u", "p").Expect().Status(400)
+		e.HEAD(url+"/"+DevilMockUUID+"/blob").WithBasicAuth("u", "p").Expect().Status(404)
+	}
+}
+
+func TestResumableUpload(t *testing.T) {
+	blobStore := NewMemoryBlobStore()
+	uploadApp, uploadAPI := newTestApp(blobStore)
+	uploadAPI.UploadExpiration = time.Hour
+	e := httptest.New(uploadApp, t)
+	b64 := base64.StdEncoding.EncodeToString
+
+	// Test OPTIONS returns the supported tus version and extensions
+	e.OPTIONS("/upload/data").WithBasicAuth("u", "p").Expect().Status(204).Header("Tus-Extension").Equal(TusExtensions)
+
+	// Test requests without Tus-Resumable header returns PreconditionFailed
+	e.POST("/upload/data").WithBasicAuth("u", "p").WithHeader("Upload-Length", BlobSize).Expect().Status(412)
+
+	// Test invalid creation requests return BadRequest or NotFound
+	e.POST("/upload/devil").WithBasicAuth("u", "p").WithHeader("Tus-Resumable", TusVersion).WithHeader("Upload-Length", BlobSize).Expect().Status(404)
+	e.POST("/upload/data").WithBasicAuth("u", "p").WithHeader("Tus-Resumable", TusVersion).WithHeader("Upload-Length", "invalid").Expect().Status(400)
+	e.POST("/upload/data").WithBasicAuth("u", "p").WithHeader("Tus-Resumable", TusVersion).WithHeader("Upload-Length", BlobSize).WithHeader("Upload-Metadata", "uuid invalid").Expect().Status(400)
+	e.POST("/upload/model").WithBasicAuth("u", "p").WithHeader("Tus-Resumable", TusVersion).WithHeader("Upload-Length", BlobSize).WithHeader("Upload-Metadata", "algo "+b64([]byte(DevilMockUUID))).Expect().Status(404)
+	e.POST("/upload/data").WithBasicAuth("u", "p").WithHeader("Tus-Resumable", TusVersion).WithHeader("Upload-Length", BlobSize).WithHeader("Upload-Metadata", "uuid "+b64([]byte(ProblemMockUUIDStr))).Expect().Status(409)
+
+	// Test blob uploaded in two chunks
+	id := uuid.NewV4().String()
+	metadata := fmt.Sprintf("uuid %s,filename %s,checksum %s", b64([]byte(id)), b64([]byte("main.go")), b64([]byte(BlobChecksum)))
+	location := e.POST("/upload/data").WithBasicAuth("u", "p").WithHeader("Tus-Resumable", TusVersion).WithHeader("Upload-Length", BlobSize).WithHeader("Upload-Metadata", metadata).Expect().Status(201).Header("Location").Match("/upload/data/(.+)").Raw()[0]
+	r := e.HEAD(location).WithBasicAuth("u", "p").WithHeader("Tus-Resumable", TusVersion).Expect().Status(200)
+	r.Header("Upload-Offset").Equal("0")
+	r.Header("Upload-Length").Equal(BlobSize)
+
+	half := len(Blob) / 2
+	e.PATCH(location).WithBasicAuth("u", "p").WithHeader("Tus-Resumable", TusVersion).WithHeader("Content-Type", TusChunkContentType).WithHeader("Upload-Offset", "0").WithHeader("Content-Length", strconv.Itoa(half)).WithBytes(Blob[:half]).Expect().Status(204).Header("Upload-Offset").Equal(strconv.Itoa(half))
+	e.HEAD(location).WithBasicAuth("u", "p").WithHeader("Tus-Resumable", TusVersion).Expect().Status(200).Header("Upload-Offset").Equal(strconv.Itoa(half))
+
+	// Test chunk sent at the wrong offset or with the wrong media type is rejected
+	e.PATCH(location).WithBasicAuth("u", "p").WithHeader("Tus-Resumable", TusVersion).WithHeader("Content-Type", TusChunkContentType).WithHeader("Upload-Offset", "0").WithHeader("Content-Length", strconv.Itoa(half)).WithBytes(Blob[:half]).Expect().Status(409)
+	e.PATCH(location).WithBasicAuth("u", "p").WithHeader("Tus-Resumable", TusVersion).WithHeader("Content-Type", "application/octet-stream").WithHeader("Upload-Offset", strconv.Itoa(half)).WithHeader("Content-Length", strconv.Itoa(len(Blob)-half)).WithBytes(Blob[half:]).Expect().Status(415)
+	e.PATCH(location).WithBasicAuth("u", "p").WithHeader("Tus-Resumable", TusVersion).WithHeader("Content-Type", TusChunkContentType).WithHeader("Upload-Offset", strconv.Itoa(half)).WithHeader("Content-Length", strconv.Itoa(len(Blob))).WithBytes(Blob).Expect().Status(400)
+
+	// Test last chunk creates the resource and discards the upload
+	e.PATCH(location).WithBasicAuth("u", "p").WithHeader("Tus-Resumable", TusVersion).WithHeader("Content-Type", TusChunkContentType).WithHeader("Upload-Offset", strconv.Itoa(half)).WithHeader("Content-Length", strconv.Itoa(len(Blob)-half)).WithBytes(Blob[half:]).Expect().Status(204).Header("Upload-Offset").Equal(BlobSize)
+	e.HEAD(location).WithBasicAuth("u", "p").WithHeader("Tus-Resumable", TusVersion).Expect().Status(404)
+	e.GET(DataListRoute+"/"+id+"/blob").WithBasicAuth("u", "p").Expect().Status(200).Body().Equal(string(Blob))
+	for key := range blobStore.blobs {
+		if strings.HasPrefix(key, "upload/") {
+			t.Errorf("Upload chunk %s left on storage", key)
+		}
+	}
+
+	// Test checksum mismatch discards the upload
+	metadata = fmt.Sprintf("checksum %s", b64([]byte(DevilChecksum)))
+	location = e.POST("/upload/data").WithBasicAuth("u", "p").WithHeader("Tus-Resumable", TusVersion).WithHeader("Upload-Length", BlobSize).WithHeader("Upload-Metadata", metadata).Expect().Status(201).Header("Location").Raw()
+	e.PATCH(location).WithBasicAuth("u", "p").WithHeader("Tus-Resumable", TusVersion).WithHeader("Content-Type", TusChunkContentType).WithHeader("Upload-Offset", "0").WithHeader("Content-Length", BlobSize).WithBytes(Blob).Expect().Status(400).Body().Match("(.*)Checksum mismatch(.*)")
+	e.HEAD(location).WithBasicAuth("u", "p").WithHeader("Tus-Resumable", TusVersion).Expect().Status(404)
+
+	// Test terminated upload is deleted
+	location = e.POST("/upload/model").WithBasicAuth("u", "p").WithHeader("Tus-Resumable", TusVersion).WithHeader("Upload-Length", BlobSize).WithHeader("Upload-Metadata", "algo "+b64([]byte(RandomUUID.String()))).Expect().Status(201).Header("Location").Raw()
+	e.PATCH(location).WithBasicAuth("u", "p").WithHeader("Tus-Resumable", TusVersion).WithHeader("Content-Type", TusChunkContentType).WithHeader("Upload-Offset", "0").WithHeader("Content-Length", strconv.Itoa(half)).WithBytes(Blob[:half]).Expect().Status(204)
+	e.DELETE(location).WithBasicAuth("u", "p").WithHeader("Tus-Resumable", TusVersion).Expect().Status(204)
+	e.HEAD(location).WithBasicAuth("u", "p").WithHeader("Tus-Resumable", TusVersion).Expect().Status(404)
+	if len(blobStore.blobs) != 1 {
+		t.Errorf("Expected only the uploaded data blob left on storage, got %d blobs", len(blobStore.blobs))
+	}
+
+	// Test requests to an upload being finished by another request
+	location = e.POST("/upload/data").WithBasicAuth("u", "p").WithHeader("Tus-Resumable", TusVersion).WithHeader("Upload-Length", BlobSize).Expect().Status(201).Header("Location").Raw()
+	e.PATCH(location).WithBasicAuth("u", "p").WithHeader("Tus-Resumable", TusVersion).WithHeader("Content-Type", TusChunkContentType).WithHeader("Upload-Offset", "0").WithHeader("Content-Length", strconv.Itoa(half)).WithBytes(Blob[:half]).Expect().Status(204)
+	uploadID := uuid.FromStringOrNil(strings.TrimPrefix(location, "/upload/data/"))
+	if err := uploadAPI.UploadModel.MarkFinishing(uploadID); err != nil {
+		t.Fatalf("Error marking upload %s as finishing: %s", uploadID, err)
+	}
+	if err := uploadAPI.UploadModel.MarkFinishing(uploadID); err != ErrUploadFinishing {
+		t.Errorf("Expected upload %s to be finished once, got %v", uploadID, err)
+	}
+	e.PATCH(location).WithBasicAuth("u", "p").WithHeader("Tus-Resumable", TusVersion).WithHeader("Content-Type", TusChunkContentType).WithHeader("Upload-Offset", strconv.Itoa(half)).WithHeader("Content-Length", strconv.Itoa(len(Blob)-half)).WithBytes(Blob[half:]).Expect().Status(409)
+	e.PATCH(location).WithBasicAuth("u", "p").WithHeader("Tus-Resumable", TusVersion).WithHeader("Content-Type", TusChunkContentType).WithHeader("Upload-Offset", BlobSize).WithHeader("Content-Length", "0").Expect().Status(202).Header("Upload-Offset").Equal(BlobSize)
+	e.DELETE(location).WithBasicAuth("u", "p").WithHeader("Tus-Resumable", TusVersion).Expect().Status(409)
+	uploadAPI.UploadModel.UnmarkFinishing(uploadID)
+
+	// Test abandoned upload expires along with its chunks
+	expires := e.HEAD(location).WithBasicAuth("u", "p").WithHeader("Tus-Resumable", TusVersion).Expect().Status(200).Header("Upload-Expires").NotEmpty().Raw()
+	if date, err := http.ParseTime(expires); err != nil || date.Before(time.Now()) {
+		t.Errorf("Expected an Upload-Expires date in the future, got %s (err: %v)", expires, err)
+	}
+	if n, err := uploadAPI.ExpireUploads(time.Now()); err != nil || n != 0 {
+		t.Errorf("Expected no upload expired yet, got %d (err: %v)", n, err)
+	}
+	if n, err := uploadAPI.ExpireUploads(time.Now().Add(2 * time.Hour)); err != nil || n != 1 {
+		t.Errorf("Expected 1 expired upload deleted, got %d (err: %v)", n, err)
+	}
+	e.HEAD(location).WithBasicAuth("u", "p").WithHeader("Tus-Resumable", TusVersion).Expect().Status(404)
+	if len(blobStore.blobs) != 1 {
+		t.Errorf("Expected the chunks of the expired upload deleted, got %d blobs", len(blobStore.blobs))
+	}
+}
+
+func TestAtomicUpload(t *testing.T) {
+	blobStore := &FaultyBlobStore{MemoryBlobStore: NewMemoryBlobStore()}
+	dataModel := NewFaultyModel(DataModelName)
+	faultyAPI := newTestServer(blobStore)
+	faultyAPI.DataModel = dataModel
+	e := httptest.New(configureTestApp(faultyAPI), t)
+
+	checkLeftovers := func(blobs int, resources int) {
+		if len(blobStore.blobs) != blobs {
+			t.Errorf("Expected %d blob(s) on storage, got %d", blobs, len(blobStore.blobs))
+		}
+		if len(dataModel.Resources) != resources {
+			t.Errorf("Expected %d resource(s) in database, got %d", resources, len(dataModel.Resources))
+		}
+	}
+
+	// Test blob store failure leaves neither blob nor resource behind
+	blobStore.FailPut = true
+	e.POST(DataListRoute).WithBasicAuth("u", "p").WithMultipart().WithFormField("size", BlobSize).WithFile("blob", "main.go").Expect().Status(500).JSON().Object().Keys().Equal([]string{"error"})
+	blobStore.FailPut = false
+	checkLeftovers(0, 0)
+
+	// Test database failure before the upload leaves no blob behind
+	dataModel.FailInsert = true
+	e.POST(DataListRoute).WithBasicAuth("u", "p").WithMultipart().WithFormField("size", BlobSize).WithFile("blob", "main.go").Expect().Status(500).JSON().Object().Keys().Equal([]string{"error"})
+	dataModel.FailInsert = false
+	checkLeftovers(0, 0)
+
+	// Test database failure on commit leaves neither blob nor resource behind
+	dataModel.FailUpdate = true
+	e.POST(DataListRoute).WithBasicAuth("u", "p").WithMultipart().WithFormField("size", BlobSize).WithFile("blob", "main.go").Expect().Status(500).JSON().Object().Keys().Equal([]string{"error"})
+	dataModel.FailUpdate = false
+	checkLeftovers(0, 0)
+
+	// Test successful upload commits the resource
+	id := uuid.NewV4()
+	e.POST(DataListRoute).WithBasicAuth("u", "p").WithMultipart().WithFormField("uuid", id.String()).WithFormField("size", BlobSize).WithFile("blob", "main.go").Expect().Status(201)
+	checkLeftovers(1, 1)
+	if status := dataModel.Resources[id].Meta().Status; status != ResourceCommitted {
+		t.Errorf("Expected data %s to be %s, got %s", id, ResourceCommitted, status)
+	}
+
+	// Test pending resources left behind are cleaned up
+	pending := NewDataResource()
+	pending.Meta().Status = ResourcePending
+	dataModel.Insert(context.Background(), pending)
+	blobStore.Put("data/"+pending.ID.String(), bytes.NewReader(Blob), int64(len(Blob)))
+	n, err := faultyAPI.ReconcilePending(time.Now())
+	if err != nil || n != 1 {
+		t.Errorf("Expected 1 pending resource cleaned up, got %d (err: %v)", n, err)
+	}
+	checkLeftovers(1, 1)
+
+	// Test database failure on a uuid patch leaves the blob under its key
+	dataModel.FailUpdate = true
+	e.PATCH(DataListRoute+"/"+id.String()).WithBasicAuth("u", "p").WithMultipart().WithFormField("uuid", uuid.NewV4()).Expect().Status(500)
+	dataModel.FailUpdate = false
+	if _, ok := blobStore.blobs["data/"+id.String()]; !ok {
+		t.Errorf("Expected blob of data %s left under its key after a failed patch", id)
+	}
+	checkLeftovers(1, 1)
+}
+
+func TestContentAddressedBlobs(t *testing.T) {
+	blobStore := &FaultyBlobStore{MemoryBlobStore: NewMemoryBlobStore()}
+	dataModel := NewFaultyModel(DataModelName)
+	dedupAPI := newTestServer(blobStore)
+	dedupAPI.DataModel = dataModel
+	dedupAPI.BlobLayout = BlobLayoutContent
+	blobRefs := dedupAPI.BlobRefs.(*MockedBlobRefModel)
+	e := httptest.New(configureTestApp(dedupAPI), t)
+	key := "sha256/" + BlobChecksum
+
+	// Test identical blobs are stored once
+	ids := []uuid.UUID{uuid.NewV4(), uuid.NewV4()}
+	for _, id := range ids {
+		e.POST(DataListRoute).WithBasicAuth("u", "p").WithMultipart().WithFormField("uuid", id.String()).WithFormField("size", BlobSize).WithFile("blob", "main.go").Expect().Status(201)
+	}
+	if _, ok := blobStore.blobs[key]; !ok || len(blobStore.blobs) != 1 {
+		t.Errorf("Expected blob %s stored once, got %d blob(s)", key, len(blobStore.blobs))
+	}
+	if n := blobRefs.References(key); n != 2 {
+		t.Errorf("Expected 2 references to blob %s, got %d", key, n)
+	}
+	for _, id := range ids {
+		e.GET(DataListRoute+"/"+id.String()+"/blob").WithBasicAuth("u", "p").Expect().Status(200).Body().Equal(string(Blob))
+	}
+
+	// Test blob is deleted along with its last reference only
+	for i, id := range ids {
+		e.DELETE(DataListRoute+"/"+id.String()).WithBasicAuth("u", "p").Expect().Status(204)
+		dedupAPI.PurgeTrash(time.Now())
+		if _, ok := blobStore.blobs[key]; ok != (i == 0) {
+			t.Errorf("Expected blob %s to be stored: %t, after purging %d reference(s)", key, i == 0, i+1)
+		}
+	}
+
+	// Test blobs stored under their resource UUID are migrated
+	legacy := NewDataResource()
+	legacy.Meta().Status = ResourceCommitted
+	dataModel.Insert(context.Background(), legacy)
+	blobStore.Put("data/"+legacy.ID.String(), bytes.NewReader(Blob), int64(len(Blob)))
+	n, err := dedupAPI.MigrateBlobLayout()
+	if err != nil || n != 1 {
+		t.Errorf("Expected 1 blob migrated, got %d (err: %v)", n, err)
+	}
+	if _, ok := blobStore.blobs[key]; !ok || len(blobStore.blobs) != 1 {
+		t.Errorf("Expected blob moved to %s, got %d blob(s)", key, len(blobStore.blobs))
+	}
+	e.GET(DataListRoute+"/"+legacy.ID.String()+"/blob").WithBasicAuth("u", "p").Expect().Status(200).Body().Equal(string(Blob))
+
+	// Test a blob that couldn't be moved to its key isn't referenced
+	dataModel.Delete(context.Background(), legacy.ID)
+	blobRefs.Release(key, blobStore.Delete)
+	blobStore.FailRename = true
+	e.POST(DataListRoute).WithBasicAuth("u", "p").WithMultipart().WithFormField("size", BlobSize).WithFile("blob", "main.go").Expect().Status(500)
+	blobStore.FailRename = false
+	if n := blobRefs.References(key); n != 0 || len(blobStore.blobs) != 0 {
+		t.Errorf("Expected no reference to blob %s and no blob left, got %d reference(s) and %d blob(s)", key, n, len(blobStore.blobs))
+	}
+
+	// Test the reference taken by an upload interrupted before its resource
+	// was committed is released along with the pending resource
+	pending := NewDataResource()
+	pending.Meta().Status = ResourcePending
+	dataModel.Insert(context.Background(), pending)
+	stagingKey := "staging/data/" + pending.ID.String()
+	blobStore.Put(stagingKey, bytes.NewReader(Blob), int64(len(Blob)))
+	_, err = blobRefs.Acquire(key, stagingKey, func(key string) error { return blobStore.Rename(stagingKey, key) })
+	if err != nil {
+		t.Fatalf("Error referencing blob %s: %s", key, err)
+	}
+	if n, err := dedupAPI.ReconcilePending(time.Now()); err != nil || n != 1 {
+		t.Errorf("Expected 1 pending resource cleaned up, got %d (err: %v)", n, err)
+	}
+	if n := blobRefs.References(key); n != 0 || len(blobStore.blobs) != 0 {
+		t.Errorf("Expected no reference to blob %s and no blob left, got %d reference(s) and %d blob(s)", key, n, len(blobStore.blobs))
+	}
+}
+
 func TestPostObjectMultipart(t *testing.T) {
 	e := httptest.New(app, t)
 
@@ -153,10 +502,10 @@ func TestPostObjectMultipart(t *testing.T) {
 		t.Logf(url)
 
 		// Test valid request with UUID returns Success
-		e.POST(url).WithBasicAuth("u", "p").WithMultipart().WithForm(MultipartFormUUIDMap[url]).WithFormField("size", "666").WithFile("blob", "main.go").Expect().Status(201).Body().Match("(.*)" + RandomUUID.String() + "(.*)")
+		e.POST(url).WithBasicAuth("u", "p").WithMultipart().WithForm(MultipartFormUUIDMap[url]).WithFormField("size", BlobSize).WithFile("blob", "main.go").Expect().Status(201).Body().Match("(.*)" + RandomUUID.String() + "(.*)")
 
 		// Test valid request without UUID returns Success
-		e.POST(url).WithBasicAuth("u", "p").WithMultipart().WithForm(MultipartFormMap[url]).WithFormField("size", "666").WithFile("blob", "main.go").Expect().Status(201)
+		e.POST(url).WithBasicAuth("u", "p").WithMultipart().WithForm(MultipartFormMap[url]).WithFormField("size", BlobSize).WithFile("blob", "main.go").Expect().Status(201)
 
 		// Test request with invalid Content-Type header returns BadRequest
 		e.POST(url).WithBasicAuth("u", "p").Expect().Status(400)
@@ -171,14 +520,42 @@ func TestPostObjectMultipart(t *testing.T) {
 		e.POST(url).WithBasicAuth("u", "p").WithMultipart().WithForm(MultipartFormUUIDMap[url]).WithFile("blob", "main.go").Expect().Status(400).Body().Match("(.*)'Size' unset(.*)")
 
 		// Test field blob not at the end returns BadRequest
-		e.POST(url).WithBasicAuth("u", "p").WithMultipart().WithFile("blob", "main.go").WithForm(MultipartFormUUIDMap[url]).WithFormField("size", "666").Expect().Status(400)
+		e.POST(url).WithBasicAuth("u", "p").WithMultipart().WithFile("blob", "main.go").WithForm(MultipartFormUUIDMap[url]).WithFormField("size", BlobSize).Expect().Status(400)
 
 		// Test failed file upload returns InternalServerError
 		e.POST(url).WithBasicAuth("u", "p").WithMultipart().WithForm(MultipartFormUUIDMap[url]).WithFormField("size", common.NaughtySize).WithFile("blob", "main.go").Expect().Status(500)
 	}
 
+	// Test declared size not matching the blob returns BadRequest
+	for _, url := range postObjectMultipartRoutes {
+		e.POST(url).WithBasicAuth("u", "p").WithMultipart().WithForm(MultipartFormMap[url]).WithFormField("size", "666").WithFile("blob", "main.go").Expect().Status(400).Body().Match("(.*)Size mismatch(.*)more were sent(.*)")
+		e.POST(url).WithBasicAuth("u", "p").WithMultipart().WithForm(MultipartFormMap[url]).WithFormField("size", "6666666").WithFile("blob", "main.go").Expect().Status(400).Body().Match("(.*)Size mismatch(.*)only(.*)")
+	}
+
+	// Test checksums are computed, and verified when sent
+	for _, url := range postObjectMultipartRoutes {
+		e.POST(url).WithBasicAuth("u", "p").WithMultipart().WithForm(MultipartFormMap[url]).WithFormField("size", BlobSize).WithFile("blob", "main.go").Expect().Status(201).JSON().Object().ValueEqual("checksum", BlobChecksum)
+		e.POST(url).WithBasicAuth("u", "p").WithMultipart().WithForm(MultipartFormMap[url]).WithFormField("size", BlobSize).WithFormField("checksum", BlobChecksum).WithFile("blob", "main.go").Expect().Status(201)
+		e.POST(url).WithBasicAuth("u", "p").WithMultipart().WithForm(MultipartFormMap[url]).WithFormField("size", BlobSize).WithFormField("checksum", DevilChecksum).WithFile("blob", "main.go").Expect().Status(400).Body().Match("(.*)Checksum mismatch(.*)")
+		e.POST(url).WithBasicAuth("u", "p").WithMultipart().WithForm(MultipartFormMap[url]).WithFormField("size", BlobSize).WithFormField("checksum", "666devil").WithFile("blob", "main.go").Expect().Status(400).Body().Match("(.*)Invalid checksum(.*)")
+	}
+
+	// Test blob file name and media type are recorded
+	for _, url := range postObjectMultipartRoutes {
+		e.POST(url).WithBasicAuth("u", "p").WithMultipart().WithForm(MultipartFormMap[url]).WithFormField("size", BlobSize).WithFormField("filename", "weights.bin").WithFile("blob", "main.go").Expect().Status(201).JSON().Object().ValueEqual("filename", "weights.bin").ValueEqual("content_type", "application/octet-stream")
+		e.POST(url).WithBasicAuth("u", "p").WithMultipart().WithForm(MultipartFormMap[url]).WithFormField("size", BlobSize).WithFormField("filename", "../../devil/weights.bin").WithFile("blob", "main.go").Expect().Status(201).JSON().Object().ValueEqual("filename", "weights.bin")
+		e.POST(url).WithBasicAuth("u", "p").WithMultipart().WithForm(MultipartFormMap[url]).WithFormField("size", BlobSize).WithFile("blob", "main.go").Expect().Status(201).JSON().Object().ValueEqual("filename", "main.go")
+		e.POST(url).WithBasicAuth("u", "p").WithMultipart().WithForm(MultipartFormMap[url]).WithFormField("size", BlobSize).WithFormField("filename", "..").WithFile("blob", "main.go").Expect().Status(400).Body().Match("(.*)Invalid filename(.*)")
+	}
+
+	// Test the authenticated user is recorded as owner
+	for _, url := range postObjectMultipartRoutes {
+		e.POST(url).WithBasicAuth("u", "p").WithMultipart().WithForm(MultipartFormMap[url]).WithFormField("size", BlobSize).WithFile("blob", "main.go").Expect().Status(201).JSON().Object().ValueEqual("owner", "u")
+	}
+	e.POST(ModelListRoute).WithQuery("algo", RandomUUID.String()).WithBasicAuth("u", "p").WithHeader("Content-Length", "15").WithBytes([]byte("fakefilecontent")).Expect().Status(201).JSON().Object().ValueEqual("owner", "u")
+
 	// Test valid form field but not suited for Object returns BadRequest
-	e.POST(DataListRoute).WithBasicAuth("u", "p").WithMultipart().WithForm(MultipartFormUUIDMap[ProblemListRoute]).WithFormField("size", "666").WithFile("blob", "main.go").Expect().Status(400)
+	e.POST(DataListRoute).WithBasicAuth("u", "p").WithMultipart().WithForm(MultipartFormUUIDMap[ProblemListRoute]).WithFormField("size", BlobSize).WithFile("blob", "main.go").Expect().Status(400)
 
 	// Test big description/size returns BadRequest
 	buf := make([]byte, StrFieldMaxLength+1)
@@ -199,6 +576,16 @@ func TestPostModel(t *testing.T) {
 	// Test request with unexistant algo uuid returns NotFound
 	e.POST(ModelListRoute).WithQuery("algo", DevilMockUUID).WithBasicAuth("u", "p").WithHeader("Content-Length", "15").WithBytes([]byte("fakefilecontent")).Expect().Status(404).Body().Match(`{\"error\":\"Error uploading model: algorithm (.+) not found: Error retrieving algo (.+): (.*)\"}`)
 
+	// Test Content-Length not matching the blob returns BadRequest
+	e.POST(ModelListRoute).WithQuery("algo", RandomUUID.String()).WithBasicAuth("u", "p").WithHeader("Content-Length", "20").WithBytes([]byte("fakefilecontent")).Expect().Status(400).Body().Match("(.*)Size mismatch(.*)")
+
+	// Test checksum is computed, and verified when sent
+	e.POST(ModelListRoute).WithQuery("algo", RandomUUID.String()).WithBasicAuth("u", "p").WithHeader("Content-Length", "15").WithBytes([]byte("fakefilecontent")).Expect().Status(201).JSON().Object().ContainsKey("checksum")
+	e.POST(ModelListRoute).WithQuery("algo", RandomUUID.String()).WithQuery("checksum", DevilChecksum).WithBasicAuth("u", "p").WithHeader("Content-Length", "15").WithBytes([]byte("fakefilecontent")).Expect().Status(400).Body().Match("(.*)Checksum mismatch(.*)")
+
+	// Test file name and media type are recorded
+	e.POST(ModelListRoute).WithQuery("algo", RandomUUID.String()).WithQuery("filename", "model.tar.gz").WithBasicAuth("u", "p").WithHeader("Content-Length", "15").WithHeader("Content-Type", "application/gzip").WithBytes([]byte("fakefilecontent")).Expect().Status(201).JSON().Object().ValueEqual("filename", "model.tar.gz").ValueEqual("content_type", "application/gzip")
+
 	// Test failed file upload returns InternalServerError
 	e.POST(ModelListRoute).WithQuery("algo", RandomUUID.String()).WithBasicAuth("u", "p").WithHeader("Content-Length", strconv.Itoa(common.NaughtySize)).WithBytes([]byte("fakefilecontent")).Expect().Status(500).Body().Match("(.*)What a naughty size(.*)")
 }
@@ -216,34 +603,437 @@ func TestPatchProblem(t *testing.T) {
 	e.PATCH(ProblemListRoute+"/"+ProblemMockUUIDStr).WithBasicAuth("u", "p").WithMultipart().WithFormField("name", "").Expect().Status(400).Body().Match("(.*)'Name' unset(.*)")
 }
 
+func TestPatchObject(t *testing.T) {
+	e := httptest.New(app, t)
+
+	for _, url := range listObjectRoutes {
+		t.Logf(url)
+
+		// Fields needed for the patched resource to be valid
+		fields := map[string]string{}
+		if url == ProblemListRoute || url == AlgoListRoute {
+			fields["name"] = "testName"
+		}
+		patch := func(id string) *httpexpect.Request {
+			req := e.PATCH(url+"/"+id).WithBasicAuth("u", "p").WithMultipart()
+			for key, value := range fields {
+				req = req.WithFormField(key, value)
+			}
+			return req
+		}
+
+		// Test valid patch of the uuid (blob renamed) returns Success
+		newUUID := uuid.NewV4()
+		patch(RandomUUID.String()).WithFormField("uuid", newUUID).Expect().Status(200).Body().Match("(.*)" + newUUID.String() + "(.*)")
+
+		// Test valid patch of the uuid and blob returns Success
+		patch(RandomUUID.String()).WithFormField("uuid", uuid.NewV4()).WithFormField("size", BlobSize).WithFile("blob", "main.go").Expect().Status(200)
+
+		// Test used UUID returns Conflict
+		e.PATCH(url+"/"+RandomUUID.String()).WithBasicAuth("u", "p").WithMultipart().WithFormField("uuid", ProblemMockUUIDStr).Expect().Status(409)
+
+		// Test invalid uuid returns BadRequest
+		patch("666devil").Expect().Status(400).Body().Match("(.*)Impossible to parse UUID(.*)")
+
+		// Test uuid not in db returns NotFound
+		patch(DevilMockUUID).Expect().Status(404)
+
+		// Test database failure on a uuid patch returns InternalServerError
+		patch(RandomUUID.String()).WithFormField("uuid", DevilMockUUID).Expect().Status(500).Body().Match("(.*)Error updating(.*)")
+
+		// Test resource owned by another user can be patched by an admin
+		patch(OwnedMockUUIDStr).Expect().Status(200)
+
+		// Test unknown field returns BadRequest
+		e.PATCH(url+"/"+RandomUUID.String()).WithBasicAuth("u", "p").WithMultipart().WithFormField("invalid", "aze").Expect().Status(400).Body().Match("(.*)Unknown field(.*)")
+	}
+
+	// Test invalid algo name returns BadRequest
+	e.PATCH(AlgoListRoute+"/"+RandomUUID.String()).WithBasicAuth("u", "p").WithMultipart().WithFormField("name", "").Expect().Status(400)
+}
+
+func TestDeleteObject(t *testing.T) {
+	e := httptest.New(app, t)
+
+	for _, url := range listObjectRoutes {
+		t.Logf(url)
+
+		// Test valid request returns NoContent
+		e.DELETE(url+"/"+RandomUUID.String()).WithBasicAuth("u", "p").Expect().Status(204)
+
+		// Test invalid uuid returns BadRequest
+		e.DELETE(url+"/666devil").WithBasicAuth("u", "p").Expect().Status(400).Body().Match("(.*)Impossible to parse UUID(.*)")
+
+		// Test uuid not in db returns NotFound
+		e.DELETE(url+"/"+DevilMockUUID).WithBasicAuth("u", "p").Expect().Status(404).Body().Match("{(.*)sql: no rows in result set\"}")
+
+		// Test resource owned by another user can be deleted by an admin
+		e.DELETE(url+"/"+OwnedMockUUIDStr).WithBasicAuth("u", "p").Expect().Status(204)
+	}
+
+	// Test algo still used by a model returns Conflict
+	e.DELETE(AlgoListRoute+"/"+AlgoMockUsedUUIDStr).WithBasicAuth("u", "p").Expect().Status(409).Body().Match("(.*)still referenced(.*)")
+
+	// Test unauthenticated request returns Unauthorized
+	e.DELETE(DataListRoute + "/" + RandomUUID.String()).Expect().Status(401)
+}
+
+func TestTrash(t *testing.T) {
+	e := httptest.New(app, t)
+
+	for _, url := range listObjectRoutes {
+		t.Logf(url)
+
+		// Test trashed resources are hidden unless explicitly requested
+		e.GET(url+"/"+TrashedMockUUIDStr).WithBasicAuth("u", "p").Expect().Status(404)
+		e.GET(url+"/"+TrashedMockUUIDStr).WithQuery("include_deleted", "true").WithBasicAuth("u", "p").Expect().Status(200).JSON().Object().ContainsKey("deleted_at")
+		e.GET(url+"/"+TrashedMockUUIDStr+"/blob").WithBasicAuth("u", "p").Expect().Status(404)
+		e.GET(url).WithQuery("include_deleted", "true").WithBasicAuth("u", "p").Expect().Status(200)
+
+		// Test invalid include_deleted returns BadRequest
+		e.GET(url+"/"+TrashedMockUUIDStr).WithQuery("include_deleted", "maybe").WithBasicAuth("u", "p").Expect().Status(400)
+		e.GET(url).WithQuery("include_deleted", "maybe").WithBasicAuth("u", "p").Expect().Status(400)
+
+		// Test trashed resources can't be deleted twice
+		e.DELETE(url+"/"+TrashedMockUUIDStr).WithBasicAuth("u", "p").Expect().Status(404)
+
+		// Test restore
+		if url == ModelListRoute {
+			// Test a model can't be restored while its algo is in the trash
+			e.POST(url+"/"+TrashedMockUUIDStr+"/restore").WithBasicAuth("u", "p").Expect().Status(409).Body().Match("(.*)in the trash or gone(.*)")
+		} else {
+			e.POST(url+"/"+TrashedMockUUIDStr+"/restore").WithBasicAuth("u", "p").Expect().Status(200).JSON().Object().NotContainsKey("deleted_at")
+		}
+		e.POST(url+"/"+RandomUUID.String()+"/restore").WithBasicAuth("u", "p").Expect().Status(409).Body().Match("(.*)not in the trash(.*)")
+		e.POST(url+"/"+DevilMockUUID+"/restore").WithBasicAuth("u", "p").Expect().Status(404)
+		e.POST(url+"/666devil/restore").WithBasicAuth("u", "p").Expect().Status(400)
+	}
+}
+
+func TestPurgeTrash(t *testing.T) {
+	// The mocked models all have a resource in the trash, but the algo stays
+	// referenced by the model in the trash
+	n, err := api.PurgeTrash(time.Now())
+	if err != nil {
+		t.Fatalf("Error purging trash: %s", err)
+	}
+	if n != len(listObjectRoutes)-1 {
+		t.Errorf("Expected %d purged resources, got %d", len(listObjectRoutes)-1, n)
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	slowApp := iris.New()
+	slowApp.Adapt(iris.DevLogger(), httprouter.New())
+	started := make(chan struct{}, 1)
+	slowApp.Get("/slow", func(c *iris.Context) {
+		started <- struct{}{}
+		time.Sleep(200 * time.Millisecond)
+		c.SetStatusCode(204)
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- Serve(slowApp, listener)
+	}()
+
+	// Test the request in flight on SIGTERM is still handled
+	responses := make(chan *http.Response, 1)
+	go func() {
+		res, err := http.Get(fmt.Sprintf("http://%s/slow", listener.Addr()))
+		if err != nil {
+			t.Errorf("Error sending request: %s", err)
+		}
+		responses <- res
+	}()
+	<-started
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	if res := <-responses; res != nil && res.StatusCode != 204 {
+		t.Errorf("Expected 204 for the request in flight, got %d", res.StatusCode)
+	}
+	select {
+	case err = <-served:
+		if err != nil {
+			t.Errorf("Error shutting down: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Server still running after SIGTERM")
+	}
+}
+
+// DevilChecksum is a valid SHA-256 checksum that never matches the test blobs
+const DevilChecksum = "6666666666666666666666666666666666666666666666666666666666666666"
+
 // setTestApp set up the Iris App for testing
 func setTestApp() *iris.Framework {
 	conf := NewStorageConfig()
+
+	// set Blobstore
+	conf.BlobStore = "mock"
+	blobStore, _ := SetBlobStore(*conf)
+
+	var app *iris.Framework
+	app, api = newTestApp(blobStore)
+	return app
+}
+
+// newTestApp sets up an Iris App backed by mocked models and a given blob store
+func newTestApp(blobStore common.BlobStore) (*iris.Framework, *APIServer) {
+	api := newTestServer(blobStore)
+	return configureTestApp(api), api
+}
+
+// configureTestApp sets up an Iris App serving a given API
+func configureTestApp(api *APIServer) *iris.Framework {
 	app := iris.New()
 	app.Adapt(iris.DevLogger(), httprouter.New())
-	auth := SetAuthentication("u", "p")
+	api.ConfigureRoutes(app, Authentication(api.Credentials, api.Tokens))
+	return app
+}
 
+// newTestServer creates an API backed by mocked models and a given blob store
+func newTestServer(blobStore common.BlobStore) *APIServer {
 	// Set models configuration
 	problemModel, _ := NewMockedModel(ProblemModelName)
 	algoModel, _ := NewMockedModel(AlgoModelName)
 	modelModel, _ := NewMockedModel(ModelModelName)
 	dataModel, _ := NewMockedModel(DataModelName)
 	predictionModel, _ := NewMockedModel(PredictionModelName)
+	uploadModel, _ := NewMockedUploadModel()
+	blobRefs, _ := NewMockedBlobRefModel()
+	tokenModel, _ := NewMockedTokenModel()
+	auditModel, _ := NewMockedAuditModel()
 
-	// set Blobstore
-	conf.BlobStore = "mock"
-	blobStore, _ := SetBlobStore(*conf)
+	// Users: an admin and a regular user
+	credentials := NewCredentials()
+	credentials.Add("u", "p", []string{RoleAdmin})
+	credentials.Add("v", "p", nil)
 
-	api := &APIServer{
+	return &APIServer{
 		BlobStore:       blobStore,
 		ProblemModel:    problemModel,
 		AlgoModel:       algoModel,
 		ModelModel:      modelModel,
 		DataModel:       dataModel,
 		PredictionModel: predictionModel,
+		UploadModel:     uploadModel,
+		BlobRefs:        blobRefs,
+		Credentials:     credentials,
+		Tokens:          tokenModel,
+		Audit:           auditModel,
 	}
-	api.ConfigureRoutes(app, auth)
-	return app
+}
+
+// MemoryBlobStore is a blob store keeping blobs in memory. Unlike the mocked
+// blob store, it actually stores blobs and its readers can seek.
+type MemoryBlobStore struct {
+	sync.Mutex
+	blobs map[string][]byte
+}
+
+// NewMemoryBlobStore creates an empty MemoryBlobStore
+func NewMemoryBlobStore() *MemoryBlobStore {
+	return &MemoryBlobStore{blobs: make(map[string][]byte)}
+}
+
+type memoryBlob struct {
+	*bytes.Reader
+}
+
+func (b memoryBlob) Close() error {
+	return nil
+}
+
+// Put stores a blob, reading r until EOF
+func (s *MemoryBlobStore) Put(key string, r io.Reader, size int64) error {
+	blob, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.blobs[key] = blob
+	return nil
+}
+
+// Get returns a seekable reader of a blob
+func (s *MemoryBlobStore) Get(key string) (io.ReadCloser, error) {
+	s.Lock()
+	defer s.Unlock()
+	blob, ok := s.blobs[key]
+	if !ok {
+		return nil, fmt.Errorf("Blob %s not found", key)
+	}
+	return memoryBlob{bytes.NewReader(blob)}, nil
+}
+
+// Delete removes a blob
+func (s *MemoryBlobStore) Delete(key string) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.blobs[key]; !ok {
+		return fmt.Errorf("Blob %s not found", key)
+	}
+	delete(s.blobs, key)
+	return nil
+}
+
+// Rename moves a blob to another key
+func (s *MemoryBlobStore) Rename(oldKey, newKey string) error {
+	s.Lock()
+	defer s.Unlock()
+	blob, ok := s.blobs[oldKey]
+	if !ok {
+		return fmt.Errorf("Blob %s not found", oldKey)
+	}
+	s.blobs[newKey] = blob
+	delete(s.blobs, oldKey)
+	return nil
+}
+
+// FaultyBlobStore is a MemoryBlobStore whose writes fail on demand
+type FaultyBlobStore struct {
+	*MemoryBlobStore
+	FailPut    bool
+	FailRename bool
+}
+
+// Put stores a blob, or half of it and fails if FailPut is set
+func (s *FaultyBlobStore) Put(key string, r io.Reader, size int64) error {
+	if s.FailPut {
+		s.MemoryBlobStore.Put(key, io.LimitReader(r, size/2), size)
+		return fmt.Errorf("Faulty blob store failed writing %s", key)
+	}
+	return s.MemoryBlobStore.Put(key, r, size)
+}
+
+// Rename moves a blob, or fails if FailRename is set
+func (s *FaultyBlobStore) Rename(oldKey, newKey string) error {
+	if s.FailRename {
+		return fmt.Errorf("Faulty blob store failed moving %s", oldKey)
+	}
+	return s.MemoryBlobStore.Rename(oldKey, newKey)
+}
+
+// FaultyModel is a mocked model keeping the instances inserted through it in
+// memory. Its insertions and updates fail on demand.
+type FaultyModel struct {
+	Model
+	sync.Mutex
+
+	FailInsert bool
+	FailUpdate bool
+	Resources  map[uuid.UUID]StoredResource
+}
+
+// NewFaultyModel creates a FaultyModel with no instance
+func NewFaultyModel(name string) *FaultyModel {
+	model, _ := NewMockedModel(name)
+	return &FaultyModel{Model: model, Resources: make(map[uuid.UUID]StoredResource)}
+}
+
+func copyResource(resource StoredResource) StoredResource {
+	c := reflect.New(reflect.TypeOf(resource).Elem())
+	c.Elem().Set(reflect.ValueOf(resource).Elem())
+	return c.Interface().(StoredResource)
+}
+
+// Insert stores a copy of an instance, or fails if FailInsert is set
+func (m *FaultyModel) Insert(ctx context.Context, instance interface{}) error {
+	m.Lock()
+	defer m.Unlock()
+	if m.FailInsert {
+		return fmt.Errorf("Faulty model failed inserting")
+	}
+	resource := instance.(StoredResource)
+	m.Resources[resource.GetUUID()] = copyResource(resource)
+	return nil
+}
+
+// GetOne returns a stored instance, or falls back on the mocked model
+func (m *FaultyModel) GetOne(ctx context.Context, instance interface{}, id uuid.UUID, includeDeleted bool) error {
+	m.Lock()
+	defer m.Unlock()
+	resource, ok := m.Resources[id]
+	if !ok {
+		return m.Model.GetOne(ctx, instance, id, includeDeleted)
+	}
+	if resource.Meta().DeletedAt != nil && !includeDeleted {
+		return fmt.Errorf("Faulty model: %s in the trash: sql: no rows in result set", id)
+	}
+	reflect.ValueOf(instance).Elem().Set(reflect.ValueOf(resource).Elem())
+	return nil
+}
+
+// Update replaces a stored instance, or fails if FailUpdate is set
+func (m *FaultyModel) Update(ctx context.Context, instance interface{}, id uuid.UUID) error {
+	m.Lock()
+	defer m.Unlock()
+	if m.FailUpdate {
+		return fmt.Errorf("Faulty model failed updating %s", id)
+	}
+	resource := instance.(StoredResource)
+	delete(m.Resources, id)
+	m.Resources[resource.GetUUID()] = copyResource(resource)
+	return nil
+}
+
+// Delete forgets an instance
+func (m *FaultyModel) Delete(ctx context.Context, id uuid.UUID) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.Resources, id)
+	return nil
+}
+
+// Trash moves a stored instance to the trash
+func (m *FaultyModel) Trash(ctx context.Context, id uuid.UUID) error {
+	m.Lock()
+	defer m.Unlock()
+	resource, ok := m.Resources[id]
+	if !ok {
+		return m.Model.Trash(ctx, id)
+	}
+	deletedAt := time.Now().Unix()
+	resource.Meta().DeletedAt = &deletedAt
+	return nil
+}
+
+// listWhere returns the UUIDs of the stored instances matching a condition
+func (m *FaultyModel) listWhere(match func(meta *ResourceMeta) bool) ([]uuid.UUID, error) {
+	m.Lock()
+	defer m.Unlock()
+	ids := []uuid.UUID{}
+	for id, resource := range m.Resources {
+		if match(resource.Meta()) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// ListTrashed returns the UUIDs of the instances in the trash
+func (m *FaultyModel) ListTrashed(ctx context.Context, before time.Time) ([]uuid.UUID, error) {
+	return m.listWhere(func(meta *ResourceMeta) bool { return meta.DeletedAt != nil })
+}
+
+// ListPending returns the UUIDs of the pending instances
+func (m *FaultyModel) ListPending(ctx context.Context, before time.Time) ([]uuid.UUID, error) {
+	return m.listWhere(func(meta *ResourceMeta) bool { return meta.Status == ResourcePending })
+}
+
+// ListLegacyBlobs returns the UUIDs of the instances whose blob isn't content
+// addressed
+func (m *FaultyModel) ListLegacyBlobs(ctx context.Context) ([]uuid.UUID, error) {
+	return m.listWhere(func(meta *ResourceMeta) bool { return meta.Status == ResourceCommitted && meta.BlobKey == "" })
+}
+
+// ListCommitted returns the UUIDs of the committed instances
+func (m *FaultyModel) ListCommitted(ctx context.Context) ([]uuid.UUID, error) {
+	return m.listWhere(func(meta *ResourceMeta) bool { return meta.Status == ResourceCommitted })
 }
 
 // NewMultipartFormUUIDMap creates valid Multipart/form-data fields for each Resource
@@ -0,0 +1,429 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/satori/go.uuid"
+	"gopkg.in/kataras/iris.v6"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+)
+
+// Context keys under which handlers record the details of a request for the
+// audit log and the metrics
+const (
+	auditResourceKey = "audit_resource"
+	auditActionKey   = "audit_action"
+	auditBytesOutKey = "audit_bytes_out"
+)
+
+// otherRoute is the route of the requests matching none of the API routes
+const otherRoute = "other"
+
+// AuditEntry records a request made to the API: who did what on which
+// resource, and how many bytes were transferred
+type AuditEntry struct {
+	ID           int64      `db:"id" json:"id"`
+	Timestamp    int64      `db:"timestamp" json:"timestamp"`
+	Principal    string     `db:"principal" json:"principal"`
+	Method       string     `db:"method" json:"method"`
+	Path         string     `db:"path" json:"path"`
+	Resource     string     `db:"resource" json:"resource"`
+	Action       string     `db:"action" json:"action"`
+	ResourceUUID *uuid.UUID `db:"resource_uuid" json:"uuid,omitempty"`
+	Status       int        `db:"status" json:"status"`
+	BytesIn      int64      `db:"bytes_in" json:"bytes_in"`
+	BytesOut     int64      `db:"bytes_out" json:"bytes_out"`
+	ClientIP     string     `db:"client_ip" json:"client_ip"`
+	DurationMs   int64      `db:"duration_ms" json:"duration_ms"`
+}
+
+// AuditFilter selects audit entries. Zero fields don't filter anything.
+type AuditFilter struct {
+	Principal    string
+	Resource     string
+	Action       string
+	ResourceUUID *uuid.UUID
+	Status       int
+	Since        int64
+	Until        int64
+	Page         int
+	PageSize     int
+}
+
+// AuditModel stores the audit log. Entries can only be appended.
+type AuditModel interface {
+	Record(entry *AuditEntry) error
+	// List returns a page of the entries matching a filter, newest first,
+	// along with the total number of matching entries
+	List(filter AuditFilter) ([]AuditEntry, int, error)
+}
+
+// SQLAuditModel stores the audit log in a postgreSQL database
+type SQLAuditModel struct {
+	*sqlx.DB
+}
+
+// NewSQLAuditModel creates an AuditModel instance, bound to a given database
+func NewSQLAuditModel(db *sqlx.DB) (*SQLAuditModel, error) {
+	return &SQLAuditModel{db}, nil
+}
+
+// Record appends an entry to the audit log
+func (m *SQLAuditModel) Record(entry *AuditEntry) error {
+	_, err := m.NamedExec(`INSERT INTO audit (timestamp, principal, method, path, resource, action, resource_uuid, status, bytes_in, bytes_out, client_ip, duration_ms) VALUES (:timestamp, :principal, :method, :path, :resource, :action, :resource_uuid, :status, :bytes_in, :bytes_out, :client_ip, :duration_ms)`, entry)
+	return err
+}
+
+// auditFilters returns the conditions (and their arguments) of a filter
+func auditFilters(filter AuditFilter) (conditions []string, args []interface{}) {
+	if filter.Principal != "" {
+		conditions = append(conditions, "principal = ?")
+		args = append(args, filter.Principal)
+	}
+	if filter.Resource != "" {
+		conditions = append(conditions, "resource = ?")
+		args = append(args, filter.Resource)
+	}
+	if filter.Action != "" {
+		conditions = append(conditions, "action = ?")
+		args = append(args, filter.Action)
+	}
+	if filter.ResourceUUID != nil {
+		conditions = append(conditions, "resource_uuid = ?")
+		args = append(args, *filter.ResourceUUID)
+	}
+	if filter.Status != 0 {
+		conditions = append(conditions, "status = ?")
+		args = append(args, filter.Status)
+	}
+	if filter.Since != 0 {
+		conditions = append(conditions, "timestamp >= ?")
+		args = append(args, filter.Since)
+	}
+	if filter.Until != 0 {
+		conditions = append(conditions, "timestamp < ?")
+		args = append(args, filter.Until)
+	}
+	return
+}
+
+// List returns a page of the entries matching a filter, newest first
+func (m *SQLAuditModel) List(filter AuditFilter) ([]AuditEntry, int, error) {
+	conditions, args := auditFilters(filter)
+	where := whereClause(conditions)
+
+	var total int
+	if err := m.Get(&total, m.Rebind(`SELECT COUNT(*) FROM audit `+where), args...); err != nil {
+		return nil, 0, fmt.Errorf("[audit] Error counting entries: %s", err)
+	}
+	entries := []AuditEntry{}
+	query := m.Rebind(`SELECT * FROM audit ` + where + ` ORDER BY id DESC LIMIT ? OFFSET ?`)
+	args = append(args, filter.PageSize, filter.Page*filter.PageSize)
+	if err := m.Select(&entries, query, args...); err != nil {
+		return nil, 0, fmt.Errorf("[audit] Error listing entries: %s", err)
+	}
+	return entries, total, nil
+}
+
+// MockedAuditModel keeps the audit log in memory
+type MockedAuditModel struct {
+	sync.Mutex
+
+	entries []AuditEntry
+}
+
+// NewMockedAuditModel creates an empty MockedAuditModel
+func NewMockedAuditModel() (*MockedAuditModel, error) {
+	return &MockedAuditModel{}, nil
+}
+
+// Record appends an entry to the audit log
+func (m *MockedAuditModel) Record(entry *AuditEntry) error {
+	m.Lock()
+	defer m.Unlock()
+	entry.ID = int64(len(m.entries) + 1)
+	m.entries = append(m.entries, *entry)
+	return nil
+}
+
+// List returns a page of the entries matching a filter, newest first
+func (m *MockedAuditModel) List(filter AuditFilter) ([]AuditEntry, int, error) {
+	m.Lock()
+	defer m.Unlock()
+	matching := []AuditEntry{}
+	for _, e := range m.entries {
+		if (filter.Principal == "" || e.Principal == filter.Principal) &&
+			(filter.Resource == "" || e.Resource == filter.Resource) &&
+			(filter.Action == "" || e.Action == filter.Action) &&
+			(filter.ResourceUUID == nil || (e.ResourceUUID != nil && *e.ResourceUUID == *filter.ResourceUUID)) &&
+			(filter.Status == 0 || e.Status == filter.Status) &&
+			(filter.Since == 0 || e.Timestamp >= filter.Since) &&
+			(filter.Until == 0 || e.Timestamp < filter.Until) {
+			matching = append(matching, e)
+		}
+	}
+	sort.Slice(matching, func(i, j int) bool { return matching[i].ID > matching[j].ID })
+
+	start := filter.Page * filter.PageSize
+	if start > len(matching) {
+		start = len(matching)
+	}
+	end := start + filter.PageSize
+	if end > len(matching) {
+		end = len(matching)
+	}
+	return matching[start:end], len(matching), nil
+}
+
+// countingResponseWriter counts the bytes of a response body written by
+// http.ServeContent
+type countingResponseWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// routeTemplate returns the route matching a request path, e.g. /data/:uuid
+// for /data/<uuid>
+func routeTemplate(path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for _, route := range routes {
+		if routeMatches(strings.Split(strings.Trim(route, "/"), "/"), segments) {
+			return route
+		}
+	}
+	return otherRoute
+}
+
+func routeMatches(route, segments []string) bool {
+	if len(route) != len(segments) {
+		return false
+	}
+	for i, segment := range route {
+		if !strings.HasPrefix(segment, ":") && segment != segments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// routeTarget derives the resource type and the action of a request from its
+// route: resource routes map to the policy action they require, admin routes
+// to their user, token or audit resource.
+func routeTarget(c *iris.Context) (string, string) {
+	route := routeTemplate(c.Request.URL.Path)
+	if route == otherRoute {
+		return "", ""
+	}
+	segments := strings.Split(strings.Trim(route, "/"), "/")
+	resource, last := segments[0], segments[len(segments)-1]
+	switch {
+	case resource == "upload":
+		return c.Param("resource"), ActionCreate
+	case resource == "admin" && len(segments) > 1:
+		resource, segments = segments[1], segments[1:]
+	case resource != "audit" && !containsString(policyResources, resource):
+		return "", ""
+	}
+
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead:
+		if last == "blob" {
+			return resource, ActionDownload
+		}
+		if len(segments) == 1 {
+			return resource, ActionList
+		}
+		return resource, ActionGet
+	case http.MethodPost:
+		// Restoring a resource requires the right to delete it
+		if last == "restore" {
+			return resource, ActionDelete
+		}
+		return resource, ActionCreate
+	case http.MethodPatch:
+		return resource, ActionPatch
+	case http.MethodDelete:
+		return resource, ActionDelete
+	}
+	return resource, ""
+}
+
+// setAuditTarget records the resource type and the action of a request, as
+// checked by the access policy
+func setAuditTarget(c *iris.Context, resource, action string) {
+	c.Set(auditResourceKey, resource)
+	c.Set(auditActionKey, action)
+}
+
+// addAuditBytesOut records bytes sent in the response body
+func addAuditBytesOut(c *iris.Context, n int64) {
+	sent, _ := c.Get(auditBytesOutKey).(int64)
+	c.Set(auditBytesOutKey, sent+n)
+}
+
+// clientIP returns the IP address of the client of a request
+func clientIP(c *iris.Context) string {
+	host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if err != nil {
+		return c.Request.RemoteAddr
+	}
+	return host
+}
+
+// audit is a middleware appending every request it wraps to the audit log,
+// once it has been handled. Its resource type and action are derived from its
+// route, so that requests rejected before the access policy is checked are
+// recorded with them too.
+func (s *APIServer) audit(c *iris.Context) {
+	start := time.Now()
+	resource, action := routeTarget(c)
+	setAuditTarget(c, resource, action)
+	c.Next()
+
+	entry := &AuditEntry{
+		Timestamp:  start.Unix(),
+		Principal:  principal(c),
+		Method:     c.Request.Method,
+		Path:       c.Request.URL.Path,
+		Resource:   c.GetString(auditResourceKey),
+		Action:     c.GetString(auditActionKey),
+		Status:     c.ResponseWriter.StatusCode(),
+		BytesIn:    requestBytesIn(c),
+		ClientIP:   clientIP(c),
+		DurationMs: int64(time.Since(start) / time.Millisecond),
+	}
+	if id, err := uuid.FromString(c.Param("uuid")); err == nil {
+		entry.ResourceUUID = &id
+	}
+	entry.BytesOut, _ = c.Get(auditBytesOutKey).(int64)
+	if err := s.Audit.Record(entry); err != nil {
+		requestLogger(c).WithField("component", "audit").Errorf("Error recording request: %s", err)
+	}
+}
+
+// parseAuditFilter reads the filter of an audit log request from its query
+func parseAuditFilter(c *iris.Context) (filter AuditFilter, err error) {
+	filter = AuditFilter{
+		Principal: c.URLParam("principal"),
+		Resource:  c.URLParam("resource"),
+		Action:    c.URLParam("action"),
+		PageSize:  DefaultPageSize,
+	}
+	if id := c.URLParam("uuid"); id != "" {
+		parsed, err := uuid.FromString(id)
+		if err != nil {
+			return filter, fmt.Errorf("Error parsing uuid: %s", err)
+		}
+		filter.ResourceUUID = &parsed
+	}
+	integers := []struct {
+		name  string
+		value *int
+	}{{"status", &filter.Status}, {"page", &filter.Page}, {"page_size", &filter.PageSize}}
+	for _, param := range integers {
+		if value := c.URLParam(param.name); value != "" {
+			if *param.value, err = strconv.Atoi(value); err != nil {
+				return filter, fmt.Errorf("Error parsing %s to integer: %s", param.name, err)
+			}
+		}
+	}
+	dates := []struct {
+		name  string
+		value *int64
+	}{{"since", &filter.Since}, {"until", &filter.Until}}
+	for _, param := range dates {
+		if value := c.URLParam(param.name); value != "" {
+			date, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return filter, fmt.Errorf("Error parsing %s: should be an RFC 3339 date: %s", param.name, err)
+			}
+			*param.value = date.Unix()
+		}
+	}
+	if filter.Page < 0 {
+		return filter, fmt.Errorf("Invalid page %d: should be positive", filter.Page)
+	}
+	if filter.PageSize < 1 || filter.PageSize > MaxPageSize {
+		return filter, fmt.Errorf("Invalid page size %d: should be between 1 and %d", filter.PageSize, MaxPageSize)
+	}
+	return filter, nil
+}
+
+func (s *APIServer) getAuditLog(c *iris.Context) {
+	filter, err := parseAuditFilter(c)
+	if err != nil {
+		c.JSON(400, common.NewAPIError(fmt.Sprintf("Invalid audit query: %s", err)))
+		return
+	}
+	entries, total, err := s.Audit.List(filter)
+	if err != nil {
+		c.JSON(500, common.NewAPIError(fmt.Sprintf("Error retrieving audit log: %s", err)))
+		return
+	}
+	var next, prev interface{}
+	if (filter.Page+1)*filter.PageSize < total {
+		next = pageLink(c, filter.Page+1)
+	}
+	if filter.Page > 0 {
+		prev = pageLink(c, filter.Page-1)
+	}
+	c.JSON(200, map[string]interface{}{
+		"page":      filter.Page,
+		"page_size": filter.PageSize,
+		"total":     total,
+		"length":    len(entries),
+		"items":     entries,
+		"next":      next,
+		"prev":      prev,
+	})
+}
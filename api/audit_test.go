@@ -0,0 +1,88 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+package main_test
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/satori/go.uuid"
+	"gopkg.in/kataras/iris.v6/httptest"
+
+	. "github.com/MorpheoOrg/morpheo-storage/api"
+)
+
+func TestAuditLog(t *testing.T) {
+	app, api := newTestApp(NewMemoryBlobStore())
+	api.Credentials.Add("uploader", "p", []string{RoleUploader})
+	e := httptest.New(app, t)
+
+	id := uuid.NewV4().String()
+	e.POST(DataListRoute).WithBasicAuth("uploader", "p").WithMultipart().WithFormField("uuid", id).WithFormField("size", BlobSize).WithFile("blob", "main.go").Expect().Status(201)
+	e.GET(DataListRoute+"/"+id+"/blob").WithBasicAuth("uploader", "p").Expect().Status(200)
+	e.GET(DataListRoute+"/"+id+"/blob").WithBasicAuth("uploader", "p").WithHeader("Range", "bytes=10-19").Expect().Status(206)
+	e.DELETE(DataListRoute+"/"+id).WithBasicAuth("uploader", "wrong").Expect().Status(401)
+
+	// Test only admins can read the audit log
+	e.GET(AuditRoute).WithBasicAuth("uploader", "p").Expect().Status(403)
+
+	// Test downloads are recorded with the bytes sent
+	downloads := e.GET(AuditRoute).WithBasicAuth("u", "p").WithQuery("uuid", id).WithQuery("action", ActionDownload).Expect().Status(200).JSON().Object()
+	downloads.ValueEqual("total", 2)
+	entry := downloads.Value("items").Array().Element(0).Object()
+	entry.ValueEqual("principal", "uploader").ValueEqual("resource", DataModelName).ValueEqual("status", 206).ValueEqual("bytes_out", 10)
+	entry.ValueEqual("method", "GET").ValueEqual("path", DataListRoute+"/"+id+"/blob")
+	downloads.Value("items").Array().Element(1).Object().ValueEqual("status", 200).ValueEqual("bytes_out", len(Blob))
+
+	// Test uploads are recorded with the bytes received
+	uploads := e.GET(AuditRoute).WithBasicAuth("u", "p").WithQuery("principal", "uploader").WithQuery("action", ActionCreate).Expect().Status(200).JSON().Object()
+	uploads.ValueEqual("total", 1)
+	uploads.Value("items").Array().Element(0).Object().ValueEqual("status", 201).Value("bytes_in").Number().Gt(len(Blob))
+
+	// Test failed requests are recorded too
+	failed := e.GET(AuditRoute).WithBasicAuth("u", "p").WithQuery("status", "401").Expect().Status(200).JSON().Object()
+	failed.ValueEqual("total", 1)
+	failed.Value("items").Array().Element(0).Object().ValueEqual("principal", "").ValueEqual("uuid", id).ValueEqual("method", "DELETE").ValueEqual("resource", DataModelName).ValueEqual("action", ActionDelete)
+
+	// Test admin routes are recorded with their resource and action
+	e.GET(AuditRoute).WithBasicAuth("u", "p").WithQuery("principal", "uploader").WithQuery("resource", "audit").WithQuery("action", ActionList).Expect().Status(200).JSON().Object().ValueEqual("total", 1).Value("items").Array().Element(0).Object().ValueEqual("status", 403)
+
+	// Test pagination and date filters
+	e.GET(AuditRoute).WithBasicAuth("u", "p").WithQuery("page_size", 1).WithQuery("page", 1).Expect().Status(200).JSON().Object().ValueEqual("length", 1).ValueEqual("page", 1)
+	e.GET(AuditRoute).WithBasicAuth("u", "p").WithQuery("until", "2000-01-01T00:00:00Z").Expect().Status(200).JSON().Object().ValueEqual("total", 0)
+	e.GET(AuditRoute).WithBasicAuth("u", "p").WithQuery("since", "yesterday").Expect().Status(400).Body().Match("(.*)RFC 3339(.*)")
+	e.GET(AuditRoute).WithBasicAuth("u", "p").WithQuery("uuid", "666devil").Expect().Status(400)
+	e.GET(AuditRoute).WithBasicAuth("u", "p").WithQuery("page_size", strconv.Itoa(MaxPageSize+1)).Expect().Status(400)
+}
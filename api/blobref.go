@@ -0,0 +1,456 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// Blob layouts: blobs are either stored under the type and UUID of their
+// resource (one copy per resource), or under their SHA-256 checksum so that
+// identical blobs are stored once, whatever the number of resources using them.
+const (
+	BlobLayoutUUID    = "uuid"
+	BlobLayoutContent = "content"
+
+	contentBlobKeyPrefix = "sha256/"
+)
+
+// BlobRefModel counts the resources referencing each content addressed blob.
+//
+// A reference is acquired on behalf of an upload, identified by a claim (its
+// staging key), before the resource using the blob is saved. The claim records
+// which blob the upload references, so that an upload interrupted before its
+// resource is saved can give its reference back. It is settled once the
+// resource is saved, the reference then belongs to the resource.
+type BlobRefModel interface {
+	// Acquire adds a reference to a blob on behalf of claim, and returns the
+	// new reference count. When it is the first one, store is called to put the
+	// blob under key, and the reference is only added if it succeeds. No
+	// reference can be released on the blob until it returns.
+	Acquire(key, claim string, store func(key string) error) (int64, error)
+	// Settle forgets a claim, leaving its reference to the resource saved
+	Settle(claim string) error
+	// Abandon releases the reference held by a claim, if any (see Release)
+	Abandon(claim string, free func(key string) error) error
+	// Release removes a reference to a blob. When it was the last one, free is
+	// called before the blob is forgotten, and no reference can be acquired
+	// on the blob until it returns.
+	Release(key string, free func(key string) error) (int64, error)
+}
+
+// SQLBlobRefModel counts blob references in a postgreSQL database
+type SQLBlobRefModel struct {
+	*sqlx.DB
+}
+
+// NewSQLBlobRefModel creates a BlobRefModel instance, bound to a given database
+func NewSQLBlobRefModel(db *sqlx.DB) (*SQLBlobRefModel, error) {
+	return &SQLBlobRefModel{db}, nil
+}
+
+// Acquire adds a reference to a blob on behalf of claim. The blob row stays
+// locked while store runs, so that the blob can't be released meanwhile, and
+// the reference and claim are only committed once the blob is stored.
+func (m *SQLBlobRefModel) Acquire(key, claim string, store func(key string) error) (int64, error) {
+	tx, err := m.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var n int64
+	if err = tx.Get(&n, `INSERT INTO blob_ref (blob_key, refcount) VALUES ($1, 1) ON CONFLICT (blob_key) DO UPDATE SET refcount = blob_ref.refcount + 1 RETURNING refcount`, key); err != nil {
+		return 0, err
+	}
+	if _, err = tx.Exec(`INSERT INTO blob_claim (claim, blob_key) VALUES ($1, $2) ON CONFLICT (claim) DO UPDATE SET blob_key = $2`, claim, key); err != nil {
+		return 0, err
+	}
+	if n == 1 {
+		if err = store(key); err != nil {
+			return 0, err
+		}
+	}
+	return n, tx.Commit()
+}
+
+// Settle forgets a claim
+func (m *SQLBlobRefModel) Settle(claim string) error {
+	_, err := m.Exec(`DELETE FROM blob_claim WHERE claim=$1`, claim)
+	return err
+}
+
+// Abandon releases the reference held by a claim, if any
+func (m *SQLBlobRefModel) Abandon(claim string, free func(key string) error) error {
+	tx, err := m.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var key string
+	err = tx.Get(&key, `DELETE FROM blob_claim WHERE claim=$1 RETURNING blob_key`, claim)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = release(tx, key, free)
+	return err
+}
+
+// Release removes a reference to a blob
+func (m *SQLBlobRefModel) Release(key string, free func(key string) error) (int64, error) {
+	tx, err := m.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	return release(tx, key, free)
+}
+
+// release removes a reference to a blob and commits tx. The blob row stays
+// locked while free runs, so that concurrent uploads of the same blob wait for
+// it to be deleted before storing it again.
+func release(tx *sqlx.Tx, key string, free func(key string) error) (int64, error) {
+	var n int64
+	if err := tx.Get(&n, `UPDATE blob_ref SET refcount = refcount - 1 WHERE blob_key=$1 RETURNING refcount`, key); err != nil {
+		return 0, err
+	}
+	if n > 0 {
+		return n, tx.Commit()
+	}
+
+	freeErr := free(key)
+	if _, err := tx.Exec(`DELETE FROM blob_ref WHERE blob_key=$1`, key); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return 0, freeErr
+}
+
+// MockedBlobRefModel counts blob references in memory
+type MockedBlobRefModel struct {
+	sync.Mutex
+
+	refs   map[string]int64
+	claims map[string]string
+}
+
+// NewMockedBlobRefModel creates a MockedBlobRefModel without any reference
+func NewMockedBlobRefModel() (*MockedBlobRefModel, error) {
+	return &MockedBlobRefModel{refs: make(map[string]int64), claims: make(map[string]string)}, nil
+}
+
+// Acquire adds a reference to a blob on behalf of claim
+func (m *MockedBlobRefModel) Acquire(key, claim string, store func(key string) error) (int64, error) {
+	m.Lock()
+	defer m.Unlock()
+	if m.refs[key] == 0 {
+		if err := store(key); err != nil {
+			return 0, err
+		}
+	}
+	m.refs[key]++
+	m.claims[claim] = key
+	return m.refs[key], nil
+}
+
+// Settle forgets a claim
+func (m *MockedBlobRefModel) Settle(claim string) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.claims, claim)
+	return nil
+}
+
+// Abandon releases the reference held by a claim, if any
+func (m *MockedBlobRefModel) Abandon(claim string, free func(key string) error) error {
+	m.Lock()
+	defer m.Unlock()
+	key, ok := m.claims[claim]
+	if !ok {
+		return nil
+	}
+	delete(m.claims, claim)
+	_, err := m.release(key, free)
+	return err
+}
+
+// Release removes a reference to a blob
+func (m *MockedBlobRefModel) Release(key string, free func(key string) error) (int64, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.release(key, free)
+}
+
+func (m *MockedBlobRefModel) release(key string, free func(key string) error) (int64, error) {
+	n, ok := m.refs[key]
+	if !ok {
+		return 0, fmt.Errorf("[mock] Blob %s not referenced: sql: no rows in result set", key)
+	}
+	if n > 1 {
+		m.refs[key]--
+		return n - 1, nil
+	}
+	delete(m.refs, key)
+	return 0, free(key)
+}
+
+// References returns the number of references to a blob
+func (m *MockedBlobRefModel) References(key string) int64 {
+	m.Lock()
+	defer m.Unlock()
+	return m.refs[key]
+}
+
+func contentBlobKey(checksum string) string {
+	return contentBlobKeyPrefix + checksum
+}
+
+// resourceBlobKey returns the key of a resource blob on the blob store
+func (s *APIServer) resourceBlobKey(modelName string, resource StoredResource) string {
+	if key := resource.Meta().BlobKey; key != "" {
+		return key
+	}
+	return s.getBlobKey(modelName, resource.GetUUID())
+}
+
+// stagingBlobKey returns the key a resource blob is uploaded to. In the uuid
+// layout, it is the blob key itself.
+func (s *APIServer) stagingBlobKey(modelName string, id uuid.UUID) string {
+	if s.BlobLayout != BlobLayoutContent {
+		return s.getBlobKey(modelName, id)
+	}
+	return fmt.Sprintf("staging/%s/%s", modelName, id)
+}
+
+// storeBlob uploads a resource blob (see putBlob) and sets its key in meta. In
+// the content layout, the blob is then moved to its content addressed key, or
+// dropped if the same blob is already stored. The reference to the blob is
+// claimed by the upload until settleBlob or abandonBlob is called.
+func (s *APIServer) storeBlob(ctx context.Context, modelName string, id uuid.UUID, body io.Reader, size int64, checksum string, meta *ResourceMeta) (int, error) {
+	stagingKey := s.stagingBlobKey(modelName, id)
+	statusCode, err := s.putBlob(ctx, stagingKey, body, size, checksum, meta)
+	if err != nil {
+		// The blob may have been partially written, or not at all
+		s.blobStore(ctx).Delete(stagingKey)
+		return statusCode, err
+	}
+	if s.BlobLayout != BlobLayoutContent {
+		meta.BlobKey = ""
+		return statusCode, nil
+	}
+
+	key := contentBlobKey(meta.Checksum)
+	if err = s.addressBlob(ctx, stagingKey, key); err != nil {
+		s.blobStore(ctx).Delete(stagingKey)
+		return 500, err
+	}
+	meta.BlobKey = key
+	meta.claim = stagingKey
+	return statusCode, nil
+}
+
+// addressBlob references a content addressed blob on behalf of the upload at
+// stagingKey, moving it from there unless it is already stored
+func (s *APIServer) addressBlob(ctx context.Context, stagingKey, key string) error {
+	n, err := s.BlobRefs.Acquire(key, stagingKey, func(key string) error {
+		return s.blobStore(ctx).Rename(stagingKey, key)
+	})
+	if err != nil {
+		return fmt.Errorf("Error referencing blob %s: %s", key, err)
+	}
+	if n > 1 {
+		s.deleteBlob(ctx, stagingKey)
+	}
+	return nil
+}
+
+// settleBlob hands the reference claimed by storeBlob over to the resource,
+// once it is saved
+func (s *APIServer) settleBlob(meta *ResourceMeta) {
+	if meta.claim == "" {
+		return
+	}
+	// A claim left behind is harmless: it is overwritten by the next upload
+	// using the same staging key
+	if err := s.BlobRefs.Settle(meta.claim); err != nil {
+		log.WithField("component", "blobstore").Warnf("Claim %s on blob %s left in database: %s", meta.claim, meta.BlobKey, err)
+	}
+	meta.claim = ""
+}
+
+// abandonBlob undoes storeBlob when the resource couldn't be saved. A blob
+// stored under the same key as the blob it replaces (keep) stays.
+func (s *APIServer) abandonBlob(ctx context.Context, modelName string, resource StoredResource, keep string) {
+	meta := resource.Meta()
+	if meta.claim == "" {
+		if key := s.resourceBlobKey(modelName, resource); key != keep {
+			s.deleteBlob(ctx, key)
+		}
+		return
+	}
+	if err := s.BlobRefs.Abandon(meta.claim, s.blobStore(ctx).Delete); err != nil {
+		log.WithField("component", "blobstore").Warnf("Reference to blob %s left in database: %s", meta.BlobKey, err)
+	}
+	meta.claim = ""
+}
+
+// replaceBlob settles the blob stored for a saved resource, and discards the
+// blob it replaced
+func (s *APIServer) replaceBlob(ctx context.Context, modelName string, resource StoredResource, oldKey string) {
+	contentAddressed := resource.Meta().claim != ""
+	s.settleBlob(resource.Meta())
+	// A blob overwritten in place is the new one, while the reference the
+	// resource held on a content addressed blob has to go in any case
+	if s.resourceBlobKey(modelName, resource) != oldKey || contentAddressed {
+		s.discardBlob(ctx, oldKey)
+	}
+}
+
+// discardBlob deletes a blob a resource doesn't use anymore. Content addressed
+// blobs are only deleted once no resource references them.
+func (s *APIServer) discardBlob(ctx context.Context, key string) {
+	if !strings.HasPrefix(key, contentBlobKeyPrefix) {
+		s.deleteBlob(ctx, key)
+		return
+	}
+	if _, err := s.BlobRefs.Release(key, s.blobStore(ctx).Delete); err != nil {
+		log.WithField("component", "blobstore").Warnf("Orphan blob %s left on storage: %s", key, err)
+	}
+}
+
+// MigrateBlobLayout moves the blobs stored under the type and UUID of their
+// resource to their content addressed key. Blobs are copied, and the previous
+// copy deleted once the resource points at the new one, so that the migration
+// can be interrupted and run again. It returns the number of migrated blobs.
+func (s *APIServer) MigrateBlobLayout() (int, error) {
+	ctx, span := startJob("MigrateBlobLayout")
+	defer span.End()
+	resourceModels := []Model{s.ProblemModel, s.AlgoModel, s.ModelModel, s.DataModel, s.PredictionModel}
+
+	migrated := 0
+	var lastErr error
+	for _, resourceModel := range resourceModels {
+		modelName := resourceModel.GetModelName()
+		ids, err := resourceModel.ListLegacyBlobs(ctx)
+		if err != nil {
+			lastErr = err
+			log.WithField("component", "migrate").Errorf("Error listing %s blobs: %s", modelName, err)
+			continue
+		}
+		for _, id := range ids {
+			if err = s.migrateBlob(ctx, resourceModel, id); err != nil {
+				lastErr = err
+				log.WithField("component", "migrate").Errorf("Error migrating %s %s blob: %s", modelName, id, err)
+				continue
+			}
+			migrated++
+		}
+	}
+	return migrated, lastErr
+}
+
+func (s *APIServer) migrateBlob(ctx context.Context, resourceModel Model, id uuid.UUID) error {
+	modelName := resourceModel.GetModelName()
+	resource, err := NewStoredResource(modelName)
+	if err != nil {
+		return err
+	}
+	if err = resourceModel.GetOne(ctx, resource, id, true); err != nil {
+		return err
+	}
+	meta := resource.Meta()
+	legacyKey := s.getBlobKey(modelName, id)
+
+	// Blobs uploaded before checksums were introduced are read a first time
+	if meta.Checksum == "" {
+		blob, err := s.blobStore(ctx).Get(legacyKey)
+		if err != nil {
+			return err
+		}
+		hash := sha256.New()
+		meta.Size, err = io.Copy(hash, blob)
+		blob.Close()
+		if err != nil {
+			return err
+		}
+		meta.Checksum = hex.EncodeToString(hash.Sum(nil))
+	}
+
+	// The reference is claimed under the legacy key. A previous run
+	// interrupted before updating the resource left its claim behind.
+	if err = s.BlobRefs.Abandon(legacyKey, s.blobStore(ctx).Delete); err != nil {
+		return err
+	}
+	key := contentBlobKey(meta.Checksum)
+	_, err = s.BlobRefs.Acquire(key, legacyKey, func(key string) error {
+		blob, err := s.blobStore(ctx).Get(legacyKey)
+		if err != nil {
+			return err
+		}
+		defer blob.Close()
+		return s.blobStore(ctx).Put(key, blob, meta.Size)
+	})
+	if err != nil {
+		return err
+	}
+
+	meta.BlobKey = key
+	meta.claim = legacyKey
+	if err = resourceModel.Update(ctx, resource, id); err != nil {
+		s.abandonBlob(ctx, modelName, resource, "")
+		return err
+	}
+	s.settleBlob(meta)
+	s.deleteBlob(ctx, legacyKey)
+	return nil
+}
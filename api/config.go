@@ -35,7 +35,11 @@
 
 package main
 
-import "flag"
+import (
+	"flag"
+	"os"
+	"time"
+)
 
 // StorageConfig holds the configuration variables for the storage API
 type StorageConfig struct {
@@ -45,9 +49,59 @@ type StorageConfig struct {
 	CertFile string
 	KeyFile  string
 
-	// Authentification
-	APIUser     string
-	APIPassword string
+	// Logs: minimum level (debug, info, warning, error...) and format
+	// (LogFormatJSON or LogFormatText)
+	LogLevel  string
+	LogFormat string
+
+	// Traces: exported to the OTLP/HTTP collector at OTLPEndpoint
+	// (TracingOTLP), written as JSON to TraceFile or the standard output
+	// (TracingStdout), or not exported at all if TracingExporter is empty
+	TracingExporter string
+	OTLPEndpoint    string
+	OTLPInsecure    bool
+	TraceFile       string
+
+	// Clients have to present a certificate signed by ClientCAFile (if set).
+	// In mTLS authentication mode, certificates are mapped to principals by
+	// ClientCertMapFile.
+	ClientCAFile      string
+	ClientCertMapFile string
+
+	// Authentification: users of CredentialsFile, or the single APIUser if
+	// it is empty. APIUser and APIPassword are read from the environment:
+	// passing them with the deprecated -user and -password flags sets
+	// DeprecatedAuthFlags.
+	APIUser             string
+	APIPassword         string
+	CredentialsFile     string
+	DeprecatedAuthFlags bool
+
+	// Authentication mode (AuthBasic, AuthJWT or AuthMTLS). JWTs are verified
+	// with the keys of JWKSURL or JWKSFile, and mapped to principals using the
+	// JWTPrincipalClaim and JWTRolesClaim claims.
+	AuthMode          string
+	JWKSURL           string
+	JWKSFile          string
+	JWTIssuer         string
+	JWTAudience       string
+	JWTPrincipalClaim string
+	JWTRolesClaim     string
+
+	// Access policy granting actions to roles (DefaultPolicy if empty)
+	PolicyFile string
+
+	// Rate limits (0 for no limit): requests per second per principal and
+	// per client IP, in bursts of up to RateLimitBurst requests, bandwidth in
+	// bytes per second per principal and per client IP, and concurrent blob
+	// uploads and downloads per principal
+	RateLimit        float64
+	RateLimitIP      float64
+	RateLimitBurst   int
+	BandwidthLimit   int64
+	BandwidthLimitIP int64
+	MaxUploads       int
+	MaxDownloads     int
 
 	// Database configuration
 	DBHost string
@@ -63,6 +117,21 @@ type StorageConfig struct {
 	// Blobstore
 	BlobStore string
 
+	// Blob layout (BlobLayoutUUID or BlobLayoutContent), and whether blobs
+	// stored under their resource UUID should be moved to the content
+	// addressed layout on startup
+	BlobLayout        string
+	MigrateBlobLayout bool
+
+	// Encryption at rest: blobs are encrypted with the keys of
+	// EncryptionKeyFile (no encryption if empty), in frames of
+	// EncryptionChunkSize bytes. Blobs stored in clear are only served with
+	// EncryptionAllowPlaintext, until they are encrypted by RewrapBlobs.
+	EncryptionKeyFile        string
+	EncryptionChunkSize      int
+	EncryptionAllowPlaintext bool
+	RewrapBlobs              bool
+
 	// local (disk) blob store configuration
 	DataDir string
 	// S3 config
@@ -70,6 +139,20 @@ type StorageConfig struct {
 	AWSRegion string
 	// Google Cloud Config
 	GCBucket string
+
+	// Trash: resources deleted for longer than TrashRetention are purged every
+	// TrashPurgeInterval
+	TrashRetention     time.Duration
+	TrashPurgeInterval time.Duration
+
+	// Resumable uploads left without a new chunk for UploadExpiration are
+	// deleted every UploadCleanupInterval
+	UploadExpiration      time.Duration
+	UploadCleanupInterval time.Duration
+	// Uploads: resources still pending PendingTimeout after the last activity
+	// of their upload are cleaned up every PendingReconcileInterval
+	PendingTimeout           time.Duration
+	PendingReconcileInterval time.Duration
 }
 
 // TLSOn returns true if TLS credentials have been provided. The API will then
@@ -86,8 +169,38 @@ func NewStorageConfig() (conf *StorageConfig) {
 		certFile string
 		keyFile  string
 
-		apiUser     string
-		apiPassword string
+		logLevel  string
+		logFormat string
+
+		tracingExporter string
+		otlpEndpoint    string
+		otlpInsecure    bool
+		traceFile       string
+
+		clientCAFile      string
+		clientCertMapFile string
+
+		apiUser         string
+		apiPassword     string
+		credentialsFile string
+
+		authMode          string
+		jwksURL           string
+		jwksFile          string
+		jwtIssuer         string
+		jwtAudience       string
+		jwtPrincipalClaim string
+		jwtRolesClaim     string
+
+		policyFile string
+
+		rateLimit        float64
+		rateLimitIP      float64
+		rateLimitBurst   int
+		bandwidthLimit   int64
+		bandwidthLimitIP int64
+		maxUploads       int
+		maxDownloads     int
 
 		dbHost string
 		dbPort int
@@ -100,10 +213,26 @@ func NewStorageConfig() (conf *StorageConfig) {
 
 		blobStore string
 
+		blobLayout        string
+		migrateBlobLayout bool
+
+		encryptionKeyFile        string
+		encryptionChunkSize      int
+		encryptionAllowPlaintext bool
+		rewrapBlobs              bool
+
 		dataDir   string
 		awsBucket string
 		awsRegion string
 		gcBucket  string
+
+		trashRetention     time.Duration
+		trashPurgeInterval time.Duration
+
+		uploadExpiration         time.Duration
+		uploadCleanupInterval    time.Duration
+		pendingTimeout           time.Duration
+		pendingReconcileInterval time.Duration
 	)
 
 	// CLI Flags
@@ -111,9 +240,36 @@ func NewStorageConfig() (conf *StorageConfig) {
 	flag.IntVar(&port, "port", 8000, "The port our compute API will be listening on")
 	flag.StringVar(&certFile, "cert", "", "The TLS certs to serve to clients (leave blank for no TLS)")
 	flag.StringVar(&keyFile, "key", "", "The TLS key used to encrypt connection (leave blank for no TLS)")
+	flag.StringVar(&logLevel, "log-level", "info", "Minimum level of the logs: 'debug', 'info' (default), 'warning', 'error', 'fatal' or 'panic'")
+	flag.StringVar(&logFormat, "log-format", LogFormatJSON, "Format of the logs: 'json' (default) or 'text'")
+	flag.StringVar(&tracingExporter, "tracing", "", "Exporter of the OpenTelemetry traces: 'otlp' for an OTLP/HTTP collector, 'stdout' to write them as JSON (leave blank to not export traces)")
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", DefaultOTLPEndpoint, "host:port of the OTLP/HTTP collector traces are sent to (default: localhost:4318)")
+	flag.BoolVar(&otlpInsecure, "otlp-insecure", false, "if true, sends traces to the OTLP collector over plain HTTP (default: false)")
+	flag.StringVar(&traceFile, "trace-file", "", "File the stdout exporter writes traces to (leave blank for the standard output)")
+	flag.StringVar(&clientCAFile, "client-ca", "", "PEM CA bundle client certificates must be signed by (leave blank to not require client certificates)")
+	flag.StringVar(&clientCertMapFile, "client-cert-map", "", "JSON mapping of client certificate identities to users, in mtls authentication mode (leave blank to give read-only access to users named after their certificate)")
+
+	flag.StringVar(&apiUser, "user", envOr("STORAGE_AUTH_USER", "u"), "Deprecated, use the STORAGE_AUTH_USER environment variable: the username for Basic Authentification")
+	flag.StringVar(&apiPassword, "password", envOr("STORAGE_AUTH_PASSWORD", "p"), "Deprecated, use the STORAGE_AUTH_PASSWORD environment variable: the password for Basic Authentification")
+	flag.StringVar(&credentialsFile, "credentials-file", "", "File of the users allowed to use the API, with their bcrypt hashed passwords, reloaded on SIGHUP (leave blank to use STORAGE_AUTH_USER and STORAGE_AUTH_PASSWORD)")
 
-	flag.StringVar(&apiUser, "user", "u", "The username for Basic Authentification")
-	flag.StringVar(&apiPassword, "password", "p", "The password for Basic Authentification")
+	flag.StringVar(&authMode, "auth", AuthBasic, "Authentication mode: 'basic' (default) for users and API tokens, 'jwt' for JWTs issued by the other Morpheo services, 'mtls' for client certificates")
+	flag.StringVar(&jwksURL, "jwks-url", "", "URL of the JWKS holding the keys JWTs are signed with")
+	flag.StringVar(&jwksFile, "jwks-file", "", "Local JWKS file holding the keys JWTs are signed with (instead of -jwks-url)")
+	flag.StringVar(&jwtIssuer, "jwt-issuer", "", "Expected issuer (iss claim) of JWTs")
+	flag.StringVar(&jwtAudience, "jwt-audience", "", "Expected audience (aud claim) of JWTs")
+	flag.StringVar(&jwtPrincipalClaim, "jwt-principal-claim", "sub", "JWT claim holding the name of the user (default: sub)")
+	flag.StringVar(&jwtRolesClaim, "jwt-roles-claim", "roles", "JWT claim holding the roles of the user (default: roles)")
+
+	flag.StringVar(&policyFile, "policy-file", "", "JSON access policy defining the actions granted by each role (leave blank for the default reader, uploader, problem-admin and admin roles)")
+
+	flag.Float64Var(&rateLimit, "rate-limit", 0, "Maximum number of requests per second of each user (default: 0, no limit)")
+	flag.Float64Var(&rateLimitIP, "rate-limit-ip", 0, "Maximum number of requests per second from each client IP (default: 0, no limit)")
+	flag.IntVar(&rateLimitBurst, "rate-limit-burst", 20, "Number of requests allowed in a burst above the rate limits (default: 20)")
+	flag.Int64Var(&bandwidthLimit, "bandwidth-limit", 0, "Maximum bytes per second uploaded and downloaded by each user (default: 0, no limit)")
+	flag.Int64Var(&bandwidthLimitIP, "bandwidth-limit-ip", 0, "Maximum bytes per second uploaded and downloaded by each client IP (default: 0, no limit)")
+	flag.IntVar(&maxUploads, "max-uploads", 0, "Maximum number of concurrent blob uploads of each user (default: 0, no limit)")
+	flag.IntVar(&maxDownloads, "max-downloads", 0, "Maximum number of concurrent blob downloads of each user (default: 0, no limit)")
 
 	flag.StringVar(&dbHost, "db-host", "postgres", "The hostname of the postgres database (default: postgres)")
 	flag.IntVar(&dbPort, "db-port", 5432, "The database port")
@@ -126,13 +282,35 @@ func NewStorageConfig() (conf *StorageConfig) {
 
 	flag.StringVar(&blobStore, "blobstore", "local", "Storage service provider: 'gc' for Google Cloud Storage, 's3' for AWS S3, 'local' (default) and 'mock' supported")
 
+	flag.StringVar(&blobLayout, "blob-layout", BlobLayoutUUID, "Blob keys: 'uuid' (default) to store blobs under their resource type and UUID, 'content' to store them under their SHA-256 checksum and deduplicate them")
+	flag.BoolVar(&migrateBlobLayout, "migrate-blob-layout", false, "if true, moves the blobs stored under their resource UUID to the content addressed layout on startup (default: false)")
+
+	flag.StringVar(&encryptionKeyFile, "encryption-keyfile", "", "JSON keyfile of the master keys used to encrypt blobs (leave blank for no encryption)")
+	flag.IntVar(&encryptionChunkSize, "encryption-chunk-size", DefaultEncryptionChunkSize, "Size in bytes of the encrypted frames of blobs (default: 65536)")
+	flag.BoolVar(&encryptionAllowPlaintext, "encryption-allow-plaintext", false, "if true, serves the blobs stored before encryption was enabled as they are (default: false)")
+	flag.BoolVar(&rewrapBlobs, "rewrap-blobs", false, "if true, re-wraps the data keys of all blobs under the current master key and encrypts the blobs stored in clear on startup (default: false)")
+
 	flag.StringVar(&dataDir, "data-dir", "/data", "The directory to store locally blob data under (default: /data)")
 	flag.StringVar(&awsBucket, "s3-bucket", "", "AWS Bucket (default: empty string)")
 	flag.StringVar(&awsRegion, "s3-region", "", "AWS Region (default: empty string)")
 	flag.StringVar(&gcBucket, "gc-bucket", "", "Google Cloud Storage Bucket (default: empty string)")
 
+	flag.DurationVar(&trashRetention, "trash-retention", 30*24*time.Hour, "How long deleted resources are kept in the trash before being purged (default: 720h)")
+	flag.DurationVar(&trashPurgeInterval, "trash-purge-interval", time.Hour, "How often the trash is purged (default: 1h)")
+
+	flag.DurationVar(&uploadExpiration, "upload-expiration", 24*time.Hour, "How long a resumable upload is kept without receiving a new chunk (default: 24h)")
+	flag.DurationVar(&uploadCleanupInterval, "upload-cleanup-interval", time.Hour, "How often expired resumable uploads are deleted (default: 1h)")
+	flag.DurationVar(&pendingTimeout, "pending-timeout", 24*time.Hour, "How long an upload can stall before its pending resource is cleaned up (default: 24h)")
+	flag.DurationVar(&pendingReconcileInterval, "pending-reconcile-interval", time.Hour, "How often pending resources are cleaned up (default: 1h)")
+
 	flag.Parse()
 
+	// Passwords passed as flags show in the process list
+	deprecatedAuthFlags := false
+	flag.Visit(func(f *flag.Flag) {
+		deprecatedAuthFlags = deprecatedAuthFlags || f.Name == "user" || f.Name == "password"
+	})
+
 	// Let's create the config structure
 	conf = &StorageConfig{
 		Hostname: hostname,
@@ -140,8 +318,39 @@ func NewStorageConfig() (conf *StorageConfig) {
 		CertFile: certFile,
 		KeyFile:  keyFile,
 
-		APIUser:     apiUser,
-		APIPassword: apiPassword,
+		LogLevel:  logLevel,
+		LogFormat: logFormat,
+
+		TracingExporter: tracingExporter,
+		OTLPEndpoint:    otlpEndpoint,
+		OTLPInsecure:    otlpInsecure,
+		TraceFile:       traceFile,
+
+		ClientCAFile:      clientCAFile,
+		ClientCertMapFile: clientCertMapFile,
+
+		APIUser:             apiUser,
+		APIPassword:         apiPassword,
+		CredentialsFile:     credentialsFile,
+		DeprecatedAuthFlags: deprecatedAuthFlags,
+
+		AuthMode:          authMode,
+		JWKSURL:           jwksURL,
+		JWKSFile:          jwksFile,
+		JWTIssuer:         jwtIssuer,
+		JWTAudience:       jwtAudience,
+		JWTPrincipalClaim: jwtPrincipalClaim,
+		JWTRolesClaim:     jwtRolesClaim,
+
+		PolicyFile: policyFile,
+
+		RateLimit:        rateLimit,
+		RateLimitIP:      rateLimitIP,
+		RateLimitBurst:   rateLimitBurst,
+		BandwidthLimit:   bandwidthLimit,
+		BandwidthLimitIP: bandwidthLimitIP,
+		MaxUploads:       maxUploads,
+		MaxDownloads:     maxDownloads,
 
 		DBHost: dbHost,
 		DBPort: dbPort,
@@ -154,10 +363,35 @@ func NewStorageConfig() (conf *StorageConfig) {
 
 		BlobStore: blobStore,
 
+		BlobLayout:        blobLayout,
+		MigrateBlobLayout: migrateBlobLayout,
+
+		EncryptionKeyFile:        encryptionKeyFile,
+		EncryptionChunkSize:      encryptionChunkSize,
+		EncryptionAllowPlaintext: encryptionAllowPlaintext,
+		RewrapBlobs:              rewrapBlobs,
+
 		DataDir:   dataDir,
 		AWSBucket: awsBucket,
 		AWSRegion: awsRegion,
 		GCBucket:  gcBucket,
+
+		TrashRetention:     trashRetention,
+		TrashPurgeInterval: trashPurgeInterval,
+
+		UploadExpiration:         uploadExpiration,
+		UploadCleanupInterval:    uploadCleanupInterval,
+		PendingTimeout:           pendingTimeout,
+		PendingReconcileInterval: pendingReconcileInterval,
 	}
 	return
 }
+
+// envOr returns the value of an environment variable, or a default value if it
+// is unset
+func envOr(name, defaultValue string) string {
+	if value, ok := os.LookupEnv(name); ok {
+		return value
+	}
+	return defaultValue
+}
@@ -0,0 +1,530 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/kataras/iris.v6"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+)
+
+// RoleAdmin is the role of the users allowed to manage other users
+const RoleAdmin = "admin"
+
+// AuthenticationRealm is the realm sent to clients failing to authenticate
+const AuthenticationRealm = "Authorization Required"
+
+// Errors returned when managing users
+var (
+	ErrUserExists   = errors.New("User already exists")
+	ErrUserNotFound = errors.New("User not found")
+)
+
+// Principal is an authenticated user. Principals authenticated by an API token
+// are restricted to the scopes of the token, other ones have all scopes.
+type Principal struct {
+	Name   string   `json:"name"`
+	Roles  []string `json:"roles"`
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// HasRole returns true if the principal has been granted a given role
+func (p *Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// HasScope returns true if the principal has been granted a given scope
+func (p *Principal) HasScope(scope string) bool {
+	if p.Scopes == nil {
+		return true
+	}
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// GetPrincipal returns the principal authenticated for a request, or nil if the
+// request is not authenticated
+func GetPrincipal(c *iris.Context) *Principal {
+	p, _ := c.Get(PrincipalContextKey).(*Principal)
+	return p
+}
+
+// credential is the bcrypt hash of the password of a user, along with its
+// roles
+type credential struct {
+	hash  []byte
+	roles []string
+}
+
+// Credentials holds the users allowed to use the API. They are read from a
+// credentials file holding one user per line:
+//
+//	name:bcrypt hash[:role,role...]
+//
+// Empty lines and lines starting with # are ignored. Users created or revoked
+// through the API are written back to the file, which is then rewritten
+// without its comments.
+type Credentials struct {
+	mu    sync.RWMutex
+	path  string
+	users map[string]credential
+
+	// HMACs of the name and password of successfully authenticated users,
+	// keyed by a random key of the process, so that bcrypt hashes are only
+	// computed once per password every VerifiedTTL
+	verifyKey []byte
+	verified  map[[sha256.Size]byte]verifiedPrincipal
+}
+
+// VerifiedTTL is how long a successful authentication is remembered
+const VerifiedTTL = 5 * time.Minute
+
+var (
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+// unknownUserHash returns the bcrypt hash passwords of unknown users are
+// checked against
+func unknownUserHash() []byte {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("unknown user"), bcrypt.DefaultCost)
+	})
+	return dummyHash
+}
+
+type verifiedPrincipal struct {
+	principal *Principal
+	expires   time.Time
+}
+
+// NewCredentials creates an empty set of credentials kept in memory only
+func NewCredentials() *Credentials {
+	verifyKey := make([]byte, sha256.Size)
+	if _, err := rand.Read(verifyKey); err != nil {
+		panic(fmt.Sprintf("Error generating credentials key: %s", err))
+	}
+	return &Credentials{
+		users:     make(map[string]credential),
+		verifyKey: verifyKey,
+		verified:  make(map[[sha256.Size]byte]verifiedPrincipal),
+	}
+}
+
+// LoadCredentials reads a credentials file. Users created or revoked through
+// the API are written back to it.
+func LoadCredentials(path string) (*Credentials, error) {
+	c := NewCredentials()
+	c.path = path
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload reads the credentials file again, replacing the users in memory
+func (c *Credentials) Reload() error {
+	if c.path == "" {
+		return nil
+	}
+	f, err := os.Open(c.path)
+	if err != nil {
+		return fmt.Errorf("Error opening credentials file: %s", err)
+	}
+	defer f.Close()
+	users, err := parseCredentials(f)
+	if err != nil {
+		return fmt.Errorf("Error reading credentials file %s: %s", c.path, err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.users = users
+	c.verified = make(map[[sha256.Size]byte]verifiedPrincipal)
+	return nil
+}
+
+// ReloadOnSignal reloads the credentials file each time a signal is received,
+// until the signal channel is closed
+func (c *Credentials) ReloadOnSignal(signals <-chan os.Signal) {
+	for range signals {
+		if err := c.Reload(); err != nil {
+			log.WithField("component", "credentials").Errorf("Error reloading credentials, keeping the current ones: %s", err)
+			continue
+		}
+		log.WithField("component", "credentials").Infof("Reloaded %d user(s) from %s", c.Len(), c.path)
+	}
+}
+
+func parseCredentials(r io.Reader) (map[string]credential, error) {
+	users := make(map[string]credential)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, ":")
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("line %d: should be name:hash[:roles]", line)
+		}
+		name := fields[0]
+		if err := checkUserName(name); err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		if _, ok := users[name]; ok {
+			return nil, fmt.Errorf("line %d: duplicate user %s", line, name)
+		}
+		if _, err := bcrypt.Cost([]byte(fields[1])); err != nil {
+			return nil, fmt.Errorf("line %d: invalid bcrypt hash for user %s: %s", line, name, err)
+		}
+		var roles []string
+		if len(fields) == 3 && fields[2] != "" {
+			roles = strings.Split(fields[2], ",")
+		}
+		if err := checkRoles(roles); err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		users[name] = credential{hash: []byte(fields[1]), roles: roles}
+	}
+	return users, scanner.Err()
+}
+
+func checkUserName(name string) error {
+	if name == "" || len(name) > StrFieldMaxLength {
+		return fmt.Errorf("Invalid user name: should be between 1 and %d characters long", StrFieldMaxLength)
+	}
+	if strings.ContainsAny(name, ":,# \t\r\n") {
+		return fmt.Errorf("Invalid user name %q: should not contain ':', ',', '#' or spaces", name)
+	}
+	return nil
+}
+
+func checkUser(name, password string, roles []string) error {
+	if err := checkUserName(name); err != nil {
+		return err
+	}
+	if password == "" {
+		return fmt.Errorf("Invalid password: should not be empty")
+	}
+	return checkRoles(roles)
+}
+
+func checkRoles(roles []string) error {
+	for _, role := range roles {
+		if role == "" || strings.ContainsAny(role, ":, \t\r\n") {
+			return fmt.Errorf("Invalid role %q", role)
+		}
+	}
+	return nil
+}
+
+// Len returns the number of users
+func (c *Credentials) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.users)
+}
+
+// Users returns the users, sorted by name
+func (c *Credentials) Users() []Principal {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	users := make([]Principal, 0, len(c.users))
+	for name, cred := range c.users {
+		roles := cred.roles
+		if roles == nil {
+			roles = []string{}
+		}
+		users = append(users, Principal{Name: name, Roles: roles})
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	return users
+}
+
+// Authenticate checks the password of a user, and returns the matching
+// principal
+func (c *Credentials) Authenticate(name, password string) (*Principal, bool) {
+	mac := hmac.New(sha256.New, c.verifyKey)
+	mac.Write([]byte(name + "\x00" + password))
+	var digest [sha256.Size]byte
+	copy(digest[:], mac.Sum(nil))
+
+	c.mu.RLock()
+	v, ok := c.verified[digest]
+	cred, exists := c.users[name]
+	c.mu.RUnlock()
+	if ok && time.Now().Before(v.expires) {
+		return v.principal, true
+	}
+	if !exists {
+		// Unknown users take as long to reject as wrong passwords, so that
+		// user names can't be told apart by response time
+		bcrypt.CompareHashAndPassword(unknownUserHash(), []byte(password))
+		return nil, false
+	}
+	if bcrypt.CompareHashAndPassword(cred.hash, []byte(password)) != nil {
+		return nil, false
+	}
+
+	p := &Principal{Name: name, Roles: cred.roles}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// The user may have been revoked while its password was being checked
+	if current, ok := c.users[name]; !ok || !bytes.Equal(current.hash, cred.hash) {
+		return nil, false
+	}
+	// Expired entries are dropped as new ones come in
+	now := time.Now()
+	for key, v := range c.verified {
+		if now.After(v.expires) {
+			delete(c.verified, key)
+		}
+	}
+	c.verified[digest] = verifiedPrincipal{principal: p, expires: now.Add(VerifiedTTL)}
+	return p, true
+}
+
+// Add creates a user, and writes it to the credentials file
+func (c *Credentials) Add(name, password string, roles []string) error {
+	if err := checkUser(name, password, roles); err != nil {
+		return err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("Error hashing password: %s", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.users[name]; ok {
+		return ErrUserExists
+	}
+	users := make(map[string]credential, len(c.users)+1)
+	for n, cred := range c.users {
+		users[n] = cred
+	}
+	users[name] = credential{hash: hash, roles: roles}
+	return c.save(users)
+}
+
+// Revoke deletes a user, and removes it from the credentials file
+func (c *Credentials) Revoke(name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.users[name]; !ok {
+		return ErrUserNotFound
+	}
+	users := make(map[string]credential, len(c.users))
+	for n, cred := range c.users {
+		if n != name {
+			users[n] = cred
+		}
+	}
+	return c.save(users)
+}
+
+// save writes users to the credentials file, and replaces the users in memory
+// once they are written. It must be called with the lock held.
+func (c *Credentials) save(users map[string]credential) error {
+	if c.path != "" {
+		names := make([]string, 0, len(users))
+		for name := range users {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var buf bytes.Buffer
+		for _, name := range names {
+			fmt.Fprintf(&buf, "%s:%s", name, users[name].hash)
+			if roles := users[name].roles; len(roles) > 0 {
+				fmt.Fprintf(&buf, ":%s", strings.Join(roles, ","))
+			}
+			buf.WriteString("\n")
+		}
+
+		// The file is replaced at once, so that a reload never reads it half
+		// written
+		tmp, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path)+".tmp")
+		if err != nil {
+			return fmt.Errorf("Error writing credentials file: %s", err)
+		}
+		if _, err = tmp.Write(buf.Bytes()); err == nil {
+			err = tmp.Close()
+		} else {
+			tmp.Close()
+		}
+		if err == nil {
+			err = os.Chmod(tmp.Name(), 0600)
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), c.path)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+			return fmt.Errorf("Error writing credentials file: %s", err)
+		}
+	}
+	c.users = users
+	c.verified = make(map[[sha256.Size]byte]verifiedPrincipal)
+	return nil
+}
+
+// BasicAuthentication returns a middleware authenticating requests with HTTP
+// basic authentication against a set of credentials. The authenticated
+// principal is stored in the request context (see GetPrincipal).
+func BasicAuthentication(credentials *Credentials) iris.HandlerFunc {
+	return func(c *iris.Context) {
+		name, password, ok := c.Request.BasicAuth()
+		if ok {
+			var p *Principal
+			if p, ok = credentials.Authenticate(name, password); ok {
+				c.Set(PrincipalContextKey, p)
+				c.Next()
+				return
+			}
+		}
+		c.SetHeader("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", AuthenticationRealm))
+		c.JSON(401, common.NewAPIError("Unauthorized"))
+	}
+}
+
+// optionalAuthentication returns a middleware authenticating the requests
+// carrying credentials, and letting the other ones through anonymously
+func optionalAuthentication(authentication iris.HandlerFunc) iris.HandlerFunc {
+	return func(c *iris.Context) {
+		hasCertificate := c.Request.TLS != nil && len(c.Request.TLS.PeerCertificates) > 0
+		if c.Request.Header.Get("Authorization") == "" && !hasCertificate {
+			c.Next()
+			return
+		}
+		authentication(c)
+	}
+}
+
+// requireRole returns a middleware restricting a route to the principals
+// granted one of the given roles
+func requireRole(roles ...string) iris.HandlerFunc {
+	return func(c *iris.Context) {
+		if p := GetPrincipal(c); p != nil {
+			for _, role := range roles {
+				if p.HasRole(role) {
+					c.Next()
+					return
+				}
+			}
+		}
+		c.JSON(403, common.NewAPIError(fmt.Sprintf("Forbidden: the %s role is required", strings.Join(roles, " or "))))
+	}
+}
+
+// userRequest is the body of user creation requests
+type userRequest struct {
+	Name     string   `json:"name"`
+	Password string   `json:"password"`
+	Roles    []string `json:"roles"`
+}
+
+// User management routes
+func (s *APIServer) getUserList(c *iris.Context) {
+	c.JSON(200, map[string]interface{}{"items": s.Credentials.Users()})
+}
+
+func (s *APIServer) postUser(c *iris.Context) {
+	defer c.Request.Body.Close()
+	var req userRequest
+	if err := json.NewDecoder(io.LimitReader(c.Request.Body, 64*1024)).Decode(&req); err != nil {
+		c.JSON(400, common.NewAPIError(fmt.Sprintf("Error parsing user: %s", err)))
+		return
+	}
+	if err := checkUser(req.Name, req.Password, req.Roles); err != nil {
+		c.JSON(400, common.NewAPIError(fmt.Sprintf("Error creating user: %s", err)))
+		return
+	}
+	err := s.Credentials.Add(req.Name, req.Password, req.Roles)
+	switch {
+	case err == ErrUserExists:
+		c.JSON(409, common.NewAPIError(fmt.Sprintf("Error creating user %s: %s", req.Name, err)))
+		return
+	case err != nil:
+		c.JSON(500, common.NewAPIError(fmt.Sprintf("Error creating user %s: %s", req.Name, err)))
+		return
+	}
+	if req.Roles == nil {
+		req.Roles = []string{}
+	}
+	c.JSON(201, Principal{Name: req.Name, Roles: req.Roles})
+}
+
+func (s *APIServer) deleteUser(c *iris.Context) {
+	err := s.Credentials.Revoke(c.Param("name"))
+	switch {
+	case err == ErrUserNotFound:
+		c.JSON(404, common.NewAPIError(fmt.Sprintf("Error revoking user %s: %s", c.Param("name"), err)))
+		return
+	case err != nil:
+		c.JSON(500, common.NewAPIError(fmt.Sprintf("Error revoking user %s: %s", c.Param("name"), err)))
+		return
+	}
+	c.SetStatusCode(204)
+}
@@ -0,0 +1,164 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/kataras/iris.v6/httptest"
+
+	. "github.com/MorpheoOrg/morpheo-storage/api"
+)
+
+func TestCredentialsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	path := filepath.Join(dir, "users")
+	content := fmt.Sprintf("# Storage users\n\nalice:%s:admin\nbob:%s\n", hash, hash)
+	if err = ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	credentials, err := LoadCredentials(path)
+	if err != nil {
+		t.Fatalf("Error loading credentials: %s", err)
+	}
+	if p, ok := credentials.Authenticate("alice", "secret"); !ok || !p.HasRole(RoleAdmin) {
+		t.Errorf("alice should be authenticated as an admin, got %v (%t)", p, ok)
+	}
+	if p, ok := credentials.Authenticate("bob", "secret"); !ok || p.HasRole(RoleAdmin) {
+		t.Errorf("bob should be authenticated as a regular user, got %v (%t)", p, ok)
+	}
+	if _, ok := credentials.Authenticate("bob", "wrong"); ok {
+		t.Errorf("Wrong password accepted")
+	}
+	if _, ok := credentials.Authenticate("carol", "secret"); ok {
+		t.Errorf("Unknown user accepted")
+	}
+
+	// Test users created or revoked are written back to the file
+	if err = credentials.Add("carol", "secret", []string{"uploader"}); err != nil {
+		t.Fatalf("Error adding user: %s", err)
+	}
+	if err = credentials.Add("carol", "secret", nil); err != ErrUserExists {
+		t.Errorf("Adding an existing user should fail with ErrUserExists, got %v", err)
+	}
+	if err = credentials.Revoke("bob"); err != nil {
+		t.Fatalf("Error revoking user: %s", err)
+	}
+	if err = credentials.Revoke("bob"); err != ErrUserNotFound {
+		t.Errorf("Revoking an unknown user should fail with ErrUserNotFound, got %v", err)
+	}
+	if _, ok := credentials.Authenticate("bob", "secret"); ok {
+		t.Errorf("Revoked user accepted")
+	}
+	reloaded, err := LoadCredentials(path)
+	if err != nil {
+		t.Fatalf("Error loading written credentials: %s", err)
+	}
+	if p, ok := reloaded.Authenticate("carol", "secret"); !ok || !p.HasRole("uploader") {
+		t.Errorf("carol should have been written to the credentials file, got %v (%t)", p, ok)
+	}
+	if _, ok := reloaded.Authenticate("bob", "secret"); ok {
+		t.Errorf("bob should have been removed from the credentials file")
+	}
+
+	// Test reload picks up the changes made to the file, and keeps the
+	// current users if the file is invalid
+	if err = ioutil.WriteFile(path, []byte(fmt.Sprintf("dave:%s\n", hash)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = credentials.Reload(); err != nil {
+		t.Fatalf("Error reloading credentials: %s", err)
+	}
+	if _, ok := credentials.Authenticate("alice", "secret"); ok {
+		t.Errorf("alice should have been removed on reload")
+	}
+	if _, ok := credentials.Authenticate("dave", "secret"); !ok {
+		t.Errorf("dave should have been added on reload")
+	}
+	for _, invalid := range []string{"dave\n", "dave:plaintext\n", fmt.Sprintf("dave:%s\ndave:%s\n", hash, hash), fmt.Sprintf("da ve:%s\n", hash)} {
+		if err = ioutil.WriteFile(path, []byte(invalid), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err = credentials.Reload(); err == nil {
+			t.Errorf("Reloading invalid credentials %q should fail", invalid)
+		}
+	}
+	if _, ok := credentials.Authenticate("dave", "secret"); !ok {
+		t.Errorf("Users should be kept when reloading invalid credentials")
+	}
+}
+
+func TestUserAdmin(t *testing.T) {
+	app, _ := newTestApp(NewMemoryBlobStore())
+	e := httptest.New(app, t)
+
+	// Test only admins can manage users
+	e.GET(AdminUserListRoute).WithBasicAuth("v", "p").Expect().Status(403)
+	e.POST(AdminUserListRoute).WithBasicAuth("v", "p").WithJSON(map[string]interface{}{"name": "w", "password": "p"}).Expect().Status(403)
+	e.DELETE(AdminUserListRoute+"/u").WithBasicAuth("v", "p").Expect().Status(403)
+	e.GET(AdminUserListRoute).Expect().Status(401)
+
+	// Test created users can use the API
+	e.GET(ProblemListRoute).WithBasicAuth("w", "p").Expect().Status(401)
+	e.POST(AdminUserListRoute).WithBasicAuth("u", "p").WithJSON(map[string]interface{}{"name": "w", "password": "p", "roles": []string{"uploader"}}).Expect().Status(201).JSON().Object().ValueEqual("name", "w")
+	e.GET(ProblemListRoute).WithBasicAuth("w", "p").Expect().Status(200)
+	e.GET(AdminUserListRoute).WithBasicAuth("u", "p").Expect().Status(200).JSON().Object().Value("items").Array().Length().Equal(3)
+
+	// Test invalid or existing users return BadRequest and Conflict
+	e.POST(AdminUserListRoute).WithBasicAuth("u", "p").WithJSON(map[string]interface{}{"name": "w", "password": "p"}).Expect().Status(409)
+	e.POST(AdminUserListRoute).WithBasicAuth("u", "p").WithJSON(map[string]interface{}{"name": "x:y", "password": "p"}).Expect().Status(400)
+	e.POST(AdminUserListRoute).WithBasicAuth("u", "p").WithJSON(map[string]interface{}{"name": "x"}).Expect().Status(400).Body().Match("(.*)Invalid password(.*)")
+	e.POST(AdminUserListRoute).WithBasicAuth("u", "p").WithJSON(map[string]interface{}{"name": strings.Repeat("x", 1000), "password": "p"}).Expect().Status(400)
+	e.POST(AdminUserListRoute).WithBasicAuth("u", "p").WithBytes([]byte("{")).Expect().Status(400)
+
+	// Test revoked users can't use the API anymore
+	e.DELETE(AdminUserListRoute+"/w").WithBasicAuth("u", "p").Expect().Status(204)
+	e.DELETE(AdminUserListRoute+"/w").WithBasicAuth("u", "p").Expect().Status(404)
+	e.GET(ProblemListRoute).WithBasicAuth("w", "p").Expect().Status(401)
+}
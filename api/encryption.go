@@ -0,0 +1,640 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+)
+
+// Encrypted blobs start with a header holding the data key of the blob, wrapped
+// by a master key:
+//
+//	magic (4) | version (1) | nonce prefix (7) | key ID length (1) | key ID |
+//	wrapped key length (2) | wrapped key
+//
+// followed by AES-256-GCM sealed frames of at most chunkSize bytes of content:
+//
+//	flag and sealed frame length (4) | sealed frame
+//
+// The nonce of a frame is the nonce prefix, the frame index and a flag set on
+// the last frame only, so that frames can't be reordered, dropped or truncated
+// without decryption failing.
+const (
+	encryptionMagic   = "MSEB"
+	encryptionVersion = 1
+
+	// DefaultEncryptionChunkSize is the default maximum size of the content of
+	// an encrypted frame
+	DefaultEncryptionChunkSize = 64 * 1024
+	// MaxEncryptionChunkSize is the maximum size of the content of an
+	// encrypted frame
+	MaxEncryptionChunkSize = 16 * 1024 * 1024
+
+	dataKeySize     = 32
+	noncePrefixSize = 7
+	lastFrameFlag   = 1 << 31
+)
+
+// KeyProvider wraps and unwraps the data keys of blobs with master keys. It can
+// be implemented on top of a key management service.
+type KeyProvider interface {
+	// WrapKey encrypts a data key with the current master key, and returns the
+	// ID of that master key along with the wrapped data key
+	WrapKey(dataKey []byte) (keyID string, wrappedKey []byte, err error)
+	// UnwrapKey decrypts a data key wrapped by a given master key
+	UnwrapKey(keyID string, wrappedKey []byte) ([]byte, error)
+}
+
+// Keyring is a KeyProvider holding AES-256 master keys. New data keys are
+// wrapped by its current key, and the previous keys are kept to unwrap the
+// data keys of existing blobs: rotating the master key is a matter of adding a
+// new key and making it current.
+type Keyring struct {
+	Current string
+	keys    map[string]cipher.AEAD
+}
+
+// keyfile is the JSON format of keyring files. Keys are base64 encoded.
+type keyfile struct {
+	Current string            `json:"current"`
+	Keys    map[string][]byte `json:"keys"`
+}
+
+// NewKeyring creates a keyring from 32 bytes master keys, indexed by ID
+func NewKeyring(current string, keys map[string][]byte) (*Keyring, error) {
+	if _, ok := keys[current]; !ok {
+		return nil, fmt.Errorf("Current master key %s not found in keyring", current)
+	}
+	keyring := &Keyring{Current: current, keys: make(map[string]cipher.AEAD)}
+	for keyID, key := range keys {
+		if len(keyID) == 0 || len(keyID) > 255 {
+			return nil, fmt.Errorf("Invalid master key ID %s: should be 1 to 255 bytes long", keyID)
+		}
+		if len(key) != dataKeySize {
+			return nil, fmt.Errorf("Invalid master key %s: should be %d bytes long, got %d", keyID, dataKeySize, len(key))
+		}
+		aead, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		keyring.keys[keyID] = aead
+	}
+	return keyring, nil
+}
+
+// LoadKeyring reads a keyring from a JSON keyfile such as:
+//
+//	{"current": "2017-10", "keys": {"2017-04": "<base64 key>", "2017-10": "<base64 key>"}}
+func LoadKeyring(path string) (*Keyring, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading keyfile %s: %s", path, err)
+	}
+	var k keyfile
+	if err = json.Unmarshal(content, &k); err != nil {
+		return nil, fmt.Errorf("Error parsing keyfile %s: %s", path, err)
+	}
+	return NewKeyring(k.Current, k.Keys)
+}
+
+// WrapKey encrypts a data key with the current master key
+func (k *Keyring) WrapKey(dataKey []byte) (string, []byte, error) {
+	aead := k.keys[k.Current]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+	return k.Current, aead.Seal(nonce, nonce, dataKey, []byte(k.Current)), nil
+}
+
+// UnwrapKey decrypts a data key wrapped by a given master key
+func (k *Keyring) UnwrapKey(keyID string, wrappedKey []byte) ([]byte, error) {
+	aead, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("Unknown master key %s", keyID)
+	}
+	if len(wrappedKey) < aead.NonceSize() {
+		return nil, fmt.Errorf("Invalid wrapped key")
+	}
+	dataKey, err := aead.Open(nil, wrappedKey[:aead.NonceSize()], wrappedKey[aead.NonceSize():], []byte(keyID))
+	if err != nil {
+		return nil, fmt.Errorf("Error unwrapping data key with master key %s: %s", keyID, err)
+	}
+	return dataKey, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptedBlobStore encrypts the blobs of any blob store. Blobs are encrypted
+// and decrypted on the fly, each with its own data key.
+type EncryptedBlobStore struct {
+	common.BlobStore
+
+	// AllowPlaintext serves the blobs stored before encryption was enabled as
+	// they are. Otherwise, they can't be read until they are encrypted (see
+	// Rewrap).
+	AllowPlaintext bool
+
+	keys      KeyProvider
+	chunkSize int
+}
+
+// NewEncryptedBlobStore wraps a blob store, encrypting blobs in frames of at
+// most chunkSize bytes with data keys wrapped by a given key provider
+func NewEncryptedBlobStore(blobStore common.BlobStore, keys KeyProvider, chunkSize int) (*EncryptedBlobStore, error) {
+	if chunkSize <= 0 || chunkSize > MaxEncryptionChunkSize {
+		return nil, fmt.Errorf("Invalid encryption chunk size %d: should be between 1 and %d", chunkSize, MaxEncryptionChunkSize)
+	}
+	return &EncryptedBlobStore{BlobStore: blobStore, keys: keys, chunkSize: chunkSize}, nil
+}
+
+// EncryptedSize returns the size of a blob of size bytes once encrypted with a
+// header of headerSize bytes
+func (s *EncryptedBlobStore) EncryptedSize(size int64, headerSize int) int64 {
+	// Empty blobs still have a (last) frame
+	frames := (size + int64(s.chunkSize) - 1) / int64(s.chunkSize)
+	if frames == 0 {
+		frames = 1
+	}
+	return int64(headerSize) + frames*(4+16) + size
+}
+
+// Put encrypts a blob of size bytes, and stores it in the underlying store
+func (s *EncryptedBlobStore) Put(key string, r io.Reader, size int64) error {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return err
+	}
+	keyID, wrappedKey, err := s.keys.WrapKey(dataKey)
+	if err != nil {
+		return fmt.Errorf("Error wrapping data key of %s: %s", key, err)
+	}
+	if !validWrappedKey(keyID, wrappedKey) {
+		return fmt.Errorf("Invalid master key ID or wrapped key for %s", key)
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return err
+	}
+
+	noncePrefix := make([]byte, noncePrefixSize)
+	if _, err := rand.Read(noncePrefix); err != nil {
+		return err
+	}
+	header := encodeHeader(noncePrefix, keyID, wrappedKey)
+	headerSize := header.Len()
+
+	encrypter := &encryptingReader{
+		source:      bufio.NewReader(r),
+		aead:        aead,
+		noncePrefix: noncePrefix,
+		chunk:       make([]byte, s.chunkSize),
+		pending:     header.Bytes(),
+	}
+	return s.BlobStore.Put(key, encrypter, s.EncryptedSize(size, headerSize))
+}
+
+// Get returns a reader decrypting a blob of the underlying store. Decryption
+// errors, e.g. if the blob was tampered with, are returned by its Read method.
+// Blobs stored before encryption was enabled are returned as they are if
+// AllowPlaintext is set.
+func (s *EncryptedBlobStore) Get(key string) (io.ReadCloser, error) {
+	blob, err := s.BlobStore.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(blob)
+	encrypted, err := isEncrypted(reader)
+	if err != nil {
+		blob.Close()
+		return nil, fmt.Errorf("Error reading %s: %s", key, err)
+	}
+	if !encrypted {
+		if s.AllowPlaintext {
+			return &plaintextBlob{Reader: reader, Closer: blob}, nil
+		}
+		blob.Close()
+		return nil, fmt.Errorf("Error decrypting %s: blob stored in clear, it has to be encrypted first", key)
+	}
+	aead, noncePrefix, err := s.readHeader(reader)
+	if err != nil {
+		blob.Close()
+		return nil, fmt.Errorf("Error decrypting %s: %s", key, err)
+	}
+	return &decryptingReader{
+		source:      reader,
+		closer:      blob,
+		aead:        aead,
+		noncePrefix: noncePrefix,
+		maxFrame:    MaxEncryptionChunkSize + aead.Overhead(),
+	}, nil
+}
+
+func (s *EncryptedBlobStore) readHeader(r io.Reader) (cipher.AEAD, []byte, error) {
+	noncePrefix, keyID, wrappedKey, err := decodeHeader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	dataKey, err := s.keys.UnwrapKey(keyID, wrappedKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := newGCM(dataKey)
+	return aead, noncePrefix, err
+}
+
+// Rewrap brings a blob of size bytes of content under the current master key:
+// the data key of an encrypted blob is re-wrapped, and a blob stored in clear
+// is encrypted. A negative size is read from the blob itself. It returns false
+// if the blob was already wrapped by the current master key.
+//
+// The blob is rewritten under a temporary key, which is then moved over the
+// blob, so that it is never left half written.
+func (s *EncryptedBlobStore) Rewrap(key string, size int64) (bool, error) {
+	blob, err := s.BlobStore.Get(key)
+	if err != nil {
+		return false, err
+	}
+	defer blob.Close()
+	reader := bufio.NewReader(blob)
+	encrypted, err := isEncrypted(reader)
+	if err != nil {
+		return false, fmt.Errorf("Error reading %s: %s", key, err)
+	}
+
+	tmpKey := key + ".rewrap"
+	if !encrypted {
+		if size < 0 {
+			if size, err = io.Copy(ioutil.Discard, reader); err != nil {
+				return false, fmt.Errorf("Error reading %s: %s", key, err)
+			}
+			return s.Rewrap(key, size)
+		}
+		err = s.Put(tmpKey, reader, size)
+	} else {
+		var rewrapped bool
+		rewrapped, err = s.rewrapHeader(tmpKey, reader, size)
+		if !rewrapped && err == nil {
+			return false, nil
+		}
+	}
+	if err == nil {
+		err = s.BlobStore.Rename(tmpKey, key)
+	}
+	if err != nil {
+		s.BlobStore.Delete(tmpKey)
+		return false, fmt.Errorf("Error rewrapping %s: %s", key, err)
+	}
+	return true, nil
+}
+
+// rewrapHeader stores under tmpKey an encrypted blob read from r, with its data
+// key wrapped by the current master key. Its frames are copied as they are.
+func (s *EncryptedBlobStore) rewrapHeader(tmpKey string, r *bufio.Reader, size int64) (bool, error) {
+	noncePrefix, keyID, wrappedKey, err := decodeHeader(r)
+	if err != nil {
+		return false, err
+	}
+	dataKey, err := s.keys.UnwrapKey(keyID, wrappedKey)
+	if err != nil {
+		return false, err
+	}
+	newKeyID, newWrappedKey, err := s.keys.WrapKey(dataKey)
+	if err != nil {
+		return false, fmt.Errorf("Error wrapping data key: %s", err)
+	}
+	if newKeyID == keyID {
+		return false, nil
+	}
+	if !validWrappedKey(newKeyID, newWrappedKey) {
+		return false, errors.New("Invalid master key ID or wrapped key")
+	}
+	header := encodeHeader(noncePrefix, newKeyID, newWrappedKey)
+
+	// The frame size depends on the chunk size the blob was encrypted with,
+	// and is read from the first frame
+	first, err := r.Peek(4)
+	if err != nil {
+		return false, fmt.Errorf("Error reading encrypted blob: truncated blob (%s)", err)
+	}
+	length := binary.BigEndian.Uint32(first)
+	frames := int64(1)
+	if chunk := int64(length&^lastFrameFlag) - 16; length&lastFrameFlag == 0 && chunk > 0 {
+		frames = (size + chunk - 1) / chunk
+	}
+	encryptedSize := int64(header.Len()) + frames*(4+16) + size
+	return true, s.BlobStore.Put(tmpKey, io.MultiReader(header, r), encryptedSize)
+}
+
+// isEncrypted tells whether a blob starts with the header of encrypted blobs
+func isEncrypted(r *bufio.Reader) (bool, error) {
+	magic, err := r.Peek(len(encryptionMagic))
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	return string(magic) == encryptionMagic, nil
+}
+
+func validWrappedKey(keyID string, wrappedKey []byte) bool {
+	return len(keyID) > 0 && len(keyID) <= 255 && len(wrappedKey) <= 65535
+}
+
+func encodeHeader(noncePrefix []byte, keyID string, wrappedKey []byte) *bytes.Buffer {
+	header := bytes.NewBufferString(encryptionMagic)
+	header.WriteByte(encryptionVersion)
+	header.Write(noncePrefix)
+	header.WriteByte(byte(len(keyID)))
+	header.WriteString(keyID)
+	binary.Write(header, binary.BigEndian, uint16(len(wrappedKey)))
+	header.Write(wrappedKey)
+	return header
+}
+
+func decodeHeader(r io.Reader) (noncePrefix []byte, keyID string, wrappedKey []byte, err error) {
+	fixed := make([]byte, len(encryptionMagic)+1+noncePrefixSize+1)
+	if _, err = io.ReadFull(r, fixed); err != nil {
+		return nil, "", nil, fmt.Errorf("Error reading header: %s", err)
+	}
+	if string(fixed[:len(encryptionMagic)]) != encryptionMagic {
+		return nil, "", nil, errors.New("Not an encrypted blob")
+	}
+	if version := fixed[len(encryptionMagic)]; version != encryptionVersion {
+		return nil, "", nil, fmt.Errorf("Unsupported encryption version %d", version)
+	}
+	noncePrefix = fixed[len(encryptionMagic)+1 : len(encryptionMagic)+1+noncePrefixSize]
+
+	id := make([]byte, fixed[len(fixed)-1])
+	var wrappedKeySize uint16
+	if _, err = io.ReadFull(r, id); err != nil {
+		return nil, "", nil, fmt.Errorf("Error reading header: %s", err)
+	}
+	if err = binary.Read(r, binary.BigEndian, &wrappedKeySize); err != nil {
+		return nil, "", nil, fmt.Errorf("Error reading header: %s", err)
+	}
+	wrappedKey = make([]byte, wrappedKeySize)
+	if _, err = io.ReadFull(r, wrappedKey); err != nil {
+		return nil, "", nil, fmt.Errorf("Error reading header: %s", err)
+	}
+	return noncePrefix, string(id), wrappedKey, nil
+}
+
+// plaintextBlob is a blob stored before encryption was enabled
+type plaintextBlob struct {
+	io.Reader
+	io.Closer
+}
+
+func frameNonce(noncePrefix []byte, index uint32, last bool) []byte {
+	nonce := make([]byte, noncePrefixSize+5)
+	copy(nonce, noncePrefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], index)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// encryptingReader reads a source and returns it encrypted, header included
+type encryptingReader struct {
+	source      *bufio.Reader
+	aead        cipher.AEAD
+	noncePrefix []byte
+	chunk       []byte
+	index       uint32
+	pending     []byte
+	done        bool
+}
+
+func (r *encryptingReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.sealFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// sealFrame encrypts the next chunk of the source
+func (r *encryptingReader) sealFrame() error {
+	n, err := io.ReadFull(r.source, r.chunk)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	last := err != nil
+	if !last {
+		// The source may end right after a full chunk
+		if _, err = r.source.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+	if r.index == ^uint32(0) {
+		return errors.New("Blob too large to be encrypted")
+	}
+
+	sealed := r.aead.Seal(nil, frameNonce(r.noncePrefix, r.index, last), r.chunk[:n], nil)
+	length := uint32(len(sealed))
+	if last {
+		length |= lastFrameFlag
+	}
+	frame := make([]byte, 4, 4+len(sealed))
+	binary.BigEndian.PutUint32(frame, length)
+	r.pending = append(frame, sealed...)
+	r.index++
+	r.done = last
+	return nil
+}
+
+// decryptingReader reads the frames of an encrypted blob and returns its
+// content
+type decryptingReader struct {
+	source      *bufio.Reader
+	closer      io.Closer
+	aead        cipher.AEAD
+	noncePrefix []byte
+	maxFrame    int
+	index       uint32
+	pending     []byte
+	done        bool
+}
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.openFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// openFrame decrypts the next frame of the blob
+func (r *decryptingReader) openFrame() error {
+	var length uint32
+	if err := binary.Read(r.source, binary.BigEndian, &length); err != nil {
+		return fmt.Errorf("Error reading encrypted blob: truncated blob (%s)", err)
+	}
+	last := length&lastFrameFlag != 0
+	length &^= lastFrameFlag
+	if int(length) > r.maxFrame {
+		return fmt.Errorf("Error reading encrypted blob: invalid frame length %d", length)
+	}
+	sealed := make([]byte, length)
+	if _, err := io.ReadFull(r.source, sealed); err != nil {
+		return fmt.Errorf("Error reading encrypted blob: truncated blob (%s)", err)
+	}
+	content, err := r.aead.Open(sealed[:0], frameNonce(r.noncePrefix, r.index, last), sealed, nil)
+	if err != nil {
+		return fmt.Errorf("Error decrypting blob frame %d: %s", r.index, err)
+	}
+	if last {
+		if _, err = r.source.Peek(1); err == nil {
+			return errors.New("Error reading encrypted blob: unexpected data after the last frame")
+		}
+	}
+	r.pending = content
+	r.index++
+	r.done = last
+	return nil
+}
+
+func (r *decryptingReader) Close() error {
+	return r.closer.Close()
+}
+
+// rewrapProgressStep is the number of blobs between two progress reports of
+// RewrapBlobs
+const rewrapProgressStep = 100
+
+// RewrapBlobs brings the blobs of all the resources under the current master
+// key (see EncryptedBlobStore.Rewrap): data keys wrapped by previous master
+// keys are re-wrapped, and blobs stored before encryption was enabled are
+// encrypted. Progress is logged along the way. Blobs can be rewrapped while
+// the API is running, and the job can be interrupted and run again. It returns
+// the number of rewritten blobs.
+func (s *APIServer) RewrapBlobs() (int, error) {
+	blobStore, ok := s.BlobStore.(*EncryptedBlobStore)
+	if !ok {
+		return 0, errors.New("Blobs aren't encrypted: no encryption keyfile set")
+	}
+	ctx, span := startJob("RewrapBlobs")
+	defer span.End()
+	resourceModels := []Model{s.ProblemModel, s.AlgoModel, s.ModelModel, s.DataModel, s.PredictionModel}
+
+	rewrapped := 0
+	var lastErr error
+	// Content addressed blobs may be shared by several resources
+	done := make(map[string]bool)
+	for _, resourceModel := range resourceModels {
+		modelName := resourceModel.GetModelName()
+		ids, err := resourceModel.ListCommitted(ctx)
+		if err != nil {
+			lastErr = err
+			log.WithField("component", "rewrap").Errorf("Error listing %s: %s", modelName, err)
+			continue
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		log.WithField("component", "rewrap").Infof("Rewrapping %d %s blob(s)", len(ids), modelName)
+		for i, id := range ids {
+			if i > 0 && i%rewrapProgressStep == 0 {
+				log.WithField("component", "rewrap").Infof("%d/%d %s blob(s) processed, %d rewritten so far", i, len(ids), modelName, rewrapped)
+			}
+			resource, err := NewStoredResource(modelName)
+			if err == nil {
+				err = resourceModel.GetOne(ctx, resource, id, true)
+			}
+			if err != nil {
+				lastErr = err
+				log.WithField("component", "rewrap").Errorf("Error retrieving %s %s from database: %s", modelName, id, err)
+				continue
+			}
+			key := s.resourceBlobKey(modelName, resource)
+			if done[key] {
+				continue
+			}
+			// Blobs uploaded before checksums were introduced have no
+			// recorded size
+			size := resource.Meta().Size
+			if resource.Meta().Checksum == "" {
+				size = -1
+			}
+			rewritten, err := blobStore.Rewrap(key, size)
+			if err != nil {
+				lastErr = err
+				log.WithField("component", "rewrap").Errorf("Error rewrapping %s %s blob: %s", modelName, id, err)
+				continue
+			}
+			done[key] = true
+			if rewritten {
+				rewrapped++
+			}
+		}
+		log.WithField("component", "rewrap").Infof("%d/%d %s blob(s) processed, %d rewritten so far", len(ids), len(ids), modelName, rewrapped)
+	}
+	return rewrapped, lastErr
+}
@@ -0,0 +1,284 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	. "github.com/MorpheoOrg/morpheo-storage/api"
+	"github.com/satori/go.uuid"
+	"gopkg.in/kataras/iris.v6/httptest"
+)
+
+func newMasterKey() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}
+
+func readBlob(blobStore *EncryptedBlobStore, key string) ([]byte, error) {
+	blob, err := blobStore.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+	return ioutil.ReadAll(blob)
+}
+
+func TestEncryptedBlobStore(t *testing.T) {
+	keyring, err := NewKeyring("k1", map[string][]byte{"k1": newMasterKey()})
+	if err != nil {
+		t.Fatalf("Error creating keyring: %s", err)
+	}
+	memoryStore := NewMemoryBlobStore()
+	blobStore, err := NewEncryptedBlobStore(memoryStore, keyring, 16)
+	if err != nil {
+		t.Fatalf("Error creating encrypted blob store: %s", err)
+	}
+
+	// Test blobs of any size are encrypted, and decrypted back
+	for _, size := range []int{0, 1, 15, 16, 17, 48, 1000} {
+		blob := make([]byte, size)
+		rand.Read(blob)
+		key := fmt.Sprintf("blob/%d", size)
+		if err = blobStore.Put(key, bytes.NewReader(blob), int64(size)); err != nil {
+			t.Errorf("Error storing %d bytes blob: %s", size, err)
+			continue
+		}
+		// Short blobs may show up in random ciphertext by chance
+		if size >= 16 && bytes.Contains(memoryStore.blobs[key], blob) {
+			t.Errorf("%d bytes blob stored in clear", size)
+		}
+		content, err := readBlob(blobStore, key)
+		if err != nil || !bytes.Equal(content, blob) {
+			t.Errorf("Error reading back %d bytes blob (err: %v)", size, err)
+		}
+	}
+
+	// Test tampered, truncated or extended blobs can't be read
+	encrypted := memoryStore.blobs["blob/1000"]
+	tampered := append([]byte{}, encrypted...)
+	tampered[len(tampered)/2] ^= 1
+	for name, content := range map[string][]byte{
+		"tampered":  tampered,
+		"truncated": encrypted[:len(encrypted)-1],
+		"shortened": encrypted[:len(encrypted)/2],
+		"extended":  append(append([]byte{}, encrypted...), 0),
+	} {
+		memoryStore.blobs["blob/devil"] = content
+		if _, err = readBlob(blobStore, "blob/devil"); err == nil {
+			t.Errorf("Expected error reading %s blob", name)
+		}
+	}
+
+	// Test blobs stored before encryption was enabled are only read as they
+	// are when allowed
+	for _, plaintext := range []string{"", "abc", "plaintext blob"} {
+		memoryStore.blobs["blob/plaintext"] = []byte(plaintext)
+		if _, err = readBlob(blobStore, "blob/plaintext"); err == nil {
+			t.Errorf("Expected error reading plaintext blob %q", plaintext)
+		}
+		blobStore.AllowPlaintext = true
+		if content, err := readBlob(blobStore, "blob/plaintext"); err != nil || string(content) != plaintext {
+			t.Errorf("Error reading plaintext blob %q: got %q (err: %v)", plaintext, content, err)
+		}
+		blobStore.AllowPlaintext = false
+	}
+
+	// Test invalid chunk size is rejected
+	if _, err = NewEncryptedBlobStore(memoryStore, keyring, 0); err == nil {
+		t.Errorf("Expected error creating encrypted blob store with a 0 chunk size")
+	}
+}
+
+func TestEncryptionKeyRotation(t *testing.T) {
+	oldKey, newKey := newMasterKey(), newMasterKey()
+	memoryStore := NewMemoryBlobStore()
+
+	oldKeyring, _ := NewKeyring("old", map[string][]byte{"old": oldKey})
+	oldStore, _ := NewEncryptedBlobStore(memoryStore, oldKeyring, DefaultEncryptionChunkSize)
+	oldStore.Put("old", bytes.NewReader(Blob), int64(len(Blob)))
+
+	// Test blobs encrypted before the rotation can still be read
+	rotatedKeyring, _ := NewKeyring("new", map[string][]byte{"old": oldKey, "new": newKey})
+	rotatedStore, _ := NewEncryptedBlobStore(memoryStore, rotatedKeyring, DefaultEncryptionChunkSize)
+	if content, err := readBlob(rotatedStore, "old"); err != nil || !bytes.Equal(content, Blob) {
+		t.Errorf("Error reading blob encrypted before rotation (err: %v)", err)
+	}
+	rotatedStore.Put("new", bytes.NewReader(Blob), int64(len(Blob)))
+
+	// Test blobs encrypted after the rotation no longer need the old key
+	newKeyring, _ := NewKeyring("new", map[string][]byte{"new": newKey})
+	newStore, _ := NewEncryptedBlobStore(memoryStore, newKeyring, DefaultEncryptionChunkSize)
+	if content, err := readBlob(newStore, "new"); err != nil || !bytes.Equal(content, Blob) {
+		t.Errorf("Error reading blob encrypted after rotation (err: %v)", err)
+	}
+	if _, err := newStore.Get("old"); err == nil {
+		t.Errorf("Expected error reading blob encrypted with a retired key")
+	}
+}
+
+// sizeCheckingBlobStore is a MemoryBlobStore checking the size of the blobs it
+// stores
+type sizeCheckingBlobStore struct {
+	*MemoryBlobStore
+	t *testing.T
+}
+
+func (s *sizeCheckingBlobStore) Put(key string, r io.Reader, size int64) error {
+	blob, err := ioutil.ReadAll(r)
+	if err == nil && int64(len(blob)) != size {
+		s.t.Errorf("Blob %s stored with size %d, got %d bytes", key, size, len(blob))
+	}
+	return s.MemoryBlobStore.Put(key, bytes.NewReader(blob), size)
+}
+
+func TestRewrap(t *testing.T) {
+	oldKey, newKey := newMasterKey(), newMasterKey()
+	memoryStore := NewMemoryBlobStore()
+	checkedStore := &sizeCheckingBlobStore{MemoryBlobStore: memoryStore, t: t}
+
+	// Blobs are encrypted with a chunk size other than the current one
+	oldKeyring, _ := NewKeyring("old", map[string][]byte{"old": oldKey})
+	oldStore, _ := NewEncryptedBlobStore(checkedStore, oldKeyring, 16)
+	blobs := map[string][]byte{}
+	for _, size := range []int{0, 15, 16, 1000} {
+		blob := make([]byte, size)
+		rand.Read(blob)
+		key := fmt.Sprintf("blob/%d", size)
+		oldStore.Put(key, bytes.NewReader(blob), int64(size))
+		blobs[key] = blob
+	}
+	memoryStore.blobs["blob/plaintext"] = Blob
+	blobs["blob/plaintext"] = Blob
+
+	// Test blobs are rewrapped, and those stored in clear encrypted
+	rotatedKeyring, _ := NewKeyring("new", map[string][]byte{"old": oldKey, "new": newKey})
+	rotatedStore, _ := NewEncryptedBlobStore(checkedStore, rotatedKeyring, DefaultEncryptionChunkSize)
+	for key, blob := range blobs {
+		size := int64(len(blob))
+		if key == "blob/plaintext" {
+			size = -1
+		}
+		if rewritten, err := rotatedStore.Rewrap(key, size); err != nil || !rewritten {
+			t.Errorf("Error rewrapping %s: rewritten %t (err: %v)", key, rewritten, err)
+		}
+		if rewritten, err := rotatedStore.Rewrap(key, size); err != nil || rewritten {
+			t.Errorf("Expected %s already rewrapped: rewritten %t (err: %v)", key, rewritten, err)
+		}
+	}
+	if len(memoryStore.blobs) != len(blobs) {
+		t.Errorf("Expected %d blobs left, got %d", len(blobs), len(memoryStore.blobs))
+	}
+
+	// Test rewrapped blobs no longer need the old key
+	newKeyring, _ := NewKeyring("new", map[string][]byte{"new": newKey})
+	newStore, _ := NewEncryptedBlobStore(memoryStore, newKeyring, DefaultEncryptionChunkSize)
+	for key, blob := range blobs {
+		if content, err := readBlob(newStore, key); err != nil || !bytes.Equal(content, blob) {
+			t.Errorf("Error reading rewrapped %s (err: %v)", key, err)
+		}
+	}
+
+	// Test the blobs of all resources are rewrapped through the API
+	oldAPI := newTestServer(oldStore)
+	dataModel := NewFaultyModel(DataModelName)
+	oldAPI.DataModel = dataModel
+	e := httptest.New(configureTestApp(oldAPI), t)
+	id := uuid.NewV4().String()
+	e.POST(DataListRoute).WithBasicAuth("u", "p").WithMultipart().WithFormField("uuid", id).WithFormField("size", BlobSize).WithFile("blob", "main.go").Expect().Status(201)
+	if n, err := oldAPI.RewrapBlobs(); err != nil || n != 0 {
+		t.Errorf("Expected no blob rewrapped under the current master key, got %d (err: %v)", n, err)
+	}
+	oldAPI.BlobStore = rotatedStore
+	if n, err := oldAPI.RewrapBlobs(); err != nil || n != 1 {
+		t.Errorf("Expected 1 blob rewrapped, got %d (err: %v)", n, err)
+	}
+	if content, err := readBlob(newStore, "data/"+id); err != nil || !bytes.Equal(content, Blob) {
+		t.Errorf("Error reading rewrapped data %s blob (err: %v)", id, err)
+	}
+	if _, err := newTestServer(memoryStore).RewrapBlobs(); err == nil {
+		t.Errorf("Expected error rewrapping blobs without encryption")
+	}
+}
+
+func TestLoadKeyring(t *testing.T) {
+	keyfile, err := ioutil.TempFile("", "keyfile")
+	if err != nil {
+		t.Fatalf("Error creating keyfile: %s", err)
+	}
+	defer os.Remove(keyfile.Name())
+	fmt.Fprintf(keyfile, `{"current": "k2", "keys": {"k1": "%s", "k2": "%s"}}`, base64.StdEncoding.EncodeToString(newMasterKey()), base64.StdEncoding.EncodeToString(newMasterKey()))
+	keyfile.Close()
+
+	keyring, err := LoadKeyring(keyfile.Name())
+	if err != nil || keyring.Current != "k2" {
+		t.Errorf("Error loading keyfile (err: %v)", err)
+	}
+
+	// Test keyring without its current key or with invalid keys is rejected
+	if _, err = NewKeyring("devil", map[string][]byte{"k1": newMasterKey()}); err == nil {
+		t.Errorf("Expected error creating keyring without its current key")
+	}
+	if _, err = NewKeyring("k1", map[string][]byte{"k1": []byte("666")}); err == nil {
+		t.Errorf("Expected error creating keyring with an invalid key")
+	}
+}
+
+// Test blobs are transparently encrypted through the API
+func TestEncryptedUpload(t *testing.T) {
+	keyring, _ := NewKeyring("k1", map[string][]byte{"k1": newMasterKey()})
+	memoryStore := NewMemoryBlobStore()
+	blobStore, _ := NewEncryptedBlobStore(memoryStore, keyring, DefaultEncryptionChunkSize)
+	encryptedApp, _ := newTestApp(blobStore)
+	e := httptest.New(encryptedApp, t)
+
+	id := uuid.NewV4().String()
+	e.POST(DataListRoute).WithBasicAuth("u", "p").WithMultipart().WithFormField("uuid", id).WithFormField("size", BlobSize).WithFile("blob", "main.go").Expect().Status(201).JSON().Object().ValueEqual("checksum", BlobChecksum)
+	if bytes.Contains(memoryStore.blobs["data/"+id], Blob) {
+		t.Errorf("Blob stored in clear")
+	}
+	r := e.GET(DataListRoute+"/"+id+"/blob").WithBasicAuth("u", "p").Expect().Status(200)
+	r.Header("Accept-Ranges").Equal("none")
+	r.Body().Equal(string(Blob))
+}
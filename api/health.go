@@ -0,0 +1,213 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	migrate "github.com/rubenv/sql-migrate"
+	"github.com/satori/go.uuid"
+	"gopkg.in/kataras/iris.v6"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+)
+
+// Health statuses
+const (
+	HealthOK          = "ok"
+	HealthUnavailable = "unavailable"
+)
+
+// HealthCheckTimeout is how long a readiness check can last before failing
+const HealthCheckTimeout = 5 * time.Second
+
+// healthProbePrefix is the blob store prefix of the blobs written by the blob
+// store readiness check
+const healthProbePrefix = "health"
+
+// HealthCheck checks that a dependency of the API works, returning an error
+// otherwise
+type HealthCheck func() error
+
+// CheckResult is the outcome of a HealthCheck
+type CheckResult struct {
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// DatabaseCheck pings a database
+func DatabaseCheck(db *sqlx.DB) HealthCheck {
+	return func() error {
+		return db.Ping()
+	}
+}
+
+// MigrationsCheck checks that all the migrations of migrationDir have been
+// applied to a database
+func MigrationsCheck(db *sqlx.DB, migrationDir string) HealthCheck {
+	return func() error {
+		migrations, err := (&migrate.FileMigrationSource{Dir: migrationDir}).FindMigrations()
+		if err != nil {
+			return fmt.Errorf("Error reading migrations: %s", err)
+		}
+		var applied []string
+		if err := db.Select(&applied, fmt.Sprintf("SELECT id FROM %s", migrationTable)); err != nil {
+			return fmt.Errorf("Error reading applied migrations: %s", err)
+		}
+		appliedSet := make(map[string]struct{}, len(applied))
+		for _, id := range applied {
+			appliedSet[id] = struct{}{}
+		}
+		var pending []string
+		for _, m := range migrations {
+			if _, ok := appliedSet[m.Id]; !ok {
+				pending = append(pending, m.Id)
+			}
+		}
+		if len(pending) > 0 {
+			return fmt.Errorf("%d migrations not applied: %s", len(pending), strings.Join(pending, ", "))
+		}
+		return nil
+	}
+}
+
+// BlobStoreCheck writes, reads back and deletes a probe blob
+func BlobStoreCheck(blobStore common.BlobStore) HealthCheck {
+	return func() error {
+		key := fmt.Sprintf("%s/%s", healthProbePrefix, uuid.NewV4())
+		probe := []byte(key)
+		if err := blobStore.Put(key, bytes.NewReader(probe), int64(len(probe))); err != nil {
+			return fmt.Errorf("Error writing probe blob: %s", err)
+		}
+		readErr := readProbe(blobStore, key, probe)
+		if err := blobStore.Delete(key); err != nil && readErr == nil {
+			return fmt.Errorf("Error deleting probe blob: %s", err)
+		}
+		return readErr
+	}
+}
+
+// readProbe checks a probe blob can be read back
+func readProbe(blobStore common.BlobStore, key string, probe []byte) error {
+	r, err := blobStore.Get(key)
+	if err != nil {
+		return fmt.Errorf("Error reading probe blob: %s", err)
+	}
+	defer r.Close()
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("Error reading probe blob: %s", err)
+	}
+	if !bytes.Equal(content, probe) {
+		return fmt.Errorf("Probe blob read back doesn't match the blob written")
+	}
+	return nil
+}
+
+// runCheck runs a HealthCheck, failing it if it lasts more than timeout
+func runCheck(check HealthCheck, timeout time.Duration) CheckResult {
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- check()
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(timeout):
+		err = fmt.Errorf("Timed out after %s", timeout)
+	}
+	result := CheckResult{
+		Status:    HealthOK,
+		LatencyMs: float64(time.Since(start)) / float64(time.Millisecond),
+	}
+	if err != nil {
+		result.Status = HealthUnavailable
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// healthLive tells the API process is up. It doesn't check its dependencies.
+func (s *APIServer) healthLive(c *iris.Context) {
+	c.JSON(200, map[string]string{"status": HealthOK})
+}
+
+// healthReady runs all the readiness checks concurrently, and returns a 503 if
+// any of them fails. Anonymous callers only get the status of each check, the
+// latencies and errors being left to authenticated users.
+func (s *APIServer) healthReady(c *iris.Context) {
+	names := make([]string, 0, len(s.HealthChecks))
+	for name := range s.HealthChecks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var wg sync.WaitGroup
+	results := make([]CheckResult, len(names))
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, check HealthCheck) {
+			defer wg.Done()
+			results[i] = runCheck(check, HealthCheckTimeout)
+		}(i, s.HealthChecks[name])
+	}
+	wg.Wait()
+
+	status, statusCode := HealthOK, 200
+	detailed := GetPrincipal(c) != nil
+	checks := make(map[string]interface{}, len(names))
+	for i, name := range names {
+		if detailed {
+			checks[name] = results[i]
+		} else {
+			checks[name] = map[string]string{"status": results[i].Status}
+		}
+		if results[i].Status != HealthOK {
+			status, statusCode = HealthUnavailable, 503
+		}
+	}
+	c.JSON(statusCode, map[string]interface{}{"status": status, "checks": checks})
+}
@@ -0,0 +1,78 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+package main_test
+
+import (
+	"fmt"
+	"testing"
+
+	"gopkg.in/kataras/iris.v6/httptest"
+
+	. "github.com/MorpheoOrg/morpheo-storage/api"
+)
+
+func TestHealth(t *testing.T) {
+	blobStore := NewMemoryBlobStore()
+	api := newTestServer(blobStore)
+	api.HealthChecks = map[string]HealthCheck{
+		"blobstore": BlobStoreCheck(blobStore),
+	}
+	e := httptest.New(configureTestApp(api), t)
+
+	// Test liveness doesn't need authentication
+	e.GET(HealthLiveRoute).Expect().Status(200).JSON().Equal(map[string]interface{}{"status": HealthOK})
+
+	// Test readiness runs the checks, and cleans up the blob store probe
+	ready := e.GET(HealthReadyRoute).WithBasicAuth("v", "p").Expect().Status(200).JSON().Object()
+	ready.ValueEqual("status", HealthOK)
+	check := ready.Value("checks").Object().Value("blobstore").Object()
+	check.ValueEqual("status", HealthOK).NotContainsKey("error")
+	check.Value("latency_ms").Number().Ge(0)
+	if len(blobStore.blobs) != 0 {
+		t.Fatalf("Blob store probe not deleted: %d blobs left", len(blobStore.blobs))
+	}
+
+	// Test a failed check returns ServiceUnavailable
+	api.HealthChecks["database"] = func() error { return fmt.Errorf("connection refused") }
+	unready := e.GET(HealthReadyRoute).WithBasicAuth("v", "p").Expect().Status(503).JSON().Object()
+	unready.ValueEqual("status", HealthUnavailable)
+	unready.Value("checks").Object().Value("database").Object().ValueEqual("status", HealthUnavailable).ValueEqual("error", "connection refused")
+	unready.Value("checks").Object().Value("blobstore").Object().ValueEqual("status", HealthOK)
+
+	// Test anonymous callers only get the status of each check
+	anonymous := e.GET(HealthReadyRoute).Expect().Status(503).JSON().Object()
+	anonymous.Value("checks").Object().Value("database").Object().Equal(map[string]interface{}{"status": HealthUnavailable})
+	e.GET(HealthReadyRoute).WithBasicAuth("v", "wrong").Expect().Status(401)
+}
@@ -0,0 +1,491 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/kataras/iris.v6"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+)
+
+// Authentication modes: users and API tokens (see Credentials and
+// Authentication), JWTs issued by Morpheo's other services, or TLS client
+// certificates (see ClientCertAuthentication)
+const (
+	AuthBasic = "basic"
+	AuthJWT   = "jwt"
+	AuthMTLS  = "mtls"
+)
+
+// Supported JWT signature algorithms
+const (
+	JWTAlgRS256 = "RS256"
+	JWTAlgES256 = "ES256"
+)
+
+// Remote key sets are fetched again once they are older than jwksMaxAge, or
+// when a token is signed by an unknown key, but not more often than
+// jwksMinRefreshInterval
+const (
+	jwksMaxAge             = time.Hour
+	jwksMinRefreshInterval = 30 * time.Second
+	jwksMaxSize            = 1 << 20
+)
+
+// minRSAKeySize is the minimum size in bits of the RSA keys of a key set
+const minRSAKeySize = 2048
+
+// jwk is a JSON Web Key, as found in the keys array of a JWKS document
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	// RSA keys
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC keys
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// ParseJWKS parses a JWKS document into public keys indexed by key ID. Keys that
+// aren't signature RSA or P-256 EC keys are skipped.
+func ParseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("Error parsing JWKS: %s", err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for i, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key crypto.PublicKey
+		var err error
+		switch k.Kty {
+		case "RSA":
+			key, err = parseRSAJWK(k)
+		case "EC":
+			key, err = parseECJWK(k)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing JWKS key %d (%q): %s", i, k.Kid, err)
+		}
+		if _, ok := keys[k.Kid]; ok {
+			return nil, fmt.Errorf("Error parsing JWKS: duplicate key ID %q", k.Kid)
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("Error parsing JWKS: no RSA or EC signature key found")
+	}
+	return keys, nil
+}
+
+func parseRSAJWK(k jwk) (*rsa.PublicKey, error) {
+	if k.Alg != "" && k.Alg != JWTAlgRS256 {
+		return nil, fmt.Errorf("unsupported algorithm %s", k.Alg)
+	}
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, fmt.Errorf("invalid modulus: %s", err)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil || len(e) == 0 || len(e) > 4 {
+		return nil, fmt.Errorf("invalid exponent")
+	}
+	key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	if key.N.BitLen() < minRSAKeySize {
+		return nil, fmt.Errorf("RSA key too short: %d bits, should be at least %d", key.N.BitLen(), minRSAKeySize)
+	}
+	if key.E < 3 || key.E%2 == 0 {
+		return nil, fmt.Errorf("invalid exponent %d", key.E)
+	}
+	return key, nil
+}
+
+func parseECJWK(k jwk) (*ecdsa.PublicKey, error) {
+	if k.Alg != "" && k.Alg != JWTAlgES256 {
+		return nil, fmt.Errorf("unsupported algorithm %s", k.Alg)
+	}
+	if k.Crv != "P-256" {
+		return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+	}
+	x, errX := base64.RawURLEncoding.DecodeString(k.X)
+	y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+	if errX != nil || errY != nil {
+		return nil, fmt.Errorf("invalid coordinates")
+	}
+	key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	if !key.Curve.IsOnCurve(key.X, key.Y) {
+		return nil, fmt.Errorf("point not on curve")
+	}
+	return key, nil
+}
+
+// JWKS is a set of public keys used to verify JWT signatures. It is either read
+// once from a local file, or fetched (and refreshed) from a URL.
+type JWKS struct {
+	mu        sync.Mutex
+	url       string
+	client    *http.Client
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+// NewJWKS creates a static key set from a JWKS document
+func NewJWKS(data []byte) (*JWKS, error) {
+	keys, err := ParseJWKS(data)
+	if err != nil {
+		return nil, err
+	}
+	return &JWKS{keys: keys}, nil
+}
+
+// LoadJWKS reads a key set from a local JWKS file
+func LoadJWKS(path string) (*JWKS, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading JWKS file: %s", err)
+	}
+	return NewJWKS(data)
+}
+
+// NewRemoteJWKS creates a key set fetched from a JWKS URL. Keys are fetched on
+// first use.
+func NewRemoteJWKS(url string) *JWKS {
+	return &JWKS{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Key returns the public key of a given ID. An empty ID is accepted when the set
+// holds a single key.
+func (s *JWKS) Key(kid string) (crypto.PublicKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.url != "" {
+		_, known := s.keys[kid]
+		age := time.Since(s.fetchedAt)
+		if s.keys == nil || age > jwksMaxAge || (!known && age > jwksMinRefreshInterval) {
+			if err := s.fetch(); err != nil {
+				// Keep on using the keys fetched previously, if any
+				log.WithField("component", "jwt").Errorf("Error fetching JWKS from %s: %s", s.url, err)
+				if s.keys == nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	if key, ok := s.keys[kid]; ok {
+		return key, nil
+	}
+	if kid == "" && len(s.keys) == 1 {
+		for _, key := range s.keys {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key ID %q", kid)
+}
+
+// fetch gets the key set from its URL. It must be called with the lock held.
+func (s *JWKS) fetch() error {
+	// Failed fetches count too, so that an unavailable server isn't hammered
+	s.fetchedAt = time.Now()
+	res, err := s.client.Get(s.url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, jwksMaxSize))
+	if err != nil {
+		return err
+	}
+	keys, err := ParseJWKS(data)
+	if err != nil {
+		return err
+	}
+	s.keys = keys
+	return nil
+}
+
+// JWTVerifier validates the JWTs issued by Morpheo's other services, and maps
+// their claims to principals
+type JWTVerifier struct {
+	Keys     *JWKS
+	Issuer   string
+	Audience string
+
+	// Claims holding the name (default: sub) and roles (default: roles) of
+	// the principal. Roles are either an array or a space separated string.
+	PrincipalClaim string
+	RolesClaim     string
+
+	// Tolerated clock skew when checking expiry and not before dates
+	Leeway time.Duration
+}
+
+// NewJWTVerifier creates a verifier of the tokens issued by issuer for
+// audience, signed by one of keys
+func NewJWTVerifier(keys *JWKS, issuer, audience string) *JWTVerifier {
+	return &JWTVerifier{
+		Keys:           keys,
+		Issuer:         issuer,
+		Audience:       audience,
+		PrincipalClaim: "sub",
+		RolesClaim:     "roles",
+		Leeway:         time.Minute,
+	}
+}
+
+// NewJWTVerifierFromConfig creates the verifier configured by the JWT flags
+func NewJWTVerifierFromConfig(conf *StorageConfig) (*JWTVerifier, error) {
+	var keys *JWKS
+	switch {
+	case conf.JWKSURL != "" && conf.JWKSFile != "":
+		return nil, fmt.Errorf("Only one of -jwks-url and -jwks-file can be set")
+	case conf.JWKSURL != "":
+		keys = NewRemoteJWKS(conf.JWKSURL)
+	case conf.JWKSFile != "":
+		var err error
+		if keys, err = LoadJWKS(conf.JWKSFile); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("JWT authentication requires -jwks-url or -jwks-file")
+	}
+	if conf.JWTIssuer == "" || conf.JWTAudience == "" {
+		return nil, fmt.Errorf("JWT authentication requires -jwt-issuer and -jwt-audience")
+	}
+
+	verifier := NewJWTVerifier(keys, conf.JWTIssuer, conf.JWTAudience)
+	if conf.JWTPrincipalClaim != "" {
+		verifier.PrincipalClaim = conf.JWTPrincipalClaim
+	}
+	if conf.JWTRolesClaim != "" {
+		verifier.RolesClaim = conf.JWTRolesClaim
+	}
+	return verifier, nil
+}
+
+// ErrInvalidJWT is returned for malformed tokens
+var ErrInvalidJWT = errors.New("malformed token")
+
+// Verify checks the signature, issuer, audience and validity dates of a token,
+// and returns the principal it authenticates
+func (v *JWTVerifier) Verify(token string) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidJWT
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidJWT
+	}
+	key, err := v.Keys.Key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err = verifyJWTSignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	claims := make(map[string]interface{})
+	if err = decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if err = v.checkClaims(claims); err != nil {
+		return nil, err
+	}
+
+	name, _ := claims[v.PrincipalClaim].(string)
+	if name == "" || len(name) > StrFieldMaxLength {
+		return nil, fmt.Errorf("invalid %s claim: should be a string between 1 and %d characters long", v.PrincipalClaim, StrFieldMaxLength)
+	}
+	roles, err := stringsClaim(claims[v.RolesClaim])
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s claim: %s", v.RolesClaim, err)
+	}
+	return &Principal{Name: name, Roles: roles}, nil
+}
+
+func (v *JWTVerifier) checkClaims(claims map[string]interface{}) error {
+	if iss, _ := claims["iss"].(string); v.Issuer != "" && iss != v.Issuer {
+		return fmt.Errorf("invalid issuer %q", iss)
+	}
+	if v.Audience != "" {
+		audiences, err := stringsClaim(claims["aud"])
+		if err != nil || !containsString(audiences, v.Audience) {
+			return fmt.Errorf("token not issued for audience %q", v.Audience)
+		}
+	}
+
+	now := time.Now()
+	exp, ok := claims["exp"].(json.Number)
+	if !ok {
+		return fmt.Errorf("missing exp claim")
+	}
+	if expiry, err := exp.Float64(); err != nil || now.Add(-v.Leeway).After(time.Unix(int64(expiry), 0)) {
+		return fmt.Errorf("token expired")
+	}
+	if nbf, ok := claims["nbf"].(json.Number); ok {
+		if notBefore, err := nbf.Float64(); err != nil || now.Add(v.Leeway).Before(time.Unix(int64(notBefore), 0)) {
+			return fmt.Errorf("token not valid yet")
+		}
+	}
+	return nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return ErrInvalidJWT
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err = decoder.Decode(v); err != nil {
+		return ErrInvalidJWT
+	}
+	return nil
+}
+
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signed))
+	switch alg {
+	case JWTAlgRS256:
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("algorithm %s doesn't match the signing key", alg)
+		}
+		if rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], signature) != nil {
+			return fmt.Errorf("invalid signature")
+		}
+	case JWTAlgES256:
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("algorithm %s doesn't match the signing key", alg)
+		}
+		if len(signature) != 64 {
+			return fmt.Errorf("invalid signature")
+		}
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(ecKey, digest[:], r, s) {
+			return fmt.Errorf("invalid signature")
+		}
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	return nil
+}
+
+// stringsClaim reads a claim holding either an array of strings or a space
+// separated string. Missing claims are empty.
+func stringsClaim(claim interface{}) ([]string, error) {
+	switch value := claim.(type) {
+	case nil:
+		return []string{}, nil
+	case string:
+		return strings.Fields(value), nil
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, v := range value {
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("should only hold strings")
+			}
+			values = append(values, s)
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("should be a string or an array of strings")
+}
+
+// JWTAuthentication returns a middleware authenticating requests with a JWT
+// sent in an Authorization: Bearer header. The principal it authenticates is
+// stored in the request context (see GetPrincipal).
+func JWTAuthentication(verifier *JWTVerifier) iris.HandlerFunc {
+	return func(c *iris.Context) {
+		authorization := c.Request.Header.Get("Authorization")
+		if !strings.HasPrefix(authorization, "Bearer ") {
+			c.SetHeader("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q", AuthenticationRealm))
+			c.JSON(401, common.NewAPIError("Unauthorized: bearer token required"))
+			return
+		}
+		p, err := verifier.Verify(strings.TrimPrefix(authorization, "Bearer "))
+		if err != nil {
+			c.SetHeader("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q, error=\"invalid_token\"", AuthenticationRealm))
+			c.JSON(401, common.NewAPIError(fmt.Sprintf("Unauthorized: %s", err)))
+			return
+		}
+		c.Set(PrincipalContextKey, p)
+		c.Next()
+	}
+}
@@ -0,0 +1,253 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	gohttptest "net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/kataras/iris.v6"
+	"gopkg.in/kataras/iris.v6/adaptors/httprouter"
+	"gopkg.in/kataras/iris.v6/httptest"
+
+	. "github.com/MorpheoOrg/morpheo-storage/api"
+)
+
+const (
+	testJWTIssuer   = "https://auth.morpheo.io"
+	testJWTAudience = "storage"
+)
+
+// testKeySet is a local stand-in for the key set of a JWT issuer
+type testKeySet struct {
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+	jwks   []byte
+}
+
+func newTestKeySet(t *testing.T) *testKeySet {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kid": "rsa", "kty": "RSA", "alg": JWTAlgRS256, "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kid": "ec", "kty": "EC", "alg": JWTAlgES256, "use": "sig", "crv": "P-256", "x": b64(padBytes(ecKey.X.Bytes(), 32)), "y": b64(padBytes(ecKey.Y.Bytes(), 32))},
+		// Encryption keys are ignored
+		{"kid": "enc", "kty": "RSA", "use": "enc", "n": "AQAB", "e": "AQAB"},
+	}})
+	return &testKeySet{rsaKey: rsaKey, ecKey: ecKey, jwks: jwks}
+}
+
+// sign returns a JWT holding claims, signed with the RSA (RS256) or EC (ES256)
+// key of the set
+func (k *testKeySet) sign(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	b64 := base64.RawURLEncoding.EncodeToString
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	var err error
+	switch alg {
+	case JWTAlgRS256:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k.rsaKey, crypto.SHA256, digest[:])
+	case JWTAlgES256:
+		var r, s *big.Int
+		if r, s, err = ecdsa.Sign(rand.Reader, k.ecKey, digest[:]); err == nil {
+			signature = append(padBytes(r.Bytes(), 32), padBytes(s.Bytes(), 32)...)
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + b64(signature)
+}
+
+func padBytes(b []byte, size int) []byte {
+	return append(make([]byte, size-len(b)), b...)
+}
+
+// testClaims returns valid claims for alice, overridden by extra (nil values
+// remove a claim)
+func testClaims(extra map[string]interface{}) map[string]interface{} {
+	claims := map[string]interface{}{
+		"iss":   testJWTIssuer,
+		"aud":   []string{testJWTAudience, "compute"},
+		"sub":   "alice",
+		"roles": []string{"uploader"},
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	}
+	for name, value := range extra {
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+	}
+	return claims
+}
+
+func TestJWTVerifier(t *testing.T) {
+	keySet := newTestKeySet(t)
+	dir, err := ioutil.TempDir("", "jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "jwks.json")
+	if err = ioutil.WriteFile(path, keySet.jwks, 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := LoadJWKS(path)
+	if err != nil {
+		t.Fatalf("Error loading JWKS: %s", err)
+	}
+	verifier := NewJWTVerifier(keys, testJWTIssuer, testJWTAudience)
+
+	// Test valid tokens are mapped to principals
+	for alg, kid := range map[string]string{JWTAlgRS256: "rsa", JWTAlgES256: "ec"} {
+		p, err := verifier.Verify(keySet.sign(t, alg, kid, testClaims(nil)))
+		if err != nil {
+			t.Fatalf("Error verifying %s token: %s", alg, err)
+		}
+		if p.Name != "alice" || !p.HasRole("uploader") {
+			t.Errorf("Wrong principal for %s token: %v", alg, p)
+		}
+	}
+	p, err := verifier.Verify(keySet.sign(t, JWTAlgRS256, "rsa", testClaims(map[string]interface{}{"aud": testJWTAudience, "roles": "reader uploader"})))
+	if err != nil || len(p.Roles) != 2 {
+		t.Errorf("Single audience and space separated roles should be accepted, got %v (%v)", p, err)
+	}
+
+	// Test invalid tokens are rejected
+	payload := strings.Split(keySet.sign(t, JWTAlgRS256, "rsa", testClaims(map[string]interface{}{"sub": "root"})), ".")[1]
+	valid := strings.Split(keySet.sign(t, JWTAlgRS256, "rsa", testClaims(nil)), ".")
+	invalid := map[string]string{
+		"wrong issuer":       keySet.sign(t, JWTAlgRS256, "rsa", testClaims(map[string]interface{}{"iss": "https://devil.io"})),
+		"wrong audience":     keySet.sign(t, JWTAlgRS256, "rsa", testClaims(map[string]interface{}{"aud": "compute"})),
+		"expired":            keySet.sign(t, JWTAlgRS256, "rsa", testClaims(map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()})),
+		"no expiry":          keySet.sign(t, JWTAlgRS256, "rsa", testClaims(map[string]interface{}{"exp": nil})),
+		"not valid yet":      keySet.sign(t, JWTAlgRS256, "rsa", testClaims(map[string]interface{}{"nbf": time.Now().Add(time.Hour).Unix()})),
+		"unknown key":        keySet.sign(t, JWTAlgRS256, "devil", testClaims(nil)),
+		"algorithm mismatch": keySet.sign(t, JWTAlgES256, "rsa", testClaims(nil)),
+		"no subject":         keySet.sign(t, JWTAlgRS256, "rsa", testClaims(map[string]interface{}{"sub": nil})),
+		"invalid roles":      keySet.sign(t, JWTAlgRS256, "rsa", testClaims(map[string]interface{}{"roles": 666})),
+		"tampered":           valid[0] + "." + payload + "." + valid[2],
+		"unsigned":           base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"rsa"}`)) + "." + valid[1] + ".",
+		"malformed":          "devil",
+	}
+	for name, token := range invalid {
+		if _, err := verifier.Verify(token); err == nil {
+			t.Errorf("Invalid token accepted: %s", name)
+		}
+	}
+
+	// Test invalid key sets are rejected
+	for _, jwks := range []string{`{`, `{"keys": []}`, `{"keys": [{"kty": "RSA", "n": "AQAB", "e": "AQAB"}]}`, `{"keys": [{"kty": "EC", "crv": "P-256", "x": "AQAB", "y": "AQAB"}]}`} {
+		if _, err := NewJWKS([]byte(jwks)); err == nil {
+			t.Errorf("Invalid JWKS accepted: %s", jwks)
+		}
+	}
+}
+
+func TestRemoteJWKS(t *testing.T) {
+	keySet := newTestKeySet(t)
+	fetches := 0
+	server := gohttptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Write(keySet.jwks)
+	}))
+	defer server.Close()
+
+	verifier := NewJWTVerifier(NewRemoteJWKS(server.URL), testJWTIssuer, testJWTAudience)
+	for i := 0; i < 3; i++ {
+		if _, err := verifier.Verify(keySet.sign(t, JWTAlgES256, "ec", testClaims(nil))); err != nil {
+			t.Fatalf("Error verifying token: %s", err)
+		}
+	}
+	// Unknown keys trigger a fetch, but not right after the previous one
+	verifier.Verify(keySet.sign(t, JWTAlgES256, "devil", testClaims(nil)))
+	if fetches != 1 {
+		t.Errorf("The key set should have been fetched once, got %d fetches", fetches)
+	}
+}
+
+func TestJWTAuthentication(t *testing.T) {
+	keySet := newTestKeySet(t)
+	keys, err := NewJWKS(keySet.jwks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := newTestServer(NewMemoryBlobStore())
+	api.Credentials, api.Tokens = nil, nil
+	app := iris.New()
+	app.Adapt(iris.DevLogger(), httprouter.New())
+	api.ConfigureRoutes(app, JWTAuthentication(NewJWTVerifier(keys, testJWTIssuer, testJWTAudience)))
+	e := httptest.New(app, t)
+
+	token := keySet.sign(t, JWTAlgRS256, "rsa", testClaims(nil))
+	e.GET(DataListRoute).WithHeader("Authorization", "Bearer "+token).Expect().Status(200)
+	e.POST(ModelListRoute).WithQuery("algo", RandomUUID.String()).WithHeader("Authorization", "Bearer "+token).WithHeader("Content-Length", "15").WithBytes([]byte("fakefilecontent")).Expect().Status(201).JSON().Object().ValueEqual("owner", "alice")
+
+	// Test missing, invalid and expired tokens return Unauthorized
+	e.GET(DataListRoute).Expect().Status(401)
+	e.GET(DataListRoute).WithBasicAuth("u", "p").Expect().Status(401)
+	e.GET(DataListRoute).WithHeader("Authorization", "Bearer devil").Expect().Status(401)
+	expired := keySet.sign(t, JWTAlgES256, "ec", testClaims(map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()}))
+	e.GET(DataListRoute).WithHeader("Authorization", "Bearer "+expired).Expect().Status(401).Body().Match("(.*)token expired(.*)")
+}
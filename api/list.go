@@ -0,0 +1,239 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/satori/go.uuid"
+	"gopkg.in/kataras/iris.v6"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+)
+
+// EncodeCursor turns a cursor into the opaque string handed out to clients
+func EncodeCursor(cursor *Cursor) string {
+	raw := fmt.Sprintf("%d|%s|%s", cursor.TimestampUpload, cursor.ID, cursor.Order)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// DecodeCursor parses a cursor returned by EncodeCursor
+func DecodeCursor(encoded string) (*Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid cursor: %s", err)
+	}
+	fields := strings.Split(string(raw), "|")
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("Invalid cursor: malformed content")
+	}
+	timestamp, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid cursor: %s", err)
+	}
+	id, err := uuid.FromString(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid cursor: %s", err)
+	}
+	if fields[2] != "asc" && fields[2] != "desc" {
+		return nil, fmt.Errorf("Invalid cursor: unknown order '%s'", fields[2])
+	}
+	return &Cursor{TimestampUpload: timestamp, ID: id, Order: fields[2]}, nil
+}
+
+// nextCursor returns the cursor pointing to the last item of a full page, or nil
+// if there is no page after it. instanceList must be a pointer to a slice of
+// resources with ID and TimestampUpload fields.
+func nextCursor(instanceList interface{}, opts ListOptions) *Cursor {
+	items := reflect.ValueOf(instanceList).Elem()
+	if opts.Sort != "timestamp_upload" || items.Len() == 0 || items.Len() < opts.PageSize {
+		return nil
+	}
+	last := reflect.Indirect(items.Index(items.Len() - 1))
+
+	cursor := &Cursor{Order: opts.Order}
+	idField := last.FieldByName("ID")
+	if !idField.IsValid() {
+		return nil
+	}
+	id, ok := idField.Interface().(uuid.UUID)
+	if !ok {
+		return nil
+	}
+	cursor.ID = id
+	switch timestamp := last.FieldByName("TimestampUpload"); timestamp.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		cursor.TimestampUpload = timestamp.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		cursor.TimestampUpload = int64(timestamp.Uint())
+	default:
+		return nil
+	}
+	return cursor
+}
+
+// parseIncludeDeleted reads the include_deleted query parameter, which shows
+// the resources in the trash when true
+func parseIncludeDeleted(c *iris.Context) (bool, error) {
+	includeDeleted := c.URLParam("include_deleted")
+	if includeDeleted == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(includeDeleted)
+	if err != nil {
+		return false, fmt.Errorf("Error parsing include_deleted to boolean: %s", err)
+	}
+	return b, nil
+}
+
+// parseListOptions reads the pagination and ordering query parameters of a list
+// request (page, page_size, sort, order, cursor and include_deleted) and checks
+// them against the model
+func parseListOptions(resourceModel Model, c *iris.Context) (ListOptions, error) {
+	opts := NewListOptions()
+
+	var err error
+	if page := c.URLParam("page"); page != "" {
+		if opts.Page, err = strconv.Atoi(page); err != nil {
+			return opts, fmt.Errorf("Error parsing page to integer: %s", err)
+		}
+	}
+	if pageSize := c.URLParam("page_size"); pageSize != "" {
+		if opts.PageSize, err = strconv.Atoi(pageSize); err != nil {
+			return opts, fmt.Errorf("Error parsing page_size to integer: %s", err)
+		}
+	}
+	if sort := c.URLParam("sort"); sort != "" {
+		opts.Sort = sort
+	}
+	if order := c.URLParam("order"); order != "" {
+		opts.Order = order
+	}
+	// The cursor carries the order it was issued with
+	if cursor := c.URLParam("cursor"); cursor != "" {
+		if opts.After, err = DecodeCursor(cursor); err != nil {
+			return opts, err
+		}
+		opts.Order = opts.After.Order
+	}
+	if opts.IncludeDeleted, err = parseIncludeDeleted(c); err != nil {
+		return opts, err
+	}
+	opts.Owner = c.URLParam("owner")
+
+	if err = CheckListOptions(resourceModel.GetModelName(), opts); err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+// pageLink returns the URL of another page of the current list request, keeping
+// all its other query parameters untouched
+func pageLink(c *iris.Context, page int) string {
+	query := c.Request.URL.Query()
+	query.Set("page", strconv.Itoa(page))
+	query.Del("cursor")
+	link := url.URL{Path: c.Request.URL.Path, RawQuery: query.Encode()}
+	return link.String()
+}
+
+// cursorLink returns the URL of the page following a cursor
+func cursorLink(c *iris.Context, cursor string) string {
+	query := c.Request.URL.Query()
+	query.Set("cursor", cursor)
+	query.Del("page")
+	link := url.URL{Path: c.Request.URL.Path, RawQuery: query.Encode()}
+	return link.String()
+}
+
+// listResources writes a page of resources of a given model. instanceList must
+// be a pointer to a slice of the model's resource type.
+func (s *APIServer) listResources(resourceModel Model, instanceList interface{}, c *iris.Context) {
+	modelName := resourceModel.GetModelName()
+
+	opts, err := parseListOptions(resourceModel, c)
+	if err != nil {
+		c.JSON(400, common.NewAPIError(fmt.Sprintf("Invalid %s list query: %s", modelName, err)))
+		return
+	}
+
+	err = resourceModel.List(requestContext(c), instanceList, opts)
+	if err != nil {
+		c.JSON(500, common.NewAPIError(fmt.Sprintf("Error retrieving %s list: %s", modelName, err)))
+		return
+	}
+
+	var total, next, prev, nextCursorStr interface{}
+	if cursor := nextCursor(instanceList, opts); cursor != nil {
+		nextCursorStr = EncodeCursor(cursor)
+	}
+	if opts.After != nil {
+		// Keyset pagination only goes forward, and cursor pages aren't
+		// counted: a COUNT(*) would scan the whole table on every page
+		if nextCursorStr != nil {
+			next = cursorLink(c, nextCursorStr.(string))
+		}
+	} else {
+		count, err := resourceModel.Count(requestContext(c), opts)
+		if err != nil {
+			c.JSON(500, common.NewAPIError(fmt.Sprintf("Error counting %s: %s", modelName, err)))
+			return
+		}
+		total = count
+		if (opts.Page+1)*opts.PageSize < count {
+			next = pageLink(c, opts.Page+1)
+		}
+		if opts.Page > 0 {
+			prev = pageLink(c, opts.Page-1)
+		}
+	}
+
+	c.JSON(200, map[string]interface{}{
+		"page":        opts.Page,
+		"page_size":   opts.PageSize,
+		"total":       total,
+		"length":      reflect.ValueOf(instanceList).Elem().Len(),
+		"items":       instanceList,
+		"next":        next,
+		"prev":        prev,
+		"next_cursor": nextCursorStr,
+	})
+}
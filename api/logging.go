@@ -0,0 +1,187 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/kataras/iris.v6"
+)
+
+// Log formats
+const (
+	LogFormatJSON = "json"
+	LogFormatText = "text"
+)
+
+// RequestIDHeader is the header carrying the ID of a request, generated by
+// the API unless set by its client, and echoed in the response
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength is the maximum length of request IDs set by clients.
+// Longer IDs are replaced by a generated one.
+const maxRequestIDLength = 128
+
+// Context keys of the request ID and of the counter of the bytes read from
+// the request body
+const (
+	requestIDKey = "request_id"
+	bytesInKey   = "bytes_in"
+)
+
+// ConfigureLogging sets the level and the format of the logs, written to
+// stderr
+func ConfigureLogging(level, format string) error {
+	return configureLogger(log.StandardLogger(), os.Stderr, level, format)
+}
+
+func configureLogger(logger *log.Logger, out io.Writer, level, format string) error {
+	lvl, err := log.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case LogFormatJSON:
+		logger.Formatter = &log.JSONFormatter{}
+	case LogFormatText:
+		logger.Formatter = &log.TextFormatter{FullTimestamp: true}
+	default:
+		return fmt.Errorf("Unknown log format %s. Should be: %s or %s", format, LogFormatJSON, LogFormatText)
+	}
+	logger.Level = lvl
+	logger.Out = out
+	return nil
+}
+
+// countingReadCloser counts the bytes read from a request body
+type countingReadCloser struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// validRequestID returns true if a request ID set by a client can be logged
+// as is: not too long, and made of printable ASCII characters only
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		if r <= ' ' || r > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestBytesIn returns the number of bytes read so far from the body of a
+// request
+func requestBytesIn(c *iris.Context) int64 {
+	if body, ok := c.Get(bytesInKey).(*countingReadCloser); ok {
+		return body.n
+	}
+	return 0
+}
+
+// requestLogger returns a logger adding the details of a request to every
+// line: its ID, method and path, the client IP, its trace ID, and the
+// principal, resource type, action and resource UUID once known
+func requestLogger(c *iris.Context) *log.Entry {
+	fields := log.Fields{
+		"request_id": c.GetString(requestIDKey),
+		"method":     c.Request.Method,
+		"path":       c.Request.URL.Path,
+		"client_ip":  clientIP(c),
+	}
+	if span := trace.SpanContextFromContext(c.Request.Context()); span.IsValid() {
+		fields["trace_id"] = span.TraceID().String()
+	}
+	if p := principal(c); p != "" {
+		fields["principal"] = p
+	}
+	if resource := c.GetString(auditResourceKey); resource != "" {
+		fields["resource"] = resource
+		fields["action"] = c.GetString(auditActionKey)
+	}
+	if id, err := uuid.FromString(c.Param("uuid")); err == nil {
+		fields["uuid"] = id.String()
+	}
+	return log.WithFields(fields)
+}
+
+// logRequest is a middleware giving each request an ID, and logging it once
+// handled with its status, the bytes it transferred and its duration
+func (s *APIServer) logRequest(c *iris.Context) {
+	start := time.Now()
+	id := c.Request.Header.Get(RequestIDHeader)
+	if !validRequestID(id) {
+		id = uuid.NewV4().String()
+	}
+	c.Set(requestIDKey, id)
+	c.SetHeader(RequestIDHeader, id)
+	if c.Request.Body != nil {
+		body := &countingReadCloser{ReadCloser: c.Request.Body}
+		c.Request.Body = body
+		c.Set(bytesInKey, body)
+	}
+
+	c.Next()
+
+	status := c.ResponseWriter.StatusCode()
+	bytesOut, _ := c.Get(auditBytesOutKey).(int64)
+	entry := requestLogger(c).WithFields(log.Fields{
+		"status":      status,
+		"bytes_in":    requestBytesIn(c),
+		"bytes_out":   bytesOut,
+		"duration_ms": float64(time.Since(start)) / float64(time.Millisecond),
+	})
+	if status >= 500 {
+		entry.Error("Request failed")
+	} else {
+		entry.Info("Request handled")
+	}
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+package main_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/satori/go.uuid"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/kataras/iris.v6/httptest"
+
+	. "github.com/MorpheoOrg/morpheo-storage/api"
+)
+
+func TestConfigureLogging(t *testing.T) {
+	defer logrus.SetOutput(os.Stderr)
+	if err := ConfigureLogging("verbose", LogFormatJSON); err == nil {
+		t.Errorf("Unknown log level accepted")
+	}
+	if err := ConfigureLogging("info", "xml"); err == nil {
+		t.Errorf("Unknown log format accepted")
+	}
+	if err := ConfigureLogging("debug", LogFormatText); err != nil {
+		t.Errorf("Error configuring logging: %s", err)
+	}
+}
+
+func TestRequestLogging(t *testing.T) {
+	if err := ConfigureLogging("info", LogFormatJSON); err != nil {
+		t.Fatalf("Error configuring logging: %s", err)
+	}
+	var logs bytes.Buffer
+	logrus.SetOutput(&logs)
+	defer logrus.SetOutput(os.Stderr)
+
+	app, _ := newTestApp(NewMemoryBlobStore())
+	e := httptest.New(app, t)
+
+	id := uuid.NewV4().String()
+	e.POST(DataListRoute).WithBasicAuth("u", "p").WithMultipart().WithFormField("uuid", id).WithFormField("size", BlobSize).WithFile("blob", "main.go").Expect().Status(201)
+
+	// Test request IDs set by clients are echoed and logged with the request
+	logs.Reset()
+	e.GET(DataListRoute+"/"+id+"/blob").WithBasicAuth("u", "p").WithHeader(RequestIDHeader, "trace-42").Expect().Status(200).Header(RequestIDHeader).Equal("trace-42")
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	var line map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &line); err != nil {
+		t.Fatalf("Request log line isn't JSON: %s", err)
+	}
+	expected := map[string]interface{}{
+		"level":      "info",
+		"request_id": "trace-42",
+		"method":     "GET",
+		"principal":  "u",
+		"resource":   DataModelName,
+		"action":     ActionDownload,
+		"uuid":       id,
+		"status":     float64(200),
+		"bytes_out":  float64(len(Blob)),
+	}
+	for field, value := range expected {
+		if line[field] != value {
+			t.Errorf("Wrong %s logged: %v, should be %v", field, line[field], value)
+		}
+	}
+	if _, ok := line["duration_ms"]; !ok {
+		t.Errorf("Request duration not logged")
+	}
+
+	// Test request IDs are generated otherwise
+	generated := e.GET(RootRoute).Expect().Status(200).Header(RequestIDHeader).NotEmpty().Raw()
+	if _, err := uuid.FromString(generated); err != nil {
+		t.Errorf("Generated request ID %s isn't a UUID: %s", generated, err)
+	}
+	e.GET(RootRoute).WithHeader(RequestIDHeader, "trace 42").Expect().Status(200).Header(RequestIDHeader).NotEqual("trace 42")
+	e.GET(RootRoute).WithHeader(RequestIDHeader, strings.Repeat("6", 129)).Expect().Status(200).Header(RequestIDHeader).Length().Equal(36)
+}
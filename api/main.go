@@ -36,45 +36,107 @@
 package main
 
 import (
+	"context"
 	"fmt"
-
-	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
 	migrate "github.com/rubenv/sql-migrate"
 	"github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
 	"gopkg.in/kataras/iris.v6"
 	"gopkg.in/kataras/iris.v6/adaptors/cors"
 	"gopkg.in/kataras/iris.v6/adaptors/httprouter" // <--- TODO or adaptors/gorillamux
-	"gopkg.in/kataras/iris.v6/middleware/basicauth"
-	"gopkg.in/kataras/iris.v6/middleware/logger"
 
 	"github.com/MorpheoOrg/morpheo-go-packages/common"
 )
 
 // Available HTTP routes
 const (
-	RootRoute           = "/"
-	HealthRoute         = "/health"
-	ProblemListRoute    = "/problem"
-	ProblemRoute        = "/problem/:uuid"
-	ProblemBlobRoute    = "/problem/:uuid/blob"
-	DataListRoute       = "/data"
-	DataRoute           = "/data/:uuid"
-	DataBlobRoute       = "/data/:uuid/blob"
-	AlgoListRoute       = "/algo"
-	AlgoRoute           = "/algo/:uuid"
-	AlgoBlobRoute       = "/algo/:uuid/blob"
-	ModelListRoute      = "/model"
-	ModelRoute          = "/model/:uuid"
-	ModelBlobRoute      = "/model/:uuid/blob"
-	PredictionListRoute = "/prediction"
-	PredictionRoute     = "/prediction/:uuid"
-	PredictionBlobRoute = "/prediction/:uuid/blob"
+	RootRoute              = "/"
+	HealthRoute            = "/health"
+	HealthLiveRoute        = "/health/live"
+	HealthReadyRoute       = "/health/ready"
+	MetricsRoute           = "/metrics"
+	ProblemListRoute       = "/problem"
+	ProblemRoute           = "/problem/:uuid"
+	ProblemBlobRoute       = "/problem/:uuid/blob"
+	ProblemRestoreRoute    = "/problem/:uuid/restore"
+	DataListRoute          = "/data"
+	DataRoute              = "/data/:uuid"
+	DataBlobRoute          = "/data/:uuid/blob"
+	DataRestoreRoute       = "/data/:uuid/restore"
+	AlgoListRoute          = "/algo"
+	AlgoRoute              = "/algo/:uuid"
+	AlgoBlobRoute          = "/algo/:uuid/blob"
+	AlgoRestoreRoute       = "/algo/:uuid/restore"
+	ModelListRoute         = "/model"
+	ModelRoute             = "/model/:uuid"
+	ModelBlobRoute         = "/model/:uuid/blob"
+	ModelRestoreRoute      = "/model/:uuid/restore"
+	PredictionListRoute    = "/prediction"
+	PredictionRoute        = "/prediction/:uuid"
+	PredictionBlobRoute    = "/prediction/:uuid/blob"
+	PredictionRestoreRoute = "/prediction/:uuid/restore"
+	UploadRoute            = "/upload/:resource"
+	UploadFileRoute        = "/upload/:resource/:upload"
+	AdminUserListRoute     = "/admin/user"
+	AdminUserRoute         = "/admin/user/:name"
+	AdminTokenListRoute    = "/admin/token"
+	AdminTokenRoute        = "/admin/token/:uuid"
+	AuditRoute             = "/audit"
 )
 
+// routes lists all the routes of the API
+var routes = []string{
+	RootRoute,
+	HealthRoute,
+	HealthLiveRoute,
+	HealthReadyRoute,
+	MetricsRoute,
+	ProblemListRoute,
+	ProblemRoute,
+	ProblemBlobRoute,
+	ProblemRestoreRoute,
+	DataListRoute,
+	DataRoute,
+	DataBlobRoute,
+	DataRestoreRoute,
+	AlgoListRoute,
+	AlgoRoute,
+	AlgoBlobRoute,
+	AlgoRestoreRoute,
+	ModelListRoute,
+	ModelRoute,
+	ModelBlobRoute,
+	ModelRestoreRoute,
+	PredictionListRoute,
+	PredictionRoute,
+	PredictionBlobRoute,
+	PredictionRestoreRoute,
+	UploadRoute,
+	UploadFileRoute,
+	AdminUserListRoute,
+	AdminUserRoute,
+	AdminTokenListRoute,
+	AdminTokenRoute,
+	AuditRoute,
+}
+
+// ShutdownTimeout is how long the requests in flight are waited for on
+// shutdown
+const ShutdownTimeout = 30 * time.Second
+
+// PrincipalContextKey is the context key under which the authentication
+// middleware stores the authenticated Principal
+const PrincipalContextKey = "principal"
+
 // APIServer represents the API configurations
 type APIServer struct {
 	Conf            *StorageConfig
@@ -84,44 +146,124 @@ type APIServer struct {
 	ModelModel      Model
 	DataModel       Model
 	PredictionModel Model
+	UploadModel     UploadModel
+	BlobRefs        BlobRefModel
+	BlobLayout      string
+	Credentials     *Credentials
+	Tokens          TokenModel
+	Policy          *Policy
+	Audit           AuditModel
+	Limiter         *Limiter
+	HealthChecks    map[string]HealthCheck
+	// UploadExpiration is how long a resumable upload is kept without a new
+	// chunk (no expiration if zero)
+	UploadExpiration time.Duration
 }
 
 // ConfigureRoutes links the urls with the func and set authentication
 func (s *APIServer) ConfigureRoutes(app *iris.Framework, authentication iris.HandlerFunc) {
+	// Every route is traced, logged with a request ID, and instrumented (see
+	// tracing and metrics)
+	app.UseFunc(s.traceRequest, s.logRequest, s.instrument)
+
 	// Misc.
 	app.Get(RootRoute, s.index)
-	app.Get(HealthRoute, s.health)
+	app.Get(HealthRoute, s.healthLive)
+	app.Get(HealthLiveRoute, s.healthLive)
+	app.Get(HealthReadyRoute, optionalAuthentication(authentication), s.healthReady)
+	app.Get(MetricsRoute, authentication, requireRole(RoleMetrics, RoleAdmin), s.metrics)
+
+	// Resource routes are restricted to the principals allowed to perform
+	// their action by the access policy (see authorize)
+	if s.Policy == nil {
+		s.Policy = DefaultPolicy()
+	}
+
+	// Every route registered from here on is recorded in the audit log
+	if s.Audit != nil {
+		app.UseFunc(s.audit)
+	}
+	// Rate limits are enforced on the same routes, for client IPs (see
+	// rateLimit) and for principals once authenticated (see limitPrincipal)
+	if s.Limiter != nil {
+		app.UseFunc(s.rateLimit)
+	}
 
 	// Problem
-	app.Get(ProblemListRoute, authentication, s.getProblemList)
-	app.Post(ProblemListRoute, authentication, s.postProblem)
-	app.Patch(ProblemRoute, authentication, s.patchProblem)
-	app.Get(ProblemRoute, authentication, s.getProblem)
-	app.Get(ProblemBlobRoute, authentication, s.getProblemBlob)
+	app.Get(ProblemListRoute, authentication, s.limitPrincipal, s.authorize(ProblemModelName, ActionList), s.getProblemList)
+	app.Post(ProblemListRoute, authentication, s.limitPrincipal, s.authorize(ProblemModelName, ActionCreate), s.postProblem)
+	app.Get(ProblemRoute, authentication, s.limitPrincipal, s.authorize(ProblemModelName, ActionGet), s.getProblem)
+	app.Patch(ProblemRoute, authentication, s.limitPrincipal, s.authorize(ProblemModelName, ActionPatch), s.patchResource(s.ProblemModel))
+	app.Delete(ProblemRoute, authentication, s.limitPrincipal, s.authorize(ProblemModelName, ActionDelete), s.deleteResource(s.ProblemModel))
+	app.Post(ProblemRestoreRoute, authentication, s.limitPrincipal, s.authorize(ProblemModelName, ActionDelete), s.restoreResource(s.ProblemModel))
+	app.Get(ProblemBlobRoute, authentication, s.limitPrincipal, s.authorize(ProblemModelName, ActionDownload), s.getProblemBlob)
+	app.Head(ProblemBlobRoute, authentication, s.limitPrincipal, s.authorize(ProblemModelName, ActionDownload), s.headResourceBlob(s.ProblemModel))
 
 	// Algo
-	app.Get(AlgoListRoute, authentication, s.getAlgoList)
-	app.Post(AlgoListRoute, authentication, s.postAlgo)
-	app.Get(AlgoRoute, authentication, s.getAlgo)
-	app.Get(AlgoBlobRoute, authentication, s.getAlgoBlob)
+	app.Get(AlgoListRoute, authentication, s.limitPrincipal, s.authorize(AlgoModelName, ActionList), s.getAlgoList)
+	app.Post(AlgoListRoute, authentication, s.limitPrincipal, s.authorize(AlgoModelName, ActionCreate), s.postAlgo)
+	app.Get(AlgoRoute, authentication, s.limitPrincipal, s.authorize(AlgoModelName, ActionGet), s.getAlgo)
+	app.Patch(AlgoRoute, authentication, s.limitPrincipal, s.authorize(AlgoModelName, ActionPatch), s.patchResource(s.AlgoModel))
+	app.Delete(AlgoRoute, authentication, s.limitPrincipal, s.authorize(AlgoModelName, ActionDelete), s.deleteResource(s.AlgoModel))
+	app.Post(AlgoRestoreRoute, authentication, s.limitPrincipal, s.authorize(AlgoModelName, ActionDelete), s.restoreResource(s.AlgoModel))
+	app.Get(AlgoBlobRoute, authentication, s.limitPrincipal, s.authorize(AlgoModelName, ActionDownload), s.getAlgoBlob)
+	app.Head(AlgoBlobRoute, authentication, s.limitPrincipal, s.authorize(AlgoModelName, ActionDownload), s.headResourceBlob(s.AlgoModel))
 
 	// Model
-	app.Get(ModelListRoute, authentication, s.getModelList)
-	app.Post(ModelListRoute, authentication, s.postModel)
-	app.Get(ModelRoute, authentication, s.getModel)
-	app.Get(ModelBlobRoute, authentication, s.getModelBlob)
+	app.Get(ModelListRoute, authentication, s.limitPrincipal, s.authorize(ModelModelName, ActionList), s.getModelList)
+	app.Post(ModelListRoute, authentication, s.limitPrincipal, s.authorize(ModelModelName, ActionCreate), s.postModel)
+	app.Get(ModelRoute, authentication, s.limitPrincipal, s.authorize(ModelModelName, ActionGet), s.getModel)
+	app.Patch(ModelRoute, authentication, s.limitPrincipal, s.authorize(ModelModelName, ActionPatch), s.patchResource(s.ModelModel))
+	app.Delete(ModelRoute, authentication, s.limitPrincipal, s.authorize(ModelModelName, ActionDelete), s.deleteResource(s.ModelModel))
+	app.Post(ModelRestoreRoute, authentication, s.limitPrincipal, s.authorize(ModelModelName, ActionDelete), s.restoreResource(s.ModelModel))
+	app.Get(ModelBlobRoute, authentication, s.limitPrincipal, s.authorize(ModelModelName, ActionDownload), s.getModelBlob)
+	app.Head(ModelBlobRoute, authentication, s.limitPrincipal, s.authorize(ModelModelName, ActionDownload), s.headResourceBlob(s.ModelModel))
 
 	// Data
-	app.Get(DataListRoute, authentication, s.getDataList)
-	app.Post(DataListRoute, authentication, s.postData)
-	app.Get(DataRoute, authentication, s.getData)
-	app.Get(DataBlobRoute, authentication, s.getDataBlob)
+	app.Get(DataListRoute, authentication, s.limitPrincipal, s.authorize(DataModelName, ActionList), s.getDataList)
+	app.Post(DataListRoute, authentication, s.limitPrincipal, s.authorize(DataModelName, ActionCreate), s.postData)
+	app.Get(DataRoute, authentication, s.limitPrincipal, s.authorize(DataModelName, ActionGet), s.getData)
+	app.Patch(DataRoute, authentication, s.limitPrincipal, s.authorize(DataModelName, ActionPatch), s.patchResource(s.DataModel))
+	app.Delete(DataRoute, authentication, s.limitPrincipal, s.authorize(DataModelName, ActionDelete), s.deleteResource(s.DataModel))
+	app.Post(DataRestoreRoute, authentication, s.limitPrincipal, s.authorize(DataModelName, ActionDelete), s.restoreResource(s.DataModel))
+	app.Get(DataBlobRoute, authentication, s.limitPrincipal, s.authorize(DataModelName, ActionDownload), s.getDataBlob)
+	app.Head(DataBlobRoute, authentication, s.limitPrincipal, s.authorize(DataModelName, ActionDownload), s.headResourceBlob(s.DataModel))
 
 	// Prediction
-	app.Get(PredictionListRoute, authentication, s.getPredictionList)
-	app.Post(PredictionListRoute, authentication, s.postPrediction)
-	app.Get(PredictionRoute, authentication, s.getPrediction)
-	app.Get(PredictionBlobRoute, authentication, s.getPredictionBlob)
+	app.Get(PredictionListRoute, authentication, s.limitPrincipal, s.authorize(PredictionModelName, ActionList), s.getPredictionList)
+	app.Post(PredictionListRoute, authentication, s.limitPrincipal, s.authorize(PredictionModelName, ActionCreate), s.postPrediction)
+	app.Get(PredictionRoute, authentication, s.limitPrincipal, s.authorize(PredictionModelName, ActionGet), s.getPrediction)
+	app.Patch(PredictionRoute, authentication, s.limitPrincipal, s.authorize(PredictionModelName, ActionPatch), s.patchResource(s.PredictionModel))
+	app.Delete(PredictionRoute, authentication, s.limitPrincipal, s.authorize(PredictionModelName, ActionDelete), s.deleteResource(s.PredictionModel))
+	app.Post(PredictionRestoreRoute, authentication, s.limitPrincipal, s.authorize(PredictionModelName, ActionDelete), s.restoreResource(s.PredictionModel))
+	app.Get(PredictionBlobRoute, authentication, s.limitPrincipal, s.authorize(PredictionModelName, ActionDownload), s.getPredictionBlob)
+	app.Head(PredictionBlobRoute, authentication, s.limitPrincipal, s.authorize(PredictionModelName, ActionDownload), s.headResourceBlob(s.PredictionModel))
+
+	// Resumable uploads (tus protocol)
+	app.Options(UploadRoute, authentication, s.limitPrincipal, s.optionsUpload)
+	app.Post(UploadRoute, authentication, s.limitPrincipal, s.authorizeUpload, tusResumable, s.createUpload)
+	app.Head(UploadFileRoute, authentication, s.limitPrincipal, s.authorizeUpload, tusResumable, s.headUpload)
+	app.Patch(UploadFileRoute, authentication, s.limitPrincipal, s.authorizeUpload, tusResumable, s.patchUpload)
+	app.Delete(UploadFileRoute, authentication, s.limitPrincipal, s.authorizeUpload, tusResumable, s.deleteUpload)
+
+	// User management (admins only)
+	if s.Credentials != nil {
+		app.Get(AdminUserListRoute, authentication, s.limitPrincipal, requireRole(RoleAdmin), s.getUserList)
+		app.Post(AdminUserListRoute, authentication, s.limitPrincipal, requireRole(RoleAdmin), s.postUser)
+		app.Delete(AdminUserRoute, authentication, s.limitPrincipal, requireRole(RoleAdmin), s.deleteUser)
+	}
+
+	// API token management (admins only)
+	if s.Tokens != nil {
+		app.Get(AdminTokenListRoute, authentication, s.limitPrincipal, requireRole(RoleAdmin), s.getTokenList)
+		app.Post(AdminTokenListRoute, authentication, s.limitPrincipal, requireRole(RoleAdmin), s.postToken)
+		app.Delete(AdminTokenRoute, authentication, s.limitPrincipal, requireRole(RoleAdmin), s.deleteToken)
+	}
+
+	// Audit log (admins only)
+	if s.Audit != nil {
+		app.Get(AuditRoute, authentication, s.limitPrincipal, requireRole(RoleAdmin), s.getAuditLog)
+	}
 }
 
 // RunMigrations applies migrations in migrationDir
@@ -142,27 +284,119 @@ func RunMigrations(db *sqlx.DB, migrationDir string, rollback bool) (int, error)
 	return migrate.ExecMax(db.DB, "postgres", migrations, operation, limit)
 }
 
-// SetAuthentication returns the app authentication
+// SetAuthentication returns the app authentication for a single admin user
 func SetAuthentication(user, password string) iris.HandlerFunc {
-	authConfig := basicauth.Config{
-		Users:      map[string]string{user: password},
-		Realm:      "Authorization Required",
-		ContextKey: "mycustomkey",
-		Expires:    time.Duration(30) * time.Minute,
+	credentials, err := singleUserCredentials(user, password)
+	if err != nil {
+		log.WithField("component", "auth").Errorf("Invalid API user, all requests will be rejected: %s", err)
+	}
+	return BasicAuthentication(credentials)
+}
+
+// singleUserCredentials returns in memory credentials holding a single admin
+// user
+func singleUserCredentials(user, password string) (*Credentials, error) {
+	credentials := NewCredentials()
+	return credentials, credentials.Add(user, password, []string{RoleAdmin})
+}
+
+// principal returns the name of the user authenticated for a request
+func principal(c *iris.Context) string {
+	if p := GetPrincipal(c); p != nil {
+		return p.Name
+	}
+	return ""
+}
+
+// checkOwner makes sure the authenticated user owns a resource, unless one of
+// their roles manages its resource type (see Policy.Manages). API tokens only
+// act on their own resources. Resources uploaded before ownership was recorded
+// have no owner and are left open.
+func (s *APIServer) checkOwner(modelName string, resource StoredResource, c *iris.Context) error {
+	owner := resource.Meta().Owner
+	if owner == "" || owner == principal(c) {
+		return nil
 	}
-	return basicauth.New(authConfig)
+	if p := GetPrincipal(c); p != nil && p.Scopes == nil && s.Policy.Manages(p.Roles, modelName) {
+		return nil
+	}
+	return fmt.Errorf("%s belongs to another user", resource.GetUUID())
 }
 
 func main() {
 	// Parses CLI flags to generate the API config
 	conf := NewStorageConfig()
+	if err := ConfigureLogging(conf.LogLevel, conf.LogFormat); err != nil {
+		log.Fatalf("Cannot configure logging: %s", err)
+	}
+	shutdownTracing, err := SetupTracing(conf)
+	if err != nil {
+		log.Fatalf("Cannot configure tracing: %s", err)
+	}
 
-	// Iris setup
+	// Iris setup, its own messages being logged like ours
 	app := iris.New()
-	app.Adapt(iris.DevLogger(), httprouter.New())
+	app.Adapt(iris.LoggerPolicy(func(mode iris.LogMode, message string) {
+		if mode == iris.ProdMode {
+			log.WithField("component", "iris").Error(message)
+		} else {
+			log.WithField("component", "iris").Debug(message)
+		}
+	}), httprouter.New())
+
+	// Iris authentication. In basic mode, users are read from the credentials
+	// file, and reloaded on SIGHUP. The single API user set in the environment
+	// is only used when no credentials file is set.
+	var credentials *Credentials
+	var authentication iris.HandlerFunc
+	switch conf.AuthMode {
+	case AuthBasic:
+		if conf.CredentialsFile != "" {
+			if credentials, err = LoadCredentials(conf.CredentialsFile); err != nil {
+				log.Fatalf("Cannot load credentials: %s", err)
+			}
+			reload := make(chan os.Signal, 1)
+			signal.Notify(reload, syscall.SIGHUP)
+			go credentials.ReloadOnSignal(reload)
+		} else {
+			if conf.DeprecatedAuthFlags {
+				log.WithField("component", "auth").Warn("The -user and -password flags are deprecated and will be removed: the password shows in the process list. Set STORAGE_AUTH_USER and STORAGE_AUTH_PASSWORD, or use -credentials-file.")
+			}
+			if credentials, err = singleUserCredentials(conf.APIUser, conf.APIPassword); err != nil {
+				log.Fatalf("Invalid API user: %s", err)
+			}
+		}
+	case AuthJWT:
+		verifier, err := NewJWTVerifierFromConfig(conf)
+		if err != nil {
+			log.Fatalf("Cannot set JWT authentication: %s", err)
+		}
+		authentication = JWTAuthentication(verifier)
+	case AuthMTLS:
+		if !conf.TLSOn() || conf.ClientCAFile == "" {
+			log.Fatalf("Client certificate authentication requires -cert, -key and -client-ca")
+		}
+		var mapping *ClientCertMapping
+		if conf.ClientCertMapFile != "" {
+			if mapping, err = LoadClientCertMapping(conf.ClientCertMapFile); err != nil {
+				log.Fatalf("Cannot load client certificate mapping: %s", err)
+			}
+		}
+		authentication = ClientCertAuthentication(mapping)
+	default:
+		log.Fatalf("Unknown authentication mode %s. Should be: %s, %s or %s", conf.AuthMode, AuthBasic, AuthJWT, AuthMTLS)
+	}
+	if conf.ClientCAFile != "" && !conf.TLSOn() {
+		log.Fatalf("Client certificates can only be required over TLS: -client-ca requires -cert and -key")
+	}
 
-	// Iris authentication
-	authentication := SetAuthentication(conf.APIUser, conf.APIPassword)
+	// Access policy
+	policy := DefaultPolicy()
+	if conf.PolicyFile != "" {
+		if policy, err = LoadPolicy(conf.PolicyFile); err != nil {
+			log.Fatalf("Cannot load access policy: %s", err)
+		}
+	}
 
 	// Iris CORS middleware
 	corsMiddleware := cors.New(cors.Options{
@@ -172,14 +406,6 @@ func main() {
 	})
 	app.Adapt(corsMiddleware)
 
-	// Logging middleware configuration
-	customLogger := logger.New(logger.Config{
-		Status: true,
-		IP:     true,
-		Method: true,
-		Path:   true,
-	})
-	app.Use(customLogger)
 	db, err := sqlx.Connect(
 		"postgres",
 		fmt.Sprintf(
@@ -195,7 +421,11 @@ func main() {
 	if err != nil {
 		log.Fatalf("Cannot apply database migrations: %s", err)
 	}
-	log.Printf("Applied %d database migrations successfully", n)
+	log.Infof("Applied %d database migrations successfully", n)
+
+	if err = RegisterDBMetrics(db); err != nil {
+		log.Fatalf("Cannot export database metrics: %s", err)
+	}
 
 	// Model configuration
 	problemModel, err := NewSQLModel(db, ProblemModelName)
@@ -223,56 +453,156 @@ func main() {
 		log.Fatalf("Cannot create model %s: %s", PredictionModelName, err)
 	}
 
+	uploadModel, err := NewSQLUploadModel(db)
+	if err != nil {
+		log.Fatalf("Cannot create upload model: %s", err)
+	}
+
+	blobRefs, err := NewSQLBlobRefModel(db)
+	if err != nil {
+		log.Fatalf("Cannot create blob reference model: %s", err)
+	}
+
+	tokenModel, err := NewSQLTokenModel(db)
+	if err != nil {
+		log.Fatalf("Cannot create API token model: %s", err)
+	}
+
+	auditModel, err := NewSQLAuditModel(db)
+	if err != nil {
+		log.Fatalf("Cannot create audit model: %s", err)
+	}
+	if conf.BlobLayout != BlobLayoutUUID && conf.BlobLayout != BlobLayoutContent {
+		log.Fatalf("Unknown blob layout %s. Should be: %s or %s", conf.BlobLayout, BlobLayoutUUID, BlobLayoutContent)
+	}
+	if conf.MigrateBlobLayout && conf.BlobLayout != BlobLayoutContent {
+		log.Fatalf("Blobs can only be migrated to the %s blob layout", BlobLayoutContent)
+	}
+	if conf.RewrapBlobs && conf.EncryptionKeyFile == "" {
+		log.Fatalf("Blobs can only be rewrapped with an encryption keyfile")
+	}
+
 	// Set BlobStore
 	blobStore, err := SetBlobStore(*conf)
 	if err != nil {
 		log.Fatalf("Cannot set blobStore: %s", err)
 	}
 
+	// Resource queries are traced as part of their request (see tracing)
 	api := &APIServer{
 		Conf:            conf,
 		BlobStore:       blobStore,
-		ProblemModel:    problemModel,
-		AlgoModel:       algoModel,
-		ModelModel:      modelModel,
-		DataModel:       dataModel,
-		PredictionModel: predictionModel,
+		ProblemModel:    TraceModel(problemModel),
+		AlgoModel:       TraceModel(algoModel),
+		ModelModel:      TraceModel(modelModel),
+		DataModel:       TraceModel(dataModel),
+		PredictionModel: TraceModel(predictionModel),
+		UploadModel:     uploadModel,
+		BlobRefs:        blobRefs,
+		BlobLayout:      conf.BlobLayout,
+		Credentials:     credentials,
+		Policy:          policy,
+		Audit:           auditModel,
+		Limiter:         NewLimiter(conf),
+		HealthChecks: map[string]HealthCheck{
+			"database":   DatabaseCheck(db),
+			"migrations": MigrationsCheck(db, conf.DBMigrationsDir),
+			"blobstore":  BlobStoreCheck(blobStore),
+		},
+
+		UploadExpiration: conf.UploadExpiration,
+	}
+	// Users and API tokens are only managed by the API in basic mode
+	if conf.AuthMode == AuthBasic {
+		api.Tokens = tokenModel
+		authentication = Authentication(credentials, tokenModel)
 	}
 	api.ConfigureRoutes(app, authentication)
 
-	// Main server loop
+	if conf.MigrateBlobLayout {
+		n, err := api.MigrateBlobLayout()
+		if err != nil {
+			log.Fatalf("Blob layout partially migrated (%d blob(s) migrated): %s", n, err)
+		}
+		log.Infof("Migrated %d blob(s) to the content addressed layout", n)
+	}
+	if conf.RewrapBlobs {
+		n, err := api.RewrapBlobs()
+		if err != nil {
+			log.Fatalf("Blobs partially rewrapped (%d blob(s) rewritten): %s", n, err)
+		}
+		log.Infof("Rewrapped %d blob(s) under the current master key", n)
+	}
+
+	// Trash purge and pending uploads cleanup loops
+	stop := make(chan struct{})
+	go api.RunTrashPurger(conf.TrashPurgeInterval, conf.TrashRetention, stop)
+	go api.RunPendingReconciler(conf.PendingReconcileInterval, conf.PendingTimeout, stop)
+
+	// Expired uploads cleanup loop
+	if conf.UploadExpiration > 0 {
+		go api.RunUploadCleaner(conf.UploadCleanupInterval, stop)
+	}
+
+	// Main server loop, until SIGINT or SIGTERM
+	var listener net.Listener
 	if conf.TLSOn() {
-		app.ListenTLS(fmt.Sprintf("%s:%d", conf.Hostname, conf.Port), conf.CertFile, conf.KeyFile)
+		if listener, err = ListenTLS(conf); err != nil {
+			log.Fatalf("Cannot listen over TLS: %s", err)
+		}
 	} else {
-		app.Listen(fmt.Sprintf("%s:%d", conf.Hostname, conf.Port))
+		if listener, err = iris.TCPKeepAlive(fmt.Sprintf("%s:%d", conf.Hostname, conf.Port)); err != nil {
+			log.Fatalf("Cannot listen: %s", err)
+		}
+	}
+	err = Serve(app, listener)
+	close(stop)
+	shutdownTracing()
+	if err != nil {
+		log.Fatalf("Error serving: %s", err)
 	}
+	log.Info("Server stopped")
 }
 
-// misc routes
-func (s *APIServer) index(c *iris.Context) {
-	c.JSON(200, []string{
-		RootRoute,
-		HealthRoute,
-		ProblemListRoute,
-		ProblemRoute,
-		ProblemBlobRoute,
-		DataListRoute,
-		DataRoute,
-		DataBlobRoute,
-		AlgoListRoute,
-		AlgoRoute,
-		AlgoBlobRoute,
-		ModelListRoute,
-		ModelRoute,
-		ModelBlobRoute,
-		PredictionRoute,
-		PredictionBlobRoute,
-	})
+// Serve serves an Iris App on listener until SIGINT or SIGTERM is received.
+// The server then stops accepting connections, and returns once the requests
+// in flight are handled, or after ShutdownTimeout.
+func Serve(app *iris.Framework, listener net.Listener) error {
+	if app.Config.VHost == "" {
+		app.Config.VHost = iris.ParseHost(listener.Addr().String())
+	}
+	app.Boot()
+	server := &http.Server{
+		Handler:        app.Router,
+		ReadTimeout:    app.Config.ReadTimeout,
+		WriteTimeout:   app.Config.WriteTimeout,
+		MaxHeaderBytes: app.Config.MaxHeaderBytes,
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(listener)
+	}()
+	log.Infof("Serving HTTP on %s", listener.Addr())
+	select {
+	case err := <-served:
+		return err
+	case sig := <-signals:
+		log.Infof("Received %s, shutting down", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	return server.Shutdown(ctx)
 }
 
-func (s *APIServer) health(c *iris.Context) {
-	// TODO: check database and blob store connectivity here
-	c.JSON(200, map[string]string{"status": "ok"})
+// misc routes
+func (s *APIServer) index(c *iris.Context) {
+	c.JSON(200, routes)
 }
 
 // Generic blob routes and utilities
@@ -280,66 +610,110 @@ func (s *APIServer) getBlobKey(blobType string, blobID uuid.UUID) string {
 	return fmt.Sprintf("%s/%s", blobType, blobID)
 }
 
-// Problem related routes
-func (s *APIServer) getProblemList(c *iris.Context) {
-	problems := make([]common.Problem, 0, 30)
-	err := s.ProblemModel.List(&problems, 0, 30)
-	if err != nil {
-		c.JSON(500, common.NewAPIError(fmt.Sprintf("Error retrieving problem list: %s", err)))
-		return
+// getResourceModel returns the model of a given resource type
+func (s *APIServer) getResourceModel(modelName string) (Model, error) {
+	switch modelName {
+	case ProblemModelName:
+		return s.ProblemModel, nil
+	case AlgoModelName:
+		return s.AlgoModel, nil
+	case ModelModelName:
+		return s.ModelModel, nil
+	case DataModelName:
+		return s.DataModel, nil
+	case PredictionModelName:
+		return s.PredictionModel, nil
+	default:
+		return nil, fmt.Errorf("Unknown resource %s", modelName)
 	}
+}
 
-	c.JSON(200, map[string]interface{}{
-		"page":   0,
-		"length": len(problems),
-		"items":  problems,
-	})
+// Generic resource routes and utilities
+
+// patchResource updates a resource from a multipart form (see
+// PatchMultipartFields). When the resource UUID changes, its blob is either
+// renamed or, if a new blob is sent, replaced.
+func (s *APIServer) patchResource(resourceModel Model) iris.HandlerFunc {
+	modelName := resourceModel.GetModelName()
+	return func(c *iris.Context) {
+		ctx := requestContext(c)
+		id, err := uuid.FromString(c.Param("uuid"))
+		if err != nil {
+			c.JSON(400, common.NewAPIError(fmt.Sprintf("Impossible to parse UUID %s: %s", id, err)))
+			return
+		}
+		resource, err := NewStoredResource(modelName)
+		if err != nil {
+			c.JSON(500, common.NewAPIError(err.Error()))
+			return
+		}
+		if err = resourceModel.GetOne(ctx, resource, id, false); err != nil {
+			c.JSON(404, common.NewAPIError(fmt.Sprintf("Error retrieving %s %s: %s", modelName, c.Param("uuid"), err)))
+			return
+		}
+		if err = s.checkOwner(modelName, resource, c); err != nil {
+			c.JSON(403, common.NewAPIError(fmt.Sprintf("Error patching %s: %s", modelName, err)))
+			return
+		}
+		oldBlobKey := s.resourceBlobKey(modelName, resource)
+		statusCode, err := s.streamMultipartToStorage(resourceModel, resource, c)
+		if err != nil {
+			c.JSON(statusCode, common.NewAPIError(fmt.Sprintf("[Error patching %s] %s", modelName, err)))
+			return
+		}
+		// A new blob is stored under a new key when the UUID changed or when
+		// blobs are content addressed, the blob it replaces then has to go.
+		// Without a new blob, a blob stored under the resource UUID follows the
+		// UUID change. It is moved back if the update fails.
+		newBlobKey := s.resourceBlobKey(modelName, resource)
+		renamed := statusCode == 200 && newBlobKey != oldBlobKey
+		if renamed {
+			if err = s.blobStore(ctx).Rename(oldBlobKey, newBlobKey); err != nil {
+				c.JSON(500, common.NewAPIError(fmt.Sprintf("Error renaming %s blob on storage: %s", modelName, err)))
+				return
+			}
+		}
+		err = resourceModel.Update(ctx, resource, id)
+		if err != nil {
+			if statusCode == 201 {
+				s.abandonBlob(ctx, modelName, resource, oldBlobKey)
+			}
+			if renamed {
+				if errRename := s.blobStore(ctx).Rename(newBlobKey, oldBlobKey); errRename != nil {
+					requestLogger(c).WithField("component", "blobstore").Errorf("Blob of %s %s left under %s: %s", modelName, id, newBlobKey, errRename)
+					c.JSON(500, common.NewAPIError(fmt.Sprintf("Error updating %s %s in database: %s. Its blob couldn't be moved back and is left under %s: %s", modelName, id, err, newBlobKey, errRename)))
+					return
+				}
+			}
+			c.JSON(500, common.NewAPIError(fmt.Sprintf("Error updating %s %s in database: %s", modelName, resource.GetUUID(), err)))
+			return
+		}
+		if statusCode == 201 {
+			s.replaceBlob(ctx, modelName, resource, oldBlobKey)
+		}
+		c.JSON(200, resource)
+	}
+}
+
+// Problem related routes
+func (s *APIServer) getProblemList(c *iris.Context) {
+	problems := make([]ProblemResource, 0, DefaultPageSize)
+	s.listResources(s.ProblemModel, &problems, c)
 }
 
 func (s *APIServer) postProblem(c *iris.Context) {
-	problem := common.NewProblem()
+	problem := NewProblemResource()
 	statusCode, err := s.streamMultipartToStorage(s.ProblemModel, problem, c)
 	if err != nil {
 		c.JSON(statusCode, common.NewAPIError(fmt.Sprintf("[Error uploading problem] %s", err)))
 		return
 	}
-	err = s.ProblemModel.Insert(problem)
-	if err != nil {
-		c.JSON(500, common.NewAPIError(fmt.Sprintf("Error inserting problem %s in database: %s", problem.ID, err)))
-	}
 	c.JSON(201, problem)
 }
 
-func (s *APIServer) patchProblem(c *iris.Context) {
-	id, err := uuid.FromString(c.Param("uuid"))
-	if err != nil {
-		c.JSON(400, common.NewAPIError(fmt.Sprintf("Impossible to parse UUID %s: %s", id, err)))
-		return
-	}
-	problem, err := s.getProblemInstance(id)
-	if err != nil {
-		c.JSON(404, common.NewAPIError(fmt.Sprintf("Error retrieving problem %s: %s", c.Param("uuid"), err)))
-		return
-	}
-	statusCode, err := s.streamMultipartToStorage(s.ProblemModel, problem, c)
-	if err != nil {
-		c.JSON(statusCode, common.NewAPIError(fmt.Sprintf("[Error patching problem] %s", err)))
-		return
-	}
-	if statusCode == 201 && problem.ID != id { // delete old blob if uuid and blob has changed
-		err = s.BlobStore.Delete(s.getBlobKey(s.ProblemModel.GetModelName(), id))
-	}
-	err = s.ProblemModel.Update(problem, id)
-	if err != nil {
-		c.JSON(500, common.NewAPIError(fmt.Sprintf("Error updating problem %s in database: %s", problem.ID, err)))
-		return
-	}
-	c.JSON(200, problem)
-}
-
-func (s *APIServer) getProblemInstance(id uuid.UUID) (*common.Problem, error) {
-	problem := common.Problem{}
-	err := s.ProblemModel.GetOne(&problem, id)
+func (s *APIServer) getProblemInstance(ctx context.Context, id uuid.UUID, includeDeleted bool) (*ProblemResource, error) {
+	problem := ProblemResource{}
+	err := s.ProblemModel.GetOne(ctx, &problem, id, includeDeleted)
 	if err != nil {
 		return nil, common.NewAPIError(fmt.Sprintf("Error retrieving problem %s: %s", id, err))
 	}
@@ -353,7 +727,13 @@ func (s *APIServer) getProblem(c *iris.Context) {
 		return
 	}
 
-	problem, err := s.getProblemInstance(id)
+	includeDeleted, err := parseIncludeDeleted(c)
+	if err != nil {
+		c.JSON(400, common.NewAPIError(err.Error()))
+		return
+	}
+
+	problem, err := s.getProblemInstance(requestContext(c), id, includeDeleted)
 	if err != nil {
 		c.JSON(404, common.NewAPIError(fmt.Sprintf("Error retrieving problem %s: %s", c.Param("uuid"), err)))
 		return
@@ -368,48 +748,34 @@ func (s *APIServer) getProblemBlob(c *iris.Context) {
 		c.JSON(400, common.NewAPIError(fmt.Sprintf("Impossible to parse UUID %s: %s", id, err)))
 		return
 	}
-	_, err = s.getProblemInstance(id)
+	problem, err := s.getProblemInstance(requestContext(c), id, false)
 	if err != nil {
 		c.JSON(404, common.NewAPIError(fmt.Sprintf("Error retrieving problem %s: %s", c.Param("uuid"), err)))
 		return
 	}
 
-	s.streamBlobFromStorage("problem", id, c)
+	s.streamBlobFromStorage("problem", id, problem, c)
 }
 
 // Algorithm related routes
 func (s *APIServer) getAlgoList(c *iris.Context) {
-	algos := make([]common.Algo, 0, 30)
-	err := s.AlgoModel.List(&algos, 0, 30)
-	if err != nil {
-		c.JSON(500, common.NewAPIError(fmt.Sprintf("Error retrieving algo list: %s", err)))
-		return
-	}
-
-	c.JSON(200, map[string]interface{}{
-		"page":   0,
-		"length": len(algos),
-		"items":  algos,
-	})
+	algos := make([]AlgoResource, 0, DefaultPageSize)
+	s.listResources(s.AlgoModel, &algos, c)
 }
 
 func (s *APIServer) postAlgo(c *iris.Context) {
-	algo := common.NewAlgo()
+	algo := NewAlgoResource()
 	statusCode, err := s.streamMultipartToStorage(s.AlgoModel, algo, c)
 	if err != nil {
 		c.JSON(statusCode, common.NewAPIError(fmt.Sprintf("[Error uploading algo] %s", err)))
 		return
 	}
-	err = s.AlgoModel.Insert(algo)
-	if err != nil {
-		c.JSON(500, common.NewAPIError(fmt.Sprintf("Error inserting algo %s in database: %s", algo.ID, err)))
-	}
 	c.JSON(201, algo)
 }
 
-func (s *APIServer) getAlgoInstance(id uuid.UUID) (*common.Algo, error) {
-	algo := common.Algo{}
-	err := s.AlgoModel.GetOne(&algo, id)
+func (s *APIServer) getAlgoInstance(ctx context.Context, id uuid.UUID, includeDeleted bool) (*AlgoResource, error) {
+	algo := AlgoResource{}
+	err := s.AlgoModel.GetOne(ctx, &algo, id, includeDeleted)
 	if err != nil {
 		return nil, common.NewAPIError(fmt.Sprintf("Error retrieving algo %s: %s", id, err))
 	}
@@ -423,7 +789,13 @@ func (s *APIServer) getAlgo(c *iris.Context) {
 		return
 	}
 
-	algo, err := s.getAlgoInstance(id)
+	includeDeleted, err := parseIncludeDeleted(c)
+	if err != nil {
+		c.JSON(400, common.NewAPIError(err.Error()))
+		return
+	}
+
+	algo, err := s.getAlgoInstance(requestContext(c), id, includeDeleted)
 	if err != nil {
 		c.JSON(404, common.NewAPIError(fmt.Sprintf("Error retrieving algo %s: %s", c.Param("uuid"), err)))
 		return
@@ -438,29 +810,19 @@ func (s *APIServer) getAlgoBlob(c *iris.Context) {
 		return
 	}
 
-	_, err = s.getAlgoInstance(id)
+	algo, err := s.getAlgoInstance(requestContext(c), id, false)
 	if err != nil {
 		c.JSON(404, common.NewAPIError(fmt.Sprintf("Error retrieving algo %s: %s", c.Param("uuid"), err)))
 		return
 	}
 
-	s.streamBlobFromStorage("algo", id, c)
+	s.streamBlobFromStorage("algo", id, algo, c)
 }
 
 // Model related routes
 func (s *APIServer) getModelList(c *iris.Context) {
-	models := make([]common.Model, 0, 30)
-	err := s.ModelModel.List(&models, 0, 30)
-	if err != nil {
-		c.JSON(500, common.NewAPIError(fmt.Sprintf("Error retrieving model list: %s", err)))
-		return
-	}
-
-	c.JSON(200, map[string]interface{}{
-		"page":   0,
-		"length": len(models),
-		"items":  models,
-	})
+	models := make([]ModelResource, 0, DefaultPageSize)
+	s.listResources(s.ModelModel, &models, c)
 }
 
 func (s *APIServer) postModel(c *iris.Context) {
@@ -469,7 +831,7 @@ func (s *APIServer) postModel(c *iris.Context) {
 		c.JSON(400, common.NewAPIError(fmt.Sprintf("Impossible to parse algo UUID %s: %s", algoID, err)))
 		return
 	}
-	algo, err := s.getAlgoInstance(algoID)
+	algo, err := s.getAlgoInstance(requestContext(c), algoID, false)
 	if err != nil {
 		c.JSON(404, common.NewAPIError(fmt.Sprintf("Error uploading model: algorithm %s not found: %s", c.URLParam("algo"), err)))
 		return
@@ -485,22 +847,18 @@ func (s *APIServer) postModel(c *iris.Context) {
 		}
 	}
 
-	model := common.NewModel(modelID, algo)
-	statusCode, err := s.streamBlobToStorage("model", model.ID, c)
+	model := NewModelResource(modelID, algo)
+	statusCode, err := s.streamBlobToStorage(s.ModelModel, model, c)
 	if err != nil {
 		c.JSON(statusCode, common.NewAPIError(fmt.Sprintf("[Error uploading model] %s", err)))
 		return
 	}
-	err = s.ModelModel.Insert(model)
-	if err != nil {
-		c.JSON(500, common.NewAPIError(fmt.Sprintf("Error inserting model %s in database: %s", model.ID, err)))
-	}
 	c.JSON(201, model)
 }
 
-func (s *APIServer) getModelInstance(id uuid.UUID) (*common.Model, error) {
-	model := common.Model{}
-	err := s.ModelModel.GetOne(&model, id)
+func (s *APIServer) getModelInstance(ctx context.Context, id uuid.UUID, includeDeleted bool) (*ModelResource, error) {
+	model := ModelResource{}
+	err := s.ModelModel.GetOne(ctx, &model, id, includeDeleted)
 	if err != nil {
 		return nil, common.NewAPIError(fmt.Sprintf("Error retrieving model %s: %s", id, err))
 	}
@@ -514,7 +872,13 @@ func (s *APIServer) getModel(c *iris.Context) {
 		return
 	}
 
-	model, err := s.getModelInstance(id)
+	includeDeleted, err := parseIncludeDeleted(c)
+	if err != nil {
+		c.JSON(400, common.NewAPIError(err.Error()))
+		return
+	}
+
+	model, err := s.getModelInstance(requestContext(c), id, includeDeleted)
 	if err != nil {
 		c.JSON(404, common.NewAPIError(fmt.Sprintf("Error retrieving model %s: %s", c.Param("uuid"), err)))
 		return
@@ -529,48 +893,34 @@ func (s *APIServer) getModelBlob(c *iris.Context) {
 		c.JSON(400, common.NewAPIError(fmt.Sprintf("Impossible to parse UUID %s: %s", id, err)))
 		return
 	}
-	_, err = s.getModelInstance(id)
+	model, err := s.getModelInstance(requestContext(c), id, false)
 	if err != nil {
 		c.JSON(404, common.NewAPIError(fmt.Sprintf("Error retrieving model %s: %s", c.Param("uuid"), err)))
 		return
 	}
 
-	s.streamBlobFromStorage("model", id, c)
+	s.streamBlobFromStorage("model", id, model, c)
 }
 
 // Data related routes
 func (s *APIServer) getDataList(c *iris.Context) {
-	datas := make([]common.Data, 0, 30)
-	err := s.DataModel.List(&datas, 0, 30)
-	if err != nil {
-		c.JSON(500, common.NewAPIError(fmt.Sprintf("Error retrieving data list: %s", err)))
-		return
-	}
-
-	c.JSON(200, map[string]interface{}{
-		"page":   0,
-		"length": len(datas),
-		"items":  datas,
-	})
+	datas := make([]DataResource, 0, DefaultPageSize)
+	s.listResources(s.DataModel, &datas, c)
 }
 
 func (s *APIServer) postData(c *iris.Context) {
-	data := common.NewData()
+	data := NewDataResource()
 	statusCode, err := s.streamMultipartToStorage(s.DataModel, data, c)
 	if err != nil {
 		c.JSON(statusCode, common.NewAPIError(fmt.Sprintf("[Error uploading data] %s", err)))
 		return
 	}
-	err = s.DataModel.Insert(data)
-	if err != nil {
-		c.JSON(500, common.NewAPIError(fmt.Sprintf("Error inserting data %s in database: %s", data.ID, err)))
-	}
 	c.JSON(201, data)
 }
 
-func (s *APIServer) getDataInstance(id uuid.UUID) (*common.Data, error) {
-	data := common.Data{}
-	err := s.DataModel.GetOne(&data, id)
+func (s *APIServer) getDataInstance(ctx context.Context, id uuid.UUID, includeDeleted bool) (*DataResource, error) {
+	data := DataResource{}
+	err := s.DataModel.GetOne(ctx, &data, id, includeDeleted)
 	if err != nil {
 		return nil, common.NewAPIError(fmt.Sprintf("Error retrieving data %s: %s", id, err))
 	}
@@ -584,7 +934,13 @@ func (s *APIServer) getData(c *iris.Context) {
 		return
 	}
 
-	data, err := s.getDataInstance(id)
+	includeDeleted, err := parseIncludeDeleted(c)
+	if err != nil {
+		c.JSON(400, common.NewAPIError(err.Error()))
+		return
+	}
+
+	data, err := s.getDataInstance(requestContext(c), id, includeDeleted)
 	if err != nil {
 		c.JSON(404, common.NewAPIError(fmt.Sprintf("Error retrieving data %s: %s", c.Param("uuid"), err)))
 		return
@@ -600,48 +956,34 @@ func (s *APIServer) getDataBlob(c *iris.Context) {
 		return
 	}
 
-	_, err = s.getDataInstance(id)
+	data, err := s.getDataInstance(requestContext(c), id, false)
 	if err != nil {
 		c.JSON(404, common.NewAPIError(fmt.Sprintf("Error retrieving data %s: %s", c.Param("uuid"), err)))
 		return
 	}
 
-	s.streamBlobFromStorage("data", id, c)
+	s.streamBlobFromStorage("data", id, data, c)
 }
 
 // Prediction related routes
 func (s *APIServer) getPredictionList(c *iris.Context) {
-	predictions := make([]common.Prediction, 0, 30)
-	err := s.PredictionModel.List(&predictions, 0, 30)
-	if err != nil {
-		c.JSON(500, common.NewAPIError(fmt.Sprintf("Error retrieving prediction list: %s", err)))
-		return
-	}
-
-	c.JSON(200, map[string]interface{}{
-		"page":   0,
-		"length": len(predictions),
-		"items":  predictions,
-	})
+	predictions := make([]PredictionResource, 0, DefaultPageSize)
+	s.listResources(s.PredictionModel, &predictions, c)
 }
 
 func (s *APIServer) postPrediction(c *iris.Context) {
-	prediction := common.NewPrediction()
+	prediction := NewPredictionResource()
 	statusCode, err := s.streamMultipartToStorage(s.PredictionModel, prediction, c)
 	if err != nil {
 		c.JSON(statusCode, common.NewAPIError(fmt.Sprintf("[Error uploading prediction] %s", err)))
 		return
 	}
-	err = s.PredictionModel.Insert(prediction)
-	if err != nil {
-		c.JSON(500, common.NewAPIError(fmt.Sprintf("Error inserting prediction %s in database: %s", prediction.ID, err)))
-	}
 	c.JSON(201, prediction)
 }
 
-func (s *APIServer) getPredictionInstance(id uuid.UUID) (*common.Prediction, error) {
-	prediction := common.Prediction{}
-	err := s.PredictionModel.GetOne(&prediction, id)
+func (s *APIServer) getPredictionInstance(ctx context.Context, id uuid.UUID, includeDeleted bool) (*PredictionResource, error) {
+	prediction := PredictionResource{}
+	err := s.PredictionModel.GetOne(ctx, &prediction, id, includeDeleted)
 	if err != nil {
 		return nil, common.NewAPIError(fmt.Sprintf("Error retrieving prediction %s: %s", id, err))
 	}
@@ -655,7 +997,13 @@ func (s *APIServer) getPrediction(c *iris.Context) {
 		return
 	}
 
-	prediction, err := s.getPredictionInstance(id)
+	includeDeleted, err := parseIncludeDeleted(c)
+	if err != nil {
+		c.JSON(400, common.NewAPIError(err.Error()))
+		return
+	}
+
+	prediction, err := s.getPredictionInstance(requestContext(c), id, includeDeleted)
 	if err != nil {
 		c.JSON(404, common.NewAPIError(fmt.Sprintf("Error retrieving prediction %s: %s", c.Param("uuid"), err)))
 		return
@@ -670,29 +1018,52 @@ func (s *APIServer) getPredictionBlob(c *iris.Context) {
 		c.JSON(400, common.NewAPIError(fmt.Sprintf("Impossible to parse UUID %s: %s", id, err)))
 		return
 	}
-	_, err = s.getPredictionInstance(id)
+	prediction, err := s.getPredictionInstance(requestContext(c), id, false)
 	if err != nil {
 		c.JSON(404, common.NewAPIError(fmt.Sprintf("Error retrieving prediction %s: %s", c.Param("uuid"), err)))
 		return
 	}
 
-	s.streamBlobFromStorage("prediction", id, c)
+	s.streamBlobFromStorage("prediction", id, prediction, c)
 }
 
-// SetBlobStore defines the blobstore type (local, fake, S3)
+// SetBlobStore defines the blobstore type (local, fake, S3), instrumented with
+// metrics, encrypting blobs if an encryption keyfile is set
 func SetBlobStore(conf StorageConfig) (common.BlobStore, error) {
+	backend, err := newBlobStore(conf)
+	if err != nil {
+		return nil, err
+	}
+	blobStore := InstrumentBlobStore(backend, conf.BlobStore)
+	if conf.EncryptionKeyFile == "" {
+		return blobStore, nil
+	}
+	keyring, err := LoadKeyring(conf.EncryptionKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error setting BlobStore encryption: %s", err)
+	}
+	log.WithField("component", "blobstore").Infof("Data encrypted with master key %s", keyring.Current)
+	encryptedBlobStore, err := NewEncryptedBlobStore(blobStore, keyring, conf.EncryptionChunkSize)
+	if err != nil {
+		return nil, err
+	}
+	encryptedBlobStore.AllowPlaintext = conf.EncryptionAllowPlaintext
+	return encryptedBlobStore, nil
+}
+
+func newBlobStore(conf StorageConfig) (common.BlobStore, error) {
 	switch {
 	case conf.BlobStore == "gc" && conf.GCBucket != "":
-		log.Println("[GCBlobStore] Data stored on Google Cloud Storage")
+		log.WithField("component", "blobstore").Info("Data stored on Google Cloud Storage")
 		return common.NewGCBlobStore(conf.GCBucket)
 	case conf.BlobStore == "s3" && conf.AWSBucket != "" && conf.AWSRegion != "":
-		log.Println("[S3BlobStore] Data stored on Amazon S3")
+		log.WithField("component", "blobstore").Info("Data stored on Amazon S3")
 		return common.NewS3BlobStore(conf.AWSBucket, conf.AWSRegion)
 	case conf.BlobStore == "local":
-		log.Println(fmt.Sprintf("[LocalBlobStore] Data is stored locally in directory: %s", conf.DataDir))
+		log.WithField("component", "blobstore").Infof("Data is stored locally in directory: %s", conf.DataDir)
 		return common.NewLocalBlobStore(conf.DataDir)
 	case conf.BlobStore == "mock":
-		log.Println("[MOCKBlobStore] Blobstore Mock used to 'store' data")
+		log.WithField("component", "blobstore").Info("Blobstore Mock used to 'store' data")
 		return common.NewMOCKBlobStore(conf.DataDir)
 	default:
 		return nil, fmt.Errorf("Error setting BlobStore: Invalid configuration")
@@ -0,0 +1,256 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gopkg.in/kataras/iris.v6"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+)
+
+// metricsNamespace prefixes the names of all the metrics of the API
+const metricsNamespace = "storage"
+
+// RoleMetrics is the role of the principals allowed to read the metrics (e.g.
+// Prometheus), along with admins
+const RoleMetrics = "metrics"
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "Number of HTTP requests handled, per route, method and status.",
+	}, []string{"route", "method", "status"})
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of HTTP requests, per route, method and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+	transferredBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "http",
+		Name:      "transferred_bytes_total",
+		Help:      "Bytes uploaded and downloaded, per resource type and direction (upload or download).",
+	}, []string{"resource", "direction"})
+	blobStoreDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "blobstore",
+		Name:      "operation_duration_seconds",
+		Help:      "Latency of blob store operations, per backend and operation. Reads only include opening the blob.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"backend", "operation"})
+	blobStoreErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "blobstore",
+		Name:      "errors_total",
+		Help:      "Number of failed blob store operations, per backend and operation.",
+	}, []string{"backend", "operation"})
+
+	metricsHandler = promhttp.Handler()
+)
+
+func init() {
+	prometheus.MustRegister(httpRequests, httpDuration, transferredBytes, blobStoreDuration, blobStoreErrors)
+}
+
+// instrument is a middleware counting the requests it wraps and measuring
+// their latency, along with the bytes of the resources they transfer
+func (s *APIServer) instrument(c *iris.Context) {
+	start := time.Now()
+	c.Next()
+
+	route := routeTemplate(c.Request.URL.Path)
+	status := strconv.Itoa(c.ResponseWriter.StatusCode())
+	httpRequests.WithLabelValues(route, c.Request.Method, status).Inc()
+	httpDuration.WithLabelValues(route, c.Request.Method, status).Observe(time.Since(start).Seconds())
+
+	resource := c.GetString(auditResourceKey)
+	if resource == "" {
+		return
+	}
+	if received := requestBytesIn(c); received > 0 {
+		transferredBytes.WithLabelValues(resource, "upload").Add(float64(received))
+	}
+	if sent, _ := c.Get(auditBytesOutKey).(int64); sent > 0 {
+		transferredBytes.WithLabelValues(resource, "download").Add(float64(sent))
+	}
+}
+
+func (s *APIServer) metrics(c *iris.Context) {
+	metricsHandler.ServeHTTP(c.ResponseWriter, c.Request)
+}
+
+// InstrumentedBlobStore measures the latency and counts the errors of the
+// operations of a blob store
+type InstrumentedBlobStore struct {
+	common.BlobStore
+
+	backend string
+}
+
+// InstrumentBlobStore wraps a blob store, labelling its metrics with the name
+// of its backend
+func InstrumentBlobStore(blobStore common.BlobStore, backend string) *InstrumentedBlobStore {
+	return &InstrumentedBlobStore{BlobStore: blobStore, backend: backend}
+}
+
+// observe records the outcome of an operation started at start
+func (s *InstrumentedBlobStore) observe(operation string, start time.Time, err error) {
+	blobStoreDuration.WithLabelValues(s.backend, operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		blobStoreErrors.WithLabelValues(s.backend, operation).Inc()
+	}
+}
+
+// Put stores a blob
+func (s *InstrumentedBlobStore) Put(key string, r io.Reader, size int64) error {
+	start := time.Now()
+	err := s.BlobStore.Put(key, r, size)
+	s.observe("put", start, err)
+	return err
+}
+
+// Get opens a blob
+func (s *InstrumentedBlobStore) Get(key string) (io.ReadCloser, error) {
+	start := time.Now()
+	r, err := s.BlobStore.Get(key)
+	s.observe("get", start, err)
+	return r, err
+}
+
+// Delete removes a blob
+func (s *InstrumentedBlobStore) Delete(key string) error {
+	start := time.Now()
+	err := s.BlobStore.Delete(key)
+	s.observe("delete", start, err)
+	return err
+}
+
+// Rename moves a blob to another key
+func (s *InstrumentedBlobStore) Rename(oldKey, newKey string) error {
+	start := time.Now()
+	err := s.BlobStore.Rename(oldKey, newKey)
+	s.observe("rename", start, err)
+	return err
+}
+
+// dbCollector exports the connection pool statistics and the migration
+// version of a database
+type dbCollector struct {
+	db *sqlx.DB
+}
+
+var (
+	dbOpenConnections = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "db", "open_connections"),
+		"Number of open connections to the database.", nil, nil)
+	dbInUseConnections = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "db", "in_use_connections"),
+		"Number of database connections in use.", nil, nil)
+	dbIdleConnections = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "db", "idle_connections"),
+		"Number of idle database connections.", nil, nil)
+	dbMaxOpenConnections = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "db", "max_open_connections"),
+		"Maximum number of open connections to the database (0 for unlimited).", nil, nil)
+	dbWaitCount = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "db", "wait_count_total"),
+		"Number of times a database connection had to be waited for.", nil, nil)
+	dbWaitDuration = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "db", "wait_duration_seconds_total"),
+		"Time spent waiting for database connections.", nil, nil)
+	dbMigrationVersion = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "db", "migration_version"),
+		"Number of the latest database migration applied.", nil, nil)
+)
+
+// RegisterDBMetrics exports the metrics of a database
+func RegisterDBMetrics(db *sqlx.DB) error {
+	return prometheus.Register(&dbCollector{db})
+}
+
+// Describe sends the descriptions of the database metrics
+func (c *dbCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{dbOpenConnections, dbInUseConnections, dbIdleConnections, dbMaxOpenConnections, dbWaitCount, dbWaitDuration, dbMigrationVersion} {
+		ch <- desc
+	}
+}
+
+// Collect reads the database metrics
+func (c *dbCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.db.Stats()
+	ch <- prometheus.MustNewConstMetric(dbOpenConnections, prometheus.GaugeValue, float64(stats.OpenConnections))
+	ch <- prometheus.MustNewConstMetric(dbInUseConnections, prometheus.GaugeValue, float64(stats.InUse))
+	ch <- prometheus.MustNewConstMetric(dbIdleConnections, prometheus.GaugeValue, float64(stats.Idle))
+	ch <- prometheus.MustNewConstMetric(dbMaxOpenConnections, prometheus.GaugeValue, float64(stats.MaxOpenConnections))
+	ch <- prometheus.MustNewConstMetric(dbWaitCount, prometheus.CounterValue, float64(stats.WaitCount))
+	ch <- prometheus.MustNewConstMetric(dbWaitDuration, prometheus.CounterValue, stats.WaitDuration.Seconds())
+
+	version, err := migrationVersion(c.db)
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(dbMigrationVersion, err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(dbMigrationVersion, prometheus.GaugeValue, float64(version))
+}
+
+// migrationVersion returns the number of the latest migration applied to a
+// database (migrations being named <number>_<name>.sql)
+func migrationVersion(db *sqlx.DB) (int, error) {
+	var applied []string
+	if err := db.Select(&applied, "SELECT id FROM "+migrationTable); err != nil {
+		return 0, err
+	}
+	version := 0
+	for _, id := range applied {
+		n, err := strconv.Atoi(strings.SplitN(id, "_", 2)[0])
+		if err == nil && n > version {
+			version = n
+		}
+	}
+	return version, nil
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+package main_test
+
+import (
+	"testing"
+
+	"github.com/satori/go.uuid"
+	"gopkg.in/kataras/iris.v6/httptest"
+
+	. "github.com/MorpheoOrg/morpheo-storage/api"
+)
+
+func TestMetrics(t *testing.T) {
+	api := newTestServer(InstrumentBlobStore(NewMemoryBlobStore(), "memory"))
+	e := httptest.New(configureTestApp(api), t)
+
+	id := uuid.NewV4().String()
+	e.POST(DataListRoute).WithBasicAuth("u", "p").WithMultipart().WithFormField("uuid", id).WithFormField("size", BlobSize).WithFile("blob", "main.go").Expect().Status(201)
+	e.GET(DataListRoute+"/"+id+"/blob").WithBasicAuth("u", "p").Expect().Status(200)
+	e.GET(DataListRoute + "/" + id + "/blob").Expect().Status(401)
+
+	// Test only admins and the metrics role can read the metrics
+	api.Credentials.Add("prometheus", "p", []string{RoleMetrics})
+	e.GET(MetricsRoute).Expect().Status(401)
+	e.GET(MetricsRoute).WithBasicAuth("v", "p").Expect().Status(403)
+	e.GET(MetricsRoute).WithBasicAuth("u", "p").Expect().Status(200)
+
+	// Test requests are labelled by route rather than by path
+	metrics := e.GET(MetricsRoute).WithBasicAuth("prometheus", "p").Expect().Status(200).Body()
+	metrics.Contains(`storage_http_requests_total{method="POST",route="/data",status="201"}`)
+	metrics.Contains(`storage_http_requests_total{method="GET",route="/data/:uuid/blob",status="200"}`)
+	metrics.Contains(`storage_http_requests_total{method="GET",route="/data/:uuid/blob",status="401"}`)
+	metrics.Contains(`storage_http_request_duration_seconds_bucket{method="GET",route="/data/:uuid/blob",status="200",le="+Inf"}`)
+	metrics.NotContains(id)
+
+	// Test bytes transferred and blob store operations are measured
+	metrics.Contains(`storage_http_transferred_bytes_total{direction="upload",resource="data"}`)
+	metrics.Contains(`storage_http_transferred_bytes_total{direction="download",resource="data"}`)
+	metrics.Contains(`storage_blobstore_operation_duration_seconds_count{backend="memory",operation="put"}`)
+	metrics.Contains(`storage_blobstore_operation_duration_seconds_count{backend="memory",operation="get"}`)
+}
@@ -0,0 +1,57 @@
+-- +migrate Up
+ALTER TABLE problem
+ADD owner VARCHAR(255) NOT NULL DEFAULT '';
+
+ALTER TABLE algo
+ADD owner VARCHAR(255) NOT NULL DEFAULT '';
+
+ALTER TABLE model
+ADD owner VARCHAR(255) NOT NULL DEFAULT '';
+
+ALTER TABLE data
+ADD owner VARCHAR(255) NOT NULL DEFAULT '';
+
+ALTER TABLE prediction
+ADD owner VARCHAR(255) NOT NULL DEFAULT '';
+
+ALTER TABLE upload
+ADD owner VARCHAR(255) NOT NULL DEFAULT '';
+
+CREATE INDEX problem_owner ON problem (owner);
+
+CREATE INDEX algo_owner ON algo (owner);
+
+CREATE INDEX model_owner ON model (owner);
+
+CREATE INDEX data_owner ON data (owner);
+
+CREATE INDEX prediction_owner ON prediction (owner);
+
+-- +migrate Down
+DROP INDEX problem_owner;
+
+DROP INDEX algo_owner;
+
+DROP INDEX model_owner;
+
+DROP INDEX data_owner;
+
+DROP INDEX prediction_owner;
+
+ALTER TABLE problem
+DROP COLUMN owner;
+
+ALTER TABLE algo
+DROP COLUMN owner;
+
+ALTER TABLE model
+DROP COLUMN owner;
+
+ALTER TABLE data
+DROP COLUMN owner;
+
+ALTER TABLE prediction
+DROP COLUMN owner;
+
+ALTER TABLE upload
+DROP COLUMN owner;
@@ -0,0 +1,12 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS api_token (
+  uuid UUID PRIMARY KEY,
+  name VARCHAR(255) NOT NULL,
+  token_hash CHAR(64) NOT NULL UNIQUE,
+  scopes TEXT[] NOT NULL,
+  created_by VARCHAR(255) NOT NULL DEFAULT '',
+  timestamp_created BIGINT NOT NULL
+);
+
+-- +migrate Down
+DROP TABLE api_token;
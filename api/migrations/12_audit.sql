@@ -0,0 +1,36 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS audit (
+  id BIGSERIAL PRIMARY KEY,
+  timestamp BIGINT NOT NULL,
+  principal VARCHAR(255) NOT NULL DEFAULT '',
+  method VARCHAR(16) NOT NULL,
+  path TEXT NOT NULL,
+  resource VARCHAR(32) NOT NULL DEFAULT '',
+  action VARCHAR(32) NOT NULL DEFAULT '',
+  resource_uuid UUID,
+  status INTEGER NOT NULL,
+  bytes_in BIGINT NOT NULL DEFAULT 0,
+  bytes_out BIGINT NOT NULL DEFAULT 0,
+  client_ip VARCHAR(64) NOT NULL DEFAULT '',
+  duration_ms BIGINT NOT NULL DEFAULT 0
+);
+CREATE INDEX audit_timestamp_idx ON audit (timestamp);
+CREATE INDEX audit_principal_idx ON audit (principal);
+CREATE INDEX audit_resource_uuid_idx ON audit (resource_uuid);
+
+-- The audit log is append-only: rows can never be updated or deleted
+-- +migrate StatementBegin
+CREATE OR REPLACE FUNCTION audit_append_only() RETURNS trigger AS $$
+BEGIN
+  RAISE EXCEPTION 'audit log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+-- +migrate StatementEnd
+CREATE TRIGGER audit_no_update BEFORE UPDATE OR DELETE ON audit
+  FOR EACH ROW EXECUTE PROCEDURE audit_append_only();
+CREATE TRIGGER audit_no_truncate BEFORE TRUNCATE ON audit
+  FOR EACH STATEMENT EXECUTE PROCEDURE audit_append_only();
+
+-- +migrate Down
+DROP TABLE audit;
+DROP FUNCTION audit_append_only();
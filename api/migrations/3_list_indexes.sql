@@ -0,0 +1,13 @@
+-- +migrate Up
+CREATE INDEX IF NOT EXISTS problem_timestamp_upload_uuid_idx ON problem (timestamp_upload, uuid);
+CREATE INDEX IF NOT EXISTS algo_timestamp_upload_uuid_idx ON algo (timestamp_upload, uuid);
+CREATE INDEX IF NOT EXISTS model_timestamp_upload_uuid_idx ON model (timestamp_upload, uuid);
+CREATE INDEX IF NOT EXISTS data_timestamp_upload_uuid_idx ON data (timestamp_upload, uuid);
+CREATE INDEX IF NOT EXISTS prediction_timestamp_upload_uuid_idx ON prediction (timestamp_upload, uuid);
+
+-- +migrate Down
+DROP INDEX problem_timestamp_upload_uuid_idx;
+DROP INDEX algo_timestamp_upload_uuid_idx;
+DROP INDEX model_timestamp_upload_uuid_idx;
+DROP INDEX data_timestamp_upload_uuid_idx;
+DROP INDEX prediction_timestamp_upload_uuid_idx;
@@ -0,0 +1,31 @@
+-- +migrate Up
+ALTER TABLE problem
+ADD deleted_at BIGINT;
+
+ALTER TABLE algo
+ADD deleted_at BIGINT;
+
+ALTER TABLE model
+ADD deleted_at BIGINT;
+
+ALTER TABLE data
+ADD deleted_at BIGINT;
+
+ALTER TABLE prediction
+ADD deleted_at BIGINT;
+
+-- +migrate Down
+ALTER TABLE problem
+DROP COLUMN deleted_at;
+
+ALTER TABLE algo
+DROP COLUMN deleted_at;
+
+ALTER TABLE model
+DROP COLUMN deleted_at;
+
+ALTER TABLE data
+DROP COLUMN deleted_at;
+
+ALTER TABLE prediction
+DROP COLUMN deleted_at;
@@ -0,0 +1,41 @@
+-- +migrate Up
+ALTER TABLE problem
+ADD checksum VARCHAR(64) NOT NULL DEFAULT '',
+ADD size BIGINT NOT NULL DEFAULT 0;
+
+ALTER TABLE algo
+ADD checksum VARCHAR(64) NOT NULL DEFAULT '',
+ADD size BIGINT NOT NULL DEFAULT 0;
+
+ALTER TABLE model
+ADD checksum VARCHAR(64) NOT NULL DEFAULT '',
+ADD size BIGINT NOT NULL DEFAULT 0;
+
+ALTER TABLE data
+ADD checksum VARCHAR(64) NOT NULL DEFAULT '',
+ADD size BIGINT NOT NULL DEFAULT 0;
+
+ALTER TABLE prediction
+ADD checksum VARCHAR(64) NOT NULL DEFAULT '',
+ADD size BIGINT NOT NULL DEFAULT 0;
+
+-- +migrate Down
+ALTER TABLE problem
+DROP COLUMN checksum,
+DROP COLUMN size;
+
+ALTER TABLE algo
+DROP COLUMN checksum,
+DROP COLUMN size;
+
+ALTER TABLE model
+DROP COLUMN checksum,
+DROP COLUMN size;
+
+ALTER TABLE data
+DROP COLUMN checksum,
+DROP COLUMN size;
+
+ALTER TABLE prediction
+DROP COLUMN checksum,
+DROP COLUMN size;
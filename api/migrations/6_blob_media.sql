@@ -0,0 +1,41 @@
+-- +migrate Up
+ALTER TABLE problem
+ADD filename VARCHAR(255) NOT NULL DEFAULT '',
+ADD content_type VARCHAR(255) NOT NULL DEFAULT '';
+
+ALTER TABLE algo
+ADD filename VARCHAR(255) NOT NULL DEFAULT '',
+ADD content_type VARCHAR(255) NOT NULL DEFAULT '';
+
+ALTER TABLE model
+ADD filename VARCHAR(255) NOT NULL DEFAULT '',
+ADD content_type VARCHAR(255) NOT NULL DEFAULT '';
+
+ALTER TABLE data
+ADD filename VARCHAR(255) NOT NULL DEFAULT '',
+ADD content_type VARCHAR(255) NOT NULL DEFAULT '';
+
+ALTER TABLE prediction
+ADD filename VARCHAR(255) NOT NULL DEFAULT '',
+ADD content_type VARCHAR(255) NOT NULL DEFAULT '';
+
+-- +migrate Down
+ALTER TABLE problem
+DROP COLUMN filename,
+DROP COLUMN content_type;
+
+ALTER TABLE algo
+DROP COLUMN filename,
+DROP COLUMN content_type;
+
+ALTER TABLE model
+DROP COLUMN filename,
+DROP COLUMN content_type;
+
+ALTER TABLE data
+DROP COLUMN filename,
+DROP COLUMN content_type;
+
+ALTER TABLE prediction
+DROP COLUMN filename,
+DROP COLUMN content_type;
@@ -0,0 +1,24 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS upload (
+  uuid UUID PRIMARY KEY,
+  resource VARCHAR(16) NOT NULL,
+  upload_length BIGINT NOT NULL,
+  upload_offset BIGINT NOT NULL DEFAULT 0,
+  metadata TEXT NOT NULL DEFAULT '',
+  status VARCHAR(16) NOT NULL DEFAULT 'receiving',
+  timestamp_created BIGINT NOT NULL,
+  timestamp_updated BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS upload_timestamp_updated_idx ON upload (timestamp_updated);
+
+CREATE TABLE IF NOT EXISTS upload_chunk (
+  upload UUID NOT NULL REFERENCES upload(uuid) ON DELETE CASCADE,
+  chunk_offset BIGINT NOT NULL,
+  blob_key VARCHAR(255) NOT NULL,
+  PRIMARY KEY (upload, chunk_offset)
+);
+
+-- +migrate Down
+DROP TABLE upload_chunk;
+DROP TABLE upload;
@@ -0,0 +1,31 @@
+-- +migrate Up
+ALTER TABLE problem
+ADD status VARCHAR(16) NOT NULL DEFAULT 'committed';
+
+ALTER TABLE algo
+ADD status VARCHAR(16) NOT NULL DEFAULT 'committed';
+
+ALTER TABLE model
+ADD status VARCHAR(16) NOT NULL DEFAULT 'committed';
+
+ALTER TABLE data
+ADD status VARCHAR(16) NOT NULL DEFAULT 'committed';
+
+ALTER TABLE prediction
+ADD status VARCHAR(16) NOT NULL DEFAULT 'committed';
+
+-- +migrate Down
+ALTER TABLE problem
+DROP COLUMN status;
+
+ALTER TABLE algo
+DROP COLUMN status;
+
+ALTER TABLE model
+DROP COLUMN status;
+
+ALTER TABLE data
+DROP COLUMN status;
+
+ALTER TABLE prediction
+DROP COLUMN status;
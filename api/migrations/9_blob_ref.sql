@@ -0,0 +1,45 @@
+-- +migrate Up
+ALTER TABLE problem
+ADD blob_key VARCHAR(255) NOT NULL DEFAULT '';
+
+ALTER TABLE algo
+ADD blob_key VARCHAR(255) NOT NULL DEFAULT '';
+
+ALTER TABLE model
+ADD blob_key VARCHAR(255) NOT NULL DEFAULT '';
+
+ALTER TABLE data
+ADD blob_key VARCHAR(255) NOT NULL DEFAULT '';
+
+ALTER TABLE prediction
+ADD blob_key VARCHAR(255) NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS blob_ref (
+  blob_key VARCHAR(255) PRIMARY KEY,
+  refcount BIGINT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS blob_claim (
+  claim VARCHAR(255) PRIMARY KEY,
+  blob_key VARCHAR(255) NOT NULL
+);
+
+-- +migrate Down
+DROP TABLE blob_claim;
+
+DROP TABLE blob_ref;
+
+ALTER TABLE problem
+DROP COLUMN blob_key;
+
+ALTER TABLE algo
+DROP COLUMN blob_key;
+
+ALTER TABLE model
+DROP COLUMN blob_key;
+
+ALTER TABLE data
+DROP COLUMN blob_key;
+
+ALTER TABLE prediction
+DROP COLUMN blob_key;
@@ -36,11 +36,14 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
-	"github.com/fatih/structs"
 	"github.com/jmoiron/sqlx"
 	uuid "github.com/satori/go.uuid"
 	"reflect"
+	"strings"
+	"time"
 )
 
 // Model (and SQL table) names
@@ -53,33 +56,133 @@ const (
 	migrationTable      = "storage_migrations"
 	DevilMockUUID       = "c54e361e-18db-48dd-aa71-96f28a1af892"
 	ProblemMockUUIDStr  = "e42a31bb-a97b-47ff-81cf-ffdd7c5ddd08"
+	AlgoMockUsedUUIDStr = "4ba5e1d7-64a4-4e4e-8ee7-8b01e2a4c3f1"
+	TrashedMockUUIDStr  = "0d1e7e7e-5a1f-4a4e-9d6b-7c3f0ca2b5e9"
+	ProblemMockChecksum = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	OwnedMockUUIDStr    = "5e1f0a9c-2d4b-4c8e-a3f6-9b7d1e0c4a2f"
+	MockOwner           = "devil"
 )
 
 var (
 	// SQL statements
 	insertStatements = map[string]string{
-		"problem":    `INSERT INTO problem (uuid, timestamp_upload, name, description ) VALUES (:uuid, :timestamp_upload, :name, :description)`,
-		"algo":       `INSERT INTO algo (uuid, timestamp_upload, name) VALUES (:uuid, :timestamp_upload, :name)`,
-		"model":      `INSERT INTO model (uuid, algo, timestamp_upload) VALUES (:uuid, :algo, :timestamp_upload)`,
-		"data":       `INSERT INTO data (uuid, timestamp_upload) VALUES (:uuid, :timestamp_upload)`,
-		"prediction": `INSERT INTO prediction (uuid, timestamp_upload) VALUES (:uuid, :timestamp_upload)`,
+		"problem":    `INSERT INTO problem (uuid, timestamp_upload, name, description, checksum, size, filename, content_type, status, blob_key, owner) VALUES (:uuid, :timestamp_upload, :name, :description, :checksum, :size, :filename, :content_type, :status, :blob_key, :owner)`,
+		"algo":       `INSERT INTO algo (uuid, timestamp_upload, name, checksum, size, filename, content_type, status, blob_key, owner) VALUES (:uuid, :timestamp_upload, :name, :checksum, :size, :filename, :content_type, :status, :blob_key, :owner)`,
+		"model":      `INSERT INTO model (uuid, algo, timestamp_upload, checksum, size, filename, content_type, status, blob_key, owner) VALUES (:uuid, :algo, :timestamp_upload, :checksum, :size, :filename, :content_type, :status, :blob_key, :owner)`,
+		"data":       `INSERT INTO data (uuid, timestamp_upload, checksum, size, filename, content_type, status, blob_key, owner) VALUES (:uuid, :timestamp_upload, :checksum, :size, :filename, :content_type, :status, :blob_key, :owner)`,
+		"prediction": `INSERT INTO prediction (uuid, timestamp_upload, checksum, size, filename, content_type, status, blob_key, owner) VALUES (:uuid, :timestamp_upload, :checksum, :size, :filename, :content_type, :status, :blob_key, :owner)`,
 	}
+	// List queries are completed with an optional WHERE clause and an ORDER BY
+	// clause built from whitelisted columns (see sortColumns and listQuery)
 	selectTemplates = map[string]string{
-		"problem":    "SELECT * FROM problem ORDER BY timestamp_upload DESC LIMIT %d OFFSET %d",
-		"algo":       "SELECT * FROM algo ORDER BY timestamp_upload DESC LIMIT %d OFFSET %d",
-		"model":      "SELECT * FROM model ORDER BY timestamp_upload DESC LIMIT %d OFFSET %d",
-		"data":       "SELECT * FROM data ORDER BY timestamp_upload DESC LIMIT %d OFFSET %d",
-		"prediction": "SELECT * FROM prediction ORDER BY timestamp_upload DESC LIMIT %d OFFSET %d",
+		"problem":    "SELECT * FROM problem %s ORDER BY %s LIMIT ? OFFSET ?",
+		"algo":       "SELECT * FROM algo %s ORDER BY %s LIMIT ? OFFSET ?",
+		"model":      "SELECT * FROM model %s ORDER BY %s LIMIT ? OFFSET ?",
+		"data":       "SELECT * FROM data %s ORDER BY %s LIMIT ? OFFSET ?",
+		"prediction": "SELECT * FROM prediction %s ORDER BY %s LIMIT ? OFFSET ?",
 	}
+	countStatements = map[string]string{
+		"problem":    `SELECT COUNT(*) FROM problem %s`,
+		"algo":       `SELECT COUNT(*) FROM algo %s`,
+		"model":      `SELECT COUNT(*) FROM model %s`,
+		"data":       `SELECT COUNT(*) FROM data %s`,
+		"prediction": `SELECT COUNT(*) FROM prediction %s`,
+	}
+	// $2 is true to include resources in the trash
 	getOneStatements = map[string]string{
-		"problem":    `SELECT * FROM problem WHERE uuid=$1 LIMIT 1`,
-		"algo":       `SELECT * FROM algo WHERE uuid=$1 LIMIT 1`,
-		"model":      `SELECT * FROM model WHERE uuid=$1 LIMIT 1`,
-		"data":       `SELECT * FROM data WHERE uuid=$1 LIMIT 1`,
-		"prediction": `SELECT * FROM prediction WHERE uuid=$1 LIMIT 1`,
+		"problem":    `SELECT * FROM problem WHERE uuid=$1 AND status='committed' AND ($2 OR deleted_at IS NULL) LIMIT 1`,
+		"algo":       `SELECT * FROM algo WHERE uuid=$1 AND status='committed' AND ($2 OR deleted_at IS NULL) LIMIT 1`,
+		"model":      `SELECT * FROM model WHERE uuid=$1 AND status='committed' AND ($2 OR deleted_at IS NULL) LIMIT 1`,
+		"data":       `SELECT * FROM data WHERE uuid=$1 AND status='committed' AND ($2 OR deleted_at IS NULL) LIMIT 1`,
+		"prediction": `SELECT * FROM prediction WHERE uuid=$1 AND status='committed' AND ($2 OR deleted_at IS NULL) LIMIT 1`,
+	}
+	trashStatements = map[string]string{
+		"problem":    `UPDATE problem SET deleted_at=$1 WHERE uuid=$2 AND deleted_at IS NULL`,
+		"algo":       `UPDATE algo SET deleted_at=$1 WHERE uuid=$2 AND deleted_at IS NULL`,
+		"model":      `UPDATE model SET deleted_at=$1 WHERE uuid=$2 AND deleted_at IS NULL`,
+		"data":       `UPDATE data SET deleted_at=$1 WHERE uuid=$2 AND deleted_at IS NULL`,
+		"prediction": `UPDATE prediction SET deleted_at=$1 WHERE uuid=$2 AND deleted_at IS NULL`,
+	}
+	restoreStatements = map[string]string{
+		"problem":    `UPDATE problem SET deleted_at=NULL WHERE uuid=$1 AND deleted_at IS NOT NULL`,
+		"algo":       `UPDATE algo SET deleted_at=NULL WHERE uuid=$1 AND deleted_at IS NOT NULL`,
+		"model":      `UPDATE model SET deleted_at=NULL WHERE uuid=$1 AND deleted_at IS NOT NULL`,
+		"data":       `UPDATE data SET deleted_at=NULL WHERE uuid=$1 AND deleted_at IS NOT NULL`,
+		"prediction": `UPDATE prediction SET deleted_at=NULL WHERE uuid=$1 AND deleted_at IS NOT NULL`,
+	}
+	trashedStatements = map[string]string{
+		"problem":    `SELECT uuid FROM problem WHERE deleted_at < $1`,
+		"algo":       `SELECT uuid FROM algo WHERE deleted_at < $1`,
+		"model":      `SELECT uuid FROM model WHERE deleted_at < $1`,
+		"data":       `SELECT uuid FROM data WHERE deleted_at < $1`,
+		"prediction": `SELECT uuid FROM prediction WHERE deleted_at < $1`,
+	}
+	// Until they are committed, resources record the last activity of their
+	// blob transfer in timestamp_upload (see Touch)
+	touchStatements = map[string]string{
+		"problem":    `UPDATE problem SET timestamp_upload=$1 WHERE uuid=$2 AND status='pending'`,
+		"algo":       `UPDATE algo SET timestamp_upload=$1 WHERE uuid=$2 AND status='pending'`,
+		"model":      `UPDATE model SET timestamp_upload=$1 WHERE uuid=$2 AND status='pending'`,
+		"data":       `UPDATE data SET timestamp_upload=$1 WHERE uuid=$2 AND status='pending'`,
+		"prediction": `UPDATE prediction SET timestamp_upload=$1 WHERE uuid=$2 AND status='pending'`,
+	}
+	pendingStatements = map[string]string{
+		"problem":    `SELECT uuid FROM problem WHERE status='pending' AND timestamp_upload < $1`,
+		"algo":       `SELECT uuid FROM algo WHERE status='pending' AND timestamp_upload < $1`,
+		"model":      `SELECT uuid FROM model WHERE status='pending' AND timestamp_upload < $1`,
+		"data":       `SELECT uuid FROM data WHERE status='pending' AND timestamp_upload < $1`,
+		"prediction": `SELECT uuid FROM prediction WHERE status='pending' AND timestamp_upload < $1`,
+	}
+	// Resources whose blob is stored under their UUID (see BlobLayoutUUID)
+	legacyBlobStatements = map[string]string{
+		"problem":    `SELECT uuid FROM problem WHERE status='committed' AND blob_key=''`,
+		"algo":       `SELECT uuid FROM algo WHERE status='committed' AND blob_key=''`,
+		"model":      `SELECT uuid FROM model WHERE status='committed' AND blob_key=''`,
+		"data":       `SELECT uuid FROM data WHERE status='committed' AND blob_key=''`,
+		"prediction": `SELECT uuid FROM prediction WHERE status='committed' AND blob_key=''`,
+	}
+	existsStatements = map[string]string{
+		"problem":    `SELECT EXISTS (SELECT 1 FROM problem WHERE uuid=$1)`,
+		"algo":       `SELECT EXISTS (SELECT 1 FROM algo WHERE uuid=$1)`,
+		"model":      `SELECT EXISTS (SELECT 1 FROM model WHERE uuid=$1)`,
+		"data":       `SELECT EXISTS (SELECT 1 FROM data WHERE uuid=$1)`,
+		"prediction": `SELECT EXISTS (SELECT 1 FROM prediction WHERE uuid=$1)`,
+	}
+	committedStatements = map[string]string{
+		"problem":    `SELECT uuid FROM problem WHERE status='committed'`,
+		"algo":       `SELECT uuid FROM algo WHERE status='committed'`,
+		"model":      `SELECT uuid FROM model WHERE status='committed'`,
+		"data":       `SELECT uuid FROM data WHERE status='committed'`,
+		"prediction": `SELECT uuid FROM prediction WHERE status='committed'`,
+	}
+	deleteStatements = map[string]string{
+		"problem":    `DELETE FROM problem WHERE uuid=$1`,
+		"algo":       `DELETE FROM algo WHERE uuid=$1`,
+		"model":      `DELETE FROM model WHERE uuid=$1`,
+		"data":       `DELETE FROM data WHERE uuid=$1`,
+		"prediction": `DELETE FROM prediction WHERE uuid=$1`,
+	}
+	// Rows of other tables pointing at a given instance, those in the trash
+	// included if $2 is true. Models without any entry here can't be
+	// referenced.
+	referenceStatements = map[string]string{
+		"algo": `SELECT COUNT(*) FROM model WHERE algo=$1 AND ($2 OR deleted_at IS NULL)`,
 	}
 	updateStatements = map[string]string{
-		"problem": `UPDATE problem SET uuid=:ID, timestamp_upload=:TimestampUpload, name=:Name, description=:Description WHERE uuid=:prev_uuid`,
+		"problem":    `UPDATE problem SET uuid=:uuid, timestamp_upload=:timestamp_upload, name=:name, description=:description, checksum=:checksum, size=:size, filename=:filename, content_type=:content_type, status=:status, blob_key=:blob_key WHERE uuid=:prev_uuid`,
+		"algo":       `UPDATE algo SET uuid=:uuid, timestamp_upload=:timestamp_upload, name=:name, checksum=:checksum, size=:size, filename=:filename, content_type=:content_type, status=:status, blob_key=:blob_key WHERE uuid=:prev_uuid`,
+		"model":      `UPDATE model SET uuid=:uuid, algo=:algo, timestamp_upload=:timestamp_upload, checksum=:checksum, size=:size, filename=:filename, content_type=:content_type, status=:status, blob_key=:blob_key WHERE uuid=:prev_uuid`,
+		"data":       `UPDATE data SET uuid=:uuid, timestamp_upload=:timestamp_upload, checksum=:checksum, size=:size, filename=:filename, content_type=:content_type, status=:status, blob_key=:blob_key WHERE uuid=:prev_uuid`,
+		"prediction": `UPDATE prediction SET uuid=:uuid, timestamp_upload=:timestamp_upload, checksum=:checksum, size=:size, filename=:filename, content_type=:content_type, status=:status, blob_key=:blob_key WHERE uuid=:prev_uuid`,
+	}
+
+	// Columns each model can be sorted by in list queries
+	sortColumns = map[string]map[string]struct{}{
+		"problem":    {"timestamp_upload": struct{}{}, "uuid": struct{}{}, "name": struct{}{}},
+		"algo":       {"timestamp_upload": struct{}{}, "uuid": struct{}{}, "name": struct{}{}},
+		"model":      {"timestamp_upload": struct{}{}, "uuid": struct{}{}},
+		"data":       {"timestamp_upload": struct{}{}, "uuid": struct{}{}},
+		"prediction": {"timestamp_upload": struct{}{}, "uuid": struct{}{}},
 	}
 
 	// Valid model names
@@ -92,13 +195,131 @@ var (
 	}
 )
 
-// Model contains methods to interact with models stored in base
+// Default list query parameters
+const (
+	DefaultPageSize  = 30
+	MaxPageSize      = 500
+	DefaultSortField = "timestamp_upload"
+	DefaultSortOrder = "desc"
+)
+
+// Cursor identifies the last item of a page for keyset pagination. Items are
+// then ordered by (timestamp_upload, uuid), which is indexed on every table.
+type Cursor struct {
+	TimestampUpload int64
+	ID              uuid.UUID
+	Order           string
+}
+
+// ListOptions holds the pagination, ordering and filtering parameters of a list
+// query. If After is set, Page is ignored and the items following the cursor
+// are listed instead.
+type ListOptions struct {
+	Page           int
+	PageSize       int
+	Sort           string
+	Order          string
+	After          *Cursor
+	IncludeDeleted bool
+	Owner          string
+}
+
+// NewListOptions returns the default list options: first page, newest first
+func NewListOptions() ListOptions {
+	return ListOptions{
+		Page:     0,
+		PageSize: DefaultPageSize,
+		Sort:     DefaultSortField,
+		Order:    DefaultSortOrder,
+	}
+}
+
+// CheckListOptions makes sure list options are valid for a given model. Since
+// the sort column and order are formatted in the SQL query, this check is
+// mandatory before running any list query.
+func CheckListOptions(modelName string, opts ListOptions) error {
+	columns, ok := sortColumns[modelName]
+	if !ok {
+		return fmt.Errorf("Unknown model %s", modelName)
+	}
+	if _, ok := columns[opts.Sort]; !ok {
+		return fmt.Errorf("Invalid sort field '%s' for %s", opts.Sort, modelName)
+	}
+	if opts.Order != "asc" && opts.Order != "desc" {
+		return fmt.Errorf("Invalid sort order '%s': should be 'asc' or 'desc'", opts.Order)
+	}
+	if opts.Page < 0 {
+		return fmt.Errorf("Invalid page %d: should be positive", opts.Page)
+	}
+	if opts.PageSize < 1 || opts.PageSize > MaxPageSize {
+		return fmt.Errorf("Invalid page size %d: should be between 1 and %d", opts.PageSize, MaxPageSize)
+	}
+	if opts.After != nil && opts.Sort != "timestamp_upload" {
+		return fmt.Errorf("Invalid sort field '%s': cursors can only be used when sorting by timestamp_upload", opts.Sort)
+	}
+	return nil
+}
+
+// listFilters returns the conditions (and their arguments) restricting the rows
+// both listed and counted by list queries
+func listFilters(opts ListOptions) (conditions []string, args []interface{}) {
+	conditions = append(conditions, "status = 'committed'")
+	if !opts.IncludeDeleted {
+		conditions = append(conditions, "deleted_at IS NULL")
+	}
+	if opts.Owner != "" {
+		conditions = append(conditions, "owner = ?")
+		args = append(args, opts.Owner)
+	}
+	return
+}
+
+// whereClause joins SQL conditions in a WHERE clause
+func whereClause(conditions []string) string {
+	if len(conditions) == 0 {
+		return ""
+	}
+	return "WHERE " + strings.Join(conditions, " AND ")
+}
+
+// listQuery returns the WHERE clause, ORDER BY clause and arguments of a list
+// query. opts must have been checked with CheckListOptions beforehand.
+func listQuery(opts ListOptions) (where string, orderBy string, args []interface{}) {
+	conditions, args := listFilters(opts)
+	orderBy = fmt.Sprintf("%[1]s %[2]s, uuid %[2]s", opts.Sort, opts.Order)
+	offset := opts.Page * opts.PageSize
+	if opts.After != nil {
+		comparison := "<"
+		if opts.Order == "asc" {
+			comparison = ">"
+		}
+		conditions = append(conditions, fmt.Sprintf("(timestamp_upload, uuid) %s (?, ?)", comparison))
+		args = append(args, opts.After.TimestampUpload, opts.After.ID)
+		offset = 0
+	}
+	args = append(args, opts.PageSize, offset)
+	return whereClause(conditions), orderBy, args
+}
+
+// Model contains methods to interact with models stored in base. Queries run
+// in the context of the request or job they are made for, carrying its span
+// (see TracedModel).
 type Model interface {
-	Insert(instance interface{}) error
-	List(instanceList interface{}, page, pageSize int) error
-	GetOne(instance interface{}, id uuid.UUID) error
-	Update(instance interface{}, id uuid.UUID) error
-	CheckUUIDNotUsed(id uuid.UUID) error
+	Insert(ctx context.Context, instance interface{}) error
+	List(ctx context.Context, instanceList interface{}, opts ListOptions) error
+	Count(ctx context.Context, opts ListOptions) (int, error)
+	GetOne(ctx context.Context, instance interface{}, id uuid.UUID, includeDeleted bool) error
+	Update(ctx context.Context, instance interface{}, id uuid.UUID) error
+	Delete(ctx context.Context, id uuid.UUID) error
+	Trash(ctx context.Context, id uuid.UUID) error
+	Restore(ctx context.Context, id uuid.UUID) error
+	ListTrashed(ctx context.Context, before time.Time) ([]uuid.UUID, error)
+	Touch(ctx context.Context, id uuid.UUID) error
+	ListPending(ctx context.Context, before time.Time) ([]uuid.UUID, error)
+	ListLegacyBlobs(ctx context.Context) ([]uuid.UUID, error)
+	ListCommitted(ctx context.Context) ([]uuid.UUID, error)
+	CountReferences(ctx context.Context, id uuid.UUID, includeDeleted bool) (int, error)
+	CheckUUIDNotUsed(ctx context.Context, id uuid.UUID) error
 	GetModelName() string
 }
 
@@ -118,9 +339,9 @@ func NewSQLModel(db *sqlx.DB, name string) (*SQLModel, error) {
 }
 
 // Insert inserts a given model instance in base
-func (m *SQLModel) Insert(instance interface{}) error {
+func (m *SQLModel) Insert(ctx context.Context, instance interface{}) error {
 	if insertStatement, ok := insertStatements[m.name]; ok {
-		if _, err := m.NamedExec(insertStatement, instance); err != nil {
+		if _, err := m.NamedExecContext(ctx, insertStatement, instance); err != nil {
 			return err
 		}
 	} else {
@@ -129,10 +350,15 @@ func (m *SQLModel) Insert(instance interface{}) error {
 	return nil
 }
 
-// List lists all model instances in base, pagination included
-func (m *SQLModel) List(instanceList interface{}, page, pageSize int) error {
+// List lists all model instances in base, pagination and ordering included
+func (m *SQLModel) List(ctx context.Context, instanceList interface{}, opts ListOptions) error {
+	if err := CheckListOptions(m.name, opts); err != nil {
+		return fmt.Errorf("[model] %s", err)
+	}
 	if selectTemplate, ok := selectTemplates[m.name]; ok {
-		if err := m.Select(instanceList, fmt.Sprintf(selectTemplate, pageSize, page*pageSize)); err != nil {
+		where, orderBy, args := listQuery(opts)
+		query := m.Rebind(fmt.Sprintf(selectTemplate, where, orderBy))
+		if err := m.SelectContext(ctx, instanceList, query, args...); err != nil {
 			return fmt.Errorf("[model] Error retrieving %s list from database: %s", m.name, err)
 		}
 	} else {
@@ -141,10 +367,27 @@ func (m *SQLModel) List(instanceList interface{}, page, pageSize int) error {
 	return nil
 }
 
-// GetOne retrieves a model instance in base using its uuid
-func (m *SQLModel) GetOne(instance interface{}, id uuid.UUID) error {
+// Count returns the total number of model instances in base matching the list
+// options filters
+func (m *SQLModel) Count(ctx context.Context, opts ListOptions) (int, error) {
+	var total int
+	if countStatement, ok := countStatements[m.name]; ok {
+		conditions, args := listFilters(opts)
+		query := m.Rebind(fmt.Sprintf(countStatement, whereClause(conditions)))
+		if err := m.GetContext(ctx, &total, query, args...); err != nil {
+			return 0, fmt.Errorf("[model] Error counting %s in database: %s", m.name, err)
+		}
+	} else {
+		return 0, fmt.Errorf("[model] No count statement found for model %s", m.name)
+	}
+	return total, nil
+}
+
+// GetOne retrieves a model instance in base using its uuid. Instances in the
+// trash are only retrieved if includeDeleted is true.
+func (m *SQLModel) GetOne(ctx context.Context, instance interface{}, id uuid.UUID, includeDeleted bool) error {
 	if getOneStatement, ok := getOneStatements[m.name]; ok {
-		if err := m.Get(instance, getOneStatement, id); err != nil {
+		if err := m.GetContext(ctx, instance, getOneStatement, id, includeDeleted); err != nil {
 			return fmt.Errorf("[model] Error retrieving %s %s from database: %s", m.name, id, err)
 		}
 	} else {
@@ -154,26 +397,147 @@ func (m *SQLModel) GetOne(instance interface{}, id uuid.UUID) error {
 }
 
 // Update changes a model instance in base using its uuid
-func (m *SQLModel) Update(instance interface{}, id uuid.UUID) error {
-	instanceMap := structs.Map(instance)
+func (m *SQLModel) Update(ctx context.Context, instance interface{}, id uuid.UUID) error {
+	// Named parameters are the instance's db field names, embedded structs
+	// included
+	instanceMap := make(map[string]interface{})
+	for name, field := range m.Mapper.FieldMap(reflect.Indirect(reflect.ValueOf(instance))) {
+		instanceMap[name] = field.Interface()
+	}
 	instanceMap["prev_uuid"] = id
 	if updateStatements, ok := updateStatements[m.name]; ok {
-		if _, err := m.NamedExec(updateStatements, instanceMap); err != nil {
+		res, err := m.NamedExecContext(ctx, updateStatements, instanceMap)
+		if err != nil {
 			return fmt.Errorf("[model] Error updating %s from database: %s", m.name, err)
 		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			return fmt.Errorf("[model] Error updating %s %s: %s", m.name, id, sql.ErrNoRows)
+		}
 	} else {
 		return fmt.Errorf("[model] No update statement found for model %s", m.name)
 	}
 	return nil
 }
 
-// CheckUUIDNotUsed checks if the UUID is alraedy used
-func (m *SQLModel) CheckUUIDNotUsed(id uuid.UUID) error {
-	rows, err := m.Queryx(fmt.Sprintf(`SELECT * FROM %s WHERE uuid='%s';`, m.name, id))
+// Delete removes a model instance from base for good using its uuid
+func (m *SQLModel) Delete(ctx context.Context, id uuid.UUID) error {
+	return m.execOne(ctx, deleteStatements, "delete", id, id)
+}
+
+// Trash moves a model instance to the trash. It is then hidden from List and
+// GetOne until it is either restored or deleted for good.
+func (m *SQLModel) Trash(ctx context.Context, id uuid.UUID) error {
+	return m.execOne(ctx, trashStatements, "trash", id, time.Now().Unix(), id)
+}
+
+// Restore moves a model instance out of the trash
+func (m *SQLModel) Restore(ctx context.Context, id uuid.UUID) error {
+	return m.execOne(ctx, restoreStatements, "restore", id, id)
+}
+
+// ListTrashed returns the UUIDs of the model instances moved to the trash before
+// a given date
+func (m *SQLModel) ListTrashed(ctx context.Context, before time.Time) ([]uuid.UUID, error) {
+	trashedStatement, ok := trashedStatements[m.name]
+	if !ok {
+		return nil, fmt.Errorf("[model] No trashed statement found for model %s", m.name)
+	}
+	ids := []uuid.UUID{}
+	if err := m.SelectContext(ctx, &ids, trashedStatement, before.Unix()); err != nil {
+		return nil, fmt.Errorf("[model] Error retrieving trashed %s from database: %s", m.name, err)
+	}
+	return ids, nil
+}
+
+// Touch records activity on the blob transfer of a pending model instance
+func (m *SQLModel) Touch(ctx context.Context, id uuid.UUID) error {
+	return m.execOne(ctx, touchStatements, "touch", id, time.Now().Unix(), id)
+}
+
+// ListPending returns the UUIDs of the model instances still pending, whose
+// blob transfer showed no activity since a given date
+func (m *SQLModel) ListPending(ctx context.Context, before time.Time) ([]uuid.UUID, error) {
+	pendingStatement, ok := pendingStatements[m.name]
+	if !ok {
+		return nil, fmt.Errorf("[model] No pending statement found for model %s", m.name)
+	}
+	ids := []uuid.UUID{}
+	if err := m.SelectContext(ctx, &ids, pendingStatement, before.Unix()); err != nil {
+		return nil, fmt.Errorf("[model] Error retrieving pending %s from database: %s", m.name, err)
+	}
+	return ids, nil
+}
+
+// ListLegacyBlobs returns the UUIDs of the model instances whose blob is stored
+// under their UUID rather than their checksum
+func (m *SQLModel) ListLegacyBlobs(ctx context.Context) ([]uuid.UUID, error) {
+	legacyBlobStatement, ok := legacyBlobStatements[m.name]
+	if !ok {
+		return nil, fmt.Errorf("[model] No legacy blob statement found for model %s", m.name)
+	}
+	ids := []uuid.UUID{}
+	if err := m.SelectContext(ctx, &ids, legacyBlobStatement); err != nil {
+		return nil, fmt.Errorf("[model] Error retrieving %s with legacy blobs from database: %s", m.name, err)
+	}
+	return ids, nil
+}
+
+// ListCommitted returns the UUIDs of all the committed model instances, those in
+// the trash included
+func (m *SQLModel) ListCommitted(ctx context.Context) ([]uuid.UUID, error) {
+	committedStatement, ok := committedStatements[m.name]
+	if !ok {
+		return nil, fmt.Errorf("[model] No committed statement found for model %s", m.name)
+	}
+	ids := []uuid.UUID{}
+	if err := m.SelectContext(ctx, &ids, committedStatement); err != nil {
+		return nil, fmt.Errorf("[model] Error retrieving committed %s from database: %s", m.name, err)
+	}
+	return ids, nil
+}
+
+// execOne runs a statement that should change exactly one model instance
+func (m *SQLModel) execOne(ctx context.Context, statements map[string]string, action string, id uuid.UUID, args ...interface{}) error {
+	statement, ok := statements[m.name]
+	if !ok {
+		return fmt.Errorf("[model] No %s statement found for model %s", action, m.name)
+	}
+	res, err := m.ExecContext(ctx, statement, args...)
 	if err != nil {
+		return fmt.Errorf("[model] Error running %s on %s %s: %s", action, m.name, id, err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("[model] Error running %s on %s %s: %s", action, m.name, id, sql.ErrNoRows)
+	}
+	return nil
+}
+
+// CountReferences returns the number of rows in other tables pointing at a
+// given model instance. Rows in the trash are only counted if includeDeleted is
+// true.
+func (m *SQLModel) CountReferences(ctx context.Context, id uuid.UUID, includeDeleted bool) (int, error) {
+	referenceStatement, ok := referenceStatements[m.name]
+	if !ok {
+		return 0, nil
+	}
+	var n int
+	if err := m.GetContext(ctx, &n, referenceStatement, id, includeDeleted); err != nil {
+		return 0, fmt.Errorf("[model] Error counting references to %s %s in database: %s", m.name, id, err)
+	}
+	return n, nil
+}
+
+// CheckUUIDNotUsed checks if the UUID is alraedy used
+func (m *SQLModel) CheckUUIDNotUsed(ctx context.Context, id uuid.UUID) error {
+	existsStatement, ok := existsStatements[m.name]
+	if !ok {
+		return fmt.Errorf("[model] No exists statement found for model %s", m.name)
+	}
+	var exists bool
+	if err := m.GetContext(ctx, &exists, existsStatement, id); err != nil {
 		return fmt.Errorf("[model] Error retrieving %s %s from database: %s", m.name, id, err)
 	}
-	if rows.Next() {
+	if exists {
 		return fmt.Errorf("[model] UUID %s already exist in table '%s'", id, m.name)
 	}
 	return nil
@@ -198,7 +562,7 @@ func NewMockedModel(name string) (*MockedModel, error) {
 }
 
 // Insert inserts a given model instance in base
-func (m *MockedModel) Insert(instance interface{}) error {
+func (m *MockedModel) Insert(ctx context.Context, instance interface{}) error {
 	if _, ok := insertStatements[m.name]; ok {
 	} else {
 		return fmt.Errorf("[model] No insert statement found for model %s", m.name)
@@ -206,8 +570,11 @@ func (m *MockedModel) Insert(instance interface{}) error {
 	return nil
 }
 
-// List lists all model instances in base, pagination included
-func (m *MockedModel) List(instanceList interface{}, page, pageSize int) error {
+// List lists all model instances in base, pagination and ordering included
+func (m *MockedModel) List(ctx context.Context, instanceList interface{}, opts ListOptions) error {
+	if err := CheckListOptions(m.name, opts); err != nil {
+		return fmt.Errorf("[model] %s", err)
+	}
 	if _, ok := selectTemplates[m.name]; ok {
 	} else {
 		return fmt.Errorf("[model] No list select statement template found for model %s", m.name)
@@ -215,8 +582,19 @@ func (m *MockedModel) List(instanceList interface{}, page, pageSize int) error {
 	return nil
 }
 
-// GetOne retrieves a model instance in base using its uuid
-func (m *MockedModel) GetOne(instance interface{}, id uuid.UUID) error {
+// Count returns the total number of model instances in base matching the list
+// options filters
+func (m *MockedModel) Count(ctx context.Context, opts ListOptions) (int, error) {
+	if _, ok := countStatements[m.name]; ok {
+	} else {
+		return 0, fmt.Errorf("[model] No count statement found for model %s", m.name)
+	}
+	return 0, nil
+}
+
+// GetOne retrieves a model instance in base using its uuid. Instances in the
+// trash are only retrieved if includeDeleted is true.
+func (m *MockedModel) GetOne(ctx context.Context, instance interface{}, id uuid.UUID, includeDeleted bool) error {
 	if _, ok := getOneStatements[m.name]; ok {
 	} else {
 		return fmt.Errorf("[model] No get one statement found for model %s", m.name)
@@ -224,6 +602,28 @@ func (m *MockedModel) GetOne(instance interface{}, id uuid.UUID) error {
 	if id.String() == DevilMockUUID {
 		return fmt.Errorf("[model] Runnin' With the Devil! sql: no rows in result set")
 	}
+	if id.String() == TrashedMockUUIDStr {
+		if !includeDeleted {
+			return fmt.Errorf("[model] Trashed! sql: no rows in result set")
+		}
+		deletedAt := time.Now().Unix()
+		if field := reflect.ValueOf(instance).Elem().FieldByName("DeletedAt"); field.IsValid() {
+			field.Set(reflect.ValueOf(&deletedAt))
+		}
+		// The model in the trash uses the algo in the trash
+		if model, ok := instance.(*ModelResource); ok {
+			model.Algo = uuid.FromStringOrNil(TrashedMockUUIDStr)
+		}
+		return nil
+	}
+	if id.String() == OwnedMockUUIDStr {
+		i := reflect.ValueOf(instance).Elem()
+		i.FieldByName("ID").Set(reflect.ValueOf(id))
+		if owner := i.FieldByName("Owner"); owner.IsValid() {
+			owner.SetString(MockOwner)
+		}
+		return nil
+	}
 	if id.String() == ProblemMockUUIDStr {
 		ProblemMockUUID, _ := uuid.FromString(ProblemMockUUIDStr)
 
@@ -234,21 +634,117 @@ func (m *MockedModel) GetOne(instance interface{}, id uuid.UUID) error {
 		i := reflect.ValueOf(instance).Elem()
 		i.FieldByName("ID").Set(reflect.ValueOf(u))
 		u = uuid.NewV4()
-		i.FieldByName("Name").SetString("testName")
-		i.FieldByName("Description").SetString("testDescription")
+		if name := i.FieldByName("Name"); name.IsValid() {
+			name.SetString("testName")
+		}
+		if description := i.FieldByName("Description"); description.IsValid() {
+			description.SetString("testDescription")
+		}
+		if checksum := i.FieldByName("Checksum"); checksum.IsValid() {
+			checksum.SetString(ProblemMockChecksum)
+		}
 
 		return nil
 	}
+
+	// Other instances exist, with the UUID they are looked up with
+	reflect.ValueOf(instance).Elem().FieldByName("ID").Set(reflect.ValueOf(id))
 	return nil
 }
 
 // Update updates a model instance in base using its uuid
-func (m *MockedModel) Update(instance interface{}, id uuid.UUID) error {
+func (m *MockedModel) Update(ctx context.Context, instance interface{}, id uuid.UUID) error {
+	if _, ok := updateStatements[m.name]; !ok {
+		return fmt.Errorf("[model] No update statement found for model %s", m.name)
+	}
+	if resource, ok := instance.(StoredResource); ok && resource.GetUUID().String() == DevilMockUUID {
+		return fmt.Errorf("[model] Runnin' With the Devil! pq: duplicate key value violates unique constraint")
+	}
 	return nil
 }
 
+// Delete removes a model instance from base using its uuid
+func (m *MockedModel) Delete(ctx context.Context, id uuid.UUID) error {
+	if _, ok := deleteStatements[m.name]; !ok {
+		return fmt.Errorf("[model] No delete statement found for model %s", m.name)
+	}
+	if id.String() == DevilMockUUID {
+		return fmt.Errorf("[model] Runnin' With the Devil! sql: no rows in result set")
+	}
+	return nil
+}
+
+// Trash moves a model instance to the trash
+func (m *MockedModel) Trash(ctx context.Context, id uuid.UUID) error {
+	if id.String() == DevilMockUUID || id.String() == TrashedMockUUIDStr {
+		return fmt.Errorf("[model] Runnin' With the Devil! sql: no rows in result set")
+	}
+	return nil
+}
+
+// Restore moves a model instance out of the trash
+func (m *MockedModel) Restore(ctx context.Context, id uuid.UUID) error {
+	if id.String() != TrashedMockUUIDStr {
+		return fmt.Errorf("[model] Not in the trash! sql: no rows in result set")
+	}
+	return nil
+}
+
+// ListTrashed returns the UUIDs of the model instances moved to the trash before
+// a given date
+func (m *MockedModel) ListTrashed(ctx context.Context, before time.Time) ([]uuid.UUID, error) {
+	if _, ok := trashedStatements[m.name]; !ok {
+		return nil, fmt.Errorf("[model] No trashed statement found for model %s", m.name)
+	}
+	return []uuid.UUID{uuid.FromStringOrNil(TrashedMockUUIDStr)}, nil
+}
+
+// Touch records activity on the blob transfer of a pending model instance
+func (m *MockedModel) Touch(ctx context.Context, id uuid.UUID) error {
+	if _, ok := touchStatements[m.name]; !ok {
+		return fmt.Errorf("[model] No touch statement found for model %s", m.name)
+	}
+	return nil
+}
+
+// ListPending returns no UUID: mocked uploads never stay pending
+func (m *MockedModel) ListPending(ctx context.Context, before time.Time) ([]uuid.UUID, error) {
+	if _, ok := pendingStatements[m.name]; !ok {
+		return nil, fmt.Errorf("[model] No pending statement found for model %s", m.name)
+	}
+	return []uuid.UUID{}, nil
+}
+
+// ListLegacyBlobs returns no UUID: mocked blobs are never migrated
+func (m *MockedModel) ListLegacyBlobs(ctx context.Context) ([]uuid.UUID, error) {
+	if _, ok := legacyBlobStatements[m.name]; !ok {
+		return nil, fmt.Errorf("[model] No legacy blob statement found for model %s", m.name)
+	}
+	return []uuid.UUID{}, nil
+}
+
+// ListCommitted returns no UUID: mocked blobs are never rewrapped
+func (m *MockedModel) ListCommitted(ctx context.Context) ([]uuid.UUID, error) {
+	if _, ok := committedStatements[m.name]; !ok {
+		return nil, fmt.Errorf("[model] No committed statement found for model %s", m.name)
+	}
+	return []uuid.UUID{}, nil
+}
+
+// CountReferences returns the number of rows in other tables pointing at a
+// given model instance
+func (m *MockedModel) CountReferences(ctx context.Context, id uuid.UUID, includeDeleted bool) (int, error) {
+	if _, ok := referenceStatements[m.name]; !ok {
+		return 0, nil
+	}
+	if id.String() == AlgoMockUsedUUIDStr || (includeDeleted && id.String() == TrashedMockUUIDStr) {
+		return 1, nil
+	}
+	return 0, nil
+}
+
 // CheckUUIDNotUsed checks if the UUID is alraedy used
-func (m *MockedModel) CheckUUIDNotUsed(id uuid.UUID) error {
+func (m *MockedModel) CheckUUIDNotUsed(ctx context.Context, id uuid.UUID) error {
 	if id.String() == ProblemMockUUIDStr {
 		return fmt.Errorf("[model] UUID %s already exist in table '%s'", id, m.name)
 	}
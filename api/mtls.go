@@ -0,0 +1,195 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+
+	"gopkg.in/kataras/iris.v6"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+)
+
+// ErrCertificateNotMapped is returned for client certificates matching none of
+// the identities of a ClientCertMapping
+var ErrCertificateNotMapped = errors.New("client certificate not mapped to any user")
+
+// NewTLSConfig returns the TLS configuration of the API server. If a client CA
+// is set, clients have to present a certificate signed by it.
+func NewTLSConfig(conf *StorageConfig) (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading server certificate: %s", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if conf.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(conf.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading client CA: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("Error reading client CA %s: no PEM certificate found", conf.ClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// ListenTLS returns a TLS listener configured by NewTLSConfig
+func ListenTLS(conf *StorageConfig) (net.Listener, error) {
+	config, err := NewTLSConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+	return tls.Listen("tcp", fmt.Sprintf("%s:%d", conf.Hostname, conf.Port), config)
+}
+
+// ClientCertMapping maps the identities of client certificates to principals.
+// Identities are read from the certificates in the following order:
+//
+//	uri:<URI SAN>, dns:<DNS SAN>, email:<email SAN>, subject:<subject DN>, cn:<subject common name>
+//
+// and the first one found in the mapping authenticates the client, e.g.:
+//
+//	{
+//	  "dns:compute.morpheo.svc": {"name": "compute", "roles": ["uploader"]},
+//	  "subject:CN=orchestrator,O=Morpheo": {"name": "orchestrator", "roles": ["admin"]}
+//	}
+type ClientCertMapping struct {
+	Identities map[string]Principal
+}
+
+// LoadClientCertMapping reads a JSON client certificate mapping file
+func LoadClientCertMapping(path string) (*ClientCertMapping, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading client certificate mapping: %s", err)
+	}
+	mapping := &ClientCertMapping{}
+	if err = json.Unmarshal(data, &mapping.Identities); err != nil {
+		return nil, fmt.Errorf("Error parsing client certificate mapping %s: %s", path, err)
+	}
+	for identity, p := range mapping.Identities {
+		if p.Name == "" || len(p.Name) > StrFieldMaxLength {
+			return nil, fmt.Errorf("Invalid client certificate mapping %s: invalid name for %s", path, identity)
+		}
+		if err = checkRoles(p.Roles); err != nil {
+			return nil, fmt.Errorf("Invalid client certificate mapping %s: %s", path, err)
+		}
+	}
+	return mapping, nil
+}
+
+// certificateIdentities returns the identities of a certificate, in the order
+// they are looked up in a ClientCertMapping
+func certificateIdentities(cert *x509.Certificate) []string {
+	var identities []string
+	for _, uri := range cert.URIs {
+		identities = append(identities, "uri:"+uri.String())
+	}
+	for _, name := range cert.DNSNames {
+		identities = append(identities, "dns:"+name)
+	}
+	for _, email := range cert.EmailAddresses {
+		identities = append(identities, "email:"+email)
+	}
+	identities = append(identities, "subject:"+cert.Subject.String())
+	if cert.Subject.CommonName != "" {
+		identities = append(identities, "cn:"+cert.Subject.CommonName)
+	}
+	return identities
+}
+
+// ClientCertDefaultRoles are the roles of the principals authenticated by a
+// client certificate when no ClientCertMapping is set: any certificate signed
+// by the client CA grants read-only access.
+var ClientCertDefaultRoles = []string{RoleReader}
+
+// Principal returns the principal authenticated by a (verified) client
+// certificate. Without mapping, the principal is named after the first DNS SAN
+// of the certificate, or its common name, and has the ClientCertDefaultRoles.
+func (m *ClientCertMapping) Principal(cert *x509.Certificate) (*Principal, error) {
+	if m == nil || len(m.Identities) == 0 {
+		name := cert.Subject.CommonName
+		if len(cert.DNSNames) > 0 {
+			name = cert.DNSNames[0]
+		}
+		if name == "" || len(name) > StrFieldMaxLength {
+			return nil, fmt.Errorf("client certificate has no DNS SAN nor common name")
+		}
+		roles := append([]string{}, ClientCertDefaultRoles...)
+		return &Principal{Name: name, Roles: roles}, nil
+	}
+	for _, identity := range certificateIdentities(cert) {
+		if p, ok := m.Identities[identity]; ok {
+			roles := append([]string{}, p.Roles...)
+			return &Principal{Name: p.Name, Roles: roles}, nil
+		}
+	}
+	return nil, ErrCertificateNotMapped
+}
+
+// ClientCertAuthentication returns a middleware authenticating requests with
+// the client certificate verified during the TLS handshake (see NewTLSConfig).
+// The principal it authenticates is stored in the request context (see
+// GetPrincipal).
+func ClientCertAuthentication(mapping *ClientCertMapping) iris.HandlerFunc {
+	return func(c *iris.Context) {
+		state := c.Request.TLS
+		if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+			c.JSON(401, common.NewAPIError("Unauthorized: verified client certificate required"))
+			return
+		}
+		p, err := mapping.Principal(state.VerifiedChains[0][0])
+		if err != nil {
+			c.JSON(401, common.NewAPIError(fmt.Sprintf("Unauthorized: %s", err)))
+			return
+		}
+		c.Set(PrincipalContextKey, p)
+		c.Next()
+	}
+}
@@ -0,0 +1,304 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	gohttptest "net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopkg.in/kataras/iris.v6"
+	"gopkg.in/kataras/iris.v6/adaptors/httprouter"
+
+	. "github.com/MorpheoOrg/morpheo-storage/api"
+)
+
+// testCA is a throwaway certificate authority
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Morpheo test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key}
+}
+
+// issue returns a certificate signed by the CA for template, along with its key
+func (ca *testCA) issue(t *testing.T, template *x509.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeTLSFiles writes the server certificate, its key and the client CA to
+// dir, and returns the matching configuration
+func writeTLSFiles(t *testing.T, dir string, ca *testCA, server tls.Certificate) *StorageConfig {
+	serverKey, _ := x509.MarshalECPrivateKey(server.PrivateKey.(*ecdsa.PrivateKey))
+	writePEM(t, filepath.Join(dir, "server.crt"), "CERTIFICATE", server.Certificate[0])
+	writePEM(t, filepath.Join(dir, "server.key"), "EC PRIVATE KEY", serverKey)
+	writePEM(t, filepath.Join(dir, "ca.crt"), "CERTIFICATE", ca.cert.Raw)
+	return &StorageConfig{
+		CertFile:     filepath.Join(dir, "server.crt"),
+		KeyFile:      filepath.Join(dir, "server.key"),
+		ClientCAFile: filepath.Join(dir, "ca.crt"),
+		AuthMode:     AuthMTLS,
+	}
+}
+
+func TestClientCertMapping(t *testing.T) {
+	ca := newTestCA(t)
+	spiffe, _ := url.Parse("spiffe://morpheo/compute")
+	compute := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "compute", Organization: []string{"Morpheo"}}, DNSNames: []string{"compute.morpheo.svc"}, URIs: []*url.URL{spiffe}}).Leaf
+	orchestrator := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "orchestrator", Organization: []string{"Morpheo"}}}).Leaf
+	unknown := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "devil"}}).Leaf
+
+	// Test certificates are named after their DNS SAN or common name, and
+	// given the default roles, without mapping
+	var mapping *ClientCertMapping
+	if p, err := mapping.Principal(compute); err != nil || p.Name != "compute.morpheo.svc" || len(p.Roles) != 1 || !p.HasRole(RoleReader) {
+		t.Errorf("Wrong unmapped principal for compute: %v (%v)", p, err)
+	}
+	if p, err := mapping.Principal(orchestrator); err != nil || p.Name != "orchestrator" {
+		t.Errorf("Wrong unmapped principal for orchestrator: %v (%v)", p, err)
+	}
+
+	dir, err := ioutil.TempDir("", "mtls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "clients.json")
+	content := `{
+		"uri:spiffe://morpheo/compute": {"name": "compute", "roles": ["uploader"]},
+		"dns:compute.morpheo.svc": {"name": "compute-dns"},
+		"subject:CN=orchestrator,O=Morpheo": {"name": "orchestrator", "roles": ["admin"]}
+	}`
+	if err = ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if mapping, err = LoadClientCertMapping(path); err != nil {
+		t.Fatalf("Error loading client certificate mapping: %s", err)
+	}
+
+	// Test URI SANs go first, then DNS SANs and subjects
+	if p, err := mapping.Principal(compute); err != nil || p.Name != "compute" || !p.HasRole(RoleUploader) {
+		t.Errorf("Wrong mapped principal for compute: %v (%v)", p, err)
+	}
+	if p, err := mapping.Principal(orchestrator); err != nil || p.Name != "orchestrator" || !p.HasRole(RoleAdmin) {
+		t.Errorf("Wrong mapped principal for orchestrator: %v (%v)", p, err)
+	}
+	if _, err := mapping.Principal(unknown); err != ErrCertificateNotMapped {
+		t.Errorf("Unmapped certificates should be rejected, got %v", err)
+	}
+
+	for _, invalid := range []string{`{`, `{"cn:devil": {"name": ""}}`, `{"cn:devil": {"name": "devil", "roles": ["a b"]}}`} {
+		if err = ioutil.WriteFile(path, []byte(invalid), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = LoadClientCertMapping(path); err == nil {
+			t.Errorf("Invalid client certificate mapping accepted: %s", invalid)
+		}
+	}
+}
+
+func TestClientCertTLS(t *testing.T) {
+	ca := newTestCA(t)
+	otherCA := newTestCA(t)
+	server := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "storage"}, IPAddresses: []net.IP{net.ParseIP("127.0.0.1")}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}})
+	client := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "compute"}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	rogue := otherCA.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "compute"}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+
+	dir, err := ioutil.TempDir("", "mtls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config, err := NewTLSConfig(writeTLSFiles(t, dir, ca, server))
+	if err != nil {
+		t.Fatalf("Error creating TLS configuration: %s", err)
+	}
+	if config.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Errorf("Client certificates should be required and verified")
+	}
+
+	var mapping *ClientCertMapping
+	ts := gohttptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := mapping.Principal(r.TLS.VerifiedChains[0][0])
+		if err != nil {
+			http.Error(w, err.Error(), 401)
+			return
+		}
+		fmt.Fprint(w, p.Name)
+	}))
+	ts.TLS = config
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(certificates []tls.Certificate) (string, error) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certificates}}}
+		res, err := client.Get(ts.URL)
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		return string(body), err
+	}
+
+	// Test clients with a certificate signed by the CA are authenticated
+	if name, err := get([]tls.Certificate{client}); err != nil || name != "compute" {
+		t.Errorf("Client with a valid certificate should be authenticated as compute, got %q (%v)", name, err)
+	}
+	// Test clients without certificate or with a certificate signed by another
+	// CA fail the handshake
+	if _, err := get(nil); err == nil {
+		t.Errorf("Client without certificate accepted")
+	}
+	if _, err := get([]tls.Certificate{rogue}); err == nil {
+		t.Errorf("Client with a certificate signed by another CA accepted")
+	}
+}
+
+// TestClientCertDefaultConfiguration runs the API over TLS in mtls mode with
+// the default policy and no client certificate mapping
+func TestClientCertDefaultConfiguration(t *testing.T) {
+	ca := newTestCA(t)
+	server := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "storage"}, IPAddresses: []net.IP{net.ParseIP("127.0.0.1")}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}})
+	client := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "compute"}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+
+	dir, err := ioutil.TempDir("", "mtls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config, err := NewTLSConfig(writeTLSFiles(t, dir, ca, server))
+	if err != nil {
+		t.Fatalf("Error creating TLS configuration: %s", err)
+	}
+
+	api := newTestServer(NewMemoryBlobStore())
+	api.Credentials, api.Tokens = nil, nil
+	app := iris.New()
+	app.Adapt(iris.DevLogger(), httprouter.New())
+	api.ConfigureRoutes(app, ClientCertAuthentication(nil))
+	app.Boot()
+	ts := gohttptest.NewUnstartedServer(app.Router)
+	ts.TLS = config
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{client}}}}
+	do := func(method, route string) int {
+		req, err := http.NewRequest(method, ts.URL+route, bytes.NewReader([]byte("fakefilecontent")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := httpClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error requesting %s %s: %s", method, route, err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	// Test certificates signed by the client CA grant read-only access
+	if status := do("GET", ProblemListRoute); status != 200 {
+		t.Errorf("Listing problems should be allowed, got %d", status)
+	}
+	if status := do("GET", DataListRoute+"/"+RandomUUID.String()); status != 200 {
+		t.Errorf("Getting data should be allowed, got %d", status)
+	}
+	if status := do("POST", DataListRoute); status != 403 {
+		t.Errorf("Uploading data should be forbidden, got %d", status)
+	}
+	if status := do("DELETE", DataListRoute+"/"+RandomUUID.String()); status != 403 {
+		t.Errorf("Deleting data should be forbidden, got %d", status)
+	}
+}
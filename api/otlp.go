@@ -0,0 +1,283 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/instrumentation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// OTLPExportTimeout is how long an OTLP collector is waited for when
+// exporting a batch of spans
+const OTLPExportTimeout = 10 * time.Second
+
+// OTLPExporter sends spans to an OTLP/HTTP collector, JSON encoded (see
+// https://opentelemetry.io/docs/specs/otlp/#otlphttp)
+type OTLPExporter struct {
+	url    string
+	client *http.Client
+}
+
+// NewOTLPExporter creates an exporter sending spans to the collector at
+// endpoint (host:port), over plain HTTP if insecure is true
+func NewOTLPExporter(endpoint string, insecure bool) *OTLPExporter {
+	scheme := "https"
+	if insecure {
+		scheme = "http"
+	}
+	return &OTLPExporter{
+		url:    fmt.Sprintf("%s://%s/v1/traces", scheme, endpoint),
+		client: &http.Client{Timeout: OTLPExportTimeout},
+	}
+}
+
+// ExportSpans sends a batch of spans to the collector
+func (e *OTLPExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	if len(spans) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(newOTLPRequest(spans))
+	if err != nil {
+		return fmt.Errorf("Error encoding spans: %s", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := e.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("Error sending spans to %s: %s", e.url, err)
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("Error sending spans to %s: HTTP %d", e.url, res.StatusCode)
+	}
+	return nil
+}
+
+// Shutdown does nothing: spans are sent as soon as they are exported
+func (e *OTLPExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+// OTLP/JSON messages, following the protobuf JSON mapping: trace and span
+// IDs are hex encoded, and 64 bits integers are strings
+type otlpRequest struct {
+	ResourceSpans []*otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource      `json:"resource"`
+	ScopeSpans []*otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Events            []otlpEvent    `json:"events,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string         `json:"timeUnixNano"`
+	Name         string         `json:"name"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string         `json:"stringValue,omitempty"`
+	BoolValue   *bool           `json:"boolValue,omitempty"`
+	IntValue    *string         `json:"intValue,omitempty"`
+	DoubleValue *float64        `json:"doubleValue,omitempty"`
+	ArrayValue  *otlpArrayValue `json:"arrayValue,omitempty"`
+}
+
+type otlpArrayValue struct {
+	Values []otlpAnyValue `json:"values"`
+}
+
+// OTLP status codes, unlike the OpenTelemetry API ones, put Ok before Error
+var otlpStatusCodes = map[codes.Code]int{
+	codes.Unset: 0,
+	codes.Ok:    1,
+	codes.Error: 2,
+}
+
+// newOTLPRequest groups spans by resource and instrumentation scope
+func newOTLPRequest(spans []sdktrace.ReadOnlySpan) *otlpRequest {
+	request := &otlpRequest{}
+	resources := make(map[*resource.Resource]*otlpResourceSpans)
+	scopes := make(map[*otlpResourceSpans]map[instrumentation.Scope]*otlpScopeSpans)
+	for _, span := range spans {
+		resourceSpans, ok := resources[span.Resource()]
+		if !ok {
+			resourceSpans = &otlpResourceSpans{
+				Resource: otlpResource{Attributes: otlpAttributes(span.Resource().Attributes())},
+			}
+			resources[span.Resource()] = resourceSpans
+			scopes[resourceSpans] = make(map[instrumentation.Scope]*otlpScopeSpans)
+			request.ResourceSpans = append(request.ResourceSpans, resourceSpans)
+		}
+		scope := span.InstrumentationScope()
+		scopeSpans, ok := scopes[resourceSpans][scope]
+		if !ok {
+			scopeSpans = &otlpScopeSpans{Scope: otlpScope{Name: scope.Name, Version: scope.Version}}
+			scopes[resourceSpans][scope] = scopeSpans
+			resourceSpans.ScopeSpans = append(resourceSpans.ScopeSpans, scopeSpans)
+		}
+		scopeSpans.Spans = append(scopeSpans.Spans, newOTLPSpan(span))
+	}
+	return request
+}
+
+func newOTLPSpan(span sdktrace.ReadOnlySpan) otlpSpan {
+	s := otlpSpan{
+		TraceID:           span.SpanContext().TraceID().String(),
+		SpanID:            span.SpanContext().SpanID().String(),
+		Name:              span.Name(),
+		Kind:              int(span.SpanKind()),
+		StartTimeUnixNano: otlpTime(span.StartTime()),
+		EndTimeUnixNano:   otlpTime(span.EndTime()),
+		Attributes:        otlpAttributes(span.Attributes()),
+		Status: otlpStatus{
+			Code:    otlpStatusCodes[span.Status().Code],
+			Message: span.Status().Description,
+		},
+	}
+	if span.Parent().IsValid() {
+		s.ParentSpanID = span.Parent().SpanID().String()
+	}
+	for _, event := range span.Events() {
+		s.Events = append(s.Events, otlpEvent{
+			TimeUnixNano: otlpTime(event.Time),
+			Name:         event.Name,
+			Attributes:   otlpAttributes(event.Attributes),
+		})
+	}
+	return s
+}
+
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func otlpAttributes(attributes []attribute.KeyValue) []otlpKeyValue {
+	var keyValues []otlpKeyValue
+	for _, kv := range attributes {
+		keyValues = append(keyValues, otlpKeyValue{Key: string(kv.Key), Value: otlpValue(kv.Value)})
+	}
+	return keyValues
+}
+
+func otlpValue(v attribute.Value) otlpAnyValue {
+	values := []otlpAnyValue{}
+	switch v.Type() {
+	case attribute.BOOL:
+		b := v.AsBool()
+		return otlpAnyValue{BoolValue: &b}
+	case attribute.INT64:
+		i := strconv.FormatInt(v.AsInt64(), 10)
+		return otlpAnyValue{IntValue: &i}
+	case attribute.FLOAT64:
+		f := v.AsFloat64()
+		return otlpAnyValue{DoubleValue: &f}
+	case attribute.BOOLSLICE:
+		for _, b := range v.AsBoolSlice() {
+			values = append(values, otlpValue(attribute.BoolValue(b)))
+		}
+	case attribute.INT64SLICE:
+		for _, i := range v.AsInt64Slice() {
+			values = append(values, otlpValue(attribute.Int64Value(i)))
+		}
+	case attribute.FLOAT64SLICE:
+		for _, f := range v.AsFloat64Slice() {
+			values = append(values, otlpValue(attribute.Float64Value(f)))
+		}
+	case attribute.STRINGSLICE:
+		for _, s := range v.AsStringSlice() {
+			values = append(values, otlpValue(attribute.StringValue(s)))
+		}
+	default:
+		s := v.Emit()
+		return otlpAnyValue{StringValue: &s}
+	}
+	return otlpAnyValue{ArrayValue: &otlpArrayValue{Values: values}}
+}
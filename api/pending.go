@@ -0,0 +1,174 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// PendingHeartbeat is how often a pending resource is touched while its blob is
+// being uploaded, so that ReconcilePending leaves it alone however long the
+// upload lasts
+const PendingHeartbeat = time.Minute
+
+// insertWithBlob creates a resource along with its blob, in two phases: the
+// resource is inserted as pending, its blob is uploaded, and the resource is
+// then committed along with the blob checksum and size. Each failure undoes the
+// previous steps, and the pending resources left behind by a crash are cleaned
+// up by ReconcilePending.
+func (s *APIServer) insertWithBlob(ctx context.Context, resourceModel Model, resource StoredResource, body io.Reader, size int64, checksum string) (int, error) {
+	modelName := resourceModel.GetModelName()
+	id := resource.GetUUID()
+
+	resource.Meta().Status = ResourcePending
+	if err := resourceModel.Insert(ctx, resource); err != nil {
+		return 500, fmt.Errorf("Error inserting %s %s in database: %s", modelName, id, err)
+	}
+
+	stopHeartbeat := s.keepPending(ctx, resourceModel, id)
+	statusCode, err := s.storeBlob(ctx, modelName, id, body, size, checksum, resource.Meta())
+	stopHeartbeat()
+	if err != nil {
+		s.deletePending(ctx, resourceModel, id)
+		return statusCode, err
+	}
+
+	resource.Meta().Status = ResourceCommitted
+	if err = resourceModel.Update(ctx, resource, id); err != nil {
+		s.abandonBlob(ctx, modelName, resource, "")
+		s.deletePending(ctx, resourceModel, id)
+		return 500, fmt.Errorf("Error committing %s %s in database: %s", modelName, id, err)
+	}
+	s.settleBlob(resource.Meta())
+	return 201, nil
+}
+
+// keepPending touches a pending resource every PendingHeartbeat, until the
+// returned function is called
+func (s *APIServer) keepPending(ctx context.Context, resourceModel Model, id uuid.UUID) func() {
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(PendingHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := resourceModel.Touch(ctx, id); err != nil {
+					log.WithField("component", "reconcile").Errorf("Error touching pending %s %s: %s", resourceModel.GetModelName(), id, err)
+				}
+			}
+		}
+	}()
+	return func() { close(stop) }
+}
+
+// deletePending deletes a pending resource. On failure, it is left to
+// ReconcilePending.
+func (s *APIServer) deletePending(ctx context.Context, resourceModel Model, id uuid.UUID) {
+	if err := resourceModel.Delete(ctx, id); err != nil {
+		log.WithField("component", "reconcile").Warnf("Pending %s %s left in database: %s", resourceModel.GetModelName(), id, err)
+	}
+}
+
+// ReconcilePending deletes the resources that never got committed and whose
+// upload showed no activity since a given date, along with their blob if any.
+// It returns the number of deleted resources.
+func (s *APIServer) ReconcilePending(before time.Time) (int, error) {
+	ctx, span := startJob("ReconcilePending")
+	defer span.End()
+	resourceModels := []Model{s.PredictionModel, s.ModelModel, s.DataModel, s.AlgoModel, s.ProblemModel}
+
+	deleted := 0
+	var lastErr error
+	for _, resourceModel := range resourceModels {
+		modelName := resourceModel.GetModelName()
+		ids, err := resourceModel.ListPending(ctx, before)
+		if err != nil {
+			lastErr = err
+			log.WithField("component", "reconcile").Errorf("Error listing pending %s: %s", modelName, err)
+			continue
+		}
+		for _, id := range ids {
+			// The blob goes first: if the resource can't be deleted, it is
+			// retried on the next run. A missing blob isn't an error here.
+			// A content addressed blob may already be referenced on behalf of
+			// the upload.
+			stagingKey := s.stagingBlobKey(modelName, id)
+			blobStore := s.blobStore(ctx)
+			blobStore.Delete(stagingKey)
+			if err = s.BlobRefs.Abandon(stagingKey, blobStore.Delete); err != nil {
+				lastErr = err
+				log.WithField("component", "reconcile").Errorf("Error releasing blob claimed by pending %s %s: %s", modelName, id, err)
+				continue
+			}
+			if err = resourceModel.Delete(ctx, id); err != nil {
+				lastErr = err
+				log.WithField("component", "reconcile").Errorf("Error deleting pending %s %s from database: %s", modelName, id, err)
+				continue
+			}
+			deleted++
+		}
+	}
+	return deleted, lastErr
+}
+
+// RunPendingReconciler cleans up every interval the resources pending for longer
+// than timeout. It returns when stop is closed.
+func (s *APIServer) RunPendingReconciler(interval, timeout time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			n, err := s.ReconcilePending(time.Now().Add(-timeout))
+			if err != nil {
+				log.WithField("component", "reconcile").Warnf("Pending resources partially cleaned up (%d resource(s) deleted): %s", n, err)
+			} else if n > 0 {
+				log.WithField("component", "reconcile").Infof("%d pending resource(s) deleted", n)
+			}
+		}
+	}
+}
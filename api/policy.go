@@ -0,0 +1,225 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"gopkg.in/kataras/iris.v6"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+)
+
+// Actions roles grant on resources
+const (
+	ActionList     = "list"
+	ActionGet      = "get"
+	ActionDownload = "download"
+	ActionCreate   = "create"
+	ActionPatch    = "patch"
+	ActionDelete   = "delete"
+)
+
+// Roles of the default policy (RoleAdmin is defined along with credentials)
+const (
+	RoleReader       = "reader"
+	RoleUploader     = "uploader"
+	RoleProblemAdmin = "problem-admin"
+)
+
+// policyWildcard stands for any resource or any action in a policy
+const policyWildcard = "*"
+
+var (
+	policyActions   = []string{ActionList, ActionGet, ActionDownload, ActionCreate, ActionPatch, ActionDelete}
+	policyResources = []string{ProblemModelName, AlgoModelName, ModelModelName, DataModelName, PredictionModelName}
+)
+
+// Policy defines the actions each role grants on each resource type, e.g.:
+//
+//	{
+//	  "roles": {
+//	    "reader": {"*": ["list", "get", "download"]},
+//	    "problem-admin": {"problem": ["*"]}
+//	  },
+//	  "default_roles": ["reader"]
+//	}
+//
+// Principals without any role are given the default roles.
+type Policy struct {
+	Roles        map[string]map[string][]string `json:"roles"`
+	DefaultRoles []string                       `json:"default_roles"`
+}
+
+// DefaultPolicy returns the policy used when no policy file is set
+func DefaultPolicy() *Policy {
+	return &Policy{
+		Roles: map[string]map[string][]string{
+			RoleReader:   {policyWildcard: {ActionList, ActionGet, ActionDownload}},
+			RoleUploader: {policyWildcard: {ActionList, ActionGet, ActionDownload, ActionCreate, ActionPatch}},
+			RoleProblemAdmin: {
+				policyWildcard:   {ActionList, ActionGet, ActionDownload},
+				ProblemModelName: {policyWildcard},
+			},
+			RoleAdmin: {policyWildcard: {policyWildcard}},
+		},
+		DefaultRoles: []string{},
+	}
+}
+
+// LoadPolicy reads a JSON policy file
+func LoadPolicy(path string) (*Policy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading policy file: %s", err)
+	}
+	policy := &Policy{}
+	if err = json.Unmarshal(data, policy); err != nil {
+		return nil, fmt.Errorf("Error parsing policy file %s: %s", path, err)
+	}
+	if err = policy.Check(); err != nil {
+		return nil, fmt.Errorf("Invalid policy file %s: %s", path, err)
+	}
+	return policy, nil
+}
+
+// Check makes sure a policy only refers to known resources and actions
+func (p *Policy) Check() error {
+	if len(p.Roles) == 0 {
+		return fmt.Errorf("no role defined")
+	}
+	for role, grants := range p.Roles {
+		if err := checkRoles([]string{role}); err != nil {
+			return err
+		}
+		for resource, actions := range grants {
+			if resource != policyWildcard && !containsString(policyResources, resource) {
+				return fmt.Errorf("role %s: unknown resource %q. Should be one of: %s, %s", role, resource, policyWildcard, strings.Join(policyResources, ", "))
+			}
+			for _, action := range actions {
+				if action != policyWildcard && !containsString(policyActions, action) {
+					return fmt.Errorf("role %s: unknown action %q. Should be one of: %s, %s", role, action, policyWildcard, strings.Join(policyActions, ", "))
+				}
+			}
+		}
+	}
+	for _, role := range p.DefaultRoles {
+		if _, ok := p.Roles[role]; !ok {
+			return fmt.Errorf("unknown default role %s", role)
+		}
+	}
+	return nil
+}
+
+// Allows returns true if one of roles grants action on resource
+func (p *Policy) Allows(roles []string, resource, action string) bool {
+	if len(roles) == 0 {
+		roles = p.DefaultRoles
+	}
+	for _, role := range roles {
+		for _, r := range []string{resource, policyWildcard} {
+			actions := p.Roles[role][r]
+			if containsString(actions, action) || containsString(actions, policyWildcard) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Manages returns true if one of roles grants every action on resource. Such
+// roles, e.g. admin and problem-admin in the default policy, can patch, delete
+// and restore the resources owned by other users.
+func (p *Policy) Manages(roles []string, resource string) bool {
+	if len(roles) == 0 {
+		roles = p.DefaultRoles
+	}
+	for _, role := range roles {
+		for _, r := range []string{resource, policyWildcard} {
+			if containsString(p.Roles[role][r], policyWildcard) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// scopeAction returns the API token scope action needed to perform a policy
+// action
+func scopeAction(action string) string {
+	switch action {
+	case ActionList, ActionGet, ActionDownload:
+		return ScopeRead
+	}
+	return ScopeWrite
+}
+
+// authorize returns a middleware restricting a route to the principals allowed
+// to perform action on resource: API tokens need the matching scope, other
+// principals a role granting the action.
+func (s *APIServer) authorize(resource, action string) iris.HandlerFunc {
+	return func(c *iris.Context) {
+		s.checkAuthorization(c, resource, action)
+	}
+}
+
+// authorizeUpload restricts resumable upload routes to the principals allowed
+// to create the type of resource uploaded
+func (s *APIServer) authorizeUpload(c *iris.Context) {
+	s.checkAuthorization(c, c.Param("resource"), ActionCreate)
+}
+
+func (s *APIServer) checkAuthorization(c *iris.Context, resource, action string) {
+	setAuditTarget(c, resource, action)
+	p := GetPrincipal(c)
+	if p == nil {
+		c.JSON(403, common.NewAPIError(fmt.Sprintf("Forbidden: %s %s requires an authenticated user", action, resource)))
+		return
+	}
+	if p.Scopes != nil {
+		if scope := Scope(resource, scopeAction(action)); !p.HasScope(scope) {
+			c.JSON(403, common.NewAPIError(fmt.Sprintf("Forbidden: %s %s requires the %s scope", action, resource, scope)))
+			return
+		}
+	} else if !s.Policy.Allows(p.Roles, resource, action) {
+		c.JSON(403, common.NewAPIError(fmt.Sprintf("Forbidden: user %s has no role allowing to %s %s", p.Name, action, resource)))
+		return
+	}
+	c.Next()
+}
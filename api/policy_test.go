@@ -0,0 +1,152 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/kataras/iris.v6/httptest"
+
+	. "github.com/MorpheoOrg/morpheo-storage/api"
+)
+
+func TestDefaultPolicy(t *testing.T) {
+	policy := DefaultPolicy()
+	if err := policy.Check(); err != nil {
+		t.Fatalf("Invalid default policy: %s", err)
+	}
+	tests := []struct {
+		roles    []string
+		resource string
+		action   string
+		allowed  bool
+	}{
+		{[]string{RoleReader}, DataModelName, ActionDownload, true},
+		{[]string{RoleReader}, DataModelName, ActionCreate, false},
+		{[]string{RoleUploader}, ModelModelName, ActionCreate, true},
+		{[]string{RoleUploader}, ModelModelName, ActionDelete, false},
+		{[]string{RoleProblemAdmin}, ProblemModelName, ActionDelete, true},
+		{[]string{RoleProblemAdmin}, DataModelName, ActionDelete, false},
+		{[]string{RoleProblemAdmin}, DataModelName, ActionList, true},
+		{[]string{RoleReader, RoleProblemAdmin}, ProblemModelName, ActionPatch, true},
+		{[]string{RoleAdmin}, PredictionModelName, ActionDelete, true},
+		{[]string{"devil"}, DataModelName, ActionList, false},
+		{nil, DataModelName, ActionList, false},
+	}
+	for _, test := range tests {
+		if allowed := policy.Allows(test.roles, test.resource, test.action); allowed != test.allowed {
+			t.Errorf("Roles %v allowed to %s %s: %t, should be %t", test.roles, test.action, test.resource, allowed, test.allowed)
+		}
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "policy.json")
+
+	valid := `{"roles": {"reader": {"*": ["list", "get"]}, "trainer": {"model": ["*"], "data": ["download"]}}, "default_roles": ["reader"]}`
+	if err = ioutil.WriteFile(path, []byte(valid), 0600); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := LoadPolicy(path)
+	if err != nil {
+		t.Fatalf("Error loading policy: %s", err)
+	}
+	if !policy.Allows([]string{"trainer"}, ModelModelName, ActionCreate) || !policy.Allows([]string{"trainer"}, DataModelName, ActionDownload) {
+		t.Errorf("trainer should be allowed to create models and download data")
+	}
+	if policy.Allows([]string{"trainer"}, DataModelName, ActionList) {
+		t.Errorf("trainer shouldn't be allowed to list data")
+	}
+	if !policy.Allows(nil, AlgoModelName, ActionList) || policy.Allows(nil, AlgoModelName, ActionDownload) {
+		t.Errorf("Principals without roles should be given the default roles")
+	}
+
+	for _, invalid := range []string{
+		`{`,
+		`{"roles": {}}`,
+		`{"roles": {"reader": {"devil": ["list"]}}}`,
+		`{"roles": {"reader": {"data": ["burn"]}}}`,
+		`{"roles": {"read er": {"data": ["list"]}}}`,
+		`{"roles": {"reader": {"data": ["list"]}}, "default_roles": ["devil"]}`,
+	} {
+		if err = ioutil.WriteFile(path, []byte(invalid), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = LoadPolicy(path); err == nil {
+			t.Errorf("Invalid policy accepted: %s", invalid)
+		}
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	api := newTestServer(NewMemoryBlobStore())
+	api.Credentials.Add("reader", "p", []string{RoleReader})
+	api.Credentials.Add("uploader", "p", []string{RoleUploader})
+	api.Credentials.Add("problem-admin", "p", []string{RoleProblemAdmin})
+	e := httptest.New(configureTestApp(api), t)
+
+	// Test readers can only read
+	e.GET(DataListRoute).WithBasicAuth("reader", "p").Expect().Status(200)
+	e.POST(ModelListRoute).WithQuery("algo", RandomUUID.String()).WithBasicAuth("reader", "p").WithHeader("Content-Length", "15").WithBytes([]byte("fakefilecontent")).Expect().Status(403).Body().Match("(.*)user reader has no role allowing to create model(.*)")
+	e.POST("/upload/data").WithBasicAuth("reader", "p").WithHeader("Tus-Resumable", TusVersion).WithHeader("Upload-Length", BlobSize).Expect().Status(403)
+
+	// Test uploaders can create but not delete
+	e.POST(ModelListRoute).WithQuery("algo", RandomUUID.String()).WithBasicAuth("uploader", "p").WithHeader("Content-Length", "15").WithBytes([]byte("fakefilecontent")).Expect().Status(201)
+	e.DELETE(DataListRoute+"/"+RandomUUID.String()).WithBasicAuth("uploader", "p").Expect().Status(403)
+	e.POST(DataListRoute+"/"+TrashedMockUUIDStr+"/restore").WithBasicAuth("uploader", "p").Expect().Status(403)
+
+	// Test problem admins can only delete problems
+	e.DELETE(ProblemListRoute+"/"+RandomUUID.String()).WithBasicAuth("problem-admin", "p").Expect().Status(204)
+	e.DELETE(DataListRoute+"/"+RandomUUID.String()).WithBasicAuth("problem-admin", "p").Expect().Status(403)
+
+	// Test only the roles managing a resource type act on other users' resources
+	e.PATCH(DataListRoute+"/"+OwnedMockUUIDStr).WithBasicAuth("uploader", "p").WithMultipart().WithFormField("description", "devil").Expect().Status(403).Body().Match("(.*)belongs to another user(.*)")
+	e.PATCH(ProblemListRoute+"/"+OwnedMockUUIDStr).WithBasicAuth("problem-admin", "p").WithMultipart().WithFormField("name", "testName").Expect().Status(200)
+	e.DELETE(ProblemListRoute+"/"+OwnedMockUUIDStr).WithBasicAuth("problem-admin", "p").Expect().Status(204)
+	e.DELETE(DataListRoute+"/"+OwnedMockUUIDStr).WithBasicAuth("u", "p").Expect().Status(204)
+
+	// Test users without roles can't do anything
+	e.GET(DataListRoute).WithBasicAuth("v", "p").Expect().Status(403)
+	e.GET(DataListRoute+"/"+RandomUUID.String()+"/blob").WithBasicAuth("v", "p").Expect().Status(403)
+}
@@ -0,0 +1,370 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopkg.in/kataras/iris.v6"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+)
+
+// Kinds of blob transfers whose concurrency is capped per principal
+const (
+	TransferUpload   = "upload"
+	TransferDownload = "download"
+)
+
+// bucketSweepInterval is how often the buckets of idle clients are dropped
+const bucketSweepInterval = time.Minute
+
+// ErrTooManyTransfers is returned when a principal already has as many blob
+// transfers in progress as allowed
+var ErrTooManyTransfers = errors.New("Too many concurrent transfers")
+
+// TokenBucket is a token bucket refilled at a constant rate, up to a burst
+// size. It starts full.
+type TokenBucket struct {
+	sync.Mutex
+
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket creates a full bucket of burst tokens, refilled with rate
+// tokens per second
+func NewTokenBucket(rate, burst float64) *TokenBucket {
+	return &TokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// refill adds the tokens accumulated since the last operation on the bucket
+func (b *TokenBucket) refill() {
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// wait returns how long it takes for the bucket to hold n tokens
+func (b *TokenBucket) wait(n float64) time.Duration {
+	if b.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+// Allow takes a token from the bucket if there is one. Otherwise, it returns
+// how long it takes for a token to be available.
+func (b *TokenBucket) Allow() (bool, time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+	b.refill()
+	if b.tokens < 1 {
+		return false, b.wait(1)
+	}
+	b.tokens--
+	return true, 0
+}
+
+// Take takes n tokens from the bucket, going into debt if there aren't enough
+func (b *TokenBucket) Take(n int64) {
+	b.Lock()
+	defer b.Unlock()
+	b.refill()
+	b.tokens -= float64(n)
+}
+
+// Debt returns how long it takes for the bucket to be out of debt
+func (b *TokenBucket) Debt() time.Duration {
+	b.Lock()
+	defer b.Unlock()
+	b.refill()
+	return b.wait(0)
+}
+
+// full returns true if the bucket has refilled up to its burst size
+func (b *TokenBucket) full() bool {
+	b.Lock()
+	defer b.Unlock()
+	b.refill()
+	return b.tokens >= b.burst
+}
+
+// Limiter enforces per principal and per client IP rate limits, on both the
+// requests and the bytes transferred, and caps the number of concurrent blob
+// transfers of each principal. Zero limits are not enforced. A nil Limiter
+// doesn't limit anything.
+type Limiter struct {
+	sync.Mutex
+
+	requestRate   float64
+	ipRequestRate float64
+	burst         float64
+	byteRate      float64
+	ipByteRate    float64
+	maxTransfers  map[string]int
+
+	buckets   map[string]*TokenBucket
+	transfers map[string]int
+	lastSweep time.Time
+}
+
+// NewLimiter creates a Limiter enforcing the limits of a configuration
+func NewLimiter(conf *StorageConfig) *Limiter {
+	return &Limiter{
+		requestRate:   conf.RateLimit,
+		ipRequestRate: conf.RateLimitIP,
+		burst:         float64(conf.RateLimitBurst),
+		byteRate:      float64(conf.BandwidthLimit),
+		ipByteRate:    float64(conf.BandwidthLimitIP),
+		maxTransfers: map[string]int{
+			TransferUpload:   conf.MaxUploads,
+			TransferDownload: conf.MaxDownloads,
+		},
+		buckets:   make(map[string]*TokenBucket),
+		transfers: make(map[string]int),
+		lastSweep: time.Now(),
+	}
+}
+
+// bucket returns the bucket of a client, creating it if needed. Byte buckets
+// hold one second worth of transfer.
+func (l *Limiter) bucket(kind, client string, rate float64) *TokenBucket {
+	l.Lock()
+	defer l.Unlock()
+	if time.Since(l.lastSweep) > bucketSweepInterval {
+		for key, b := range l.buckets {
+			if b.full() {
+				delete(l.buckets, key)
+			}
+		}
+		l.lastSweep = time.Now()
+	}
+
+	key := kind + "|" + client
+	b, ok := l.buckets[key]
+	if !ok {
+		burst := rate
+		if kind == "requests" || kind == "ip-requests" {
+			burst = math.Max(l.burst, 1)
+		}
+		b = NewTokenBucket(rate, burst)
+		l.buckets[key] = b
+	}
+	return b
+}
+
+// allow takes a request token of a client, and checks it isn't in debt of
+// bytes. It returns how long the client should wait otherwise.
+func (l *Limiter) allow(kind, client string, requestRate, byteRate float64) (bool, time.Duration) {
+	if requestRate > 0 {
+		if ok, wait := l.bucket(kind+"requests", client, requestRate).Allow(); !ok {
+			return false, wait
+		}
+	}
+	if byteRate > 0 {
+		if debt := l.bucket(kind+"bytes", client, byteRate).Debt(); debt > 0 {
+			return false, debt
+		}
+	}
+	return true, 0
+}
+
+// AllowIP checks the rate limits of a client IP
+func (l *Limiter) AllowIP(ip string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	return l.allow("ip-", ip, l.ipRequestRate, l.ipByteRate)
+}
+
+// AllowPrincipal checks the rate limits of a principal
+func (l *Limiter) AllowPrincipal(name string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	return l.allow("", name, l.requestRate, l.byteRate)
+}
+
+// byteBuckets returns the byte buckets of the client IP and the principal of a
+// request, if their bandwidth is limited
+func (l *Limiter) byteBuckets(c *iris.Context) (buckets []*TokenBucket) {
+	if l.ipByteRate > 0 {
+		buckets = append(buckets, l.bucket("ip-bytes", clientIP(c), l.ipByteRate))
+	}
+	if p := GetPrincipal(c); p != nil && l.byteRate > 0 {
+		buckets = append(buckets, l.bucket("bytes", p.Name, l.byteRate))
+	}
+	return
+}
+
+// Throttle returns a reader reading r no faster than the bandwidth limits of
+// the client of a request. Seekable readers remain seekable.
+func (l *Limiter) Throttle(c *iris.Context, r io.Reader) io.Reader {
+	if l == nil || (l.byteRate <= 0 && l.ipByteRate <= 0) {
+		return r
+	}
+	throttled := &throttledReader{Reader: r, limiter: l, c: c}
+	if seeker, ok := r.(io.Seeker); ok {
+		return &throttledReadSeeker{throttledReader: throttled, Seeker: seeker}
+	}
+	return throttled
+}
+
+// StartTransfer registers a blob transfer of a principal. It fails with
+// ErrTooManyTransfers if the principal already has as many transfers of this
+// kind in progress as allowed. Otherwise, release must be called once the
+// transfer is over.
+func (l *Limiter) StartTransfer(kind, name string) (release func(), err error) {
+	if l == nil || l.maxTransfers[kind] <= 0 {
+		return func() {}, nil
+	}
+	key := kind + "|" + name
+
+	l.Lock()
+	defer l.Unlock()
+	if l.transfers[key] >= l.maxTransfers[kind] {
+		return nil, ErrTooManyTransfers
+	}
+	l.transfers[key]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.Lock()
+			defer l.Unlock()
+			if l.transfers[key]--; l.transfers[key] <= 0 {
+				delete(l.transfers, key)
+			}
+		})
+	}, nil
+}
+
+// throttledReader waits for the byte buckets of a client to be out of debt
+// before each read, and takes the bytes read from them
+type throttledReader struct {
+	io.Reader
+
+	limiter *Limiter
+	c       *iris.Context
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	buckets := r.limiter.byteBuckets(r.c)
+	var wait time.Duration
+	for _, b := range buckets {
+		if debt := b.Debt(); debt > wait {
+			wait = debt
+		}
+	}
+	time.Sleep(wait)
+
+	n, err := r.Reader.Read(p)
+	for _, b := range buckets {
+		b.Take(int64(n))
+	}
+	return n, err
+}
+
+type throttledReadSeeker struct {
+	*throttledReader
+	io.Seeker
+}
+
+// retryAfter returns the value of the Retry-After header for a given wait:
+// a number of seconds, at least 1
+func retryAfter(wait time.Duration) string {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return strconv.Itoa(seconds)
+}
+
+// tooManyRequests rejects a request with a 429 and a Retry-After header
+func tooManyRequests(c *iris.Context, wait time.Duration, message string) {
+	c.SetHeader("Retry-After", retryAfter(wait))
+	c.JSON(429, common.NewAPIError(message))
+}
+
+// rateLimit is a middleware enforcing the rate limits of client IPs. It also
+// throttles request bodies to their client bandwidth limits. Principals are
+// limited once authenticated, by limitPrincipal.
+func (s *APIServer) rateLimit(c *iris.Context) {
+	ip := clientIP(c)
+	if ok, wait := s.Limiter.AllowIP(ip); !ok {
+		tooManyRequests(c, wait, fmt.Sprintf("Too many requests from %s", ip))
+		return
+	}
+	if body := c.Request.Body; body != nil {
+		c.Request.Body = struct {
+			io.Reader
+			io.Closer
+		}{s.Limiter.Throttle(c, body), body}
+	}
+	c.Next()
+}
+
+// limitPrincipal is a middleware enforcing the rate limits of the principal
+// authenticated by the previous handler of a route
+func (s *APIServer) limitPrincipal(c *iris.Context) {
+	if p := GetPrincipal(c); p != nil {
+		if ok, wait := s.Limiter.AllowPrincipal(p.Name); !ok {
+			tooManyRequests(c, wait, fmt.Sprintf("Too many requests from %s", p.Name))
+			return
+		}
+	}
+	c.Next()
+}
+
+// startTransfer registers a blob transfer of the principal of a request,
+// setting its Retry-After header if too many are already in progress
+func (s *APIServer) startTransfer(kind string, c *iris.Context) (release func(), err error) {
+	release, err = s.Limiter.StartTransfer(kind, principal(c))
+	if err != nil {
+		c.SetHeader("Retry-After", retryAfter(time.Second))
+		return nil, fmt.Errorf("%s: %s already has %d %ss in progress", err, principal(c), s.Limiter.maxTransfers[kind], kind)
+	}
+	return release, nil
+}
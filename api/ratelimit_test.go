@@ -0,0 +1,164 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+package main_test
+
+import (
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"gopkg.in/kataras/iris.v6/httptest"
+
+	. "github.com/MorpheoOrg/morpheo-storage/api"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := NewTokenBucket(10, 2)
+	for i := 0; i < 2; i++ {
+		if ok, _ := b.Allow(); !ok {
+			t.Fatalf("Request %d of the burst wasn't allowed", i)
+		}
+	}
+	ok, wait := b.Allow()
+	if ok || wait <= 0 || wait > 100*time.Millisecond {
+		t.Fatalf("Request above the burst: allowed %t, wait %s. Expected a wait of at most 100ms", ok, wait)
+	}
+	time.Sleep(wait)
+	if ok, _ := b.Allow(); !ok {
+		t.Fatalf("Request wasn't allowed after waiting %s", wait)
+	}
+
+	// Test byte buckets can go into debt
+	b = NewTokenBucket(1000, 1000)
+	b.Take(1500)
+	if debt := b.Debt(); debt < 400*time.Millisecond || debt > 500*time.Millisecond {
+		t.Fatalf("Wrong debt %s for 500 bytes at 1000 bytes per second", debt)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	api := newTestServer(NewMemoryBlobStore())
+	api.Credentials.Add("uploader", "p", []string{RoleUploader})
+	api.Limiter = NewLimiter(&StorageConfig{RateLimit: 1, RateLimitBurst: 2})
+	e := httptest.New(configureTestApp(api), t)
+
+	// Test requests above the burst return TooManyRequests, per principal
+	e.GET(DataListRoute).WithBasicAuth("u", "p").Expect().Status(200)
+	e.GET(DataListRoute).WithBasicAuth("u", "p").Expect().Status(200)
+	r := e.GET(DataListRoute).WithBasicAuth("u", "p").Expect()
+	r.Status(429).Header("Retry-After").Equal("1")
+	r.Body().Match("(.*)Too many requests from u(.*)")
+	e.GET(DataListRoute).WithBasicAuth("uploader", "p").Expect().Status(200)
+
+	// Test admin routes are limited too
+	e.GET(AdminUserListRoute).WithBasicAuth("u", "p").Expect().Status(429)
+	e.GET(AuditRoute).WithBasicAuth("u", "p").Expect().Status(429)
+
+	// Test client IPs are limited before authentication
+	api = newTestServer(NewMemoryBlobStore())
+	api.Limiter = NewLimiter(&StorageConfig{RateLimitIP: 1, RateLimitBurst: 1})
+	e = httptest.New(configureTestApp(api), t)
+	e.GET(DataListRoute).WithBasicAuth("u", "wrong").Expect().Status(401)
+	e.GET(DataListRoute).WithBasicAuth("u", "p").Expect().Status(429).Header("Retry-After").Equal("1")
+	e.GET(RootRoute).Expect().Status(200)
+}
+
+func TestBandwidthLimit(t *testing.T) {
+	api := newTestServer(NewMemoryBlobStore())
+	api.Credentials.Add("ci", "p", []string{RoleAdmin})
+	api.Credentials.Add("uploader", "p", []string{RoleUploader})
+	api.Limiter = NewLimiter(&StorageConfig{BandwidthLimit: int64(len(Blob) / 2)})
+	e := httptest.New(configureTestApp(api), t)
+
+	// The upload puts its principal in debt too
+	id := uuid.NewV4().String()
+	e.POST(DataListRoute).WithBasicAuth("ci", "p").WithMultipart().WithFormField("uuid", id).WithFormField("size", BlobSize).WithFile("blob", "main.go").Expect().Status(201)
+
+	// Test downloads put their principal in debt of bytes
+	e.GET(DataListRoute+"/"+id+"/blob").WithBasicAuth("uploader", "p").Expect().Status(200).Body().Equal(string(Blob))
+	e.GET(DataListRoute).WithBasicAuth("uploader", "p").Expect().Status(429).Header("Retry-After").NotEmpty()
+	e.GET(DataListRoute).WithBasicAuth("u", "p").Expect().Status(200)
+}
+
+// blockingBlobStore blocks blob reads until released
+type blockingBlobStore struct {
+	*MemoryBlobStore
+
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingBlobStore) Get(key string) (io.ReadCloser, error) {
+	s.started <- struct{}{}
+	<-s.release
+	return s.MemoryBlobStore.Get(key)
+}
+
+func TestTransferCaps(t *testing.T) {
+	blobStore := &blockingBlobStore{MemoryBlobStore: NewMemoryBlobStore(), started: make(chan struct{}, 10), release: make(chan struct{})}
+	api := newTestServer(blobStore)
+	api.Credentials.Add("uploader", "p", []string{RoleUploader})
+	api.Limiter = NewLimiter(&StorageConfig{MaxDownloads: 1})
+	e := httptest.New(configureTestApp(api), t)
+
+	id := uuid.NewV4().String()
+	e.POST(DataListRoute).WithBasicAuth("uploader", "p").WithMultipart().WithFormField("uuid", id).WithFormField("size", BlobSize).WithFile("blob", "main.go").Expect().Status(201)
+
+	var wg sync.WaitGroup
+	download := func(user string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e.GET(DataListRoute+"/"+id+"/blob").WithBasicAuth(user, "p").Expect().Status(200)
+		}()
+		<-blobStore.started
+	}
+
+	// Test a second concurrent download of the same principal is rejected
+	download("uploader")
+	r := e.GET(DataListRoute+"/"+id+"/blob").WithBasicAuth("uploader", "p").Expect()
+	r.Status(429).Header("Retry-After").Equal("1")
+	r.Body().Match("(.*)uploader already has 1 downloads in progress(.*)")
+
+	// Test other principals aren't affected
+	download("u")
+
+	// Test the cap is released once downloads are over
+	close(blobStore.release)
+	wg.Wait()
+	e.GET(DataListRoute+"/"+id+"/blob").WithBasicAuth("uploader", "p").Expect().Status(200)
+}
@@ -0,0 +1,192 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/satori/go.uuid"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+)
+
+// Resources are inserted as pending before their blob is uploaded, and
+// committed once it is stored. Only committed resources are served.
+const (
+	ResourcePending   = "pending"
+	ResourceCommitted = "committed"
+)
+
+// ResourceMeta holds the storage specific metadata of a resource. It is stored
+// in the resource table, next to the columns of the common resource type.
+type ResourceMeta struct {
+	Status    string `db:"status" json:"-"`
+	DeletedAt *int64 `db:"deleted_at" json:"deleted_at,omitempty"`
+
+	// Name of the user who uploaded the resource. Empty for resources uploaded
+	// before ownership was recorded.
+	Owner string `db:"owner" json:"owner,omitempty"`
+
+	// Blob SHA-256 checksum (hex encoded) and size in bytes, as computed while
+	// uploading it. Empty for blobs uploaded before checksums were introduced.
+	Checksum string `db:"checksum" json:"checksum,omitempty"`
+	Size     int64  `db:"size" json:"size"`
+
+	// Blob file name and media type, as sent by the uploader. They are used to
+	// fill the Content-Disposition and Content-Type headers on download.
+	Filename    string `db:"filename" json:"filename,omitempty"`
+	ContentType string `db:"content_type" json:"content_type,omitempty"`
+
+	// Blob key on the blob store, for content addressed blobs (see
+	// BlobLayoutContent). Empty for blobs stored under the resource UUID.
+	BlobKey string `db:"blob_key" json:"-"`
+	// Claim on the reference to the content addressed blob, while it is being
+	// stored for the resource (see BlobRefModel)
+	claim string
+}
+
+// Meta returns the storage metadata of a resource
+func (m *ResourceMeta) Meta() *ResourceMeta {
+	return m
+}
+
+// StoredResource is a resource along with its storage metadata
+type StoredResource interface {
+	common.Resource
+	Meta() *ResourceMeta
+	UploadTime() time.Time
+}
+
+// ProblemResource is a problem as stored by the storage API
+type ProblemResource struct {
+	common.Problem
+	ResourceMeta
+}
+
+// UploadTime returns the date the problem was uploaded at
+func (r *ProblemResource) UploadTime() time.Time {
+	return time.Unix(int64(r.TimestampUpload), 0)
+}
+
+// NewProblemResource creates a new problem with a fresh UUID
+func NewProblemResource() *ProblemResource {
+	return &ProblemResource{Problem: *common.NewProblem()}
+}
+
+// AlgoResource is an algo as stored by the storage API
+type AlgoResource struct {
+	common.Algo
+	ResourceMeta
+}
+
+// UploadTime returns the date the algo was uploaded at
+func (r *AlgoResource) UploadTime() time.Time {
+	return time.Unix(int64(r.TimestampUpload), 0)
+}
+
+// NewAlgoResource creates a new algo with a fresh UUID
+func NewAlgoResource() *AlgoResource {
+	return &AlgoResource{Algo: *common.NewAlgo()}
+}
+
+// ModelResource is a model as stored by the storage API
+type ModelResource struct {
+	common.Model
+	ResourceMeta
+}
+
+// UploadTime returns the date the model was uploaded at
+func (r *ModelResource) UploadTime() time.Time {
+	return time.Unix(int64(r.TimestampUpload), 0)
+}
+
+// NewModelResource creates a new model trained from a given algo. A fresh UUID
+// is generated if id is uuid.Nil.
+func NewModelResource(id uuid.UUID, algo *AlgoResource) *ModelResource {
+	return &ModelResource{Model: *common.NewModel(id, &algo.Algo)}
+}
+
+// DataResource is a dataset as stored by the storage API
+type DataResource struct {
+	common.Data
+	ResourceMeta
+}
+
+// UploadTime returns the date the dataset was uploaded at
+func (r *DataResource) UploadTime() time.Time {
+	return time.Unix(int64(r.TimestampUpload), 0)
+}
+
+// NewDataResource creates a new dataset with a fresh UUID
+func NewDataResource() *DataResource {
+	return &DataResource{Data: *common.NewData()}
+}
+
+// PredictionResource is a prediction as stored by the storage API
+type PredictionResource struct {
+	common.Prediction
+	ResourceMeta
+}
+
+// UploadTime returns the date the prediction was uploaded at
+func (r *PredictionResource) UploadTime() time.Time {
+	return time.Unix(int64(r.TimestampUpload), 0)
+}
+
+// NewPredictionResource creates a new prediction with a fresh UUID
+func NewPredictionResource() *PredictionResource {
+	return &PredictionResource{Prediction: *common.NewPrediction()}
+}
+
+// NewStoredResource returns an empty resource of a given model, to be filled
+// by the model's GetOne method
+func NewStoredResource(modelName string) (StoredResource, error) {
+	switch modelName {
+	case ProblemModelName:
+		return &ProblemResource{}, nil
+	case AlgoModelName:
+		return &AlgoResource{}, nil
+	case ModelModelName:
+		return &ModelResource{}, nil
+	case DataModelName:
+		return &DataResource{}, nil
+	case PredictionModelName:
+		return &PredictionResource{}, nil
+	default:
+		return nil, fmt.Errorf("Unknown model %s", modelName)
+	}
+}
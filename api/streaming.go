@@ -1,31 +1,52 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/MorpheoOrg/morpheo-go-packages/common"
 	"github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
 	"gopkg.in/kataras/iris.v6"
+	"hash"
 	"io"
-	// "log"
+	"io/ioutil"
 	"mime"
 	"mime/multipart"
+	"net/http"
+	"path"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // PostMultipartFields represents all the valid multipart fields for the routes
 var PostMultipartFields = map[string][]string{
-	ProblemListRoute: []string{"uuid", "name", "description", "size", "blob"},
-	AlgoListRoute:    []string{"uuid", "name", "size", "blob"},
+	ProblemListRoute: []string{"uuid", "name", "description", "size", "checksum", "filename", "blob"},
+	AlgoListRoute:    []string{"uuid", "name", "size", "checksum", "filename", "blob"},
 	// ModelListRoute:   []string{"uuid", "name", "size", "blob"},
-	DataListRoute: []string{"uuid", "size", "blob"},
+	DataListRoute: []string{"uuid", "size", "checksum", "filename", "blob"},
+}
+
+// PatchMultipartFields represents all the valid multipart fields for the patch
+// routes. They are all optional.
+var PatchMultipartFields = map[string][]string{
+	ProblemRoute:    []string{"uuid", "name", "description", "size", "checksum", "filename", "blob"},
+	AlgoRoute:       []string{"uuid", "name", "size", "checksum", "filename", "blob"},
+	ModelRoute:      []string{"uuid", "size", "checksum", "filename", "blob"},
+	DataRoute:       []string{"uuid", "size", "checksum", "filename", "blob"},
+	PredictionRoute: []string{"uuid", "size", "checksum", "filename", "blob"},
 }
 
 const (
 	// StrFieldMaxLength is the max length for the multipart fields
 	StrFieldMaxLength = 255 // in bytes
 	intFieldMaxLength = 20  // in bytes
+
+	// DefaultBlobContentType is the media type of blobs uploaded without one
+	DefaultBlobContentType = "application/octet-stream"
 )
 
 func readMultipartField(formName string, part io.ReadCloser, maxLength int) (string, error) {
@@ -53,20 +74,146 @@ func readMultipartField(formName string, part io.ReadCloser, maxLength int) (str
 	return string(buf[:offset]), nil
 }
 
-func (s *APIServer) streamBlobToStorage(blobType string, id uuid.UUID, c *iris.Context) (int, error) {
-	size, err := strconv.ParseInt(c.Request.Header.Get("Content-Length"), 10, 64)
+// parseFilename keeps the last path element of a file name sent by a client
+func parseFilename(filename string) (string, error) {
+	name := path.Base(strings.Replace(filename, "\\", "/", -1))
+	if name == "." || name == ".." || name == "/" {
+		return "", fmt.Errorf("Invalid filename %s", filename)
+	}
+	return name, nil
+}
+
+// parseBlobContentType normalizes the media type of an uploaded blob. Blobs
+// sent without a valid media type get an empty one, i.e. the default one.
+func parseBlobContentType(contentType string) string {
+	mediaType, params, err := mime.ParseMediaType(contentType)
 	if err != nil {
-		return 400, fmt.Errorf("Error parsing header 'Content-Length': should be blob size in bytes. err: %s", err)
+		return ""
+	}
+	contentType = mime.FormatMediaType(mediaType, params)
+	if len(contentType) > StrFieldMaxLength {
+		return ""
+	}
+	return contentType
+}
+
+// blobReader computes the SHA-256 checksum and counts the bytes of a blob as it
+// is read. Reading fails as soon as the byte count can't match the declared
+// size anymore, so that blob stores reading the whole stream abort the upload.
+type blobReader struct {
+	reader io.Reader
+	hash   hash.Hash
+	n      int64
+	size   int64
+	err    error
+}
+
+func newBlobReader(r io.Reader, size int64) *blobReader {
+	h := sha256.New()
+	return &blobReader{reader: io.TeeReader(r, h), hash: h, size: size}
+}
+
+func (r *blobReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.reader.Read(p)
+	r.n += int64(n)
+	switch {
+	case r.n > r.size:
+		r.err = fmt.Errorf("Size mismatch: %d bytes declared but more were sent", r.size)
+	case (err == io.EOF || err == io.ErrUnexpectedEOF) && r.n < r.size:
+		r.err = fmt.Errorf("Size mismatch: %d bytes declared but only %d were received", r.size, r.n)
+	default:
+		return n, err
+	}
+	return n, r.err
+}
+
+// Checksum returns the hex encoded SHA-256 checksum of the bytes read so far
+func (r *blobReader) Checksum() string {
+	return hex.EncodeToString(r.hash.Sum(nil))
+}
+
+// parseChecksum checks that a client supplied checksum is a hex encoded SHA-256
+func parseChecksum(checksum string) (string, error) {
+	checksum = strings.ToLower(strings.TrimSpace(checksum))
+	if b, err := hex.DecodeString(checksum); err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("Invalid checksum '%s': should be a hex encoded SHA-256", checksum)
+	}
+	return checksum, nil
+}
+
+// putBlob streams a blob to the blob store, recording its actual size and
+// checksum in the resource metadata. If the received bytes don't match the
+// declared size or expectedChecksum (when set), the blob is removed from the
+// blob store.
+func (s *APIServer) putBlob(ctx context.Context, key string, body io.Reader, size int64, expectedChecksum string, meta *ResourceMeta) (int, error) {
+	reader := newBlobReader(body, size)
+	err := s.blobStore(ctx).Put(key, reader, size)
+	if reader.err != nil {
+		s.deleteBlob(ctx, key)
+		return 400, reader.err
 	}
-	err = s.BlobStore.Put(s.getBlobKey(blobType, id), c.Request.Body, size)
-	defer c.Request.Body.Close()
 	if err != nil {
-		return 500, err
+		return 500, fmt.Errorf("Error writing blob content to storage: %s", err)
+	}
+	// Whatever the blob store didn't read still has to be hashed and counted:
+	// not all blob stores read the stream up to its end
+	if _, err := io.Copy(ioutil.Discard, reader); err != nil {
+		s.deleteBlob(ctx, key)
+		if reader.err != nil {
+			return 400, reader.err
+		}
+		return 400, fmt.Errorf("Error reading blob content: %s", err)
 	}
+
+	checksum := reader.Checksum()
+	if expectedChecksum != "" && expectedChecksum != checksum {
+		s.deleteBlob(ctx, key)
+		return 400, fmt.Errorf("Checksum mismatch: %s was sent but the received blob's SHA-256 is %s", expectedChecksum, checksum)
+	}
+	meta.Checksum = checksum
+	meta.Size = reader.n
 	return 201, nil
 }
 
-func (s *APIServer) streamMultipartToStorage(ResourceModel Model, resource common.Resource, c *iris.Context) (int, error) {
+// deleteBlob removes a rejected blob from the blob store
+func (s *APIServer) deleteBlob(ctx context.Context, key string) {
+	if err := s.blobStore(ctx).Delete(key); err != nil {
+		log.WithField("component", "blobstore").Warnf("Orphan blob %s left on storage: %s", key, err)
+	}
+}
+
+func (s *APIServer) streamBlobToStorage(ResourceModel Model, resource StoredResource, c *iris.Context) (int, error) {
+	defer c.Request.Body.Close()
+	release, err := s.startTransfer(TransferUpload, c)
+	if err != nil {
+		return 429, err
+	}
+	defer release()
+
+	size, err := strconv.ParseInt(c.Request.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return 400, fmt.Errorf("Error parsing header 'Content-Length': should be blob size in bytes. err: %s", err)
+	}
+	var checksum string
+	if c.URLParam("checksum") != "" {
+		if checksum, err = parseChecksum(c.URLParam("checksum")); err != nil {
+			return 400, err
+		}
+	}
+	if c.URLParam("filename") != "" {
+		if resource.Meta().Filename, err = parseFilename(c.URLParam("filename")); err != nil {
+			return 400, err
+		}
+	}
+	resource.Meta().ContentType = parseBlobContentType(c.Request.Header.Get("Content-Type"))
+	resource.Meta().Owner = principal(c)
+	return s.insertWithBlob(requestContext(c), ResourceModel, resource, c.Request.Body, size, checksum)
+}
+
+func (s *APIServer) streamMultipartToStorage(ResourceModel Model, resource StoredResource, c *iris.Context) (int, error) {
 	mediaType, params, err := mime.ParseMediaType(c.Request.Header.Get("Content-Type"))
 	if err != nil {
 		return 400, fmt.Errorf("Error parsing header \"Content-Type\": %s", err)
@@ -76,10 +223,17 @@ func (s *APIServer) streamMultipartToStorage(ResourceModel Model, resource commo
 		return 400, fmt.Errorf("Invalid media type: %s. Should be: multipart/form-data", mediaType)
 	}
 
+	release, err := s.startTransfer(TransferUpload, c)
+	if err != nil {
+		return 429, err
+	}
+	defer release()
+
 	reader := multipart.NewReader(c.Request.Body, params["boundary"])
 	defer c.Request.Body.Close()
 
 	var size int64
+	var checksum, filename string
 	formFields := make(map[string]interface{})
 	for {
 		part, err := reader.NextPart()
@@ -100,7 +254,7 @@ func (s *APIServer) streamMultipartToStorage(ResourceModel Model, resource commo
 			if err != nil {
 				return 400, fmt.Errorf("Error parsing UUID %s", err)
 			}
-			if err = ResourceModel.CheckUUIDNotUsed(id); err != nil {
+			if err = ResourceModel.CheckUUIDNotUsed(requestContext(c), id); err != nil {
 				return 409, err
 			}
 			formFields["uuid"] = id
@@ -123,6 +277,22 @@ func (s *APIServer) streamMultipartToStorage(ResourceModel Model, resource commo
 			if err != nil {
 				return 400, fmt.Errorf("Error parsing size field to integer: %s", err)
 			}
+		case "checksum":
+			checksumStr, err := readMultipartField(formName, part, StrFieldMaxLength)
+			if err != nil {
+				return 400, fmt.Errorf("Error reading checksum field: %s", err)
+			}
+			if checksum, err = parseChecksum(checksumStr); err != nil {
+				return 400, err
+			}
+		case "filename":
+			filenameStr, err := readMultipartField(formName, part, StrFieldMaxLength)
+			if err != nil {
+				return 400, fmt.Errorf("Error reading filename field: %s", err)
+			}
+			if filename, err = parseFilename(filenameStr); err != nil {
+				return 400, err
+			}
 		default:
 			defer part.Close()
 			if formName == "blob" {
@@ -136,47 +306,158 @@ func (s *APIServer) streamMultipartToStorage(ResourceModel Model, resource commo
 				if size == 0 {
 					return 400, fmt.Errorf("Invalid form: 'Size' unset. Make sure that each form field is sent before blob in the multipart/form")
 				}
-				err = s.BlobStore.Put(s.getBlobKey(ResourceModel.GetModelName(), resource.GetUUID()), part, size)
-				if err != nil {
-					return 500, fmt.Errorf("Error writing blob content to storage: %s", err)
+				// The file name defaults to the one of the blob part itself
+				if filename == "" && part.FileName() != "" {
+					filename, _ = parseFilename(part.FileName())
 				}
-				return 201, nil
+				resource.Meta().Filename = filename
+				resource.Meta().ContentType = parseBlobContentType(part.Header.Get("Content-Type"))
+				if c.Method() == "PATCH" {
+					return s.storeBlob(requestContext(c), ResourceModel.GetModelName(), resource.GetUUID(), part, size, checksum, resource.Meta())
+				}
+				resource.Meta().Owner = principal(c)
+				return s.insertWithBlob(requestContext(c), ResourceModel, resource, part, size, checksum)
 			}
 			return 400, fmt.Errorf("Unknown field \"%s\"", part.FormName())
 		}
 	}
 	// If method is patch, fill resource and return 200 if patch is valid
 	if c.Method() == "PATCH" {
+		if checksum != "" {
+			return 400, fmt.Errorf("Invalid form: 'checksum' sent without any blob")
+		}
 		if err := resource.FillResource(formFields); err != nil {
 			return 400, fmt.Errorf("Invalid form: %s. Make sure that each form field is sent before blob in the multipart/form", err)
 		}
 		if err = resource.Check(); err != nil {
 			return 400, fmt.Errorf("Invalid form: %s. Make sure that each form field is sent before blob in the multipart/form", err)
 		}
-		if formFields["uuid"] != nil {
-			id, err := uuid.FromString(c.Param("uuid"))
-			if err != nil {
-				return 400, fmt.Errorf("Impossible to parse UUID %s: %s", id, err)
-			}
-			err = s.BlobStore.Rename(s.getBlobKey(ResourceModel.GetModelName(), id), s.getBlobKey(ResourceModel.GetModelName(), resource.GetUUID()))
-			if err != nil {
-				return 500, fmt.Errorf("Error renaming blob on storage: %s", err)
-			}
+		if filename != "" {
+			resource.Meta().Filename = filename
 		}
 		return 200, nil
 	}
 	return 400, errors.New("Premature EOF while parsing request")
 }
 
-func (s *APIServer) streamBlobFromStorage(blobType string, blobID uuid.UUID, c *iris.Context) {
-	blobReader, err := s.BlobStore.Get(s.getBlobKey(blobType, blobID))
+// blobNotModified evaluates the If-None-Match and If-Modified-Since headers of a
+// blob download request (If-None-Match taking precedence, as per RFC 7232)
+func blobNotModified(r *http.Request, etag string, modtime time.Time) bool {
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		for _, candidate := range strings.Split(ifNoneMatch, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || (etag != "" && candidate == etag) {
+				return true
+			}
+		}
+		return false
+	}
+	if ifModifiedSince := r.Header.Get("If-Modified-Since"); ifModifiedSince != "" {
+		t, err := http.ParseTime(ifModifiedSince)
+		return err == nil && !modtime.Truncate(time.Second).After(t)
+	}
+	return false
+}
+
+// setBlobHeaders sets the headers describing a resource blob, from the metadata
+// recorded at upload. It returns the blob ETag (empty if its checksum is
+// unknown) and modification time.
+func setBlobHeaders(blobID uuid.UUID, resource StoredResource, c *iris.Context) (string, time.Time) {
+	meta := resource.Meta()
+	etag := ""
+	if meta.Checksum != "" {
+		etag = fmt.Sprintf("\"%s\"", meta.Checksum)
+		c.SetHeader("ETag", etag)
+	}
+	modtime := resource.UploadTime()
+	c.SetHeader("Last-Modified", modtime.UTC().Format(http.TimeFormat))
+
+	contentType := meta.ContentType
+	if contentType == "" {
+		contentType = DefaultBlobContentType
+	}
+	c.SetContentType(contentType)
+	filename := meta.Filename
+	if filename == "" {
+		filename = blobID.String()
+	}
+	c.SetHeader("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	return etag, modtime
+}
+
+// headResourceBlob returns the headers of a GET on the resource blob, without
+// reading the blob from storage
+func (s *APIServer) headResourceBlob(resourceModel Model) iris.HandlerFunc {
+	return func(c *iris.Context) {
+		modelName := resourceModel.GetModelName()
+		id, err := uuid.FromString(c.Param("uuid"))
+		if err != nil {
+			c.JSON(400, common.NewAPIError(fmt.Sprintf("Impossible to parse UUID %s: %s", id, err)))
+			return
+		}
+		resource, err := NewStoredResource(modelName)
+		if err != nil {
+			c.JSON(500, common.NewAPIError(err.Error()))
+			return
+		}
+		if err = resourceModel.GetOne(requestContext(c), resource, id, false); err != nil {
+			c.JSON(404, common.NewAPIError(fmt.Sprintf("Error retrieving %s %s: %s", modelName, id, err)))
+			return
+		}
+
+		etag, modtime := setBlobHeaders(id, resource, c)
+		if blobNotModified(c.Request, etag, modtime) {
+			c.SetStatusCode(304)
+			return
+		}
+		if size := resource.Meta().Size; size > 0 {
+			c.SetHeader("Content-Length", strconv.FormatInt(size, 10))
+		}
+		c.SetStatusCode(200)
+	}
+}
+
+// streamBlobFromStorage sends a resource blob. Conditional requests are answered
+// with a 304 when the blob hasn't changed and, if the blob store returns
+// seekable readers, byte ranges are served with a 206. Other blob stores always
+// send the whole blob.
+func (s *APIServer) streamBlobFromStorage(blobType string, blobID uuid.UUID, resource StoredResource, c *iris.Context) {
+	etag, modtime := setBlobHeaders(blobID, resource, c)
+	if blobNotModified(c.Request, etag, modtime) {
+		c.SetStatusCode(304)
+		return
+	}
+
+	release, err := s.startTransfer(TransferDownload, c)
+	if err != nil {
+		c.JSON(429, common.NewAPIError(err.Error()))
+		return
+	}
+	defer release()
+
+	blob, err := s.blobStore(requestContext(c)).Get(s.resourceBlobKey(blobType, resource))
 	if err != nil {
 		c.JSON(500, common.NewAPIError(fmt.Sprintf("Error retrieving %s %s: %s", blobType, blobID, err)))
 		return
 	}
-	defer blobReader.Close()
+	defer blob.Close()
+
+	// Downloads are throttled to the bandwidth limits of their client
+	reader := s.Limiter.Throttle(c, blob)
+	if seeker, ok := reader.(io.ReadSeeker); ok {
+		w := &countingResponseWriter{ResponseWriter: c.ResponseWriter}
+		http.ServeContent(w, c.Request, "", modtime, seeker)
+		addAuditBytesOut(c, w.n)
+		return
+	}
+
+	c.SetHeader("Accept-Ranges", "none")
+	if size := resource.Meta().Size; size > 0 {
+		c.SetHeader("Content-Length", strconv.FormatInt(size, 10))
+	}
 	c.StreamWriter(func(w io.Writer) bool {
-		_, err := io.Copy(w, blobReader)
+		n, err := io.Copy(w, reader)
+		addAuditBytesOut(c, n)
 		if err != nil {
 			c.JSON(500, common.NewAPIError(fmt.Sprintf("Error reading %s %s: %s", blobType, blobID, err)))
 			return false
@@ -0,0 +1,360 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/satori/go.uuid"
+	"gopkg.in/kataras/iris.v6"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+)
+
+// Scope actions: API tokens are granted scopes such as "data:read" or
+// "model:write"
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+)
+
+// tokenBytes is the number of random bytes of an API token
+const tokenBytes = 32
+
+// Scope returns the scope needed to perform an action on a resource type
+func Scope(modelName, action string) string {
+	return modelName + ":" + action
+}
+
+// ValidScopes returns the scopes API tokens can be granted
+func ValidScopes() []string {
+	var scopes []string
+	for _, modelName := range []string{ProblemModelName, AlgoModelName, ModelModelName, DataModelName, PredictionModelName} {
+		scopes = append(scopes, Scope(modelName, ScopeRead), Scope(modelName, ScopeWrite))
+	}
+	return scopes
+}
+
+func checkScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return fmt.Errorf("Invalid scopes: at least one scope is required")
+	}
+	valid := ValidScopes()
+	for _, scope := range scopes {
+		if !containsString(valid, scope) {
+			return fmt.Errorf("Invalid scope %q. Should be one of: %s", scope, strings.Join(valid, ", "))
+		}
+	}
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// TokenPrincipalPrefix prefixes the principal name of API tokens, so that a
+// token can't act as the user of the same name (user names can't hold ':')
+const TokenPrincipalPrefix = "token:"
+
+// APIToken is a long lived token authenticating a machine (e.g. a CI pipeline
+// or a compute node) as the principal "token:<Name>", restricted to a set of
+// scopes. Only the SHA-256 hash of the token is stored.
+type APIToken struct {
+	ID               uuid.UUID      `db:"uuid" json:"uuid"`
+	Name             string         `db:"name" json:"name"`
+	Hash             string         `db:"token_hash" json:"-"`
+	Scopes           pq.StringArray `db:"scopes" json:"scopes"`
+	CreatedBy        string         `db:"created_by" json:"created_by"`
+	TimestampCreated int64          `db:"timestamp_created" json:"timestamp_created"`
+}
+
+// Principal returns the principal authenticated by the token
+func (t *APIToken) Principal() *Principal {
+	return &Principal{Name: TokenPrincipalPrefix + t.Name, Roles: []string{}, Scopes: append([]string{}, t.Scopes...)}
+}
+
+// NewAPIToken creates a token with a fresh UUID, and returns it along with its
+// secret value. The secret is sent to the client once, and never stored.
+func NewAPIToken(name string, scopes []string, createdBy string) (*APIToken, string, error) {
+	buf := make([]byte, tokenBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, "", fmt.Errorf("Error generating token: %s", err)
+	}
+	secret := base64.RawURLEncoding.EncodeToString(buf)
+	token := &APIToken{
+		ID:               uuid.NewV4(),
+		Name:             name,
+		Hash:             hashToken(secret),
+		Scopes:           scopes,
+		CreatedBy:        createdBy,
+		TimestampCreated: time.Now().Unix(),
+	}
+	return token, secret, nil
+}
+
+// hashToken returns the hex encoded SHA-256 hash of a token. Tokens are random,
+// so that they don't need a slow password hash.
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// TokenModel stores API tokens
+type TokenModel interface {
+	Create(token *APIToken) error
+	GetByHash(hash string) (*APIToken, error)
+	List() ([]APIToken, error)
+	Delete(id uuid.UUID) error
+}
+
+// SQLTokenModel stores API tokens in a postgreSQL database
+type SQLTokenModel struct {
+	*sqlx.DB
+}
+
+// NewSQLTokenModel creates a TokenModel instance, bound to a given database
+func NewSQLTokenModel(db *sqlx.DB) (*SQLTokenModel, error) {
+	return &SQLTokenModel{db}, nil
+}
+
+// Create inserts a new token in base
+func (m *SQLTokenModel) Create(token *APIToken) error {
+	_, err := m.NamedExec(`INSERT INTO api_token (uuid, name, token_hash, scopes, created_by, timestamp_created) VALUES (:uuid, :name, :token_hash, :scopes, :created_by, :timestamp_created)`, token)
+	return err
+}
+
+// GetByHash fetches a token by hash. sql.ErrNoRows is returned if it doesn't
+// exist.
+func (m *SQLTokenModel) GetByHash(hash string) (*APIToken, error) {
+	token := &APIToken{}
+	if err := m.DB.Get(token, `SELECT * FROM api_token WHERE token_hash=$1 LIMIT 1`, hash); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// List returns all the tokens, oldest first
+func (m *SQLTokenModel) List() ([]APIToken, error) {
+	tokens := []APIToken{}
+	if err := m.Select(&tokens, `SELECT * FROM api_token ORDER BY timestamp_created, uuid`); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// Delete revokes a token. sql.ErrNoRows is returned if it doesn't exist.
+func (m *SQLTokenModel) Delete(id uuid.UUID) error {
+	res, err := m.Exec(`DELETE FROM api_token WHERE uuid=$1`, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// MockedTokenModel keeps API tokens in memory
+type MockedTokenModel struct {
+	sync.Mutex
+
+	tokens map[uuid.UUID]APIToken
+}
+
+// NewMockedTokenModel creates an empty MockedTokenModel
+func NewMockedTokenModel() (*MockedTokenModel, error) {
+	return &MockedTokenModel{tokens: make(map[uuid.UUID]APIToken)}, nil
+}
+
+// Create stores a new token
+func (m *MockedTokenModel) Create(token *APIToken) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.tokens[token.ID]; ok {
+		return fmt.Errorf("[mock] Token %s already exists", token.ID)
+	}
+	m.tokens[token.ID] = *token
+	return nil
+}
+
+// GetByHash returns a copy of a token
+func (m *MockedTokenModel) GetByHash(hash string) (*APIToken, error) {
+	m.Lock()
+	defer m.Unlock()
+	for _, token := range m.tokens {
+		if token.Hash == hash {
+			t := token
+			return &t, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+// List returns all the tokens, oldest first
+func (m *MockedTokenModel) List() ([]APIToken, error) {
+	m.Lock()
+	defer m.Unlock()
+	tokens := make([]APIToken, 0, len(m.tokens))
+	for _, token := range m.tokens {
+		tokens = append(tokens, token)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		if tokens[i].TimestampCreated != tokens[j].TimestampCreated {
+			return tokens[i].TimestampCreated < tokens[j].TimestampCreated
+		}
+		return tokens[i].ID.String() < tokens[j].ID.String()
+	})
+	return tokens, nil
+}
+
+// Delete revokes a token
+func (m *MockedTokenModel) Delete(id uuid.UUID) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.tokens[id]; !ok {
+		return sql.ErrNoRows
+	}
+	delete(m.tokens, id)
+	return nil
+}
+
+// Authentication returns a middleware authenticating requests either with an
+// API token (Authorization: Bearer header) or with HTTP basic authentication.
+// Token authentication is disabled if tokens is nil.
+func Authentication(credentials *Credentials, tokens TokenModel) iris.HandlerFunc {
+	basic := BasicAuthentication(credentials)
+	return func(c *iris.Context) {
+		authorization := c.Request.Header.Get("Authorization")
+		if tokens == nil || !strings.HasPrefix(authorization, "Bearer ") {
+			basic(c)
+			return
+		}
+		token, err := tokens.GetByHash(hashToken(strings.TrimPrefix(authorization, "Bearer ")))
+		if err != nil && err != sql.ErrNoRows {
+			c.JSON(500, common.NewAPIError(fmt.Sprintf("Error retrieving token: %s", err)))
+			return
+		}
+		if err != nil {
+			c.SetHeader("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q", AuthenticationRealm))
+			c.JSON(401, common.NewAPIError("Unauthorized: invalid or revoked token"))
+			return
+		}
+		c.Set(PrincipalContextKey, token.Principal())
+		c.Next()
+	}
+}
+
+// tokenRequest is the body of token creation requests
+type tokenRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+// API token management routes
+func (s *APIServer) getTokenList(c *iris.Context) {
+	tokens, err := s.Tokens.List()
+	if err != nil {
+		c.JSON(500, common.NewAPIError(fmt.Sprintf("Error listing tokens: %s", err)))
+		return
+	}
+	c.JSON(200, map[string]interface{}{"items": tokens})
+}
+
+func (s *APIServer) postToken(c *iris.Context) {
+	defer c.Request.Body.Close()
+	var req tokenRequest
+	if err := json.NewDecoder(io.LimitReader(c.Request.Body, 64*1024)).Decode(&req); err != nil {
+		c.JSON(400, common.NewAPIError(fmt.Sprintf("Error parsing token: %s", err)))
+		return
+	}
+	if err := checkUserName(req.Name); err != nil {
+		c.JSON(400, common.NewAPIError(fmt.Sprintf("Error creating token: %s", err)))
+		return
+	}
+	if err := checkScopes(req.Scopes); err != nil {
+		c.JSON(400, common.NewAPIError(fmt.Sprintf("Error creating token: %s", err)))
+		return
+	}
+	token, secret, err := NewAPIToken(req.Name, req.Scopes, principal(c))
+	if err != nil {
+		c.JSON(500, common.NewAPIError(err.Error()))
+		return
+	}
+	if err = s.Tokens.Create(token); err != nil {
+		c.JSON(500, common.NewAPIError(fmt.Sprintf("Error creating token in database: %s", err)))
+		return
+	}
+	// The token itself is only ever returned here
+	c.JSON(201, struct {
+		*APIToken
+		Token string `json:"token"`
+	}{token, secret})
+}
+
+func (s *APIServer) deleteToken(c *iris.Context) {
+	id, err := uuid.FromString(c.Param("uuid"))
+	if err != nil {
+		c.JSON(400, common.NewAPIError(fmt.Sprintf("Impossible to parse UUID %s: %s", c.Param("uuid"), err)))
+		return
+	}
+	if err = s.Tokens.Delete(id); err == sql.ErrNoRows {
+		c.JSON(404, common.NewAPIError(fmt.Sprintf("Error revoking token %s: token not found", id)))
+		return
+	}
+	if err != nil {
+		c.JSON(500, common.NewAPIError(fmt.Sprintf("Error revoking token %s: %s", id, err)))
+		return
+	}
+	c.SetStatusCode(204)
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main_test
+
+import (
+	"testing"
+
+	"gopkg.in/kataras/iris.v6/httptest"
+
+	. "github.com/MorpheoOrg/morpheo-storage/api"
+)
+
+func TestAPIToken(t *testing.T) {
+	app, _ := newTestApp(NewMemoryBlobStore())
+	e := httptest.New(app, t)
+
+	// Test only admins can issue tokens
+	e.POST(AdminTokenListRoute).WithBasicAuth("v", "p").WithJSON(map[string]interface{}{"name": "ci", "scopes": []string{"data:read"}}).Expect().Status(403)
+
+	// Test invalid tokens return BadRequest
+	e.POST(AdminTokenListRoute).WithBasicAuth("u", "p").WithJSON(map[string]interface{}{"name": "ci"}).Expect().Status(400).Body().Match("(.*)at least one scope(.*)")
+	e.POST(AdminTokenListRoute).WithBasicAuth("u", "p").WithJSON(map[string]interface{}{"name": "ci", "scopes": []string{"data:delete"}}).Expect().Status(400).Body().Match("(.*)Invalid scope(.*)")
+	e.POST(AdminTokenListRoute).WithBasicAuth("u", "p").WithJSON(map[string]interface{}{"name": "c:i", "scopes": []string{"data:read"}}).Expect().Status(400)
+
+	// Test the token is returned once, and never listed
+	created := e.POST(AdminTokenListRoute).WithBasicAuth("u", "p").WithJSON(map[string]interface{}{"name": "ci", "scopes": []string{"data:read", "model:write"}}).Expect().Status(201).JSON().Object()
+	created.ValueEqual("name", "ci").ValueEqual("created_by", "u")
+	token := created.Value("token").String().NotEmpty().Raw()
+	id := created.Value("uuid").String().Raw()
+	listed := e.GET(AdminTokenListRoute).WithBasicAuth("u", "p").Expect().Status(200).JSON().Object().Value("items").Array()
+	listed.Length().Equal(1)
+	listed.Element(0).Object().ValueEqual("uuid", id).NotContainsKey("token").NotContainsKey("token_hash")
+
+	// Test scopes are enforced per route
+	e.GET(DataListRoute).WithHeader("Authorization", "Bearer "+token).Expect().Status(200)
+	e.GET(ProblemListRoute).WithHeader("Authorization", "Bearer "+token).Expect().Status(403).Body().Match("(.*)problem:read scope(.*)")
+	e.POST(DataListRoute).WithHeader("Authorization", "Bearer "+token).WithMultipart().WithForm(MultipartFormMap[DataListRoute]).WithFormField("size", BlobSize).WithFile("blob", "main.go").Expect().Status(403)
+	e.POST(ModelListRoute).WithQuery("algo", RandomUUID.String()).WithHeader("Authorization", "Bearer "+token).WithHeader("Content-Length", "15").WithBytes([]byte("fakefilecontent")).Expect().Status(201).JSON().Object().ValueEqual("owner", "token:ci")
+	e.POST("/upload/data").WithHeader("Authorization", "Bearer "+token).WithHeader("Tus-Resumable", TusVersion).WithHeader("Upload-Length", "15").Expect().Status(403)
+	e.POST("/upload/model").WithHeader("Authorization", "Bearer "+token).WithHeader("Tus-Resumable", TusVersion).WithHeader("Upload-Length", "15").Expect().Status(400)
+
+	// Test tokens can't manage users nor tokens
+	e.GET(AdminUserListRoute).WithHeader("Authorization", "Bearer "+token).Expect().Status(403)
+	e.GET(AdminTokenListRoute).WithHeader("Authorization", "Bearer "+token).Expect().Status(403)
+
+	// Test tokens can't act as the user of the same name
+	devil := e.POST(AdminTokenListRoute).WithBasicAuth("u", "p").WithJSON(map[string]interface{}{"name": MockOwner, "scopes": []string{"data:write"}}).Expect().Status(201).JSON().Object().Value("token").String().Raw()
+	e.PATCH(DataListRoute+"/"+OwnedMockUUIDStr).WithHeader("Authorization", "Bearer "+devil).WithMultipart().WithFormField("description", "devil").Expect().Status(403).Body().Match("(.*)belongs to another user(.*)")
+
+	// Test unknown and revoked tokens return Unauthorized
+	e.GET(DataListRoute).WithHeader("Authorization", "Bearer devil").Expect().Status(401)
+	e.DELETE(AdminTokenListRoute+"/666devil").WithBasicAuth("u", "p").Expect().Status(400)
+	e.DELETE(AdminTokenListRoute+"/"+id).WithBasicAuth("u", "p").Expect().Status(204)
+	e.DELETE(AdminTokenListRoute+"/"+id).WithBasicAuth("u", "p").Expect().Status(404)
+	e.GET(DataListRoute).WithHeader("Authorization", "Bearer "+token).Expect().Status(401)
+}
@@ -0,0 +1,426 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/kataras/iris.v6"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+)
+
+// Trace exporters
+const (
+	TracingOTLP   = "otlp"
+	TracingStdout = "stdout"
+)
+
+// DefaultOTLPEndpoint is the address of a local OTLP/HTTP collector
+const DefaultOTLPEndpoint = "localhost:4318"
+
+// tracingServiceName is the name of the service reported in the spans
+const tracingServiceName = "morpheo-storage"
+
+// tracerName is the name of the instrumentation library creating the spans
+const tracerName = "github.com/MorpheoOrg/morpheo-storage/api"
+
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// SetupTracing sets the exporter of the traces, and the W3C Trace Context
+// propagation of incoming requests. Requests are traced unless their client
+// sampled their trace out. The returned shutdown func flushes the spans not
+// exported yet.
+func SetupTracing(conf *StorageConfig) (func(), error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var file *os.File
+	var err error
+	switch conf.TracingExporter {
+	case "":
+		return func() {}, nil
+	case TracingOTLP:
+		exporter = NewOTLPExporter(conf.OTLPEndpoint, conf.OTLPInsecure)
+	case TracingStdout:
+		out := io.Writer(os.Stdout)
+		if conf.TraceFile != "" {
+			if file, err = os.OpenFile(conf.TraceFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+				return nil, fmt.Errorf("Error opening trace file: %s", err)
+			}
+			out = file
+		}
+		if exporter, err = stdouttrace.New(stdouttrace.WithWriter(out)); err != nil {
+			return nil, fmt.Errorf("Error creating stdout exporter: %s", err)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown trace exporter %s", conf.TracingExporter)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.AlwaysSample())),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", tracingServiceName))),
+	)
+	otel.SetTracerProvider(provider)
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			log.WithField("component", "tracing").Errorf("Error flushing traces: %s", err)
+		}
+		if file != nil {
+			file.Close()
+		}
+	}, nil
+}
+
+// traceRequest is a middleware starting the span of a request, as a child of the
+// span of its client if the request carries a traceparent header. The
+// context of the request carries the span to the SQL and blob store
+// operations of its handler (see requestContext).
+func (s *APIServer) traceRequest(c *iris.Context) {
+	ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+	route := routeTemplate(c.Request.URL.Path)
+	ctx, span := tracer().Start(ctx, fmt.Sprintf("HTTP %s %s", c.Request.Method, route),
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.method", c.Request.Method),
+			attribute.String("http.route", route),
+		),
+	)
+	defer span.End()
+	c.Request = c.Request.WithContext(ctx)
+	c.Next()
+
+	status := c.ResponseWriter.StatusCode()
+	span.SetAttributes(attribute.Int("http.status_code", status))
+	if resource := c.GetString(auditResourceKey); resource != "" {
+		span.SetAttributes(
+			attribute.String("storage.resource", resource),
+			attribute.String("storage.action", c.GetString(auditActionKey)),
+		)
+	}
+	if status >= 500 {
+		span.SetStatus(codes.Error, fmt.Sprintf("HTTP %d", status))
+	}
+}
+
+// requestContext returns the context the queries and blob store operations
+// of a request are run in, carrying its span. It isn't canceled when the
+// client goes away, so that a request never leaves a resource half written.
+func requestContext(c *iris.Context) context.Context {
+	return context.WithoutCancel(c.Request.Context())
+}
+
+// startJob starts the root span of a background job run (trash purge,
+// pending uploads reconciliation...), returning the context its queries and
+// blob store operations are run in
+func startJob(name string) (context.Context, trace.Span) {
+	return tracer().Start(context.Background(), name, trace.WithSpanKind(trace.SpanKindInternal))
+}
+
+// endSpan records the outcome of an operation and ends its span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// TracedModel traces the queries of a resource model in spans, children of
+// the span held by the context of each query
+type TracedModel struct {
+	Model
+}
+
+// TraceModel wraps a resource model to trace its queries
+func TraceModel(model Model) *TracedModel {
+	return &TracedModel{Model: model}
+}
+
+func (m *TracedModel) start(ctx context.Context, operation string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	attributes = append(attributes,
+		attribute.String("db.system", "postgresql"),
+		attribute.String("storage.model", m.GetModelName()),
+	)
+	return tracer().Start(ctx, "SQLModel."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attributes...),
+	)
+}
+
+func uuidAttribute(id uuid.UUID) attribute.KeyValue {
+	return attribute.String("storage.uuid", id.String())
+}
+
+// Insert adds a resource
+func (m *TracedModel) Insert(ctx context.Context, instance interface{}) error {
+	ctx, span := m.start(ctx, "Insert")
+	err := m.Model.Insert(ctx, instance)
+	endSpan(span, err)
+	return err
+}
+
+// List reads a page of resources
+func (m *TracedModel) List(ctx context.Context, instanceList interface{}, opts ListOptions) error {
+	ctx, span := m.start(ctx, "List")
+	err := m.Model.List(ctx, instanceList, opts)
+	endSpan(span, err)
+	return err
+}
+
+// Count counts the resources listed with given options
+func (m *TracedModel) Count(ctx context.Context, opts ListOptions) (int, error) {
+	ctx, span := m.start(ctx, "Count")
+	count, err := m.Model.Count(ctx, opts)
+	endSpan(span, err)
+	return count, err
+}
+
+// GetOne reads a resource
+func (m *TracedModel) GetOne(ctx context.Context, instance interface{}, id uuid.UUID, includeDeleted bool) error {
+	ctx, span := m.start(ctx, "GetOne", uuidAttribute(id))
+	err := m.Model.GetOne(ctx, instance, id, includeDeleted)
+	endSpan(span, err)
+	return err
+}
+
+// Update modifies a resource
+func (m *TracedModel) Update(ctx context.Context, instance interface{}, id uuid.UUID) error {
+	ctx, span := m.start(ctx, "Update", uuidAttribute(id))
+	err := m.Model.Update(ctx, instance, id)
+	endSpan(span, err)
+	return err
+}
+
+// Delete removes a resource
+func (m *TracedModel) Delete(ctx context.Context, id uuid.UUID) error {
+	ctx, span := m.start(ctx, "Delete", uuidAttribute(id))
+	err := m.Model.Delete(ctx, id)
+	endSpan(span, err)
+	return err
+}
+
+// Trash moves a resource to the trash
+func (m *TracedModel) Trash(ctx context.Context, id uuid.UUID) error {
+	ctx, span := m.start(ctx, "Trash", uuidAttribute(id))
+	err := m.Model.Trash(ctx, id)
+	endSpan(span, err)
+	return err
+}
+
+// Restore takes a resource out of the trash
+func (m *TracedModel) Restore(ctx context.Context, id uuid.UUID) error {
+	ctx, span := m.start(ctx, "Restore", uuidAttribute(id))
+	err := m.Model.Restore(ctx, id)
+	endSpan(span, err)
+	return err
+}
+
+// ListTrashed lists the resources trashed before a given time
+func (m *TracedModel) ListTrashed(ctx context.Context, before time.Time) ([]uuid.UUID, error) {
+	ctx, span := m.start(ctx, "ListTrashed")
+	ids, err := m.Model.ListTrashed(ctx, before)
+	endSpan(span, err)
+	return ids, err
+}
+
+// Touch marks a pending resource as still being uploaded
+func (m *TracedModel) Touch(ctx context.Context, id uuid.UUID) error {
+	ctx, span := m.start(ctx, "Touch", uuidAttribute(id))
+	err := m.Model.Touch(ctx, id)
+	endSpan(span, err)
+	return err
+}
+
+// ListPending lists the pending resources last touched before a given time
+func (m *TracedModel) ListPending(ctx context.Context, before time.Time) ([]uuid.UUID, error) {
+	ctx, span := m.start(ctx, "ListPending")
+	ids, err := m.Model.ListPending(ctx, before)
+	endSpan(span, err)
+	return ids, err
+}
+
+// ListLegacyBlobs lists the resources whose blob is stored under its UUID
+func (m *TracedModel) ListLegacyBlobs(ctx context.Context) ([]uuid.UUID, error) {
+	ctx, span := m.start(ctx, "ListLegacyBlobs")
+	ids, err := m.Model.ListLegacyBlobs(ctx)
+	endSpan(span, err)
+	return ids, err
+}
+
+// ListCommitted lists the resources whose blob is stored
+func (m *TracedModel) ListCommitted(ctx context.Context) ([]uuid.UUID, error) {
+	ctx, span := m.start(ctx, "ListCommitted")
+	ids, err := m.Model.ListCommitted(ctx)
+	endSpan(span, err)
+	return ids, err
+}
+
+// CountReferences counts the resources referencing a resource
+func (m *TracedModel) CountReferences(ctx context.Context, id uuid.UUID, includeDeleted bool) (int, error) {
+	ctx, span := m.start(ctx, "CountReferences", uuidAttribute(id))
+	count, err := m.Model.CountReferences(ctx, id, includeDeleted)
+	endSpan(span, err)
+	return count, err
+}
+
+// CheckUUIDNotUsed checks no resource has a given UUID
+func (m *TracedModel) CheckUUIDNotUsed(ctx context.Context, id uuid.UUID) error {
+	ctx, span := m.start(ctx, "CheckUUIDNotUsed", uuidAttribute(id))
+	err := m.Model.CheckUUIDNotUsed(ctx, id)
+	endSpan(span, err)
+	return err
+}
+
+// TracedBlobStore traces the operations of a blob store in spans, children
+// of the span held by ctx. The span of a Get lasts until the blob is closed,
+// so that it covers its download from the backend.
+type TracedBlobStore struct {
+	common.BlobStore
+
+	ctx context.Context
+}
+
+// TraceBlobStore wraps a blob store to trace its operations in ctx
+func TraceBlobStore(ctx context.Context, blobStore common.BlobStore) *TracedBlobStore {
+	return &TracedBlobStore{BlobStore: blobStore, ctx: ctx}
+}
+
+// blobStore returns the blob store of the API, tracing its operations in ctx
+func (s *APIServer) blobStore(ctx context.Context) common.BlobStore {
+	return TraceBlobStore(ctx, s.BlobStore)
+}
+
+func (s *TracedBlobStore) start(operation, key string, attributes ...attribute.KeyValue) trace.Span {
+	attributes = append(attributes, attribute.String("blob.key", key))
+	_, span := tracer().Start(s.ctx, "BlobStore."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attributes...),
+	)
+	return span
+}
+
+// Put stores a blob
+func (s *TracedBlobStore) Put(key string, r io.Reader, size int64) error {
+	span := s.start("Put", key, attribute.Int64("blob.size", size))
+	err := s.BlobStore.Put(key, r, size)
+	endSpan(span, err)
+	return err
+}
+
+// Get opens a blob, its span ending once it is closed
+func (s *TracedBlobStore) Get(key string) (io.ReadCloser, error) {
+	span := s.start("Get", key)
+	r, err := s.BlobStore.Get(key)
+	if err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+	traced := &tracedReadCloser{ReadCloser: r, span: span}
+	if seeker, ok := r.(io.Seeker); ok {
+		return &tracedReadSeekCloser{tracedReadCloser: traced, Seeker: seeker}, nil
+	}
+	return traced, nil
+}
+
+// Delete removes a blob
+func (s *TracedBlobStore) Delete(key string) error {
+	span := s.start("Delete", key)
+	err := s.BlobStore.Delete(key)
+	endSpan(span, err)
+	return err
+}
+
+// Rename moves a blob to another key
+func (s *TracedBlobStore) Rename(oldKey, newKey string) error {
+	span := s.start("Rename", oldKey, attribute.String("blob.new_key", newKey))
+	err := s.BlobStore.Rename(oldKey, newKey)
+	endSpan(span, err)
+	return err
+}
+
+// tracedReadCloser ends the span of a blob download when the blob is closed,
+// recording the bytes read and the read errors
+type tracedReadCloser struct {
+	io.ReadCloser
+
+	span trace.Span
+	read int64
+	err  error
+}
+
+func (r *tracedReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.read += int64(n)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+func (r *tracedReadCloser) Close() error {
+	err := r.ReadCloser.Close()
+	if r.err == nil {
+		r.err = err
+	}
+	r.span.SetAttributes(attribute.Int64("blob.bytes_read", r.read))
+	endSpan(r.span, r.err)
+	return err
+}
+
+type tracedReadSeekCloser struct {
+	*tracedReadCloser
+	io.Seeker
+}
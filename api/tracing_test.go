@@ -0,0 +1,330 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	gohttptest "net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"gopkg.in/kataras/iris.v6"
+	"gopkg.in/kataras/iris.v6/httptest"
+
+	. "github.com/MorpheoOrg/morpheo-storage/api"
+)
+
+// Trace of the client of the traced requests
+const (
+	clientTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	clientSpanID  = "00f067aa0ba902b7"
+)
+
+// newTracedTestApp sets up an Iris App serving an API whose resource queries
+// are traced
+func newTracedTestApp() *iris.Framework {
+	api := newTestServer(NewMemoryBlobStore())
+	api.ProblemModel = TraceModel(api.ProblemModel)
+	api.AlgoModel = TraceModel(api.AlgoModel)
+	api.ModelModel = TraceModel(api.ModelModel)
+	api.DataModel = TraceModel(api.DataModel)
+	api.PredictionModel = TraceModel(api.PredictionModel)
+	return configureTestApp(api)
+}
+
+// exportedSpan holds the fields of the spans written by the stdout exporter
+// checked by the tests
+type exportedSpan struct {
+	Name        string
+	SpanContext struct {
+		TraceID string
+		SpanID  string
+	}
+	Parent struct {
+		TraceID string
+		SpanID  string
+	}
+}
+
+func TestTracing(t *testing.T) {
+	if _, err := SetupTracing(&StorageConfig{TracingExporter: "zipkin"}); err == nil {
+		t.Errorf("Unknown trace exporter accepted")
+	}
+
+	dir, err := ioutil.TempDir("", "tracing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	traceFile := filepath.Join(dir, "traces.json")
+	shutdown, err := SetupTracing(&StorageConfig{TracingExporter: TracingStdout, TraceFile: traceFile})
+	if err != nil {
+		t.Fatalf("Error setting up tracing: %s", err)
+	}
+
+	e := httptest.New(newTracedTestApp(), t)
+
+	id := uuid.NewV4().String()
+	e.POST(DataListRoute).WithBasicAuth("u", "p").WithMultipart().WithFormField("uuid", id).WithFormField("size", BlobSize).WithFile("blob", "main.go").Expect().Status(201)
+
+	// Test the traceparent of the client is propagated
+	e.GET(DataListRoute+"/"+id+"/blob").WithBasicAuth("u", "p").WithHeader("traceparent", "00-"+clientTraceID+"-"+clientSpanID+"-01").Expect().Status(200)
+
+	// Test a trace sampled out by the client isn't recorded
+	unsampledTraceID := "0af7651916cd43dd8448eb211c80319c"
+	e.GET(DataListRoute+"/"+id).WithBasicAuth("u", "p").WithHeader("traceparent", "00-"+unsampledTraceID+"-b7ad6b7169203331-00").Expect().Status(200)
+	shutdown()
+
+	f, err := os.Open(traceFile)
+	if err != nil {
+		t.Fatalf("Error opening trace file: %s", err)
+	}
+	defer f.Close()
+	spans := make(map[string][]exportedSpan)
+	decoder := json.NewDecoder(f)
+	for {
+		var span exportedSpan
+		if err := decoder.Decode(&span); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Error decoding spans: %s", err)
+		}
+		if span.SpanContext.TraceID == unsampledTraceID {
+			t.Errorf("Span %s of a trace sampled out exported", span.Name)
+		}
+		spans[span.Name] = append(spans[span.Name], span)
+	}
+
+	// Test the upload is traced down to its SQL and blob store operations
+	for _, name := range []string{"HTTP POST /data", "SQLModel.CheckUUIDNotUsed", "SQLModel.Insert", "SQLModel.Update", "BlobStore.Put"} {
+		if len(spans[name]) == 0 {
+			t.Errorf("No %s span exported", name)
+		}
+	}
+
+	// Test the spans of the download belong to the trace of the client
+	requests := spans["HTTP GET /data/:uuid/blob"]
+	if len(requests) != 1 {
+		t.Fatalf("Expected 1 download span, got %d", len(requests))
+	}
+	request := requests[0]
+	if request.SpanContext.TraceID != clientTraceID || request.Parent.SpanID != clientSpanID {
+		t.Errorf("Download span %s/%s isn't a child of %s/%s", request.SpanContext.TraceID, request.Parent.SpanID, clientTraceID, clientSpanID)
+	}
+	for _, name := range []string{"SQLModel.GetOne", "BlobStore.Get"} {
+		found := false
+		for _, span := range spans[name] {
+			if span.SpanContext.TraceID == clientTraceID && span.Parent.SpanID == request.SpanContext.SpanID {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("No %s span child of the download span", name)
+		}
+	}
+}
+
+func TestTracedModel(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(provider)
+	defer provider.Shutdown(context.Background())
+
+	model, _ := NewMockedModel(DataModelName)
+	traced := TraceModel(model)
+	ctx, parent := otel.Tracer("test").Start(context.Background(), "parent")
+	id := uuid.NewV4()
+	data := NewDataResource()
+	list := []DataResource{}
+	opts := NewListOptions()
+	traced.Insert(ctx, data)
+	traced.List(ctx, &list, opts)
+	traced.Count(ctx, opts)
+	traced.GetOne(ctx, data, id, false)
+	traced.Update(ctx, data, id)
+	traced.Delete(ctx, id)
+	traced.Trash(ctx, id)
+	traced.Restore(ctx, id)
+	traced.ListTrashed(ctx, time.Now())
+	traced.Touch(ctx, id)
+	traced.ListPending(ctx, time.Now())
+	traced.ListLegacyBlobs(ctx)
+	traced.ListCommitted(ctx)
+	traced.CountReferences(ctx, id, false)
+	traced.CheckUUIDNotUsed(ctx, id)
+	parent.End()
+
+	// Test every query is traced as a child of the span of its context
+	traces := make(map[string]bool)
+	for _, span := range recorder.Ended() {
+		if span.Parent().SpanID() == parent.SpanContext().SpanID() {
+			traces[span.Name()] = true
+		}
+	}
+	for _, operation := range []string{"Insert", "List", "Count", "GetOne", "Update", "Delete", "Trash", "Restore", "ListTrashed", "Touch", "ListPending", "ListLegacyBlobs", "ListCommitted", "CountReferences", "CheckUUIDNotUsed"} {
+		if !traces["SQLModel."+operation] {
+			t.Errorf("SQLModel.%s not traced in its context", operation)
+		}
+	}
+
+	// Test the queries of background jobs are traced under the span of the job
+	api := newTestServer(NewMemoryBlobStore())
+	api.DataModel = TraceModel(api.DataModel)
+	api.PurgeTrash(time.Now())
+	var job sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		if span.Name() == "PurgeTrash" {
+			job = span
+		}
+	}
+	if job == nil {
+		t.Fatalf("Trash purge not traced")
+	}
+	found := false
+	for _, span := range recorder.Ended() {
+		if span.Name() == "SQLModel.ListTrashed" && span.Parent().SpanID() == job.SpanContext().SpanID() {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("No SQLModel.ListTrashed span child of the trash purge span")
+	}
+}
+
+// otlpTraces holds the fields of the OTLP/JSON requests checked by the tests
+type otlpTraces struct {
+	ResourceSpans []struct {
+		Resource struct {
+			Attributes []struct {
+				Key   string
+				Value struct {
+					StringValue string
+				}
+			}
+		}
+		ScopeSpans []struct {
+			Scope struct {
+				Name string
+			}
+			Spans []struct {
+				TraceID           string
+				SpanID            string
+				ParentSpanID      string
+				Name              string
+				Kind              int
+				StartTimeUnixNano string
+				EndTimeUnixNano   string
+			}
+		}
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var lock sync.Mutex
+	var requests []otlpTraces
+	collector := gohttptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Unexpected OTLP request: %s %s (%s)", r.Method, r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		var traces otlpTraces
+		if err := json.NewDecoder(r.Body).Decode(&traces); err != nil {
+			t.Errorf("Error decoding OTLP request: %s", err)
+		}
+		lock.Lock()
+		requests = append(requests, traces)
+		lock.Unlock()
+		w.WriteHeader(200)
+	}))
+	defer collector.Close()
+
+	shutdown, err := SetupTracing(&StorageConfig{
+		TracingExporter: TracingOTLP,
+		OTLPEndpoint:    strings.TrimPrefix(collector.URL, "http://"),
+		OTLPInsecure:    true,
+	})
+	if err != nil {
+		t.Fatalf("Error setting up tracing: %s", err)
+	}
+	e := httptest.New(newTracedTestApp(), t)
+	e.GET(DataListRoute).WithBasicAuth("u", "p").WithHeader("traceparent", "00-"+clientTraceID+"-"+clientSpanID+"-01").Expect().Status(200)
+	shutdown()
+
+	lock.Lock()
+	defer lock.Unlock()
+	names := make(map[string]bool)
+	for _, traces := range requests {
+		for _, resourceSpans := range traces.ResourceSpans {
+			attributes := resourceSpans.Resource.Attributes
+			if len(attributes) != 1 || attributes[0].Key != "service.name" || attributes[0].Value.StringValue != "morpheo-storage" {
+				t.Errorf("Unexpected resource attributes %v", attributes)
+			}
+			for _, scopeSpans := range resourceSpans.ScopeSpans {
+				for _, span := range scopeSpans.Spans {
+					names[span.Name] = true
+					if span.TraceID != clientTraceID {
+						t.Errorf("Span %s exported in trace %s instead of %s", span.Name, span.TraceID, clientTraceID)
+					}
+					start, errStart := strconv.ParseInt(span.StartTimeUnixNano, 10, 64)
+					end, errEnd := strconv.ParseInt(span.EndTimeUnixNano, 10, 64)
+					if errStart != nil || errEnd != nil || start == 0 || end < start {
+						t.Errorf("Invalid times for span %s: %s-%s", span.Name, span.StartTimeUnixNano, span.EndTimeUnixNano)
+					}
+					if span.Name == "HTTP GET /data" && (span.ParentSpanID != clientSpanID || span.Kind != 2) {
+						t.Errorf("Request span exported with parent %s and kind %d", span.ParentSpanID, span.Kind)
+					}
+				}
+			}
+		}
+	}
+	for _, name := range []string{"HTTP GET /data", "SQLModel.List", "SQLModel.Count"} {
+		if !names[name] {
+			t.Errorf("No %s span sent to the OTLP collector", name)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/kataras/iris.v6"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+)
+
+// deleteResource moves a resource to the trash. Its blob is kept until the
+// trash is purged, so that it can still be restored. Resources still referenced
+// by other ones outside of the trash can't be deleted.
+func (s *APIServer) deleteResource(resourceModel Model) iris.HandlerFunc {
+	modelName := resourceModel.GetModelName()
+	return func(c *iris.Context) {
+		ctx := requestContext(c)
+		id, err := uuid.FromString(c.Param("uuid"))
+		if err != nil {
+			c.JSON(400, common.NewAPIError(fmt.Sprintf("Impossible to parse UUID %s: %s", id, err)))
+			return
+		}
+		resource, err := NewStoredResource(modelName)
+		if err != nil {
+			c.JSON(500, common.NewAPIError(err.Error()))
+			return
+		}
+		if err = resourceModel.GetOne(ctx, resource, id, false); err != nil {
+			c.JSON(404, common.NewAPIError(fmt.Sprintf("Error retrieving %s %s: %s", modelName, c.Param("uuid"), err)))
+			return
+		}
+		if err = s.checkOwner(modelName, resource, c); err != nil {
+			c.JSON(403, common.NewAPIError(fmt.Sprintf("Error deleting %s: %s", modelName, err)))
+			return
+		}
+
+		references, err := resourceModel.CountReferences(ctx, id, false)
+		if err != nil {
+			c.JSON(500, common.NewAPIError(fmt.Sprintf("Error deleting %s %s: %s", modelName, id, err)))
+			return
+		}
+		if references > 0 {
+			c.JSON(409, common.NewAPIError(fmt.Sprintf("Error deleting %s %s: still referenced by %d other resource(s)", modelName, id, references)))
+			return
+		}
+
+		if err = resourceModel.Trash(ctx, id); err != nil {
+			c.JSON(500, common.NewAPIError(fmt.Sprintf("Error moving %s %s to the trash: %s", modelName, id, err)))
+			return
+		}
+		c.SetStatusCode(204)
+	}
+}
+
+// restoreResource moves a resource out of the trash
+func (s *APIServer) restoreResource(resourceModel Model) iris.HandlerFunc {
+	modelName := resourceModel.GetModelName()
+	return func(c *iris.Context) {
+		ctx := requestContext(c)
+		id, err := uuid.FromString(c.Param("uuid"))
+		if err != nil {
+			c.JSON(400, common.NewAPIError(fmt.Sprintf("Impossible to parse UUID %s: %s", id, err)))
+			return
+		}
+		resource, err := NewStoredResource(modelName)
+		if err != nil {
+			c.JSON(500, common.NewAPIError(err.Error()))
+			return
+		}
+		if err = resourceModel.GetOne(ctx, resource, id, true); err != nil {
+			c.JSON(404, common.NewAPIError(fmt.Sprintf("Error retrieving %s %s: %s", modelName, c.Param("uuid"), err)))
+			return
+		}
+		if err = s.checkOwner(modelName, resource, c); err != nil {
+			c.JSON(403, common.NewAPIError(fmt.Sprintf("Error restoring %s: %s", modelName, err)))
+			return
+		}
+		if resource.Meta().DeletedAt == nil {
+			c.JSON(409, common.NewAPIError(fmt.Sprintf("Error restoring %s %s: not in the trash", modelName, id)))
+			return
+		}
+		// A model can't be restored without its algo
+		if model, ok := resource.(*ModelResource); ok {
+			if _, err = s.getAlgoInstance(ctx, model.Algo, false); err != nil {
+				c.JSON(409, common.NewAPIError(fmt.Sprintf("Error restoring %s %s: its algo %s is in the trash or gone: %s", modelName, id, model.Algo, err)))
+				return
+			}
+		}
+
+		if err = resourceModel.Restore(ctx, id); err != nil {
+			c.JSON(500, common.NewAPIError(fmt.Sprintf("Error restoring %s %s: %s", modelName, id, err)))
+			return
+		}
+		resource.Meta().DeletedAt = nil
+		c.JSON(200, resource)
+	}
+}
+
+// PurgeTrash deletes for good the resources moved to the trash before a given
+// date, along with their blobs. It returns the number of purged resources.
+func (s *APIServer) PurgeTrash(before time.Time) (int, error) {
+	ctx, span := startJob("PurgeTrash")
+	defer span.End()
+
+	// Referencing resources go first, so that the resources they point at can
+	// be deleted in the same run
+	resourceModels := []Model{s.PredictionModel, s.ModelModel, s.DataModel, s.AlgoModel, s.ProblemModel}
+
+	purged := 0
+	var lastErr error
+	for _, resourceModel := range resourceModels {
+		modelName := resourceModel.GetModelName()
+		ids, err := resourceModel.ListTrashed(ctx, before)
+		if err != nil {
+			lastErr = err
+			log.WithField("component", "purge").Errorf("Error listing trashed %s: %s", modelName, err)
+			continue
+		}
+		for _, id := range ids {
+			// Resources still referenced, even by resources in the trash, wait
+			// for the resources pointing at them to be purged
+			references, err := resourceModel.CountReferences(ctx, id, true)
+			if err != nil {
+				lastErr = err
+				log.WithField("component", "purge").Errorf("Error counting references to %s %s: %s", modelName, id, err)
+				continue
+			}
+			if references > 0 {
+				log.WithField("component", "purge").Warnf("Not purging %s %s: still referenced by %d other resource(s)", modelName, id, references)
+				continue
+			}
+			resource, err := NewStoredResource(modelName)
+			if err == nil {
+				err = resourceModel.GetOne(ctx, resource, id, true)
+			}
+			if err != nil {
+				lastErr = err
+				log.WithField("component", "purge").Errorf("Error retrieving %s %s from database: %s", modelName, id, err)
+				continue
+			}
+			if err = resourceModel.Delete(ctx, id); err != nil {
+				lastErr = err
+				log.WithField("component", "purge").Errorf("Error deleting %s %s from database: %s", modelName, id, err)
+				continue
+			}
+			purged++
+			s.discardBlob(ctx, s.resourceBlobKey(modelName, resource))
+		}
+	}
+	return purged, lastErr
+}
+
+// RunTrashPurger purges the trash every interval, deleting the resources that
+// have been in there for longer than retention. It returns when stop is closed.
+func (s *APIServer) RunTrashPurger(interval, retention time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			n, err := s.PurgeTrash(time.Now().Add(-retention))
+			if err != nil {
+				log.WithField("component", "purge").Warnf("Trash partially purged (%d resource(s) deleted): %s", n, err)
+			} else if n > 0 {
+				log.WithField("component", "purge").Infof("%d resource(s) deleted from the trash", n)
+			}
+		}
+	}
+}
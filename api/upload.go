@@ -0,0 +1,823 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/kataras/iris.v6"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+)
+
+// Resumable uploads implement the core protocol of tus 1.0 (http://tus.io),
+// along with its creation, expiration and termination extensions. Each PATCH
+// request stores its bytes as a chunk on the blob store. Once all the bytes of
+// an upload have been received, its chunks are concatenated into the resource
+// blob and the resource is inserted in base. Uploads left without a new chunk
+// for UploadExpiration are deleted along with their chunks by ExpireUploads.
+const (
+	TusVersion    = "1.0.0"
+	TusExtensions = "creation,expiration,termination"
+
+	// TusChunkContentType is the content type of tus PATCH requests
+	TusChunkContentType = "application/offset+octet-stream"
+)
+
+// UploadMetadataFields lists the Upload-Metadata keys used to fill the
+// uploaded resource. Other keys are ignored.
+var UploadMetadataFields = map[string][]string{
+	ProblemModelName:    []string{"uuid", "name", "description", "checksum", "filename", "filetype"},
+	AlgoModelName:       []string{"uuid", "name", "checksum", "filename", "filetype"},
+	ModelModelName:      []string{"uuid", "algo", "checksum", "filename", "filetype"},
+	DataModelName:       []string{"uuid", "checksum", "filename", "filetype"},
+	PredictionModelName: []string{"uuid", "checksum", "filename", "filetype"},
+}
+
+// An upload is receiving chunks until its last byte is received. It is then
+// finishing while its resource is created, which only one request can do.
+const (
+	UploadReceiving = "receiving"
+	UploadFinishing = "finishing"
+)
+
+// ErrUploadConflict is returned when a chunk is added to an upload whose offset
+// was moved by another request
+var ErrUploadConflict = errors.New("Upload offset changed by a concurrent request")
+
+// ErrUploadFinishing is returned when an upload is already being finished by
+// another request
+var ErrUploadFinishing = errors.New("Upload already being finished by another request")
+
+// Upload is a resumable upload in progress
+type Upload struct {
+	ID               uuid.UUID `db:"uuid"`
+	Resource         string    `db:"resource"`
+	Length           int64     `db:"upload_length"`
+	Offset           int64     `db:"upload_offset"`
+	Metadata         string    `db:"metadata"`
+	Status           string    `db:"status"`
+	TimestampCreated int64     `db:"timestamp_created"`
+	TimestampUpdated int64     `db:"timestamp_updated"`
+	Owner            string    `db:"owner"`
+}
+
+// Expires returns the date after which an upload left without a new chunk
+// expires
+func (u *Upload) Expires(expiration time.Duration) time.Time {
+	return time.Unix(u.TimestampUpdated, 0).Add(expiration)
+}
+
+// UploadModel stores the state of resumable uploads
+type UploadModel interface {
+	Create(upload *Upload) error
+	Get(id uuid.UUID) (*Upload, error)
+	AddChunk(id uuid.UUID, offset int64, size int64, blobKey string) error
+	ListChunks(id uuid.UUID) ([]string, error)
+	MarkFinishing(id uuid.UUID) error
+	UnmarkFinishing(id uuid.UUID) error
+	ListExpired(before time.Time) ([]uuid.UUID, error)
+	Delete(id uuid.UUID) error
+}
+
+// SQLUploadModel stores resumable uploads in a postgreSQL database
+type SQLUploadModel struct {
+	*sqlx.DB
+}
+
+// NewSQLUploadModel creates an UploadModel instance, bound to a given database
+func NewSQLUploadModel(db *sqlx.DB) (*SQLUploadModel, error) {
+	return &SQLUploadModel{db}, nil
+}
+
+// Create inserts a new upload in base
+func (m *SQLUploadModel) Create(upload *Upload) error {
+	_, err := m.NamedExec(`INSERT INTO upload (uuid, resource, upload_length, upload_offset, metadata, status, timestamp_created, timestamp_updated, owner) VALUES (:uuid, :resource, :upload_length, :upload_offset, :metadata, :status, :timestamp_created, :timestamp_updated, :owner)`, upload)
+	return err
+}
+
+// Get fetches an upload by uuid
+func (m *SQLUploadModel) Get(id uuid.UUID) (*Upload, error) {
+	upload := &Upload{}
+	if err := m.DB.Get(upload, `SELECT * FROM upload WHERE uuid=$1 LIMIT 1`, id); err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+// AddChunk records a chunk of size bytes stored under blobKey, and moves the
+// upload offset past it, which postpones its expiration. ErrUploadConflict is
+// returned if the upload offset isn't offset anymore.
+func (m *SQLUploadModel) AddChunk(id uuid.UUID, offset int64, size int64, blobKey string) error {
+	tx, err := m.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`UPDATE upload SET upload_offset=$3, timestamp_updated=$4 WHERE uuid=$1 AND upload_offset=$2 AND status='receiving'`, id, offset, offset+size, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrUploadConflict
+	}
+	if _, err = tx.Exec(`INSERT INTO upload_chunk (upload, chunk_offset, blob_key) VALUES ($1, $2, $3)`, id, offset, blobKey); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ListChunks returns the blob keys of the chunks of an upload, in order
+func (m *SQLUploadModel) ListChunks(id uuid.UUID) ([]string, error) {
+	var keys []string
+	if err := m.Select(&keys, `SELECT blob_key FROM upload_chunk WHERE upload=$1 ORDER BY chunk_offset`, id); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// MarkFinishing marks a complete upload as finishing. The update locks the
+// upload row, so that ErrUploadFinishing is returned to all the concurrent
+// requests but one.
+func (m *SQLUploadModel) MarkFinishing(id uuid.UUID) error {
+	res, err := m.Exec(`UPDATE upload SET status='finishing', timestamp_updated=$2 WHERE uuid=$1 AND status='receiving'`, id, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrUploadFinishing
+	}
+	return nil
+}
+
+// UnmarkFinishing marks an upload that couldn't be finished as receiving again,
+// so that it can be finished by a retry
+func (m *SQLUploadModel) UnmarkFinishing(id uuid.UUID) error {
+	_, err := m.Exec(`UPDATE upload SET status='receiving' WHERE uuid=$1 AND status='finishing'`, id)
+	return err
+}
+
+// ListExpired returns the UUIDs of the uploads whose last chunk was received
+// before a given date
+func (m *SQLUploadModel) ListExpired(before time.Time) ([]uuid.UUID, error) {
+	var ids []uuid.UUID
+	if err := m.Select(&ids, `SELECT uuid FROM upload WHERE timestamp_updated<$1`, before.Unix()); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// Delete deletes an upload and its chunk records
+func (m *SQLUploadModel) Delete(id uuid.UUID) error {
+	_, err := m.Exec(`DELETE FROM upload WHERE uuid=$1`, id)
+	return err
+}
+
+// MockedUploadModel keeps resumable uploads in memory
+type MockedUploadModel struct {
+	sync.Mutex
+
+	uploads map[uuid.UUID]*Upload
+	chunks  map[uuid.UUID][]string
+}
+
+// NewMockedUploadModel creates an empty MockedUploadModel
+func NewMockedUploadModel() (*MockedUploadModel, error) {
+	return &MockedUploadModel{
+		uploads: make(map[uuid.UUID]*Upload),
+		chunks:  make(map[uuid.UUID][]string),
+	}, nil
+}
+
+// Create stores a new upload
+func (m *MockedUploadModel) Create(upload *Upload) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.uploads[upload.ID]; ok {
+		return fmt.Errorf("[mock] Upload %s already exists", upload.ID)
+	}
+	u := *upload
+	m.uploads[upload.ID] = &u
+	return nil
+}
+
+// Get returns a copy of an upload
+func (m *MockedUploadModel) Get(id uuid.UUID) (*Upload, error) {
+	m.Lock()
+	defer m.Unlock()
+	upload, ok := m.uploads[id]
+	if !ok {
+		return nil, fmt.Errorf("[mock] Upload %s not found: sql: no rows in result set", id)
+	}
+	u := *upload
+	return &u, nil
+}
+
+// AddChunk records a chunk and moves the upload offset past it
+func (m *MockedUploadModel) AddChunk(id uuid.UUID, offset int64, size int64, blobKey string) error {
+	m.Lock()
+	defer m.Unlock()
+	upload, ok := m.uploads[id]
+	if !ok || upload.Offset != offset || upload.Status != UploadReceiving {
+		return ErrUploadConflict
+	}
+	upload.Offset += size
+	upload.TimestampUpdated = time.Now().Unix()
+	m.chunks[id] = append(m.chunks[id], blobKey)
+	return nil
+}
+
+// ListChunks returns the blob keys of the chunks of an upload, in order
+func (m *MockedUploadModel) ListChunks(id uuid.UUID) ([]string, error) {
+	m.Lock()
+	defer m.Unlock()
+	return append([]string(nil), m.chunks[id]...), nil
+}
+
+// MarkFinishing marks a complete upload as finishing
+func (m *MockedUploadModel) MarkFinishing(id uuid.UUID) error {
+	m.Lock()
+	defer m.Unlock()
+	upload, ok := m.uploads[id]
+	if !ok || upload.Status != UploadReceiving {
+		return ErrUploadFinishing
+	}
+	upload.Status = UploadFinishing
+	upload.TimestampUpdated = time.Now().Unix()
+	return nil
+}
+
+// UnmarkFinishing marks an upload that couldn't be finished as receiving again
+func (m *MockedUploadModel) UnmarkFinishing(id uuid.UUID) error {
+	m.Lock()
+	defer m.Unlock()
+	if upload, ok := m.uploads[id]; ok {
+		upload.Status = UploadReceiving
+	}
+	return nil
+}
+
+// ListExpired returns the UUIDs of the uploads whose last chunk was received
+// before a given date
+func (m *MockedUploadModel) ListExpired(before time.Time) ([]uuid.UUID, error) {
+	m.Lock()
+	defer m.Unlock()
+	ids := []uuid.UUID{}
+	for id, upload := range m.uploads {
+		if upload.TimestampUpdated < before.Unix() {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// Delete deletes an upload
+func (m *MockedUploadModel) Delete(id uuid.UUID) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.uploads, id)
+	delete(m.chunks, id)
+	return nil
+}
+
+// parseUploadMetadata parses an Upload-Metadata header: a comma separated list
+// of keys followed by their base64 encoded value
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		fields := strings.Fields(pair)
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("Invalid Upload-Metadata pair %s", pair)
+		}
+		value := ""
+		if len(fields) == 2 {
+			decoded, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("Error decoding Upload-Metadata value of %s: %s", fields[0], err)
+			}
+			if len(decoded) > StrFieldMaxLength {
+				return nil, fmt.Errorf("Upload-Metadata value of %s too long (max length is %d)", fields[0], StrFieldMaxLength)
+			}
+			value = string(decoded)
+		}
+		metadata[fields[0]] = value
+	}
+	return metadata, nil
+}
+
+// encodeUploadMetadata is the inverse of parseUploadMetadata, keys are sorted
+func encodeUploadMetadata(metadata map[string]string) string {
+	keys := make([]string, 0, len(metadata))
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, key+" "+base64.StdEncoding.EncodeToString([]byte(metadata[key])))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// newUploadResource builds the resource described by the metadata of an
+// upload, the same way streamMultipartToStorage does from a multipart form
+func (s *APIServer) newUploadResource(ctx context.Context, modelName string, metadata map[string]string) (StoredResource, int, error) {
+	formFields := make(map[string]interface{})
+	for _, field := range UploadMetadataFields[modelName] {
+		value, ok := metadata[field]
+		if !ok {
+			continue
+		}
+		switch field {
+		case "uuid":
+			id, err := uuid.FromString(value)
+			if err != nil {
+				return nil, 400, fmt.Errorf("Error parsing UUID %s", err)
+			}
+			formFields["uuid"] = id
+		case "name", "description":
+			formFields[field] = value
+		}
+	}
+
+	// Models are bound to their algo when created, as in postModel
+	var resource StoredResource
+	switch modelName {
+	case ProblemModelName:
+		resource = NewProblemResource()
+	case AlgoModelName:
+		resource = NewAlgoResource()
+	case DataModelName:
+		resource = NewDataResource()
+	case PredictionModelName:
+		resource = NewPredictionResource()
+	case ModelModelName:
+		algoID, err := uuid.FromString(metadata["algo"])
+		if err != nil {
+			return nil, 400, fmt.Errorf("Impossible to parse algo UUID %s: %s", metadata["algo"], err)
+		}
+		algo, err := s.getAlgoInstance(ctx, algoID, false)
+		if err != nil {
+			return nil, 404, fmt.Errorf("Algorithm %s not found: %s", algoID, err)
+		}
+		modelID, _ := formFields["uuid"].(uuid.UUID)
+		resource = NewModelResource(modelID, algo)
+	default:
+		return nil, 404, fmt.Errorf("Unknown resource %s", modelName)
+	}
+
+	if modelName != ModelModelName {
+		if err := resource.FillResource(formFields); err != nil {
+			return nil, 400, fmt.Errorf("Invalid Upload-Metadata: %s", err)
+		}
+	}
+	if err := resource.Check(); err != nil {
+		return nil, 400, fmt.Errorf("Invalid Upload-Metadata: %s", err)
+	}
+	if filename, ok := metadata["filename"]; ok {
+		var err error
+		if resource.Meta().Filename, err = parseFilename(filename); err != nil {
+			return nil, 400, err
+		}
+	}
+	resource.Meta().ContentType = parseBlobContentType(metadata["filetype"])
+	return resource, 201, nil
+}
+
+// tusResumable checks the protocol version of tus requests, and sets it on
+// their responses
+func tusResumable(c *iris.Context) {
+	c.SetHeader("Tus-Resumable", TusVersion)
+	if c.Request.Header.Get("Tus-Resumable") != TusVersion {
+		c.SetHeader("Tus-Version", TusVersion)
+		c.JSON(412, common.NewAPIError(fmt.Sprintf("Unsupported tus version %s. Should be: %s", c.Request.Header.Get("Tus-Resumable"), TusVersion)))
+		return
+	}
+	c.Next()
+}
+
+func (s *APIServer) optionsUpload(c *iris.Context) {
+	c.SetHeader("Tus-Resumable", TusVersion)
+	c.SetHeader("Tus-Version", TusVersion)
+	c.SetHeader("Tus-Extension", TusExtensions)
+	c.SetStatusCode(204)
+}
+
+func (s *APIServer) createUpload(c *iris.Context) {
+	modelName := c.Param("resource")
+	resourceModel, err := s.getResourceModel(modelName)
+	if err != nil {
+		c.JSON(404, common.NewAPIError(err.Error()))
+		return
+	}
+
+	if c.Request.Header.Get("Upload-Defer-Length") != "" {
+		c.JSON(400, common.NewAPIError("Upload-Defer-Length is not supported, Upload-Length must be set"))
+		return
+	}
+	length, err := strconv.ParseInt(c.Request.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		c.JSON(400, common.NewAPIError(fmt.Sprintf("Invalid Upload-Length %s: should be the blob size in bytes", c.Request.Header.Get("Upload-Length"))))
+		return
+	}
+	metadata, err := parseUploadMetadata(c.Request.Header.Get("Upload-Metadata"))
+	if err != nil {
+		c.JSON(400, common.NewAPIError(err.Error()))
+		return
+	}
+	if checksum, ok := metadata["checksum"]; ok {
+		if _, err = parseChecksum(checksum); err != nil {
+			c.JSON(400, common.NewAPIError(err.Error()))
+			return
+		}
+	}
+
+	// The resource is checked right away, so that invalid uploads are
+	// rejected before any byte is sent
+	resource, statusCode, err := s.newUploadResource(requestContext(c), modelName, metadata)
+	if err != nil {
+		c.JSON(statusCode, common.NewAPIError(fmt.Sprintf("[Error creating %s upload] %s", modelName, err)))
+		return
+	}
+	if err = resourceModel.CheckUUIDNotUsed(requestContext(c), resource.GetUUID()); err != nil {
+		c.JSON(409, common.NewAPIError(err.Error()))
+		return
+	}
+	metadata["uuid"] = resource.GetUUID().String()
+
+	now := time.Now().Unix()
+	upload := &Upload{
+		ID:               uuid.NewV4(),
+		Resource:         modelName,
+		Length:           length,
+		Metadata:         encodeUploadMetadata(metadata),
+		Status:           UploadReceiving,
+		TimestampCreated: now,
+		TimestampUpdated: now,
+		Owner:            principal(c),
+	}
+	if err = s.UploadModel.Create(upload); err != nil {
+		c.JSON(500, common.NewAPIError(fmt.Sprintf("Error creating %s upload in database: %s", modelName, err)))
+		return
+	}
+	c.SetHeader("Location", fmt.Sprintf("/upload/%s/%s", modelName, upload.ID))
+	s.setUploadExpires(upload, c)
+	c.SetStatusCode(201)
+}
+
+// setUploadExpires sets the Upload-Expires header of an upload response, unless
+// uploads never expire
+func (s *APIServer) setUploadExpires(upload *Upload, c *iris.Context) {
+	if s.UploadExpiration > 0 {
+		c.SetHeader("Upload-Expires", upload.Expires(s.UploadExpiration).UTC().Format(http.TimeFormat))
+	}
+}
+
+// getUpload returns the upload targeted by a request, or writes the error
+// response and returns nil. Uploads can only be resumed by the user who created
+// them. Expired uploads waiting for ExpireUploads are Gone.
+func (s *APIServer) getUpload(c *iris.Context) *Upload {
+	id, err := uuid.FromString(c.Param("upload"))
+	if err != nil {
+		c.JSON(400, common.NewAPIError(fmt.Sprintf("Impossible to parse upload UUID %s: %s", c.Param("upload"), err)))
+		return nil
+	}
+	upload, err := s.UploadModel.Get(id)
+	if err == nil && upload.Resource != c.Param("resource") {
+		err = fmt.Errorf("upload is a %s upload", upload.Resource)
+	}
+	if err != nil {
+		c.JSON(404, common.NewAPIError(fmt.Sprintf("Error retrieving %s upload %s: %s", c.Param("resource"), id, err)))
+		return nil
+	}
+	if upload.Owner != principal(c) {
+		c.JSON(403, common.NewAPIError(fmt.Sprintf("Error retrieving %s upload %s: upload belongs to another user", c.Param("resource"), id)))
+		return nil
+	}
+	if s.UploadExpiration > 0 && time.Now().After(upload.Expires(s.UploadExpiration)) {
+		c.JSON(410, common.NewAPIError(fmt.Sprintf("Error retrieving %s upload %s: upload expired", c.Param("resource"), id)))
+		return nil
+	}
+	return upload
+}
+
+func (s *APIServer) headUpload(c *iris.Context) {
+	upload := s.getUpload(c)
+	if upload == nil {
+		return
+	}
+	c.SetHeader("Cache-Control", "no-store")
+	c.SetHeader("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.SetHeader("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	c.SetHeader("Upload-Metadata", upload.Metadata)
+	s.setUploadExpires(upload, c)
+	c.SetStatusCode(200)
+}
+
+// patchUpload stores a chunk of an upload, and finishes the upload once its
+// last byte is received. Finishing an upload can take a while, as its whole blob
+// is copied: a request sent while it is finishing, e.g. a client retrying the
+// last PATCH after a timeout, gets a 202 if it sends no more bytes, and a 409
+// otherwise. If the upload can't be finished for a reason other than an invalid
+// blob, it can be finished again by a PATCH sending no bytes at its last offset.
+func (s *APIServer) patchUpload(c *iris.Context) {
+	defer c.Request.Body.Close()
+	upload := s.getUpload(c)
+	if upload == nil {
+		return
+	}
+	release, err := s.startTransfer(TransferUpload, c)
+	if err != nil {
+		c.JSON(429, common.NewAPIError(err.Error()))
+		return
+	}
+	defer release()
+
+	if c.Request.Header.Get("Content-Type") != TusChunkContentType {
+		c.JSON(415, common.NewAPIError(fmt.Sprintf("Invalid media type: %s. Should be: %s", c.Request.Header.Get("Content-Type"), TusChunkContentType)))
+		return
+	}
+	offset, err := strconv.ParseInt(c.Request.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		c.JSON(400, common.NewAPIError(fmt.Sprintf("Error parsing header 'Upload-Offset': %s", err)))
+		return
+	}
+	if upload.Status == UploadFinishing {
+		finishingResponse(upload, offset, c)
+		return
+	}
+	if offset != upload.Offset {
+		c.JSON(409, common.NewAPIError(fmt.Sprintf("Upload-Offset %d doesn't match the upload offset %d", offset, upload.Offset)))
+		return
+	}
+	size, err := strconv.ParseInt(c.Request.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		c.JSON(400, common.NewAPIError(fmt.Sprintf("Error parsing header 'Content-Length': should be chunk size in bytes. err: %s", err)))
+		return
+	}
+	if offset+size > upload.Length {
+		c.JSON(400, common.NewAPIError(fmt.Sprintf("Chunk too large: %d bytes sent at offset %d, but the upload length is %d", size, offset, upload.Length)))
+		return
+	}
+
+	if size > 0 {
+		chunkKey := fmt.Sprintf("upload/%s/%s", upload.ID, uuid.NewV4())
+		if statusCode, err := s.putBlob(requestContext(c), chunkKey, c.Request.Body, size, "", &ResourceMeta{}); err != nil {
+			c.JSON(statusCode, common.NewAPIError(fmt.Sprintf("[Error uploading chunk] %s", err)))
+			return
+		}
+		if err = s.UploadModel.AddChunk(upload.ID, offset, size, chunkKey); err != nil {
+			s.deleteBlob(requestContext(c), chunkKey)
+			if err == ErrUploadConflict {
+				c.JSON(409, common.NewAPIError(err.Error()))
+				return
+			}
+			c.JSON(500, common.NewAPIError(fmt.Sprintf("Error recording chunk of upload %s in database: %s", upload.ID, err)))
+			return
+		}
+		upload.Offset += size
+		upload.TimestampUpdated = time.Now().Unix()
+	}
+
+	if upload.Offset == upload.Length {
+		if err = s.UploadModel.MarkFinishing(upload.ID); err != nil {
+			if err == ErrUploadFinishing {
+				finishingResponse(upload, offset+size, c)
+				return
+			}
+			c.JSON(500, common.NewAPIError(fmt.Sprintf("Error finishing upload %s in database: %s", upload.ID, err)))
+			return
+		}
+		if statusCode, err := s.finishUpload(requestContext(c), upload); err != nil {
+			if statusCode != 400 {
+				if errUnmark := s.UploadModel.UnmarkFinishing(upload.ID); errUnmark != nil {
+					log.WithField("component", "upload").Errorf("Error marking upload %s as receiving again: %s", upload.ID, errUnmark)
+				}
+			}
+			c.JSON(statusCode, common.NewAPIError(fmt.Sprintf("[Error uploading %s] %s", upload.Resource, err)))
+			return
+		}
+	} else {
+		s.setUploadExpires(upload, c)
+	}
+	c.SetHeader("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.SetStatusCode(204)
+}
+
+// finishingResponse answers a PATCH request sent to an upload being finished
+// by another request. The request is accepted if it sent no more bytes.
+func finishingResponse(upload *Upload, offset int64, c *iris.Context) {
+	if offset != upload.Length {
+		c.JSON(409, common.NewAPIError(fmt.Sprintf("Upload %s is complete and being finished", upload.ID)))
+		return
+	}
+	c.SetHeader("Upload-Offset", strconv.FormatInt(upload.Length, 10))
+	c.SetStatusCode(202)
+}
+
+// finishUpload concatenates the chunks of a complete upload into the resource
+// blob, and creates the resource with insertWithBlob. The upload is discarded once done,
+// or if its blob turns out to be invalid.
+func (s *APIServer) finishUpload(ctx context.Context, upload *Upload) (int, error) {
+	resourceModel, err := s.getResourceModel(upload.Resource)
+	if err != nil {
+		return 500, err
+	}
+	metadata, err := parseUploadMetadata(upload.Metadata)
+	if err != nil {
+		return 500, err
+	}
+	resource, statusCode, err := s.newUploadResource(ctx, upload.Resource, metadata)
+	if err != nil {
+		return statusCode, err
+	}
+	chunkKeys, err := s.UploadModel.ListChunks(upload.ID)
+	if err != nil {
+		return 500, fmt.Errorf("Error retrieving chunks of upload %s: %s", upload.ID, err)
+	}
+
+	blob := &chunkReader{blobStore: s.blobStore(ctx), keys: chunkKeys}
+	defer blob.Close()
+	resource.Meta().Owner = upload.Owner
+	statusCode, err = s.insertWithBlob(ctx, resourceModel, resource, blob, upload.Length, metadata["checksum"])
+	if err != nil {
+		if statusCode == 400 {
+			s.discardUpload(ctx, upload.ID, chunkKeys)
+		}
+		return statusCode, err
+	}
+	s.discardUpload(ctx, upload.ID, chunkKeys)
+	return 201, nil
+}
+
+// discardUpload deletes an upload and its chunks
+func (s *APIServer) discardUpload(ctx context.Context, id uuid.UUID, chunkKeys []string) error {
+	if err := s.UploadModel.Delete(id); err != nil {
+		return err
+	}
+	for _, key := range chunkKeys {
+		s.deleteBlob(ctx, key)
+	}
+	return nil
+}
+
+func (s *APIServer) deleteUpload(c *iris.Context) {
+	upload := s.getUpload(c)
+	if upload == nil {
+		return
+	}
+	if upload.Status == UploadFinishing {
+		c.JSON(409, common.NewAPIError(fmt.Sprintf("Error deleting upload %s: upload complete and being finished", upload.ID)))
+		return
+	}
+	chunkKeys, err := s.UploadModel.ListChunks(upload.ID)
+	if err != nil {
+		c.JSON(500, common.NewAPIError(fmt.Sprintf("Error retrieving chunks of upload %s: %s", upload.ID, err)))
+		return
+	}
+	if err = s.discardUpload(requestContext(c), upload.ID, chunkKeys); err != nil {
+		c.JSON(500, common.NewAPIError(fmt.Sprintf("Error deleting upload %s: %s", upload.ID, err)))
+		return
+	}
+	c.SetStatusCode(204)
+}
+
+// ExpireUploads deletes the uploads left without a new chunk for
+// UploadExpiration at a given date, along with their chunks. It returns the
+// number of deleted uploads.
+func (s *APIServer) ExpireUploads(now time.Time) (int, error) {
+	ctx, span := startJob("ExpireUploads")
+	defer span.End()
+
+	ids, err := s.UploadModel.ListExpired(now.Add(-s.UploadExpiration))
+	if err != nil {
+		return 0, fmt.Errorf("Error listing expired uploads: %s", err)
+	}
+	deleted := 0
+	var lastErr error
+	for _, id := range ids {
+		chunkKeys, err := s.UploadModel.ListChunks(id)
+		if err == nil {
+			err = s.discardUpload(ctx, id, chunkKeys)
+		}
+		if err != nil {
+			lastErr = err
+			log.WithField("component", "upload").Errorf("Error deleting expired upload %s: %s", id, err)
+			continue
+		}
+		deleted++
+	}
+	return deleted, lastErr
+}
+
+// RunUploadCleaner deletes the expired uploads every interval. It returns when
+// stop is closed.
+func (s *APIServer) RunUploadCleaner(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			n, err := s.ExpireUploads(time.Now())
+			if err != nil {
+				log.WithField("component", "upload").Warnf("Expired uploads partially cleaned up (%d upload(s) deleted): %s", n, err)
+			} else if n > 0 {
+				log.WithField("component", "upload").Infof("%d expired upload(s) deleted", n)
+			}
+		}
+	}
+}
+
+// chunkReader reads the chunks of an upload one after the other, opening each
+// of them only once the previous one has been read
+type chunkReader struct {
+	blobStore common.BlobStore
+	keys      []string
+	current   io.ReadCloser
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.keys) == 0 {
+				return 0, io.EOF
+			}
+			chunk, err := r.blobStore.Get(r.keys[0])
+			if err != nil {
+				return 0, fmt.Errorf("Error reading chunk %s: %s", r.keys[0], err)
+			}
+			r.current, r.keys = chunk, r.keys[1:]
+		}
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (r *chunkReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+	return r.current.Close()
+}